@@ -0,0 +1,319 @@
+package backtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"thierry/gocoin/common"
+	"time"
+)
+
+// FeeModel returns the fee paid on a fill
+type FeeModel interface {
+	// Fee of a fill of notional value (price times size), maker when the order
+	// added liquidity to the book
+	Fee(notional decimal.Decimal, maker bool, t time.Time) decimal.Decimal
+}
+
+// SlippageModel returns the average price an order is actually filled at
+type SlippageModel interface {
+	Price(side string, price, size decimal.Decimal, candle *common.Candle) decimal.Decimal
+}
+
+// DepthSource returns the order book levels recorded at a time, best price first
+type DepthSource interface {
+	Depth(t time.Time) (bids, asks []common.Order, ok bool)
+}
+
+// FlatFee applies the same rate to every fill
+type FlatFee struct {
+	Rate decimal.Decimal
+}
+
+type MakerTakerFee struct {
+	Maker decimal.Decimal
+	Taker decimal.Decimal
+}
+
+// TieredFee picks the maker and taker rates from the traded volume of the last 30 days
+type TieredFee struct {
+	// Sorted by MinVolume
+	Tiers  []FeeTier
+	Window time.Duration
+	fills  []volumeEntry
+	volume decimal.Decimal
+}
+
+type FeeTier struct {
+	// Volume traded over the window, in quote currency, from which the tier applies
+	MinVolume decimal.Decimal
+	Maker     decimal.Decimal
+	Taker     decimal.Decimal
+}
+
+type volumeEntry struct {
+	time     time.Time
+	notional decimal.Decimal
+}
+
+// FixedSlippage moves the price against the order by a number of basis points
+type FixedSlippage struct {
+	Bps decimal.Decimal
+}
+
+// VolumeSlippage moves the price against the order in proportion to the part of the
+// candle volume the order takes, e.g. with an Impact of 0.1, taking the whole candle
+// volume costs 10%
+type VolumeSlippage struct {
+	Impact decimal.Decimal
+	// Upper limit of the slippage, as a ratio of the price
+	Max decimal.Decimal
+}
+
+// BookSlippage walks the recorded order book levels to fill the order, and falls back
+// to another model when no book was recorded or it's not deep enough
+type BookSlippage struct {
+	Depth    DepthSource
+	Fallback SlippageModel
+}
+
+// RecordedDepth keeps order book snapshots in memory, sorted by time
+type RecordedDepth struct {
+	Snapshots []DepthSnapshot
+	// Snapshots older than this are not used
+	MaxAge time.Duration
+}
+
+type DepthSnapshot struct {
+	Time time.Time
+	Bids []common.Order
+	Asks []common.Order
+}
+
+// Line of a depth file, levels are [price, size] pairs as strings like in gdax books
+type depthLine struct {
+	Time time.Time  `json:"time"`
+	Bids [][]string `json:"bids"`
+	Asks [][]string `json:"asks"`
+}
+
+// Fee models of each exchange, a new model is created for each backtest as tiered
+// fees keep track of the traded volume
+var EXCHANGE_FEES = map[string]func() FeeModel{
+	// Taker fees going down with the 30 days volume, no maker fees
+	"gdax": func() FeeModel {
+		return CreateNewTieredFee([]FeeTier{
+			{MinVolume: decimal.Zero, Maker: decimal.Zero, Taker: decimal.New(3, -3)},
+			{MinVolume: decimal.New(10, 6), Maker: decimal.Zero, Taker: decimal.New(25, -4)},
+			{MinVolume: decimal.New(100, 6), Maker: decimal.Zero, Taker: decimal.New(2, -3)},
+		})
+	},
+	"bitfinex": func() FeeModel {
+		return &MakerTakerFee{Maker: decimal.New(1, -3), Taker: decimal.New(2, -3)}
+	},
+	// XBTUSD perpetual, makers get a rebate
+	"bitmex": func() FeeModel {
+		return &MakerTakerFee{Maker: decimal.New(-25, -5), Taker: decimal.New(75, -5)}
+	},
+}
+
+// Public
+
+func ExchangeFees(exchange string) (FeeModel, error) {
+	fees, ok := EXCHANGE_FEES[exchange]
+	if !ok {
+		return nil, fmt.Errorf("no fees for exchange %s", exchange)
+	}
+	return fees(), nil
+}
+
+func (fee *FlatFee) Fee(notional decimal.Decimal, maker bool, t time.Time) decimal.Decimal {
+	return notional.Mul(fee.Rate)
+}
+
+func (fee *MakerTakerFee) Fee(notional decimal.Decimal, maker bool, t time.Time) decimal.Decimal {
+	if maker {
+		return notional.Mul(fee.Maker)
+	}
+	return notional.Mul(fee.Taker)
+}
+
+func CreateNewTieredFee(tiers []FeeTier) *TieredFee {
+	sorted := make([]FeeTier, len(tiers))
+	copy(sorted, tiers)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MinVolume.Cmp(sorted[j].MinVolume) < 0 })
+	return &TieredFee{Tiers: sorted, Window: 30 * 24 * time.Hour}
+}
+
+// Fee uses the tier of the volume traded before the fill, then adds the fill to it.
+// Fills are expected in time order
+func (fee *TieredFee) Fee(notional decimal.Decimal, maker bool, t time.Time) decimal.Decimal {
+	for len(fee.fills) > 0 && !fee.fills[0].time.After(t.Add(-fee.Window)) {
+		fee.volume = fee.volume.Sub(fee.fills[0].notional)
+		fee.fills = fee.fills[1:]
+	}
+	tier := FeeTier{}
+	for _, candidate := range fee.Tiers {
+		if fee.volume.Cmp(candidate.MinVolume) >= 0 {
+			tier = candidate
+		}
+	}
+	fee.fills = append(fee.fills, volumeEntry{time: t, notional: notional.Abs()})
+	fee.volume = fee.volume.Add(notional.Abs())
+
+	if maker {
+		return notional.Mul(tier.Maker)
+	}
+	return notional.Mul(tier.Taker)
+}
+
+func (slippage *FixedSlippage) Price(side string, price, size decimal.Decimal, candle *common.Candle) decimal.Decimal {
+	return againstOrder(side, price, slippage.Bps.Div(decimal.New(1, 4)))
+}
+
+func (slippage *VolumeSlippage) Price(side string, price, size decimal.Decimal, candle *common.Candle) decimal.Decimal {
+	ratio := slippage.Max
+	if candle != nil && candle.Volume.Sign() > 0 {
+		ratio = slippage.Impact.Mul(size).Div(candle.Volume)
+	}
+	if slippage.Max.Sign() > 0 && ratio.Cmp(slippage.Max) > 0 {
+		ratio = slippage.Max
+	}
+	return againstOrder(side, price, ratio)
+}
+
+func (slippage *BookSlippage) Price(side string, price, size decimal.Decimal, candle *common.Candle) decimal.Decimal {
+	if candle != nil && slippage.Depth != nil {
+		if bids, asks, ok := slippage.Depth.Depth(candle.Time); ok {
+			// Buys take the asks, sells the bids
+			levels := asks
+			if side == common.SIDE_SELL {
+				levels = bids
+			}
+			if average, ok := walkBook(levels, size); ok {
+				return average
+			}
+		}
+	}
+	if slippage.Fallback != nil {
+		return slippage.Fallback.Price(side, price, size, candle)
+	}
+	return price
+}
+
+// Add keeps the snapshots sorted, snapshots are expected mostly in order
+func (depth *RecordedDepth) Add(snapshot DepthSnapshot) {
+	i := sort.Search(len(depth.Snapshots), func(i int) bool { return depth.Snapshots[i].Time.After(snapshot.Time) })
+	depth.Snapshots = append(depth.Snapshots, DepthSnapshot{})
+	copy(depth.Snapshots[i+1:], depth.Snapshots[i:])
+	depth.Snapshots[i] = snapshot
+}
+
+// Depth returns the last snapshot at or before t
+func (depth *RecordedDepth) Depth(t time.Time) ([]common.Order, []common.Order, bool) {
+	i := sort.Search(len(depth.Snapshots), func(i int) bool { return depth.Snapshots[i].Time.After(t) })
+	if i == 0 {
+		return nil, nil, false
+	}
+	snapshot := depth.Snapshots[i-1]
+	if depth.MaxAge > 0 && t.Sub(snapshot.Time) > depth.MaxAge {
+		return nil, nil, false
+	}
+	return snapshot.Bids, snapshot.Asks, true
+}
+
+// ReadDepthFile reads order book snapshots, one JSON object per line with an RFC3339
+// time, e.g. {"time":"2018-01-01T00:00:00Z","bids":[["999.5","2"]],"asks":[["1000","1.5"]]}
+func ReadDepthFile(path string) (*RecordedDepth, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadDepth(file)
+}
+
+func ReadDepth(r io.Reader) (*RecordedDepth, error) {
+	depth := &RecordedDepth{Snapshots: []DepthSnapshot{}}
+	scanner := bufio.NewScanner(r)
+	// Full books make long lines
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		data := depthLine{}
+		if err := json.Unmarshal([]byte(text), &data); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		bids, err := depthLevels(common.SIDE_BUY, data.Bids)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		asks, err := depthLevels(common.SIDE_SELL, data.Asks)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		depth.Add(DepthSnapshot{Time: data.Time, Bids: bids, Asks: asks})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return depth, nil
+}
+
+// Private
+
+// Orders of the [price, size] levels of a side
+func depthLevels(side string, levels [][]string) ([]common.Order, error) {
+	orders := []common.Order{}
+	for _, level := range levels {
+		if len(level) < 2 {
+			return nil, fmt.Errorf("expected a price and a size, got %v", level)
+		}
+		price, err := decimal.NewFromString(level[0])
+		if err != nil {
+			return nil, err
+		}
+		size, err := decimal.NewFromString(level[1])
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, common.Order{Side: side, Price: price, Size: size})
+	}
+	return orders, nil
+}
+
+// Moves the price up for buys and down for sells, by ratio of the price
+func againstOrder(side string, price, ratio decimal.Decimal) decimal.Decimal {
+	if side == common.SIDE_SELL {
+		return price.Mul(decimal.New(1, 0).Sub(ratio))
+	}
+	return price.Mul(decimal.New(1, 0).Add(ratio))
+}
+
+// Average price of taking size on the levels, false when they are not deep enough
+func walkBook(levels []common.Order, size decimal.Decimal) (decimal.Decimal, bool) {
+	if size.Sign() <= 0 {
+		return decimal.Zero, false
+	}
+	remaining, cost := size, decimal.Zero
+	for _, level := range levels {
+		taken := level.Size
+		if taken.Cmp(remaining) > 0 {
+			taken = remaining
+		}
+		cost = cost.Add(taken.Mul(level.Price))
+		remaining = remaining.Sub(taken)
+		if remaining.Sign() <= 0 {
+			return cost.Div(size), true
+		}
+	}
+	return decimal.Zero, false
+}
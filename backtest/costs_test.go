@@ -0,0 +1,120 @@
+package backtest
+
+import (
+	"github.com/shopspring/decimal"
+	"strings"
+	"testing"
+	"thierry/gocoin/common"
+	"time"
+)
+
+func TestMakerTakerFee(t *testing.T) {
+	// GIVEN
+	fees, err := ExchangeFees("bitmex")
+	_, errUnknown := ExchangeFees("mtgox")
+
+	// WHEN
+	maker := fees.Fee(decimal.NewFromFloat(10000), true, time.Unix(0, 0))
+	taker := fees.Fee(decimal.NewFromFloat(10000), false, time.Unix(0, 0))
+
+	// THEN
+	if err != nil || errUnknown == nil {
+		t.Fatalf("Wrong exchange fees %v %v", err, errUnknown)
+	}
+	if !maker.Equal(decimal.NewFromFloat(-2.5)) || !taker.Equal(decimal.NewFromFloat(7.5)) {
+		t.Errorf("Wrong bitmex fees %s %s", maker, taker)
+	}
+}
+
+func TestTieredFee(t *testing.T) {
+	// GIVEN
+	fees := CreateNewTieredFee([]FeeTier{
+		{MinVolume: decimal.NewFromFloat(1000), Taker: decimal.NewFromFloat(0.001)},
+		{MinVolume: decimal.Zero, Taker: decimal.NewFromFloat(0.002)},
+	})
+	start := time.Unix(0, 0)
+
+	// WHEN
+	first := fees.Fee(decimal.NewFromFloat(1000), false, start)
+	second := fees.Fee(decimal.NewFromFloat(1000), false, start.Add(24*time.Hour))
+	// First fill is out of the 30 days window, but not the second one
+	third := fees.Fee(decimal.NewFromFloat(1000), false, start.Add(30*24*time.Hour))
+	fourth := fees.Fee(decimal.NewFromFloat(1000), false, start.Add(70*24*time.Hour))
+
+	// THEN
+	if !first.Equal(decimal.NewFromFloat(2)) || !second.Equal(decimal.NewFromFloat(1)) || !third.Equal(decimal.NewFromFloat(1)) {
+		t.Errorf("Wrong tiered fees %s %s %s", first, second, third)
+	}
+	if !fourth.Equal(decimal.NewFromFloat(2)) {
+		t.Errorf("Volume should leave the window %s", fourth)
+	}
+}
+
+func TestVolumeSlippage(t *testing.T) {
+	// GIVEN
+	slippage := &VolumeSlippage{Impact: decimal.NewFromFloat(0.1), Max: decimal.NewFromFloat(0.05)}
+	candle := &common.Candle{Volume: decimal.NewFromFloat(100)}
+	price := decimal.NewFromFloat(100)
+
+	// WHEN
+	small := slippage.Price(common.SIDE_BUY, price, decimal.NewFromFloat(10), candle)
+	large := slippage.Price(common.SIDE_SELL, price, decimal.NewFromFloat(100), candle)
+
+	// THEN
+	if !small.Equal(decimal.NewFromFloat(101)) || !large.Equal(decimal.NewFromFloat(95)) {
+		t.Errorf("Wrong volume slippage %s %s", small, large)
+	}
+}
+
+func TestBookSlippage(t *testing.T) {
+	// GIVEN
+	depth := &RecordedDepth{MaxAge: time.Minute}
+	depth.Add(DepthSnapshot{
+		Time: time.Unix(60, 0),
+		Bids: []common.Order{{Price: decimal.NewFromFloat(99), Size: decimal.NewFromFloat(1)}},
+		Asks: []common.Order{
+			{Price: decimal.NewFromFloat(101), Size: decimal.NewFromFloat(1)},
+			{Price: decimal.NewFromFloat(103), Size: decimal.NewFromFloat(1)},
+		},
+	})
+	slippage := &BookSlippage{Depth: depth, Fallback: &FixedSlippage{Bps: decimal.NewFromFloat(50)}}
+	price := decimal.NewFromFloat(100)
+
+	// WHEN
+	walked := slippage.Price(common.SIDE_BUY, price, decimal.NewFromFloat(2), &common.Candle{Time: time.Unix(90, 0)})
+	tooDeep := slippage.Price(common.SIDE_SELL, price, decimal.NewFromFloat(2), &common.Candle{Time: time.Unix(90, 0)})
+	tooOld := slippage.Price(common.SIDE_BUY, price, decimal.NewFromFloat(1), &common.Candle{Time: time.Unix(200, 0)})
+
+	// THEN
+	if !walked.Equal(decimal.NewFromFloat(102)) {
+		t.Errorf("Wrong book walk %s", walked)
+	}
+	if !tooDeep.Equal(decimal.NewFromFloat(99.5)) || !tooOld.Equal(decimal.NewFromFloat(100.5)) {
+		t.Errorf("Should fall back without depth %s %s", tooDeep, tooOld)
+	}
+}
+
+func TestReadDepth(t *testing.T) {
+	// GIVEN
+	// Snapshots out of order, with a blank line
+	lines := `{"time":"2018-01-01T00:01:00Z","bids":[["99","2"]],"asks":[["101","1"],["102","3"]]}
+
+{"time":"2018-01-01T00:00:00Z","bids":[["98","1"]],"asks":[["100","1"]]}
+`
+
+	// WHEN
+	depth, err := ReadDepth(strings.NewReader(lines))
+	bids, asks, ok := depth.Depth(time.Date(2018, 1, 1, 0, 1, 30, 0, time.UTC))
+	_, errInvalid := ReadDepth(strings.NewReader(`{"time":"2018-01-01T00:00:00Z","bids":[["98"]]}`))
+
+	// THEN
+	if err != nil || len(depth.Snapshots) != 2 || !depth.Snapshots[0].Time.Before(depth.Snapshots[1].Time) {
+		t.Fatalf("Snapshots should be read in time order %v %v", depth.Snapshots, err)
+	}
+	if !ok || len(bids) != 1 || len(asks) != 2 || !asks[1].Price.Equal(decimal.NewFromFloat(102)) || !bids[0].Size.Equal(decimal.NewFromFloat(2)) {
+		t.Errorf("Wrong levels %v %v", bids, asks)
+	}
+	if errInvalid == nil {
+		t.Errorf("Level without size should fail")
+	}
+}
@@ -0,0 +1,209 @@
+package backtest
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"thierry/gocoin/common"
+	"time"
+)
+
+// Candles needed before signals are used, so indicators are all computed
+const WARMUP_CANDLE = 60
+
+// Engine replays candles through a chart, and applies the strategy signals to the
+// portfolio
+type Engine struct {
+	Strategy  Strategy
+	Portfolio *Portfolio
+	Chart     *common.CandleChart
+	// Signals are ignored for the first candles
+	Warmup int
+	// Number of candles replayed
+	Counter int
+	// Portfolio value at the close of each candle, after the warmup
+	Equity []EquityPoint
+	// Protective exits attached to each position, can be nil
+	Stops *Stops
+	// Funding paid on the open position, can be nil
+	Funding    *FundingRates
+	protection *protection
+	lastTime   time.Time
+}
+
+// CandleSource returns the candles of a product and timeframe, from from up to but
+// without to, with no bound for zero times. Implemented by storage.Database
+type CandleSource interface {
+	Candles(productId string, timeframe time.Duration, from, to time.Time) ([]common.Candle, error)
+}
+
+type EquityPoint struct {
+	Time    time.Time
+	Equity  decimal.Decimal
+	Holding bool
+}
+
+// Public
+
+// CreateNewEngine uses the sizing of the strategy when it picks one
+func CreateNewEngine(strategy Strategy, portfolio *Portfolio) *Engine {
+	engine := &Engine{
+		Strategy:  strategy,
+		Portfolio: portfolio,
+		Chart:     common.CreateNewCandleChart(),
+		Warmup:    WARMUP_CANDLE,
+	}
+	portfolio.Chart = engine.Chart
+	if sized, isSized := strategy.(SizedStrategy); isSized && sized.Sizer() != nil {
+		portfolio.Sizing = sized.Sizer()
+	}
+	return engine
+}
+
+// Run replays all candles, then sells what is still held on the last candle
+func (engine *Engine) Run(candles []common.Candle) {
+	for _, candle := range candles {
+		engine.AddCandle(candle)
+	}
+	engine.Close()
+}
+
+// RunFile replays a candle file, see ReadCandleFile
+func (engine *Engine) RunFile(path string) error {
+	candles, err := ReadCandleFile(path)
+	if err != nil {
+		return err
+	}
+	engine.Run(candles)
+	return nil
+}
+
+// RunSource replays the candles of a product and timeframe between from and to, see
+// CandleSource
+func (engine *Engine) RunSource(source CandleSource, productId string, timeframe time.Duration, from, to time.Time) error {
+	candles, err := source.Candles(productId, timeframe, from, to)
+	if err != nil {
+		return err
+	} else if len(candles) == 0 {
+		return fmt.Errorf("no %s candles for %s", common.TimeframeName(timeframe), productId)
+	}
+	// Otherwise each step between candles looks like a gap of minutes to fill
+	engine.Chart.Timeframe = timeframe
+	engine.Run(candles)
+	return nil
+}
+
+// AddCandle completes a candle on the chart, and applies the strategy signal
+func (engine *Engine) AddCandle(candle common.Candle) {
+	engine.Chart.AddCandle(candle)
+	engine.Chart.CompleteCurrentCandle()
+	engine.Counter += 1
+	if engine.Portfolio.IsHolding() {
+		engine.Portfolio.HoldingCandles += 1
+	}
+
+	current := engine.Chart.CurrentCandle()
+	if engine.Funding != nil && engine.Portfolio.IsHolding() && !engine.lastTime.IsZero() {
+		for _, funding := range engine.Funding.Between(engine.lastTime, current.Time) {
+			engine.Portfolio.PayFunding(funding.Rate, current.Open)
+		}
+	}
+	engine.lastTime = current.Time
+	// Stops and liquidations are checked first, they happened during the candle
+	if engine.Portfolio.IsHolding() {
+		engine.protect(current)
+	}
+	signal := engine.Strategy.OnCandle(engine.Chart)
+	if engine.Counter <= engine.Warmup {
+		return
+	}
+	if signal.Action != "" {
+		engine.fill(signal.Action, current.Close, current, signal.Reason)
+	}
+	engine.Equity = append(engine.Equity, EquityPoint{
+		Time:    current.Time,
+		Equity:  engine.Portfolio.Equity(current.Close),
+		Holding: engine.Portfolio.IsHolding(),
+	})
+}
+
+// Close closes the position still held at the last close
+func (engine *Engine) Close() {
+	if !engine.Portfolio.IsHolding() {
+		return
+	}
+	current := engine.Chart.CurrentCandle()
+	engine.fill(ACTION_CLOSE, current.Close, current, "end of backtest")
+	// Last equity now includes the closing fee
+	if len(engine.Equity) > 0 {
+		engine.Equity[len(engine.Equity)-1].Equity = engine.Portfolio.Cash
+	}
+}
+
+// ReadCandleFile reads a candle file in the format of its extension, see
+// common.CandleStoreFor, and checks the candles are in time order
+func ReadCandleFile(path string) ([]common.Candle, error) {
+	store, err := common.CandleStoreFor(path)
+	if err != nil {
+		return nil, err
+	}
+	candles, err := store.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(candles); i++ {
+		if candles[i].Time.Before(candles[i-1].Time) {
+			return nil, fmt.Errorf("%s candle %d: time %s is before %s", path, i+1, candles[i].Time, candles[i-1].Time)
+		}
+	}
+	return candles, nil
+}
+
+// Private
+
+func (engine *Engine) fill(side string, price decimal.Decimal, current *common.Candle, reason string) {
+	var fill Fill
+	var ok bool
+	switch side {
+	case common.SIDE_BUY:
+		fill, ok = engine.Portfolio.Buy(price, current, reason)
+	case common.SIDE_SELL:
+		fill, ok = engine.Portfolio.Sell(price, current, reason)
+	case ACTION_CLOSE:
+		fill, ok = engine.Portfolio.ClosePosition(price, current, reason)
+	}
+	if ok {
+		engine.filled(fill)
+	}
+}
+
+// Attaches the stops to the position opened or added to by the fill, from its average
+// entry, and tells the strategy
+func (engine *Engine) filled(fill Fill) {
+	engine.protection = nil
+	if !fill.Position.IsZero() && engine.Stops != nil {
+		engine.protection = engine.Stops.open(engine.Portfolio.Entry, fill.Position.Sign() < 0, engine.Chart)
+	}
+	if listener, isListener := engine.Strategy.(FillListener); isListener {
+		listener.OnFill(fill)
+	}
+}
+
+// Closes the position on the stop or the liquidation the candle reached first
+func (engine *Engine) protect(current *common.Candle) {
+	liquidated := engine.Portfolio.IsLiquidated(current)
+	if engine.protection != nil {
+		if price, reason, hit := engine.Stops.check(engine.protection, current); hit {
+			// The stop is only reached first when it is better than the liquidation price
+			liquidation, _ := engine.Portfolio.LiquidationPrice()
+			if !liquidated || engine.protection.worse(liquidation, price) {
+				engine.fill(ACTION_CLOSE, price, current, reason)
+				return
+			}
+		}
+	}
+	if liquidated {
+		if fill, ok := engine.Portfolio.Liquidate(current); ok {
+			engine.filled(fill)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package backtest
+
+import (
+	"github.com/shopspring/decimal"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"thierry/gocoin/common"
+	"time"
+)
+
+// Buys and sells on given candles
+type scriptedStrategy struct {
+	counter int
+	buys    map[int]bool
+	sells   map[int]bool
+	fills   []Fill
+}
+
+func (strategy *scriptedStrategy) Name() string {
+	return "scripted"
+}
+
+func (strategy *scriptedStrategy) OnCandle(chart *common.CandleChart) Signal {
+	strategy.counter += 1
+	if strategy.buys[strategy.counter] {
+		return Signal{Action: common.SIDE_BUY, Reason: "scripted buy"}
+	} else if strategy.sells[strategy.counter] {
+		return Signal{Action: common.SIDE_SELL, Reason: "scripted sell"}
+	}
+	return Signal{}
+}
+
+func (strategy *scriptedStrategy) OnFill(fill Fill) {
+	strategy.fills = append(strategy.fills, fill)
+}
+
+func generateCandles(prices ...float64) []common.Candle {
+	candles := []common.Candle{}
+	for i, price := range prices {
+		candles = append(candles, common.Candle{
+			Time:   time.Unix(int64(i*60), 0),
+			Open:   decimal.NewFromFloat(price),
+			High:   decimal.NewFromFloat(price),
+			Low:    decimal.NewFromFloat(price),
+			Close:  decimal.NewFromFloat(price),
+			Volume: decimal.NewFromFloat(1),
+		})
+	}
+	return candles
+}
+
+func TestEngineRun(t *testing.T) {
+	// GIVEN
+	strategy := &scriptedStrategy{buys: map[int]bool{1: true, 3: true, 6: true}, sells: map[int]bool{5: true}}
+	engine := CreateNewEngine(strategy, CreateNewPortfolio(decimal.NewFromFloat(100)))
+	engine.Warmup = 2
+
+	// WHEN
+	engine.Run(generateCandles(10, 10, 10, 15, 20, 10, 20))
+
+	// THEN
+	fills := engine.Portfolio.Fills
+	if len(fills) != 4 || len(strategy.fills) != 4 {
+		t.Fatalf("Wrong fills %v", fills)
+	}
+	// Buy during warmup is ignored
+	if fills[0].Side != common.SIDE_BUY || !fills[0].Price.Equal(decimal.NewFromFloat(10)) {
+		t.Errorf("Wrong buy %#v", fills[0])
+	}
+	if fills[1].Side != common.SIDE_SELL || !fills[1].Price.Equal(decimal.NewFromFloat(20)) || fills[1].HoldingCandles != 2 {
+		t.Errorf("Wrong sell %#v", fills[1])
+	}
+	if fills[3].Reason != "end of backtest" || !engine.Portfolio.Cash.Equal(decimal.NewFromFloat(400)) {
+		t.Errorf("Wrong end of backtest %#v %s", fills[3], engine.Portfolio.Cash)
+	}
+}
+
+// Candles of one product and timeframe, keeping the query it got
+type stubCandleSource struct {
+	candles   []common.Candle
+	productId string
+	timeframe time.Duration
+	from, to  time.Time
+}
+
+func (source *stubCandleSource) Candles(productId string, timeframe time.Duration, from, to time.Time) ([]common.Candle, error) {
+	source.productId, source.timeframe, source.from, source.to = productId, timeframe, from, to
+	if productId != "ETH-USD" {
+		return []common.Candle{}, nil
+	}
+	return source.candles, nil
+}
+
+func TestEngineRunSource(t *testing.T) {
+	// GIVEN
+	source := &stubCandleSource{candles: generateCandles(10, 10, 20)}
+	strategy := &scriptedStrategy{buys: map[int]bool{2: true}}
+	engine := CreateNewEngine(strategy, CreateNewPortfolio(decimal.NewFromFloat(100)))
+	engine.Warmup = 1
+	from := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	// WHEN
+	err := engine.RunSource(source, "ETH-USD", 5*time.Minute, from, from.Add(24*time.Hour))
+	errEmpty := CreateNewEngine(strategy, CreateNewPortfolio(decimal.NewFromFloat(100))).RunSource(source, "LTC-USD", time.Minute, from, time.Time{})
+
+	// THEN
+	if err != nil || source.productId != "LTC-USD" || source.timeframe != time.Minute || !source.from.Equal(from) {
+		t.Errorf("Wrong query %v %#v", err, source)
+	}
+	if len(engine.Portfolio.Fills) != 2 || !engine.Portfolio.Cash.Equal(decimal.NewFromFloat(200)) {
+		t.Errorf("Source candles should be replayed %v", engine.Portfolio.Fills)
+	}
+	if errEmpty == nil {
+		t.Errorf("A source without candles should fail")
+	}
+}
+
+// Candles every timeframe, starting at the unix epoch
+func generateTimeframeCandles(timeframe time.Duration, num int) []common.Candle {
+	candles := generateCandles(make([]float64, num)...)
+	for i := range candles {
+		candles[i].Time = time.Unix(0, 0).Add(time.Duration(i) * timeframe)
+		candles[i].Close = decimal.NewFromFloat(float64(10 + i))
+	}
+	return candles
+}
+
+func TestEngineRunSourceTimeframe(t *testing.T) {
+	// GIVEN
+	source := &stubCandleSource{candles: generateTimeframeCandles(5*time.Minute, 10)}
+	engine := CreateNewEngine(&scriptedStrategy{}, CreateNewPortfolio(decimal.NewFromFloat(100)))
+
+	// WHEN
+	err := engine.RunSource(source, "ETH-USD", 5*time.Minute, time.Time{}, time.Time{})
+
+	// THEN
+	// No candle was added to fill the 5 minutes between candles
+	if err != nil || engine.Chart.Timeframe != 5*time.Minute {
+		t.Fatalf("Could not run source %v %v", err, engine.Chart.Timeframe)
+	}
+	for i := 0; i < 10; i++ {
+		if candle := engine.Chart.GetPastRelativeCandle(i - 9); !candle.Time.Equal(source.candles[i].Time) {
+			t.Errorf("Candle %d should be the source candle at %v, got %s", i, source.candles[i].Time, candle.String())
+		}
+	}
+}
+
+func TestReadCandleFile(t *testing.T) {
+	// GIVEN
+	dir, _ := ioutil.TempDir("", "candles")
+	defer os.RemoveAll(dir)
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(data), 0644)
+		return path
+	}
+	path := write("BTC-USD.txt", "1512086400 10 12 9 11 10.5 3 0.000000 0.000000 0.000000\n\n1512086460 11 13 10 12 11.5 4 50.0 0.1 0.01")
+	unordered := write("ETH-USD.txt", "1512086460 1 1 1 1 1 1\n1512086400 1 1 1 1 1 1\n")
+	fields := write("LTC-USD.txt", "1512086460 1 1 1\n")
+
+	// WHEN
+	candles, err := ReadCandleFile(path)
+	_, errOrder := ReadCandleFile(unordered)
+	_, errFields := ReadCandleFile(fields)
+	_, errFormat := ReadCandleFile(filepath.Join(dir, "BTC-USD.xls"))
+
+	// THEN
+	if err != nil || len(candles) != 2 {
+		t.Fatalf("Could not read candles %v", err)
+	}
+	if candles[1].Time.Unix() != 1512086460 || !candles[1].High.Equal(decimal.NewFromFloat(13)) || !candles[1].Volume.Equal(decimal.NewFromFloat(4)) {
+		t.Errorf("Wrong candle %s", candles[1].String())
+	}
+	if errOrder == nil || errFields == nil || errFormat == nil {
+		t.Errorf("Invalid candles should not be read")
+	}
+}
+
+func TestEngineShortLiquidation(t *testing.T) {
+	// GIVEN
+	portfolio := CreateNewPortfolio(decimal.NewFromFloat(100))
+	portfolio.Leverage, portfolio.AllowShort = decimal.NewFromFloat(10), true
+	portfolio.MaintenanceMargin = BITMEX_MAINTENANCE_MARGIN
+	strategy := &scriptedStrategy{sells: map[int]bool{2: true}}
+	engine := CreateNewEngine(strategy, portfolio)
+	engine.Warmup = 1
+
+	// WHEN
+	engine.Run(generateCandles(10, 10, 10, 12, 12))
+
+	// THEN
+	fills := engine.Portfolio.Fills
+	if len(fills) != 2 || len(strategy.fills) != 2 {
+		t.Fatalf("Wrong fills %v", fills)
+	}
+	if fills[1].Side != common.SIDE_BUY || fills[1].Reason != EXIT_LIQUIDATION || fills[1].Price.StringFixed(2) != "10.95" {
+		t.Errorf("Wrong liquidation %#v", fills[1])
+	}
+	report := engine.Report()
+	if report.Trades != 1 || report.Exits[EXIT_LIQUIDATION] != 1 || report.EndingEquity > 0.01 {
+		t.Errorf("Wrong report %#v", report)
+	}
+}
+
+func TestEngineFunding(t *testing.T) {
+	// GIVEN
+	strategy := &scriptedStrategy{buys: map[int]bool{2: true}}
+	engine := CreateNewEngine(strategy, CreateNewPortfolio(decimal.NewFromFloat(100)))
+	engine.Warmup = 1
+	engine.Funding, _ = ReadFundingRates(strings.NewReader("60 0.01\n120 0.01"))
+
+	// WHEN
+	engine.Run(generateCandles(10, 10, 10, 10))
+
+	// THEN
+	// Funding at the time of the buy candle is not paid
+	if !engine.Portfolio.Cash.Equal(decimal.NewFromFloat(99)) || engine.Report().Funding != 1 {
+		t.Errorf("Wrong funding, cash %s", engine.Portfolio.Cash)
+	}
+}
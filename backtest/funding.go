@@ -0,0 +1,76 @@
+package backtest
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Funding rate paid by longs to shorts at a time, negative when shorts pay longs.
+// BitMEX charges it every 8 hours on perpetual swaps
+type FundingRate struct {
+	Time time.Time
+	Rate decimal.Decimal
+}
+
+// FundingRates are sorted by time
+type FundingRates struct {
+	Rates []FundingRate
+}
+
+// Public
+
+// ReadFundingFile reads funding rates, one per line as "time rate" with a unix time
+func ReadFundingFile(path string) (*FundingRates, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadFundingRates(file)
+}
+
+func ReadFundingRates(r io.Reader) (*FundingRates, error) {
+	funding := &FundingRates{Rates: []FundingRate{}}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		data := strings.Fields(text)
+		if len(data) < 2 {
+			return nil, fmt.Errorf("line %d: expected a time and a rate", line)
+		}
+		seconds, err := strconv.ParseInt(data[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rate, err := decimal.NewFromString(data[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		funding.Rates = append(funding.Rates, FundingRate{Time: time.Unix(seconds, 0), Rate: rate})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(funding.Rates, func(i, j int) bool { return funding.Rates[i].Time.Before(funding.Rates[j].Time) })
+	return funding, nil
+}
+
+// Between returns the rates after from, up to and including to
+func (funding *FundingRates) Between(from, to time.Time) []FundingRate {
+	start := sort.Search(len(funding.Rates), func(i int) bool { return funding.Rates[i].Time.After(from) })
+	end := sort.Search(len(funding.Rates), func(i int) bool { return funding.Rates[i].Time.After(to) })
+	if start >= end {
+		return nil
+	}
+	return funding.Rates[start:end]
+}
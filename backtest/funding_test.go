@@ -0,0 +1,39 @@
+package backtest
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadFundingRates(t *testing.T) {
+	// GIVEN
+	data := "28800 -0.0002\n0 0.0001\n\n57600 0.0003\n"
+
+	// WHEN
+	funding, err := ReadFundingRates(strings.NewReader(data))
+	_, badErr := ReadFundingRates(strings.NewReader("0 abc"))
+
+	// THEN
+	if err != nil || len(funding.Rates) != 3 || badErr == nil {
+		t.Fatalf("Wrong funding rates %v %v %v", funding, err, badErr)
+	}
+	if funding.Rates[0].Time.Unix() != 0 || funding.Rates[1].Rate.String() != "-0.0002" {
+		t.Errorf("Rates not sorted %v", funding.Rates)
+	}
+}
+
+func TestFundingBetween(t *testing.T) {
+	// GIVEN
+	funding, _ := ReadFundingRates(strings.NewReader("0 0.0001\n28800 -0.0002\n57600 0.0003"))
+
+	// WHEN
+	first := funding.Between(time.Unix(0, 0), time.Unix(28800, 0))
+	none := funding.Between(time.Unix(1, 0), time.Unix(28799, 0))
+	all := funding.Between(time.Unix(-1, 0), time.Unix(60000, 0))
+
+	// THEN
+	if len(first) != 1 || first[0].Time.Unix() != 28800 || len(none) != 0 || len(all) != 3 {
+		t.Errorf("Wrong rates %v %v %v", first, none, all)
+	}
+}
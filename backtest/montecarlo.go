@@ -0,0 +1,196 @@
+package backtest
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"thierry/gocoin/common"
+)
+
+const (
+	// Same trades in a random order, the final equity only changes with price noise
+	RESAMPLE_SHUFFLE = iota
+	// Trades drawn at random with replacement
+	RESAMPLE_BOOTSTRAP
+)
+
+// MonteCarlo replays the trades of a run in random orders, compounding the return of
+// each trade, to see how much of the result was luck
+type MonteCarlo struct {
+	Runs int
+	// RESAMPLE_SHUFFLE or RESAMPLE_BOOTSTRAP
+	Method int
+	// Standard deviation of a random move against or for the entry price of each trade,
+	// as a ratio of the price, e.g. 0.001. None when 0
+	PriceNoise float64
+	// A run going under this ratio of the initial equity is ruined, e.g. 0.5
+	RuinLevel float64
+	Seed      int64
+}
+
+// Distribution of a value over the runs
+type Percentiles struct {
+	P5   float64 `json:"p5"`
+	P25  float64 `json:"p25"`
+	P50  float64 `json:"p50"`
+	P75  float64 `json:"p75"`
+	P95  float64 `json:"p95"`
+	Mean float64 `json:"mean"`
+}
+
+type MonteCarloResult struct {
+	Runs   int `json:"runs"`
+	Trades int `json:"trades"`
+	// Of the trades in their actual order
+	FinalEquity       float64     `json:"final_equity"`
+	MaxDrawdown       float64     `json:"max_drawdown"`
+	FinalEquities     Percentiles `json:"final_equities"`
+	MaxDrawdowns      Percentiles `json:"max_drawdowns"`
+	ProbabilityOfRuin float64     `json:"probability_of_ruin"`
+}
+
+// A closed trade as ratios of the equity it started with
+type tradeReturn struct {
+	profit float64
+	// Value of the position over the equity, and 1 for longs or -1 for shorts
+	exposure  float64
+	direction float64
+}
+
+// Public
+
+func CreateNewMonteCarlo() *MonteCarlo {
+	return &MonteCarlo{Runs: 1000, Method: RESAMPLE_SHUFFLE, RuinLevel: 0.5, Seed: 1}
+}
+
+// Run resamples the trades closed by the fills of a portfolio which started with initial
+func (monteCarlo *MonteCarlo) Run(initial decimal.Decimal, fills []Fill) MonteCarloResult {
+	start, _ := initial.Float64()
+	trades := tradeReturns(start, fills)
+	result := MonteCarloResult{Runs: monteCarlo.Runs, Trades: len(trades), FinalEquity: start}
+	if len(trades) == 0 || monteCarlo.Runs <= 0 {
+		return result
+	}
+	result.FinalEquity, result.MaxDrawdown, _ = monteCarlo.replay(start, trades, nil)
+
+	random := rand.New(rand.NewSource(monteCarlo.Seed))
+	finals := make([]float64, monteCarlo.Runs)
+	drawdowns := make([]float64, monteCarlo.Runs)
+	ruined := 0
+	sample := make([]tradeReturn, len(trades))
+	for run := 0; run < monteCarlo.Runs; run++ {
+		if monteCarlo.Method == RESAMPLE_BOOTSTRAP {
+			for i := range sample {
+				sample[i] = trades[random.Intn(len(trades))]
+			}
+		} else {
+			copy(sample, trades)
+			random.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+		}
+		final, maxDrawdown, isRuined := monteCarlo.replay(start, sample, random)
+		finals[run], drawdowns[run] = final, maxDrawdown
+		if isRuined {
+			ruined += 1
+		}
+	}
+	result.FinalEquities = percentiles(finals)
+	result.MaxDrawdowns = percentiles(drawdowns)
+	result.ProbabilityOfRuin = float64(ruined) / float64(monteCarlo.Runs)
+	return result
+}
+
+func (result MonteCarloResult) String() string {
+	return strings.Join([]string{
+		fmt.Sprintf("Monte Carlo:  %d runs of %d trades", result.Runs, result.Trades),
+		fmt.Sprintf("Actual:       %.2f final equity, %.2f%% max drawdown", result.FinalEquity, 100*result.MaxDrawdown),
+		fmt.Sprintf("Final equity: %.2f / %.2f / %.2f / %.2f / %.2f (5/25/50/75/95%%), mean %.2f",
+			result.FinalEquities.P5, result.FinalEquities.P25, result.FinalEquities.P50, result.FinalEquities.P75,
+			result.FinalEquities.P95, result.FinalEquities.Mean),
+		fmt.Sprintf("Max drawdown: %.2f%% / %.2f%% / %.2f%% / %.2f%% / %.2f%% (5/25/50/75/95%%), mean %.2f%%",
+			100*result.MaxDrawdowns.P5, 100*result.MaxDrawdowns.P25, 100*result.MaxDrawdowns.P50,
+			100*result.MaxDrawdowns.P75, 100*result.MaxDrawdowns.P95, 100*result.MaxDrawdowns.Mean),
+		fmt.Sprintf("Ruin:         %.2f%%", 100*result.ProbabilityOfRuin),
+	}, "\n")
+}
+
+// Private
+
+// Compounds the trades, with a random entry price move when random is set. Returns the
+// final equity, the max drawdown and whether the run was ruined
+func (monteCarlo *MonteCarlo) replay(start float64, trades []tradeReturn, random *rand.Rand) (float64, float64, bool) {
+	equity := make([]float64, 0, len(trades)+1)
+	equity = append(equity, start)
+	value, ruined := start, false
+	for _, trade := range trades {
+		profit := trade.profit
+		if random != nil && monteCarlo.PriceNoise > 0 {
+			// A higher entry costs longs and pays shorts
+			profit -= trade.direction * trade.exposure * random.NormFloat64() * monteCarlo.PriceNoise
+		}
+		value *= 1 + profit
+		if value < 0 {
+			value = 0
+		}
+		if value <= start*monteCarlo.RuinLevel {
+			ruined = true
+		}
+		equity = append(equity, value)
+	}
+	maxDrawdown, _ := drawdown(equity)
+	return value, maxDrawdown, ruined
+}
+
+func tradeReturns(start float64, fills []Fill) []tradeReturn {
+	trades := []tradeReturn{}
+	equity, notional, profit := start, 0.0, decimal.Zero
+	previous := decimal.Zero
+	for _, fill := range fills {
+		profit = profit.Add(fill.Pnl).Sub(fill.Fee)
+		// Fills growing the position make its entry
+		if fill.Position.Abs().Cmp(previous.Abs()) > 0 {
+			value, _ := fill.Size.Mul(fill.Price).Float64()
+			notional += value
+		}
+		previous = fill.Position
+		if !fill.Position.IsZero() {
+			continue
+		}
+		// Closed by a buy for shorts
+		direction := 1.0
+		if fill.Side == common.SIDE_BUY {
+			direction = -1
+		}
+		value, _ := profit.Float64()
+		if equity > 0 {
+			trades = append(trades, tradeReturn{profit: value / equity, exposure: notional / equity, direction: direction})
+		}
+		equity += value
+		notional, profit = 0, decimal.Zero
+	}
+	return trades
+}
+
+// Nearest rank percentiles and mean of the values
+func percentiles(values []float64) Percentiles {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	rank := func(p float64) float64 {
+		return sorted[int(math.Round(p*float64(len(sorted)-1)))]
+	}
+	mean := 0.0
+	for _, value := range sorted {
+		mean += value
+	}
+	return Percentiles{
+		P5:   rank(0.05),
+		P25:  rank(0.25),
+		P50:  rank(0.5),
+		P75:  rank(0.75),
+		P95:  rank(0.95),
+		Mean: mean / float64(len(sorted)),
+	}
+}
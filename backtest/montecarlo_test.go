@@ -0,0 +1,76 @@
+package backtest
+
+import (
+	"github.com/shopspring/decimal"
+	"math"
+	"testing"
+)
+
+// Longs of 1000 making the profits, one after the other
+func generateTrades(profits ...float64) []Fill {
+	fills := []Fill{}
+	for _, profit := range profits {
+		fills = append(fills,
+			Fill{Side: "buy", Price: decimal.NewFromFloat(100), Size: decimal.NewFromFloat(10), Position: decimal.NewFromFloat(10)},
+			Fill{Side: "sell", Size: decimal.NewFromFloat(10), Pnl: decimal.NewFromFloat(profit)})
+	}
+	return fills
+}
+
+func TestMonteCarloShuffle(t *testing.T) {
+	// GIVEN
+	monteCarlo := CreateNewMonteCarlo()
+	monteCarlo.Runs = 200
+
+	// WHEN
+	result := monteCarlo.Run(decimal.NewFromFloat(1000), generateTrades(100, -50))
+
+	// THEN
+	// Returns of 10% and -4.5%, in any order
+	if result.Trades != 2 || math.Abs(result.FinalEquity-1050) > 1e-9 || math.Abs(result.FinalEquities.P5-result.FinalEquities.P95) > 1e-9 {
+		t.Errorf("Wrong final equities %#v", result)
+	}
+	// The loss is always 4.5%, before or after the win
+	if math.Abs(result.MaxDrawdowns.P5-50.0/1100) > 1e-9 || math.Abs(result.MaxDrawdowns.P95-50.0/1100) > 1e-9 || result.ProbabilityOfRuin != 0 {
+		t.Errorf("Wrong drawdowns %#v", result.MaxDrawdowns)
+	}
+}
+
+func TestMonteCarloBootstrap(t *testing.T) {
+	// GIVEN
+	monteCarlo := CreateNewMonteCarlo()
+	monteCarlo.Method = RESAMPLE_BOOTSTRAP
+	monteCarlo.Runs = 200
+
+	// WHEN
+	result := monteCarlo.Run(decimal.NewFromFloat(1000), generateTrades(100, -50))
+
+	// THEN
+	// Two wins, two losses or one of each
+	if math.Abs(result.FinalEquities.P5-1000*(1-50.0/1100)*(1-50.0/1100)) > 1e-9 || math.Abs(result.FinalEquities.P95-1210) > 1e-9 {
+		t.Errorf("Wrong final equities %#v", result.FinalEquities)
+	}
+}
+
+func TestMonteCarloRuinAndNoise(t *testing.T) {
+	// GIVEN
+	ruin := CreateNewMonteCarlo()
+	noisy := CreateNewMonteCarlo()
+	noisy.PriceNoise = 0.01
+
+	// WHEN
+	ruined := ruin.Run(decimal.NewFromFloat(1000), generateTrades(100, -700))
+	moved := noisy.Run(decimal.NewFromFloat(1000), generateTrades(100, -50))
+	empty := ruin.Run(decimal.NewFromFloat(1000), nil)
+
+	// THEN
+	if ruined.ProbabilityOfRuin != 1 {
+		t.Errorf("Wrong probability of ruin %f", ruined.ProbabilityOfRuin)
+	}
+	if moved.FinalEquities.P95-moved.FinalEquities.P5 < 1 {
+		t.Errorf("Entry prices not perturbed %#v", moved.FinalEquities)
+	}
+	if empty.Trades != 0 || empty.FinalEquity != 1000 {
+		t.Errorf("Wrong result without trades %#v", empty)
+	}
+}
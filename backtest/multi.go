@@ -0,0 +1,336 @@
+package backtest
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"os"
+	"path/filepath"
+	"strings"
+	"thierry/gocoin/common"
+	"time"
+)
+
+// Allocation returns the part of the total equity each asset trades with, the rest
+// stays in cash
+type Allocation interface {
+	Weights(products []string) map[string]decimal.Decimal
+}
+
+// EqualWeights splits the equity evenly between the assets
+type EqualWeights struct{}
+
+// FixedWeights gives each asset its weight, 0 for missing assets
+type FixedWeights map[string]decimal.Decimal
+
+// Rebalance resizes the open positions so each asset gets back to its weight, keeping
+// the exposure the strategy picked
+type Rebalance struct {
+	// Time between rebalances, never when 0
+	Every time.Duration
+	// Also rebalances an asset when its weight is this far from the target, as a ratio
+	// of the target, e.g. 0.2. Never when 0
+	Threshold decimal.Decimal
+}
+
+// MultiEngine runs an engine per asset on candles merged on their time. All assets share
+// one cash balance, flat assets get their share of the total equity when a candle comes,
+// and give it back if they didn't open a position
+type MultiEngine struct {
+	Products []string
+	Engines  map[string]*Engine
+	Initial  decimal.Decimal
+	// Cash no asset is using
+	Cash       decimal.Decimal
+	Allocation Allocation
+	// Can be nil
+	Rebalance *Rebalance
+	// Timeframe of the candles, for the chart of each asset
+	Timeframe time.Duration
+	// Total equity at each time, once an asset is past its warmup
+	Equity        []EquityPoint
+	weights       map[string]decimal.Decimal
+	assets        map[string]*assetState
+	lastRebalance time.Time
+}
+
+// Per asset profits, for their report
+type assetState struct {
+	price decimal.Decimal
+	// Profits of the fills seen so far, minus fees
+	realized decimal.Decimal
+	fills    int
+	// Weight of the asset times the initial cash, plus profits
+	equity []EquityPoint
+}
+
+// Performance of the whole portfolio and of each asset, asset returns are relative to
+// their initial share of the cash
+type MultiReport struct {
+	Combined Report
+	Assets   map[string]Report
+	Products []string
+}
+
+// Public
+
+func CreateNewMultiEngine(cash decimal.Decimal) *MultiEngine {
+	return &MultiEngine{
+		Products:   []string{},
+		Engines:    map[string]*Engine{},
+		Initial:    cash,
+		Cash:       cash,
+		Allocation: &EqualWeights{},
+		Timeframe:  time.Minute,
+		assets:     map[string]*assetState{},
+	}
+}
+
+func (allocation *EqualWeights) Weights(products []string) map[string]decimal.Decimal {
+	weights := map[string]decimal.Decimal{}
+	for _, product := range products {
+		weights[product] = decimal.New(1, 0).Div(decimal.New(int64(len(products)), 0))
+	}
+	return weights
+}
+
+func (allocation FixedWeights) Weights(products []string) map[string]decimal.Decimal {
+	weights := map[string]decimal.Decimal{}
+	for _, product := range products {
+		weights[product] = allocation[product]
+	}
+	return weights
+}
+
+// AddAsset returns the engine of the asset, to set its stops or portfolio costs
+func (multi *MultiEngine) AddAsset(product string, strategy Strategy) *Engine {
+	engine := CreateNewEngine(strategy, CreateNewPortfolio(decimal.Zero))
+	multi.Products = append(multi.Products, product)
+	multi.Engines[product] = engine
+	multi.assets[product] = &assetState{}
+	return engine
+}
+
+// Run replays the candles of each product in time order, then closes every position
+func (multi *MultiEngine) Run(candles map[string][]common.Candle) {
+	multi.weights = multi.Allocation.Weights(multi.Products)
+	for _, product := range multi.Products {
+		multi.Engines[product].Chart.Timeframe = multi.Timeframe
+	}
+	indexes := map[string]int{}
+	for {
+		var next time.Time
+		for _, product := range multi.Products {
+			if i := indexes[product]; i < len(candles[product]) && (next.IsZero() || candles[product][i].Time.Before(next)) {
+				next = candles[product][i].Time
+			}
+		}
+		if next.IsZero() {
+			break
+		}
+		updated := []string{}
+		for _, product := range multi.Products {
+			if i := indexes[product]; i < len(candles[product]) && candles[product][i].Time.Equal(next) {
+				multi.addCandle(product, candles[product][i])
+				indexes[product] += 1
+				updated = append(updated, product)
+			}
+		}
+		multi.rebalance(next, updated)
+		multi.addEquity(next)
+	}
+	multi.Close()
+}
+
+// Close closes the positions still open at their last close
+func (multi *MultiEngine) Close() {
+	for _, product := range multi.Products {
+		engine := multi.Engines[product]
+		engine.Close()
+		multi.Cash = multi.Cash.Add(engine.Portfolio.Cash)
+		engine.Portfolio.Cash = decimal.Zero
+		// Last equity now includes the closing fees
+		if asset := multi.assets[product]; len(asset.equity) > 0 {
+			asset.equity[len(asset.equity)-1].Equity = multi.assetEquity(product)
+		}
+	}
+	if len(multi.Equity) > 0 {
+		multi.Equity[len(multi.Equity)-1].Equity = multi.Cash
+	}
+}
+
+// TotalEquity returns the cash plus the value of every asset at its last price
+func (multi *MultiEngine) TotalEquity() decimal.Decimal {
+	total := multi.Cash
+	for _, product := range multi.Products {
+		total = total.Add(multi.Engines[product].Portfolio.Equity(multi.assets[product].price))
+	}
+	return total
+}
+
+func (multi *MultiEngine) Report() MultiReport {
+	report := MultiReport{Assets: map[string]Report{}, Products: multi.Products}
+	fills := []Fill{}
+	funding := decimal.Zero
+	for _, product := range multi.Products {
+		engine := multi.Engines[product]
+		initial := multi.Initial.Mul(multi.weights[product])
+		asset := CreateNewReport(engine.Strategy.Name(), initial, multi.assets[product].equity, engine.Portfolio.Fills)
+		asset.Funding, _ = engine.Portfolio.Funding.Float64()
+		report.Assets[product] = asset
+		// Kept in order for each asset, so trades are not mixed up
+		fills = append(fills, engine.Portfolio.Fills...)
+		funding = funding.Add(engine.Portfolio.Funding)
+	}
+	report.Combined = CreateNewReport(strings.Join(multi.Products, ","), multi.Initial, multi.Equity, fills)
+	report.Combined.Funding, _ = funding.Float64()
+	return report
+}
+
+func (report MultiReport) String() string {
+	lines := []string{}
+	for _, product := range report.Products {
+		asset := report.Assets[product]
+		lines = append(lines, fmt.Sprintf("%-8s PnL %.2f (%.2f%%), %d trades, %.2f%% won, %.2f in fees",
+			product, asset.EndingEquity-asset.StartingEquity, 100*asset.TotalReturn, asset.Trades, 100*asset.WinRate, asset.Fees))
+	}
+	lines = append(lines, "", report.Combined.String())
+	return strings.Join(lines, "\n")
+}
+
+// ReadProductFiles reads the candle files of a directory as recorded by gdax, named
+// after the products, in any of the candle formats
+func ReadProductFiles(dir string, products []string) (map[string][]common.Candle, error) {
+	candles := map[string][]common.Candle{}
+	for _, product := range products {
+		path, err := productFile(dir, product)
+		if err != nil {
+			return nil, err
+		}
+		productCandles, err := ReadCandleFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", product, err)
+		}
+		candles[product] = productCandles
+	}
+	return candles, nil
+}
+
+// ReadProductSource reads the candles of each product from the source, see CandleSource
+func ReadProductSource(source CandleSource, products []string, timeframe time.Duration, from, to time.Time) (map[string][]common.Candle, error) {
+	candles := map[string][]common.Candle{}
+	for _, product := range products {
+		productCandles, err := source.Candles(product, timeframe, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", product, err)
+		} else if len(productCandles) == 0 {
+			return nil, fmt.Errorf("%s: no %s candles", product, common.TimeframeName(timeframe))
+		}
+		candles[product] = productCandles
+	}
+	return candles, nil
+}
+
+// Private
+
+// First file of the product found, newer formats first
+func productFile(dir, product string) (string, error) {
+	for _, extension := range []string{".csv", ".jsonl", ".candles", ".txt"} {
+		path := filepath.Join(dir, product+extension)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s: no candle file in %s", product, dir)
+}
+
+func (multi *MultiEngine) addCandle(product string, candle common.Candle) {
+	engine := multi.Engines[product]
+	portfolio := engine.Portfolio
+	if !portfolio.IsHolding() {
+		multi.Cash = multi.Cash.Add(portfolio.Cash)
+		portfolio.Cash = decimal.Zero
+		budget := multi.TotalEquity().Mul(multi.weights[product])
+		if budget.Cmp(multi.Cash) > 0 {
+			budget = multi.Cash
+		}
+		if budget.Sign() > 0 {
+			portfolio.Cash = budget
+			multi.Cash = multi.Cash.Sub(budget)
+		}
+	}
+	engine.AddCandle(candle)
+	multi.assets[product].price = candle.Close
+	if !portfolio.IsHolding() {
+		multi.Cash = multi.Cash.Add(portfolio.Cash)
+		portfolio.Cash = decimal.Zero
+	}
+}
+
+// Moves cash between the open positions and the shared cash, on the assets which just
+// got a candle
+func (multi *MultiEngine) rebalance(t time.Time, updated []string) {
+	if multi.Rebalance == nil {
+		return
+	}
+	due := false
+	if multi.Rebalance.Every > 0 {
+		if multi.lastRebalance.IsZero() {
+			multi.lastRebalance = t
+		} else if t.Sub(multi.lastRebalance) >= multi.Rebalance.Every {
+			due, multi.lastRebalance = true, t
+		}
+	}
+	total := multi.TotalEquity()
+	for _, product := range updated {
+		portfolio, price := multi.Engines[product].Portfolio, multi.assets[product].price
+		target := total.Mul(multi.weights[product])
+		value := portfolio.Equity(price)
+		if !portfolio.IsHolding() || target.Sign() <= 0 || value.Sign() <= 0 {
+			continue
+		}
+		drift := value.Sub(target).Abs().Div(target)
+		if !due && (multi.Rebalance.Threshold.Sign() <= 0 || drift.Cmp(multi.Rebalance.Threshold) < 0) {
+			continue
+		}
+		transfer := target.Sub(value)
+		if transfer.Cmp(multi.Cash) > 0 {
+			transfer = multi.Cash
+		}
+		exposure := portfolio.Position.Abs().Mul(price).Div(value)
+		portfolio.Cash = portfolio.Cash.Add(transfer)
+		multi.Cash = multi.Cash.Sub(transfer)
+		portfolio.Resize(portfolio.Equity(price).Mul(exposure), price, multi.Engines[product].Chart.CurrentCandle(), "rebalance")
+	}
+}
+
+func (multi *MultiEngine) addEquity(t time.Time) {
+	started, holding := false, false
+	for _, product := range multi.Products {
+		engine := multi.Engines[product]
+		started = started || engine.Counter > engine.Warmup
+		holding = holding || engine.Portfolio.IsHolding()
+	}
+	if !started {
+		return
+	}
+	multi.Equity = append(multi.Equity, EquityPoint{Time: t, Equity: multi.TotalEquity(), Holding: holding})
+	for _, product := range multi.Products {
+		asset := multi.assets[product]
+		asset.equity = append(asset.equity, EquityPoint{
+			Time:    t,
+			Equity:  multi.assetEquity(product),
+			Holding: multi.Engines[product].Portfolio.IsHolding(),
+		})
+	}
+}
+
+// Initial share of the asset plus its profits so far
+func (multi *MultiEngine) assetEquity(product string) decimal.Decimal {
+	asset, portfolio := multi.assets[product], multi.Engines[product].Portfolio
+	for ; asset.fills < len(portfolio.Fills); asset.fills++ {
+		fill := portfolio.Fills[asset.fills]
+		asset.realized = asset.realized.Add(fill.Pnl).Sub(fill.Fee)
+	}
+	unrealized := portfolio.Position.Mul(asset.price.Sub(portfolio.Entry))
+	return multi.Initial.Mul(multi.weights[product]).Add(asset.realized).Sub(portfolio.Funding).Add(unrealized)
+}
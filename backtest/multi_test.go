@@ -0,0 +1,132 @@
+package backtest
+
+import (
+	"github.com/shopspring/decimal"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"thierry/gocoin/common"
+	"time"
+)
+
+func TestMultiEngineSharedCash(t *testing.T) {
+	// GIVEN
+	multi := CreateNewMultiEngine(decimal.NewFromFloat(1000))
+	multi.AddAsset("A", &scriptedStrategy{buys: map[int]bool{2: true}}).Warmup = 1
+	multi.AddAsset("B", &scriptedStrategy{buys: map[int]bool{2: true}}).Warmup = 1
+	candles := map[string][]common.Candle{
+		"A": generateCandles(10, 10, 20),
+		"B": generateCandles(20, 20, 10),
+	}
+
+	// WHEN
+	multi.Run(candles)
+
+	// THEN
+	a, b := multi.Engines["A"].Portfolio.Fills, multi.Engines["B"].Portfolio.Fills
+	if len(a) != 2 || len(b) != 2 || !a[0].Size.Equal(decimal.NewFromFloat(50)) || !b[0].Size.Equal(decimal.NewFromFloat(25)) {
+		t.Fatalf("Wrong fills %v %v", a, b)
+	}
+	report := multi.Report()
+	if !multi.Cash.Equal(decimal.NewFromFloat(1250)) || report.Combined.EndingEquity != 1250 || report.Combined.Trades != 2 {
+		t.Errorf("Wrong combined report %#v", report.Combined)
+	}
+	if report.Assets["A"].EndingEquity != 1000 || report.Assets["B"].EndingEquity != 250 || report.Assets["A"].StartingEquity != 500 {
+		t.Errorf("Wrong asset reports %#v", report.Assets)
+	}
+}
+
+func TestMultiEngineMerge(t *testing.T) {
+	// GIVEN
+	multi := CreateNewMultiEngine(decimal.NewFromFloat(1000))
+	multi.AddAsset("A", &scriptedStrategy{}).Warmup = 0
+	multi.AddAsset("B", &scriptedStrategy{}).Warmup = 0
+	late := generateCandles(10, 10, 10, 10)[2:]
+
+	// WHEN
+	multi.Run(map[string][]common.Candle{"A": generateCandles(10, 10, 10), "B": late})
+
+	// THEN
+	if len(multi.Equity) != 4 || multi.Engines["A"].Counter != 3 || multi.Engines["B"].Counter != 2 {
+		t.Errorf("Wrong merge %v", multi.Equity)
+	}
+}
+
+func TestMultiEngineTimeframe(t *testing.T) {
+	// GIVEN
+	multi := CreateNewMultiEngine(decimal.NewFromFloat(1000))
+	multi.Timeframe = time.Hour
+	multi.AddAsset("A", &scriptedStrategy{}).Warmup = 0
+	candles := generateTimeframeCandles(time.Hour, 3)
+
+	// WHEN
+	multi.Run(map[string][]common.Candle{"A": candles})
+
+	// THEN
+	chart := multi.Engines["A"].Chart
+	if chart.Timeframe != time.Hour || !chart.GetPastRelativeCandle(-1).Time.Equal(candles[1].Time) {
+		t.Errorf("Hourly candles should not be gap filled %s", chart.GetPastRelativeCandle(-1).String())
+	}
+}
+
+func TestMultiEngineRebalance(t *testing.T) {
+	// GIVEN
+	multi := CreateNewMultiEngine(decimal.NewFromFloat(1000))
+	multi.Rebalance = &Rebalance{Threshold: decimal.NewFromFloat(0.1)}
+	multi.AddAsset("A", &scriptedStrategy{buys: map[int]bool{2: true}}).Warmup = 1
+	multi.AddAsset("B", &scriptedStrategy{buys: map[int]bool{2: true}}).Warmup = 1
+
+	// WHEN
+	multi.Run(map[string][]common.Candle{
+		"A": generateCandles(10, 10, 20, 20),
+		"B": generateCandles(20, 20, 20, 20),
+	})
+
+	// THEN
+	// A went up to 1000 and B stayed at 500, both are brought back to 750
+	a, b := multi.Engines["A"].Portfolio.Fills, multi.Engines["B"].Portfolio.Fills
+	if len(a) != 3 || a[1].Reason != "rebalance" || !a[1].Position.Equal(decimal.NewFromFloat(37.5)) {
+		t.Fatalf("Wrong rebalance of A %v", a)
+	}
+	if len(b) != 3 || b[1].Side != common.SIDE_BUY || !b[1].Position.Equal(decimal.NewFromFloat(37.5)) {
+		t.Errorf("Wrong rebalance of B %v", b)
+	}
+	if !multi.Cash.Equal(decimal.NewFromFloat(1500)) || multi.Report().Combined.Trades != 2 {
+		t.Errorf("Wrong cash %s", multi.Cash)
+	}
+}
+
+func TestFixedWeights(t *testing.T) {
+	// GIVEN
+	allocation := FixedWeights{"A": decimal.NewFromFloat(0.7)}
+
+	// WHEN
+	weights := allocation.Weights([]string{"A", "B"})
+
+	// THEN
+	if !weights["A"].Equal(decimal.NewFromFloat(0.7)) || !weights["B"].IsZero() {
+		t.Errorf("Wrong weights %v", weights)
+	}
+}
+
+func TestReadProductFiles(t *testing.T) {
+	// GIVEN
+	dir, _ := ioutil.TempDir("", "products")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "BTC-USD.txt"), []byte("1512086400 10 12 9 11 10.5 3\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "ETH-USD.txt"), []byte("1512086400 1 2 1 2 1.5 3\n1512086460 2 2 1 1 1.5 3\n"), 0644)
+	// Newer formats are read first
+	ioutil.WriteFile(filepath.Join(dir, "LTC-USD.txt"), []byte("1512086400 1 2 1 2 1.5 3\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "LTC-USD.csv"), []byte("# candles v1\ntime,open,high,low,close,average,volume,missing\n"+
+		"2017-12-01T00:00:00Z,1,2,1,2,1.5,3,\n2017-12-01T00:01:00Z,2,2,1,1,1.5,3,\n2017-12-01T00:02:00Z,1,1,1,1,1,0,1\n"), 0644)
+
+	// WHEN
+	candles, err := ReadProductFiles(dir, []string{"BTC-USD", "ETH-USD", "LTC-USD"})
+	_, missingErr := ReadProductFiles(dir, []string{"XRP-USD"})
+
+	// THEN
+	if err != nil || len(candles["BTC-USD"]) != 1 || len(candles["ETH-USD"]) != 2 || len(candles["LTC-USD"]) != 3 || missingErr == nil {
+		t.Errorf("Wrong product candles %v %v %v", candles, err, missingErr)
+	}
+}
@@ -0,0 +1,247 @@
+package backtest
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"io"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"thierry/gocoin/common"
+	"time"
+)
+
+// Report values the optimizer can rank results by, higher is better
+var METRICS = map[string]func(report Report) float64{
+	"total_return":      func(report Report) float64 { return report.TotalReturn },
+	"annualized_return": func(report Report) float64 { return report.AnnualizedReturn },
+	"sharpe":            func(report Report) float64 { return report.Sharpe },
+	"sortino":           func(report Report) float64 { return report.Sortino },
+	"max_drawdown":      func(report Report) float64 { return -report.MaxDrawdown },
+	"win_rate":          func(report Report) float64 { return report.WinRate },
+	"profit_factor":     func(report Report) float64 { return report.ProfitFactor },
+}
+
+// Values of the strategy parameters, keyed by name
+type Params map[string]float64
+
+// Range of values tried for a parameter, from Min to Max included
+type Range struct {
+	Name string
+	Min  float64
+	Max  float64
+	Step float64
+}
+
+// Optimizer runs a backtest for each set of parameters, on as many cores as available
+type Optimizer struct {
+	Ranges []Range
+	// Creates the strategy to test with a set of parameters
+	Strategy func(params Params) (Strategy, error)
+	// Creates the portfolio of each run, an all in portfolio of 1000 by default
+	Portfolio func() *Portfolio
+	// Candles replayed before signals are used, see Engine
+	Warmup int
+	// Timeframe of the candles, for the chart of each run
+	Timeframe time.Duration
+	// Protective exits used by every run, can be nil
+	Stops *Stops
+	// Funding paid on positions by every run, can be nil
+	Funding *FundingRates
+	// Name of the METRICS used to rank results
+	Metric string
+	// Number of backtests running at the same time, defaults to the number of CPUs
+	Workers int
+	// When set, tries this many random sets of parameters instead of the whole grid
+	Samples int
+	Seed    int64
+}
+
+type OptimizerResult struct {
+	Params Params
+	Report Report
+	Score  float64
+}
+
+// Public
+
+func CreateNewOptimizer(strategy func(params Params) (Strategy, error), ranges []Range) *Optimizer {
+	return &Optimizer{
+		Ranges:   ranges,
+		Strategy: strategy,
+		Portfolio: func() *Portfolio {
+			return CreateNewPortfolio(decimal.NewFromFloat(1000.0))
+		},
+		Warmup:    WARMUP_CANDLE,
+		Timeframe: time.Minute,
+		Metric:    "total_return",
+		Workers:   runtime.NumCPU(),
+		Seed:      1,
+	}
+}
+
+// Run backtests all the parameters on the candles, best results first
+func (optimizer *Optimizer) Run(candles []common.Candle) ([]OptimizerResult, error) {
+	metric, ok := METRICS[optimizer.Metric]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %s", optimizer.Metric)
+	}
+	for _, r := range optimizer.Ranges {
+		if r.Max < r.Min || (r.Step <= 0 && r.Max != r.Min) {
+			return nil, fmt.Errorf("invalid range for %s", r.Name)
+		}
+	}
+	paramsList := optimizer.Grid()
+	if optimizer.Samples > 0 {
+		paramsList = optimizer.Sample()
+	}
+
+	workers := optimizer.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	results := make([]OptimizerResult, len(paramsList))
+	errs := make([]error, len(paramsList))
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i], errs[i] = optimizer.backtest(paramsList[i], candles, metric)
+			}
+		}()
+	}
+	for i := range paramsList {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results, nil
+}
+
+// Grid returns every combination of the ranges values
+func (optimizer *Optimizer) Grid() []Params {
+	paramsList := []Params{{}}
+	for _, r := range optimizer.Ranges {
+		next := []Params{}
+		for _, params := range paramsList {
+			for _, value := range r.values() {
+				combination := params.copy()
+				combination[r.Name] = value
+				next = append(next, combination)
+			}
+		}
+		paramsList = next
+	}
+	return paramsList
+}
+
+// Sample returns Samples random combinations, values picked on each range steps
+func (optimizer *Optimizer) Sample() []Params {
+	random := rand.New(rand.NewSource(optimizer.Seed))
+	paramsList := make([]Params, optimizer.Samples)
+	for i := range paramsList {
+		paramsList[i] = Params{}
+		for _, r := range optimizer.Ranges {
+			values := r.values()
+			paramsList[i][r.Name] = values[random.Intn(len(values))]
+		}
+	}
+	return paramsList
+}
+
+// WriteResultsCSV writes one line per result, with the parameters then the report values
+func WriteResultsCSV(w io.Writer, ranges []Range, results []OptimizerResult) error {
+	writer := csv.NewWriter(w)
+	header := []string{}
+	for _, r := range ranges {
+		header = append(header, r.Name)
+	}
+	header = append(header, "score", "total_return", "annualized_return", "sharpe", "sortino", "max_drawdown",
+		"max_drawdown_candles", "trades", "win_rate", "average_win", "average_loss", "profit_factor", "exposure",
+		"average_holding_candles")
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, result := range results {
+		record := []string{}
+		for _, r := range ranges {
+			record = append(record, formatFloat(result.Params[r.Name]))
+		}
+		report := result.Report
+		record = append(record, formatFloat(result.Score), formatFloat(report.TotalReturn), formatFloat(report.AnnualizedReturn),
+			formatFloat(report.Sharpe), formatFloat(report.Sortino), formatFloat(report.MaxDrawdown),
+			strconv.Itoa(report.MaxDrawdownCandles), strconv.Itoa(report.Trades), formatFloat(report.WinRate),
+			formatFloat(report.AverageWin), formatFloat(report.AverageLoss), formatFloat(report.ProfitFactor),
+			formatFloat(report.Exposure), formatFloat(report.AverageHoldingCandles))
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func WriteResultsCSVFile(path string, ranges []Range, results []OptimizerResult) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return WriteResultsCSV(file, ranges, results)
+}
+
+// Private
+
+func (optimizer *Optimizer) backtest(params Params, candles []common.Candle, metric func(Report) float64) (OptimizerResult, error) {
+	strategy, err := optimizer.Strategy(params)
+	if err != nil {
+		return OptimizerResult{}, err
+	}
+	engine := CreateNewEngine(strategy, optimizer.Portfolio())
+	engine.Warmup = optimizer.Warmup
+	engine.Chart.Timeframe = optimizer.Timeframe
+	engine.Stops = optimizer.Stops
+	engine.Funding = optimizer.Funding
+	engine.Run(candles)
+	report := engine.Report()
+	return OptimizerResult{Params: params, Report: report, Score: metric(report)}, nil
+}
+
+func (r Range) values() []float64 {
+	if r.Step <= 0 {
+		return []float64{r.Min}
+	}
+	values := []float64{}
+	// Steps are counted so rounding errors don't add or drop the last value
+	steps := int((r.Max-r.Min)/r.Step + 1e-9)
+	for i := 0; i <= steps; i++ {
+		values = append(values, r.Min+float64(i)*r.Step)
+	}
+	return values
+}
+
+func (params Params) copy() Params {
+	res := make(Params, len(params))
+	for name, value := range params {
+		res[name] = value
+	}
+	return res
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,80 @@
+package backtest
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+func TestOptimizerGrid(t *testing.T) {
+	// GIVEN
+	optimizer := CreateNewOptimizer(CreateNewMfiMacdWithParams, []Range{
+		{Name: "macdh_buy", Min: 0.1, Max: 0.3, Step: 0.1},
+		{Name: "volume_length", Min: 5, Max: 5},
+	})
+
+	// WHEN
+	grid := optimizer.Grid()
+	optimizer.Samples = 10
+	samples := optimizer.Sample()
+
+	// THEN
+	if len(grid) != 3 || grid[2]["macdh_buy"] < 0.29 || grid[2]["volume_length"] != 5 {
+		t.Errorf("Wrong grid %v", grid)
+	}
+	if len(samples) != 10 || samples[0]["volume_length"] != 5 {
+		t.Errorf("Wrong samples %v", samples)
+	}
+}
+
+func TestOptimizerRun(t *testing.T) {
+	// GIVEN
+	// Buys on the first candle, and sells on the candle given by the "sell" parameter
+	strategy := func(params Params) (Strategy, error) {
+		return &scriptedStrategy{buys: map[int]bool{1: true}, sells: map[int]bool{int(params["sell"]): true}}, nil
+	}
+	ranges := []Range{{Name: "sell", Min: 2, Max: 5, Step: 1}}
+	optimizer := CreateNewOptimizer(strategy, ranges)
+	optimizer.Workers = 3
+	optimizer.Warmup = 0
+
+	// WHEN
+	results, err := optimizer.Run(generateCandles(10, 11, 15, 12, 9, 10))
+	optimizer.Metric = "unknown"
+	_, errMetric := optimizer.Run(generateCandles(10))
+
+	// THEN
+	if err != nil || len(results) != 4 {
+		t.Fatalf("Could not run optimizer %v", err)
+	}
+	if results[0].Params["sell"] != 3 || results[3].Params["sell"] != 5 || results[0].Score != results[0].Report.TotalReturn {
+		t.Errorf("Wrong ranking %v", results)
+	}
+	if errMetric == nil {
+		t.Errorf("Unknown metric should fail")
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := WriteResultsCSV(buffer, ranges, results); err != nil {
+		t.Fatalf("Could not write results %v", err)
+	}
+	records, err := csv.NewReader(buffer).ReadAll()
+	if err != nil || len(records) != 5 || records[0][0] != "sell" || records[1][0] != "3" || records[1][2] != "0.5" {
+		t.Errorf("Wrong csv %v %v", records, err)
+	}
+}
+
+func TestCreateNewMfiMacdWithParams(t *testing.T) {
+	// WHEN
+	strategy, err := CreateNewMfiMacdWithParams(Params{"mfi_sell": 85, "volume_length": 7})
+	_, errUnknown := CreateNewMfiMacdWithParams(Params{"rsi": 30})
+
+	// THEN
+	mfiMacd := strategy.(*MfiMacd)
+	if err != nil || mfiMacd.MfiSell != 85 || mfiMacd.VolumeLength != 7 || mfiMacd.MfiBuyMax != 60 {
+		t.Errorf("Wrong strategy %#v %v", strategy, err)
+	}
+	if errUnknown == nil {
+		t.Errorf("Unknown parameter should fail")
+	}
+}
@@ -0,0 +1,342 @@
+package backtest
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"thierry/gocoin/common"
+	"time"
+)
+
+// Maintenance margin of the BitMEX XBTUSD perpetual swap
+var BITMEX_MAINTENANCE_MARGIN = decimal.New(5, -3)
+
+const EXIT_LIQUIDATION = "liquidation"
+
+// Portfolio applies the strategy signals, opening a position sized by its Sizing on
+// buys, or on sells when shorts are allowed, and closing it entirely on the opposite
+// signal.
+// Profits are linear, the position is worth its size times the price move since entry
+type Portfolio struct {
+	// Cash the portfolio started with
+	Initial decimal.Decimal
+	// Wallet balance, the margin of the open position is part of it
+	Cash decimal.Decimal
+	// Size of the open position, negative for shorts
+	Position decimal.Decimal
+	// Average price the position was opened at
+	Entry decimal.Decimal
+	// Position notional value as a multiple of the cash, 1 by default
+	Leverage decimal.Decimal
+	// The position is liquidated when the equity goes under this ratio of its notional
+	// value, e.g. 0.005 for 0.5%
+	MaintenanceMargin decimal.Decimal
+	AllowShort        bool
+	Fees              FeeModel
+	// Notional of new positions, all the equity times the leverage when nil
+	Sizing Sizer
+	// Read by the sizing, set by the engine
+	Chart *common.CandleChart
+	// Can be nil, orders are then filled at the signal price
+	Slippage SlippageModel
+	// Whether orders are posted as limit orders, paying maker fees without slippage
+	Maker bool
+	Fills []Fill
+	// Total funding paid, negative when received
+	Funding decimal.Decimal
+	// Print each fill
+	Verbose bool
+	// Number of candles the current position has been held, after the opening candle
+	HoldingCandles int
+	// Number of times the position was opened or added to, see Pyramid
+	Units int
+}
+
+type Fill struct {
+	Time time.Time
+	Side string
+	// Average price the order was filled at, including slippage
+	Price decimal.Decimal
+	Size  decimal.Decimal
+	Fee   decimal.Decimal
+	// Cost of the slippage, compared to a fill at the signal price
+	Slippage decimal.Decimal
+	Reason   string
+	// Position after the fill, negative for shorts
+	Position decimal.Decimal
+	// Profit of the part of the position closed by the fill, without fees
+	Pnl decimal.Decimal
+	// Number of candles the position was held, for closing fills
+	HoldingCandles int
+	// Sizing policy of opening fills, and units of the position after them
+	Sizing string
+	Units  int
+	// Indicators of the candle the fill happened on
+	Indicators map[string]float64
+}
+
+// Public
+
+func CreateNewPortfolio(cash decimal.Decimal) *Portfolio {
+	return &Portfolio{
+		Initial:  cash,
+		Cash:     cash,
+		Leverage: decimal.New(1, 0),
+		Fees:     &FlatFee{},
+		Fills:    []Fill{},
+	}
+}
+
+func (portfolio *Portfolio) IsHolding() bool {
+	return portfolio.Position.Sign() != 0
+}
+
+func (portfolio *Portfolio) IsShort() bool {
+	return portfolio.Position.Sign() < 0
+}
+
+// Buy opens a long position, adds a unit to it, or closes the short one. Returns false
+// when already long with all the units
+func (portfolio *Portfolio) Buy(price decimal.Decimal, candle *common.Candle, reason string) (Fill, bool) {
+	if portfolio.IsShort() {
+		return portfolio.ClosePosition(price, candle, reason)
+	} else if portfolio.IsHolding() && portfolio.Units >= portfolio.maxUnits() {
+		return Fill{}, false
+	}
+	return portfolio.open(common.SIDE_BUY, price, candle, reason)
+}
+
+// Sell closes the long position, or opens or adds to a short one when allowed
+func (portfolio *Portfolio) Sell(price decimal.Decimal, candle *common.Candle, reason string) (Fill, bool) {
+	if portfolio.IsHolding() && !portfolio.IsShort() {
+		return portfolio.ClosePosition(price, candle, reason)
+	} else if !portfolio.AllowShort || (portfolio.IsHolding() && portfolio.Units >= portfolio.maxUnits()) {
+		return Fill{}, false
+	}
+	return portfolio.open(common.SIDE_SELL, price, candle, reason)
+}
+
+// ClosePosition closes the whole position. Returns false when there is none
+func (portfolio *Portfolio) ClosePosition(price decimal.Decimal, candle *common.Candle, reason string) (Fill, bool) {
+	if !portfolio.IsHolding() {
+		return Fill{}, false
+	}
+	return portfolio.reduce(portfolio.Position.Abs(), price, candle, reason), true
+}
+
+// Resize adds to or reduces the position so it is worth notional at price, e.g. to
+// rebalance it. Returns false when there is no position or nothing could be done
+func (portfolio *Portfolio) Resize(notional, price decimal.Decimal, candle *common.Candle, reason string) (Fill, bool) {
+	if !portfolio.IsHolding() || price.Sign() <= 0 {
+		return Fill{}, false
+	}
+	difference := notional.Sub(portfolio.Position.Abs().Mul(price))
+	if difference.Sign() < 0 {
+		size := difference.Neg().Div(price)
+		if size.Cmp(portfolio.Position.Abs()) > 0 {
+			size = portfolio.Position.Abs()
+		}
+		return portfolio.reduce(size, price, candle, reason), true
+	}
+	side := common.SIDE_BUY
+	if portfolio.IsShort() {
+		side = common.SIDE_SELL
+	}
+	return portfolio.increase(side, price, difference, candle, reason)
+}
+
+// Liquidate closes the position at the liquidation price, the exchange keeps the
+// maintenance margin left
+func (portfolio *Portfolio) Liquidate(candle *common.Candle) (Fill, bool) {
+	price, ok := portfolio.LiquidationPrice()
+	if !ok {
+		return Fill{}, false
+	}
+	// Liquidations are market orders, going through the book
+	maker := portfolio.Maker
+	portfolio.Maker = false
+	fill, _ := portfolio.ClosePosition(price, candle, EXIT_LIQUIDATION)
+	portfolio.Maker = maker
+	if portfolio.Cash.Sign() > 0 {
+		margin := portfolio.MaintenanceMargin.Mul(fill.Size).Mul(price)
+		if margin.Cmp(portfolio.Cash) > 0 {
+			margin = portfolio.Cash
+		}
+		portfolio.Cash = portfolio.Cash.Sub(margin)
+		portfolio.Fills[len(portfolio.Fills)-1].Fee = fill.Fee.Add(margin)
+		fill.Fee = fill.Fee.Add(margin)
+	}
+	return fill, true
+}
+
+// LiquidationPrice returns the price at which the equity goes down to the maintenance
+// margin of the position
+func (portfolio *Portfolio) LiquidationPrice() (decimal.Decimal, bool) {
+	if !portfolio.IsHolding() {
+		return decimal.Zero, false
+	}
+	// Cash + position * (price - entry) = maintenance * |position| * price
+	divisor := portfolio.Position.Sub(portfolio.MaintenanceMargin.Mul(portfolio.Position.Abs()))
+	if divisor.Sign() == 0 {
+		return decimal.Zero, false
+	}
+	price := portfolio.Position.Mul(portfolio.Entry).Sub(portfolio.Cash).Div(divisor)
+	if price.Sign() <= 0 {
+		return decimal.Zero, false
+	}
+	return price, true
+}
+
+// IsLiquidated returns whether the candle went past the liquidation price
+func (portfolio *Portfolio) IsLiquidated(candle *common.Candle) bool {
+	price, ok := portfolio.LiquidationPrice()
+	if !ok {
+		return false
+	}
+	if portfolio.IsShort() {
+		return candle.High.Cmp(price) >= 0
+	}
+	return candle.Low.Cmp(price) <= 0
+}
+
+// PayFunding pays the funding rate on the position value, longs pay shorts when the
+// rate is positive
+func (portfolio *Portfolio) PayFunding(rate, price decimal.Decimal) decimal.Decimal {
+	payment := portfolio.Position.Mul(price).Mul(rate)
+	portfolio.Cash = portfolio.Cash.Sub(payment)
+	portfolio.Funding = portfolio.Funding.Add(payment)
+	return payment
+}
+
+// Equity returns the value of the portfolio if the position was closed at price
+func (portfolio *Portfolio) Equity(price decimal.Decimal) decimal.Decimal {
+	return portfolio.Cash.Add(portfolio.Position.Mul(price.Sub(portfolio.Entry)))
+}
+
+// Private
+
+// Opens a position or adds a unit to it, as much as the sizing asks
+func (portfolio *Portfolio) open(side string, price decimal.Decimal, candle *common.Candle, reason string) (Fill, bool) {
+	notional := portfolio.Equity(price).Mul(portfolio.Leverage)
+	if portfolio.Sizing != nil {
+		notional = portfolio.Sizing.Notional(portfolio, price, portfolio.Chart)
+	}
+	fill, ok := portfolio.increase(side, price, notional, candle, reason)
+	if ok {
+		portfolio.Units += 1
+		fill.Units = portfolio.Units
+		portfolio.Fills[len(portfolio.Fills)-1].Units = portfolio.Units
+	}
+	return fill, ok
+}
+
+// Adds notional to the position, within the equity times the leverage. Fee comes on top
+func (portfolio *Portfolio) increase(side string, price, notional decimal.Decimal, candle *common.Candle, reason string) (Fill, bool) {
+	equity := portfolio.Equity(price)
+	if equity.Sign() <= 0 {
+		return Fill{}, false
+	}
+	if available := equity.Mul(portfolio.Leverage).Sub(portfolio.Position.Abs().Mul(price)); available.Cmp(notional) < 0 {
+		notional = available
+	}
+	if notional.Sign() <= 0 {
+		return Fill{}, false
+	}
+	fillPrice := portfolio.fillPrice(side, price, notional.Div(price), candle)
+	fill := Fill{
+		Time:   candle.Time,
+		Side:   side,
+		Price:  fillPrice,
+		Size:   notional.Div(fillPrice),
+		Fee:    portfolio.Fees.Fee(notional, portfolio.Maker, candle.Time),
+		Reason: reason,
+		Sizing: portfolio.sizingName(),
+		// Copied, chart candles are reused
+		Indicators: copyIndicators(candle.Indicators),
+	}
+	fill.Slippage = fillPrice.Sub(price).Abs().Mul(fill.Size)
+	if portfolio.Verbose {
+		fmt.Printf("%s: Opening %s at %s price for a total of %s. Fee %s. (%s)\n", candle.Time.Format("2006-01-02 15:04"), side, fillPrice, notional, fill.Fee, reason)
+	}
+	size := fill.Size
+	if side == common.SIDE_SELL {
+		size = size.Neg()
+	}
+	if portfolio.IsHolding() {
+		// Entry is the average price of the units
+		cost := portfolio.Position.Mul(portfolio.Entry).Add(size.Mul(fillPrice))
+		portfolio.Position = portfolio.Position.Add(size)
+		portfolio.Entry = cost.Div(portfolio.Position)
+	} else {
+		portfolio.Position, portfolio.Entry = size, fillPrice
+		portfolio.HoldingCandles = 0
+	}
+	portfolio.Cash = portfolio.Cash.Sub(fill.Fee)
+	fill.Position, fill.Units = portfolio.Position, portfolio.Units
+	portfolio.Fills = append(portfolio.Fills, fill)
+	return fill, true
+}
+
+// Closes size of the position, all of it when size is the whole position
+func (portfolio *Portfolio) reduce(size, price decimal.Decimal, candle *common.Candle, reason string) Fill {
+	side, sign := common.SIDE_SELL, decimal.New(1, 0)
+	if portfolio.IsShort() {
+		side, sign = common.SIDE_BUY, decimal.New(-1, 0)
+	}
+	fillPrice := portfolio.fillPrice(side, price, size, candle)
+	fill := Fill{
+		Time:           candle.Time,
+		Side:           side,
+		Price:          fillPrice,
+		Size:           size,
+		Fee:            portfolio.Fees.Fee(size.Mul(fillPrice), portfolio.Maker, candle.Time),
+		Slippage:       fillPrice.Sub(price).Abs().Mul(size),
+		Reason:         reason,
+		Pnl:            size.Mul(sign).Mul(fillPrice.Sub(portfolio.Entry)),
+		HoldingCandles: portfolio.HoldingCandles,
+		Indicators:     copyIndicators(candle.Indicators),
+	}
+	if portfolio.Verbose {
+		fmt.Printf("%s: Closing %s at %s price for a profit of %s, minus fee of %s (%s - %d)\n", candle.Time.Format("2006-01-02 15:04"), side, fillPrice, fill.Pnl, fill.Fee, reason, portfolio.HoldingCandles)
+	}
+	portfolio.Cash = portfolio.Cash.Add(fill.Pnl).Sub(fill.Fee)
+	portfolio.Position = portfolio.Position.Sub(size.Mul(sign))
+	if portfolio.Position.IsZero() {
+		portfolio.Entry = decimal.Zero
+		portfolio.HoldingCandles, portfolio.Units = 0, 0
+	}
+	fill.Position, fill.Units = portfolio.Position, portfolio.Units
+	portfolio.Fills = append(portfolio.Fills, fill)
+	return fill
+}
+
+func (portfolio *Portfolio) maxUnits() int {
+	if pyramid, isPyramid := portfolio.Sizing.(*Pyramid); isPyramid && pyramid.MaxUnits > 1 {
+		return pyramid.MaxUnits
+	}
+	return 1
+}
+
+func (portfolio *Portfolio) sizingName() string {
+	if portfolio.Sizing == nil {
+		return "all in"
+	}
+	return portfolio.Sizing.String()
+}
+
+func (portfolio *Portfolio) fillPrice(side string, price, size decimal.Decimal, candle *common.Candle) decimal.Decimal {
+	if portfolio.Maker || portfolio.Slippage == nil {
+		return price
+	}
+	return portfolio.Slippage.Price(side, price, size, candle)
+}
+
+func copyIndicators(indicators map[string]float64) map[string]float64 {
+	if indicators == nil {
+		return nil
+	}
+	res := make(map[string]float64, len(indicators))
+	for name, value := range indicators {
+		res[name] = value
+	}
+	return res
+}
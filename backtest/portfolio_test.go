@@ -0,0 +1,157 @@
+package backtest
+
+import (
+	"github.com/shopspring/decimal"
+	"testing"
+)
+
+func TestPortfolioBuySell(t *testing.T) {
+	// GIVEN
+	portfolio := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	portfolio.Fees = &FlatFee{Rate: decimal.NewFromFloat(0.01)}
+	candles := generateCandles(100, 100, 110, 110)
+
+	// WHEN
+	_, bought := portfolio.Buy(decimal.NewFromFloat(100), &candles[0], "test")
+	_, boughtAgain := portfolio.Buy(decimal.NewFromFloat(100), &candles[1], "test")
+	fill, sold := portfolio.Sell(decimal.NewFromFloat(110), &candles[2], "test")
+	_, soldAgain := portfolio.Sell(decimal.NewFromFloat(110), &candles[3], "test")
+
+	// THEN
+	if !bought || boughtAgain || !sold || soldAgain {
+		t.Fatalf("Wrong fills %v %v %v %v", bought, boughtAgain, sold, soldAgain)
+	}
+	// 10 shares sold 1100, minus 10 buy fee and 11 sell fee
+	if !portfolio.Cash.Equal(decimal.NewFromFloat(1079)) || !fill.Size.Equal(decimal.NewFromFloat(10)) {
+		t.Errorf("Wrong cash %s after selling %s", portfolio.Cash, fill.Size)
+	}
+	if len(portfolio.Fills) != 2 || portfolio.IsHolding() {
+		t.Errorf("Wrong portfolio %#v", portfolio)
+	}
+}
+
+func TestPortfolioEquity(t *testing.T) {
+	// GIVEN
+	portfolio := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	candles := generateCandles(100)
+
+	// WHEN
+	portfolio.Buy(decimal.NewFromFloat(100), &candles[0], "test")
+
+	// THEN
+	if !portfolio.Equity(decimal.NewFromFloat(90)).Equal(decimal.NewFromFloat(900)) {
+		t.Errorf("Wrong equity %s", portfolio.Equity(decimal.NewFromFloat(90)))
+	}
+}
+
+func TestPortfolioSlippage(t *testing.T) {
+	// GIVEN
+	portfolio := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	portfolio.Slippage = &FixedSlippage{Bps: decimal.NewFromFloat(100)}
+	candles := generateCandles(100, 100)
+
+	// WHEN
+	buy, _ := portfolio.Buy(decimal.NewFromFloat(100), &candles[0], "test")
+	sell, _ := portfolio.Sell(decimal.NewFromFloat(100), &candles[1], "test")
+
+	// THEN
+	if !buy.Price.Equal(decimal.NewFromFloat(101)) || !sell.Price.Equal(decimal.NewFromFloat(99)) {
+		t.Errorf("Wrong fill prices %s %s", buy.Price, sell.Price)
+	}
+	if !sell.Slippage.Equal(sell.Size) || portfolio.Cash.Cmp(decimal.NewFromFloat(981)) > 0 {
+		t.Errorf("Wrong slippage %s, cash %s", sell.Slippage, portfolio.Cash)
+	}
+}
+
+func TestPortfolioShort(t *testing.T) {
+	// GIVEN
+	portfolio := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	candles := generateCandles(100, 90)
+
+	// WHEN
+	_, notAllowed := portfolio.Sell(decimal.NewFromFloat(100), &candles[0], "test")
+	portfolio.AllowShort = true
+	short, _ := portfolio.Sell(decimal.NewFromFloat(100), &candles[0], "test")
+	equity := portfolio.Equity(decimal.NewFromFloat(90))
+	cover, covered := portfolio.Buy(decimal.NewFromFloat(90), &candles[1], "test")
+
+	// THEN
+	if notAllowed || !short.Position.Equal(decimal.NewFromFloat(-10)) || !equity.Equal(decimal.NewFromFloat(1100)) {
+		t.Errorf("Wrong short %#v, equity %s", short, equity)
+	}
+	if !covered || !cover.Pnl.Equal(decimal.NewFromFloat(100)) || !portfolio.Cash.Equal(decimal.NewFromFloat(1100)) || portfolio.IsHolding() {
+		t.Errorf("Wrong cover %#v, cash %s", cover, portfolio.Cash)
+	}
+}
+
+func TestPortfolioLiquidationPrice(t *testing.T) {
+	// GIVEN
+	long := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	long.Leverage = decimal.NewFromFloat(10)
+	long.MaintenanceMargin = BITMEX_MAINTENANCE_MARGIN
+	short := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	short.Leverage, short.AllowShort = decimal.NewFromFloat(10), true
+	short.MaintenanceMargin = BITMEX_MAINTENANCE_MARGIN
+	candles := generateCandles(100)
+
+	// WHEN
+	long.Buy(decimal.NewFromFloat(100), &candles[0], "test")
+	short.Sell(decimal.NewFromFloat(100), &candles[0], "test")
+	longPrice, _ := long.LiquidationPrice()
+	shortPrice, _ := short.LiquidationPrice()
+
+	// THEN
+	// 1000 of margin on a 10000 position, minus 0.5% of maintenance margin
+	if longPrice.StringFixed(2) != "90.45" || shortPrice.StringFixed(2) != "109.45" {
+		t.Errorf("Wrong liquidation prices %s %s", longPrice, shortPrice)
+	}
+	if long.IsLiquidated(generateOhlcCandle(95, 96, 91, 92)) || !long.IsLiquidated(generateOhlcCandle(95, 96, 90, 92)) {
+		t.Errorf("Wrong long liquidation")
+	}
+	if short.IsLiquidated(generateOhlcCandle(105, 109, 104, 108)) || !short.IsLiquidated(generateOhlcCandle(105, 110, 104, 108)) {
+		t.Errorf("Wrong short liquidation")
+	}
+}
+
+func TestPortfolioLiquidate(t *testing.T) {
+	// GIVEN
+	portfolio := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	portfolio.Leverage = decimal.NewFromFloat(10)
+	portfolio.MaintenanceMargin = BITMEX_MAINTENANCE_MARGIN
+	candles := generateCandles(100, 90)
+
+	// WHEN
+	portfolio.Buy(decimal.NewFromFloat(100), &candles[0], "test")
+	fill, liquidated := portfolio.Liquidate(&candles[1])
+
+	// THEN
+	if !liquidated || fill.Reason != EXIT_LIQUIDATION || portfolio.IsHolding() {
+		t.Fatalf("Wrong liquidation %#v", fill)
+	}
+	// Maintenance margin is lost as well
+	if portfolio.Cash.Sign() < 0 || portfolio.Cash.Cmp(decimal.NewFromFloat(0.01)) > 0 {
+		t.Errorf("Wrong cash %s after liquidation", portfolio.Cash)
+	}
+}
+
+func TestPortfolioFunding(t *testing.T) {
+	// GIVEN
+	long := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	short := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	short.AllowShort = true
+	candles := generateCandles(100)
+	long.Buy(decimal.NewFromFloat(100), &candles[0], "test")
+	short.Sell(decimal.NewFromFloat(100), &candles[0], "test")
+
+	// WHEN
+	long.PayFunding(decimal.NewFromFloat(0.0001), decimal.NewFromFloat(100))
+	short.PayFunding(decimal.NewFromFloat(0.0001), decimal.NewFromFloat(100))
+
+	// THEN
+	if !long.Cash.Equal(decimal.NewFromFloat(999.9)) || !long.Funding.Equal(decimal.NewFromFloat(0.1)) {
+		t.Errorf("Wrong long funding %s %s", long.Cash, long.Funding)
+	}
+	if !short.Cash.Equal(decimal.NewFromFloat(1000.1)) || !short.Funding.Equal(decimal.NewFromFloat(-0.1)) {
+		t.Errorf("Wrong short funding %s %s", short.Cash, short.Funding)
+	}
+}
@@ -0,0 +1,219 @@
+package backtest
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"math"
+	"sort"
+	"strings"
+	"thierry/gocoin/common"
+	"time"
+)
+
+const YEAR = 365 * 24 * time.Hour
+
+// Report sums up a backtest run, returns are ratios (0.1 for 10%)
+type Report struct {
+	Strategy         string    `json:"strategy"`
+	Start            time.Time `json:"start"`
+	End              time.Time `json:"end"`
+	Candles          int       `json:"candles"`
+	StartingEquity   float64   `json:"starting_equity"`
+	EndingEquity     float64   `json:"ending_equity"`
+	TotalReturn      float64   `json:"total_return"`
+	AnnualizedReturn float64   `json:"annualized_return"`
+	// Annualized from the returns of each candle
+	Sharpe  float64 `json:"sharpe"`
+	Sortino float64 `json:"sortino"`
+	// Largest drop from a peak, and longest time spent under a peak
+	MaxDrawdown        float64 `json:"max_drawdown"`
+	MaxDrawdownCandles int     `json:"max_drawdown_candles"`
+	Trades             int     `json:"trades"`
+	WinRate            float64 `json:"win_rate"`
+	AverageWin         float64 `json:"average_win"`
+	AverageLoss        float64 `json:"average_loss"`
+	ProfitFactor       float64 `json:"profit_factor"`
+	// Number of exits for each reason
+	Exits map[string]int `json:"exits"`
+	// Total paid in fees and slippage
+	Fees     float64 `json:"fees"`
+	Slippage float64 `json:"slippage"`
+	// Total funding paid, negative when received
+	Funding float64 `json:"funding"`
+	// Part of the candles spent holding a position
+	Exposure              float64 `json:"exposure"`
+	AverageHoldingCandles float64 `json:"average_holding_candles"`
+}
+
+// Public
+
+// Report computes the performance of the run so far
+func (engine *Engine) Report() Report {
+	report := CreateNewReport(engine.Strategy.Name(), engine.Portfolio.Initial, engine.Equity, engine.Portfolio.Fills)
+	report.Funding, _ = engine.Portfolio.Funding.Float64()
+	return report
+}
+
+// CreateNewReport computes the performance of an equity curve and its fills, e.g. when
+// joining several runs
+func CreateNewReport(strategy string, initial decimal.Decimal, equityCurve []EquityPoint, fills []Fill) Report {
+	report := Report{Strategy: strategy, Candles: len(equityCurve), Exits: map[string]int{}}
+	report.StartingEquity, _ = initial.Float64()
+	report.EndingEquity = report.StartingEquity
+	if len(equityCurve) == 0 {
+		return report
+	}
+	report.Start, report.End = equityCurve[0].Time, equityCurve[len(equityCurve)-1].Time
+	report.EndingEquity, _ = equityCurve[len(equityCurve)-1].Equity.Float64()
+	if report.StartingEquity > 0 {
+		report.TotalReturn = report.EndingEquity/report.StartingEquity - 1
+	}
+
+	equity := make([]float64, 0, len(equityCurve)+1)
+	equity = append(equity, report.StartingEquity)
+	holding := 0
+	for _, point := range equityCurve {
+		value, _ := point.Equity.Float64()
+		equity = append(equity, value)
+		if point.Holding {
+			holding += 1
+		}
+	}
+	report.Exposure = float64(holding) / float64(len(equityCurve))
+	report.MaxDrawdown, report.MaxDrawdownCandles = drawdown(equity)
+
+	if duration := report.End.Sub(report.Start); duration > 0 {
+		years := float64(duration) / float64(YEAR)
+		// Overflows on very short runs, then left to 0
+		if annualized := math.Pow(1+report.TotalReturn, 1/years) - 1; report.TotalReturn > -1 && !math.IsInf(annualized, 0) {
+			report.AnnualizedReturn = annualized
+		}
+		periodsPerYear := float64(len(equityCurve)-1) / years
+		report.Sharpe, report.Sortino = riskRatios(equity, periodsPerYear)
+	}
+
+	report.addTrades(fills)
+	return report
+}
+
+func (report Report) String() string {
+	lines := []string{
+		fmt.Sprintf("Strategy %s, %d candles from %s to %s", report.Strategy, report.Candles, report.Start.Format("2006-01-02 15:04"), report.End.Format("2006-01-02 15:04")),
+		fmt.Sprintf("Equity:       %.2f -> %.2f", report.StartingEquity, report.EndingEquity),
+		fmt.Sprintf("Return:       %.2f%% (%.2f%% annualized)", 100*report.TotalReturn, 100*report.AnnualizedReturn),
+		fmt.Sprintf("Sharpe:       %.3f", report.Sharpe),
+		fmt.Sprintf("Sortino:      %.3f", report.Sortino),
+		fmt.Sprintf("Max drawdown: %.2f%% (%d candles)", 100*report.MaxDrawdown, report.MaxDrawdownCandles),
+		fmt.Sprintf("Trades:       %d, %.2f%% won", report.Trades, 100*report.WinRate),
+		fmt.Sprintf("Average win:  %.2f, loss %.2f, profit factor %.3f", report.AverageWin, report.AverageLoss, report.ProfitFactor),
+		fmt.Sprintf("Costs:        %.2f in fees, %.2f in slippage, %.2f in funding", report.Fees, report.Slippage, report.Funding),
+		fmt.Sprintf("Exposure:     %.2f%%, holding %.1f candles on average", 100*report.Exposure, report.AverageHoldingCandles),
+	}
+	reasons := make([]string, 0, len(report.Exits))
+	for reason := range report.Exits {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		lines = append(lines, fmt.Sprintf("Exit:         %d on %s", report.Exits[reason], reason))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (report Report) JSON() ([]byte, error) {
+	return common.JSONEncode(report)
+}
+
+// Private
+
+// A trade goes from opening a position to being flat again, profits include all fees
+func (report *Report) addTrades(fills []Fill) {
+	var grossWin, grossLoss float64
+	var wins, holding int
+	for _, fill := range fills {
+		fee, _ := fill.Fee.Float64()
+		slippage, _ := fill.Slippage.Float64()
+		report.Fees += fee
+		report.Slippage += slippage
+	}
+	for _, trade := range closedTrades(fills) {
+		profit, _ := trade.Profit.Float64()
+		report.Trades += 1
+		report.Exits[trade.Exit.Reason] += 1
+		holding += trade.Exit.HoldingCandles
+		if profit > 0 {
+			wins += 1
+			grossWin += profit
+		} else {
+			grossLoss -= profit
+		}
+	}
+	if report.Trades == 0 {
+		return
+	}
+	report.WinRate = float64(wins) / float64(report.Trades)
+	report.AverageHoldingCandles = float64(holding) / float64(report.Trades)
+	if wins > 0 {
+		report.AverageWin = grossWin / float64(wins)
+	}
+	if losses := report.Trades - wins; losses > 0 {
+		report.AverageLoss = grossLoss / float64(losses)
+	}
+	// Left to 0 without losing trades, infinity can't be written to JSON
+	if grossLoss > 0 {
+		report.ProfitFactor = grossWin / grossLoss
+	}
+}
+
+func drawdown(equity []float64) (float64, int) {
+	maxDrawdown, maxCandles := 0.0, 0
+	peak, peakIndex := 0.0, 0
+	for i, value := range equity {
+		if value >= peak {
+			peak, peakIndex = value, i
+			continue
+		}
+		if peak > 0 && (peak-value)/peak > maxDrawdown {
+			maxDrawdown = (peak - value) / peak
+		}
+		if i-peakIndex > maxCandles {
+			maxCandles = i - peakIndex
+		}
+	}
+	return maxDrawdown, maxCandles
+}
+
+// Sharpe and Sortino ratios of the returns between each equity value, with no risk free rate
+func riskRatios(equity []float64, periodsPerYear float64) (float64, float64) {
+	returns := make([]float64, 0, len(equity))
+	for i := 1; i < len(equity); i++ {
+		if equity[i-1] > 0 {
+			returns = append(returns, equity[i]/equity[i-1]-1)
+		}
+	}
+	if len(returns) < 2 {
+		return 0, 0
+	}
+	var mean, variance, downside float64
+	for _, r := range returns {
+		mean += r
+	}
+	mean /= float64(len(returns))
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+		if r < 0 {
+			downside += r * r
+		}
+	}
+	std := math.Sqrt(variance / float64(len(returns)-1))
+	downsideStd := math.Sqrt(downside / float64(len(returns)))
+
+	var sharpe, sortino float64
+	if std > 0 {
+		sharpe = mean / std * math.Sqrt(periodsPerYear)
+	}
+	if downsideStd > 0 {
+		sortino = mean / downsideStd * math.Sqrt(periodsPerYear)
+	}
+	return sharpe, sortino
+}
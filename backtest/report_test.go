@@ -0,0 +1,65 @@
+package backtest
+
+import (
+	"github.com/shopspring/decimal"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	// GIVEN
+	strategy := &scriptedStrategy{buys: map[int]bool{1: true, 5: true}, sells: map[int]bool{3: true, 7: true}}
+	engine := CreateNewEngine(strategy, CreateNewPortfolio(decimal.NewFromFloat(100)))
+	engine.Warmup = 0
+
+	candles := generateCandles(10, 20, 15, 15, 10, 5, 8, 8)
+	for i := range candles {
+		candles[i].Time = time.Unix(int64(i*24*3600), 0)
+	}
+
+	// WHEN
+	engine.Run(candles)
+	report := engine.Report()
+
+	// THEN
+	// Bought at 10, sold at 15, bought at 10 and sold at 8: 150 -> 120
+	if report.Trades != 2 || report.WinRate != 0.5 || report.EndingEquity != 120 || math.Abs(report.TotalReturn-0.2) > 1e-9 {
+		t.Errorf("Wrong trades %#v", report)
+	}
+	if report.AverageWin != 50 || report.AverageLoss != 30 || math.Abs(report.ProfitFactor-50.0/30.0) > 1e-9 {
+		t.Errorf("Wrong trade statistics %#v", report)
+	}
+	// From 200 down to 75
+	if report.MaxDrawdown != 0.625 || report.MaxDrawdownCandles != 6 {
+		t.Errorf("Wrong drawdown %f %d", report.MaxDrawdown, report.MaxDrawdownCandles)
+	}
+	if report.Exposure != 0.5 || report.AverageHoldingCandles != 2 {
+		t.Errorf("Wrong exposure %f %f", report.Exposure, report.AverageHoldingCandles)
+	}
+	if report.Sharpe == 0 || report.Sortino == 0 || report.AnnualizedReturn <= report.TotalReturn {
+		t.Errorf("Wrong ratios %#v", report)
+	}
+}
+
+func TestReportOutput(t *testing.T) {
+	// GIVEN
+	strategy := &scriptedStrategy{buys: map[int]bool{1: true}}
+	engine := CreateNewEngine(strategy, CreateNewPortfolio(decimal.NewFromFloat(100)))
+	engine.Portfolio.Fees = &FlatFee{Rate: decimal.NewFromFloat(0.01)}
+	engine.Warmup = 0
+	engine.Run(generateCandles(10, 11, 12))
+
+	// WHEN
+	text := engine.Report().String()
+	data, err := engine.Report().JSON()
+
+	// THEN
+	if !strings.Contains(text, "Return:       17.80%") || !strings.Contains(text, "Costs:        2.20 in fees") || !strings.Contains(text, "Trades:       1, 100.00% won") {
+		t.Errorf("Wrong text report %s", text)
+	}
+	if err != nil || !strings.Contains(string(data), `"trades":1`) || !strings.Contains(string(data), `"strategy":"scripted"`) {
+		t.Errorf("Wrong JSON report %s %v", data, err)
+	}
+}
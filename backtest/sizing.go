@@ -0,0 +1,204 @@
+package backtest
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"thierry/gocoin/common"
+)
+
+// Sizer returns the notional value (size times price) of a new position, or of a unit
+// added to it. The portfolio never goes over its equity times the leverage, and a zero
+// value skips the signal
+type Sizer interface {
+	Notional(portfolio *Portfolio, price decimal.Decimal, chart *common.CandleChart) decimal.Decimal
+	// Description written with each fill
+	String() string
+}
+
+// SizedStrategy is implemented by strategies picking their own sizing, used instead of
+// the one of the portfolio when not nil
+type SizedStrategy interface {
+	Sizer() Sizer
+}
+
+// FixedFraction puts a part of the equity in each position, 0.5 for half of it
+type FixedFraction struct {
+	Fraction decimal.Decimal
+}
+
+// FixedNotional always trades the same value
+type FixedNotional struct {
+	Value decimal.Decimal
+}
+
+const (
+	VOLATILITY_ATR = iota
+	VOLATILITY_STDDEV
+)
+
+// VolatilityTarget sizes positions so a move of Multiple times the volatility costs
+// Risk of the equity, e.g. 0.01 for 1%. Nothing is traded until the chart has enough
+// candles to measure the volatility
+type VolatilityTarget struct {
+	Risk     decimal.Decimal
+	Multiple float64
+	Period   int
+	// VOLATILITY_ATR or VOLATILITY_STDDEV of the close changes
+	Measure int
+}
+
+// Kelly bets the Kelly fraction of the equity, from the win rate and the average win
+// over average loss of the closed trades
+type Kelly struct {
+	// Part of the Kelly fraction used, 0.5 for half Kelly
+	Fraction float64
+	// Estimates used until MinTrades trades are closed
+	WinRate   float64
+	Payoff    float64
+	MinTrades int
+}
+
+// Pyramid adds to a winning or losing position on each new signal in its direction, up
+// to MaxUnits units sized by Unit
+type Pyramid struct {
+	// Sizing of each unit, the equity split in MaxUnits when nil
+	Unit     Sizer
+	MaxUnits int
+}
+
+// A trade from opening a position to being flat again
+type closedTrade struct {
+	// Fill closing the position
+	Exit Fill
+	// Sum of the profits minus all fees
+	Profit decimal.Decimal
+}
+
+// Public
+
+func CreateNewVolatilityTarget(risk decimal.Decimal, measure int) *VolatilityTarget {
+	return &VolatilityTarget{Risk: risk, Multiple: 2, Period: 14, Measure: measure}
+}
+
+func CreateNewKelly() *Kelly {
+	return &Kelly{Fraction: 0.5, WinRate: 0.5, Payoff: 1.5, MinTrades: 20}
+}
+
+func (sizer *FixedFraction) Notional(portfolio *Portfolio, price decimal.Decimal, chart *common.CandleChart) decimal.Decimal {
+	return portfolio.Equity(price).Mul(sizer.Fraction)
+}
+
+func (sizer *FixedFraction) String() string {
+	return fmt.Sprintf("fixed fraction %s", sizer.Fraction)
+}
+
+func (sizer *FixedNotional) Notional(portfolio *Portfolio, price decimal.Decimal, chart *common.CandleChart) decimal.Decimal {
+	return sizer.Value
+}
+
+func (sizer *FixedNotional) String() string {
+	return fmt.Sprintf("fixed notional %s", sizer.Value)
+}
+
+func (sizer *VolatilityTarget) Notional(portfolio *Portfolio, price decimal.Decimal, chart *common.CandleChart) decimal.Decimal {
+	if chart == nil || sizer.Multiple <= 0 {
+		return decimal.Zero
+	}
+	volatility := chart.CalculateAtr(sizer.Period)
+	if sizer.Measure == VOLATILITY_STDDEV {
+		volatility = chart.CalculateStdDev(sizer.Period)
+	}
+	if volatility <= 0 {
+		return decimal.Zero
+	}
+	risk := portfolio.Equity(price).Mul(sizer.Risk)
+	return risk.Div(decimal.NewFromFloat(sizer.Multiple * volatility)).Mul(price)
+}
+
+func (sizer *VolatilityTarget) String() string {
+	measure := "ATR"
+	if sizer.Measure == VOLATILITY_STDDEV {
+		measure = "stddev"
+	}
+	return fmt.Sprintf("volatility target %s per %g %s(%d)", sizer.Risk, sizer.Multiple, measure, sizer.Period)
+}
+
+func (sizer *Kelly) Notional(portfolio *Portfolio, price decimal.Decimal, chart *common.CandleChart) decimal.Decimal {
+	winRate, payoff := sizer.WinRate, sizer.Payoff
+	if trades := closedTrades(portfolio.Fills); len(trades) >= sizer.MinTrades && len(trades) > 0 {
+		winRate, payoff = kellyEstimates(trades)
+	}
+	if payoff <= 0 {
+		return decimal.Zero
+	}
+	fraction := winRate - (1-winRate)/payoff
+	if fraction <= 0 {
+		return decimal.Zero
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	return portfolio.Equity(price).Mul(decimal.NewFromFloat(fraction * sizer.Fraction))
+}
+
+func (sizer *Kelly) String() string {
+	return fmt.Sprintf("kelly %g", sizer.Fraction)
+}
+
+func (sizer *Pyramid) Notional(portfolio *Portfolio, price decimal.Decimal, chart *common.CandleChart) decimal.Decimal {
+	if sizer.Unit != nil {
+		return sizer.Unit.Notional(portfolio, price, chart)
+	}
+	units := sizer.MaxUnits
+	if units < 1 {
+		units = 1
+	}
+	return portfolio.Equity(price).Mul(portfolio.Leverage).Div(decimal.New(int64(units), 0))
+}
+
+func (sizer *Pyramid) String() string {
+	unit := "equal"
+	if sizer.Unit != nil {
+		unit = sizer.Unit.String()
+	}
+	return fmt.Sprintf("pyramid of %d %s units", sizer.MaxUnits, unit)
+}
+
+// Private
+
+func closedTrades(fills []Fill) []closedTrade {
+	trades := []closedTrade{}
+	profit := decimal.Zero
+	for _, fill := range fills {
+		profit = profit.Add(fill.Pnl).Sub(fill.Fee)
+		if fill.Position.IsZero() {
+			trades = append(trades, closedTrade{Exit: fill, Profit: profit})
+			profit = decimal.Zero
+		}
+	}
+	return trades
+}
+
+// Win rate and average win over average loss
+func kellyEstimates(trades []closedTrade) (float64, float64) {
+	var wins int
+	var grossWin, grossLoss float64
+	for _, trade := range trades {
+		profit, _ := trade.Profit.Float64()
+		if profit > 0 {
+			wins += 1
+			grossWin += profit
+		} else {
+			grossLoss -= profit
+		}
+	}
+	winRate := float64(wins) / float64(len(trades))
+	if wins == 0 {
+		return winRate, 0
+	} else if grossLoss == 0 {
+		// Never lost, bet as much as allowed
+		return 1, 1
+	}
+	averageWin := grossWin / float64(wins)
+	averageLoss := grossLoss / float64(len(trades)-wins)
+	return winRate, averageWin / averageLoss
+}
@@ -0,0 +1,108 @@
+package backtest
+
+import (
+	"github.com/shopspring/decimal"
+	"testing"
+	"thierry/gocoin/common"
+)
+
+func TestFixedSizing(t *testing.T) {
+	// GIVEN
+	fraction := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	fraction.Sizing = &FixedFraction{Fraction: decimal.NewFromFloat(0.5)}
+	notional := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	notional.Sizing = &FixedNotional{Value: decimal.NewFromFloat(5000)}
+	candles := generateCandles(100)
+
+	// WHEN
+	half, _ := fraction.Buy(decimal.NewFromFloat(100), &candles[0], "test")
+	capped, _ := notional.Buy(decimal.NewFromFloat(100), &candles[0], "test")
+
+	// THEN
+	if !half.Size.Equal(decimal.NewFromFloat(5)) || half.Sizing != "fixed fraction 0.5" || half.Units != 1 {
+		t.Errorf("Wrong fixed fraction fill %#v", half)
+	}
+	// Can't go over the equity without leverage
+	if !capped.Size.Equal(decimal.NewFromFloat(10)) {
+		t.Errorf("Wrong fixed notional fill %#v", capped)
+	}
+}
+
+func TestVolatilityTarget(t *testing.T) {
+	// GIVEN
+	portfolio := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	chart := common.CreateNewCandleChart()
+	for _, candle := range generateCandles(100, 100, 100, 100, 100) {
+		candle.High, candle.Low = decimal.NewFromFloat(101), decimal.NewFromFloat(99)
+		chart.AddCandle(candle)
+	}
+	sizer := CreateNewVolatilityTarget(decimal.NewFromFloat(0.01), VOLATILITY_ATR)
+	sizer.Period = 3
+
+	// WHEN
+	res := sizer.Notional(portfolio, decimal.NewFromFloat(100), chart)
+	sizer.Measure = VOLATILITY_STDDEV
+	flat := sizer.Notional(portfolio, decimal.NewFromFloat(100), chart)
+
+	// THEN
+	// Losing 10 over 2 ATR of 2 is 2.5 at 100
+	if !res.Equal(decimal.NewFromFloat(250)) {
+		t.Errorf("Wrong volatility target notional %s", res)
+	}
+	// Closes never move, nothing to size from
+	if !flat.IsZero() {
+		t.Errorf("Wrong notional without volatility %s", flat)
+	}
+}
+
+func TestKelly(t *testing.T) {
+	// GIVEN
+	portfolio := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	sizer := CreateNewKelly()
+	sizer.MinTrades = 3
+	one := decimal.NewFromFloat(1)
+
+	// WHEN
+	estimated := sizer.Notional(portfolio, decimal.NewFromFloat(100), nil)
+	for _, pnl := range []float64{20, -10, 20} {
+		portfolio.Fills = append(portfolio.Fills, Fill{Position: one}, Fill{Pnl: decimal.NewFromFloat(pnl)})
+	}
+	sizer.Fraction = 1
+	measured := sizer.Notional(portfolio, decimal.NewFromFloat(100), nil)
+
+	// THEN
+	// Half of 0.5 - 0.5 / 1.5
+	if estimated.StringFixed(2) != "83.33" {
+		t.Errorf("Wrong notional from estimates %s", estimated)
+	}
+	// Won 2 trades out of 3, twice as much as lost
+	if measured.StringFixed(2) != "500.00" {
+		t.Errorf("Wrong notional from trades %s", measured)
+	}
+}
+
+func TestPyramid(t *testing.T) {
+	// GIVEN
+	portfolio := CreateNewPortfolio(decimal.NewFromFloat(1000))
+	portfolio.Sizing = &Pyramid{MaxUnits: 2}
+	candles := generateCandles(100, 120, 120, 130)
+
+	// WHEN
+	first, _ := portfolio.Buy(decimal.NewFromFloat(100), &candles[0], "test")
+	second, _ := portfolio.Buy(decimal.NewFromFloat(120), &candles[1], "test")
+	_, third := portfolio.Buy(decimal.NewFromFloat(120), &candles[2], "test")
+	sell, _ := portfolio.Sell(decimal.NewFromFloat(130), &candles[3], "test")
+
+	// THEN
+	if !first.Size.Equal(decimal.NewFromFloat(5)) || second.Units != 2 || third {
+		t.Fatalf("Wrong units %#v %#v %v", first, second, third)
+	}
+	// Second unit capped by the equity, 500 left at 120
+	if second.Size.StringFixed(4) != "4.1667" || portfolio.Fills[1].Position.StringFixed(4) != "9.1667" {
+		t.Errorf("Wrong second unit %#v", second)
+	}
+	// 30 on the first unit, 10 on the second
+	if !sell.Size.Equal(portfolio.Fills[1].Position) || portfolio.Cash.StringFixed(2) != "1191.67" || portfolio.Units != 0 {
+		t.Errorf("Wrong sell %#v, cash %s", sell, portfolio.Cash)
+	}
+}
@@ -0,0 +1,143 @@
+package backtest
+
+import (
+	"github.com/shopspring/decimal"
+	"thierry/gocoin/common"
+)
+
+// Which level is assumed to be hit first, when a candle reaches both the stop and the
+// take profit, as candles don't tell the order of their high and low
+type IntraCandleRule int
+
+const (
+	// Pessimistic, the stop is always hit first
+	STOP_FIRST IntraCandleRule = iota
+	TAKE_PROFIT_FIRST
+	// Up candles are assumed to go to their low first, down candles to their high
+	CANDLE_DIRECTION
+)
+
+const (
+	EXIT_STOP_LOSS     = "stop loss"
+	EXIT_TRAILING_STOP = "trailing stop"
+	EXIT_TAKE_PROFIT   = "take profit"
+)
+
+// Stops are protective exits attached to each position when it is opened, and checked
+// against the high and low of the following candles. Levels are ratios of the entry
+// price (0.02 for 2%), zero disables them
+type Stops struct {
+	StopLoss decimal.Decimal
+	// Stop loss at this many ATR under the entry price, the highest of both stops is used
+	StopLossAtr float64
+	AtrPeriod   int
+	TakeProfit  decimal.Decimal
+	// Stop following the highest price since the entry, the lowest for shorts
+	TrailingStop decimal.Decimal
+	Rule         IntraCandleRule
+}
+
+// Levels of the current position
+type protection struct {
+	short bool
+	stop  decimal.Decimal
+	take  decimal.Decimal
+	// Highest price since the entry for longs, lowest for shorts
+	extreme decimal.Decimal
+}
+
+// Public
+
+// CreateNewStops returns stops with nothing enabled, and ATR over 14 candles
+func CreateNewStops() *Stops {
+	return &Stops{AtrPeriod: 14, Rule: STOP_FIRST}
+}
+
+// Private
+
+// Sets the levels of a position opened at entry, ATR is read from the chart. Levels of
+// shorts are mirrored, the stop is above the entry and the take profit below
+func (stops *Stops) open(entry decimal.Decimal, short bool, chart *common.CandleChart) *protection {
+	position := &protection{short: short, extreme: entry}
+	if stops.StopLoss.Sign() > 0 {
+		position.stop = position.away(entry, stops.StopLoss.Neg())
+	}
+	if stops.StopLossAtr > 0 {
+		if atr := chart.CalculateAtr(stops.AtrPeriod); atr > 0 {
+			atrStop := position.away(entry, decimal.NewFromFloat(-stops.StopLossAtr*atr).Div(entry))
+			if position.stop.Sign() == 0 || position.worse(position.stop, atrStop) {
+				position.stop = atrStop
+			}
+		}
+	}
+	if stops.TakeProfit.Sign() > 0 {
+		position.take = position.away(entry, stops.TakeProfit)
+	}
+	return position
+}
+
+// Returns the price and reason of the exit when the candle reaches a level, then moves
+// the trailing stop with the candle
+func (stops *Stops) check(position *protection, candle *common.Candle) (decimal.Decimal, string, bool) {
+	stop, stopReason := position.stop, EXIT_STOP_LOSS
+	if stops.TrailingStop.Sign() > 0 {
+		trailing := position.away(position.extreme, stops.TrailingStop.Neg())
+		if stop.Sign() == 0 || position.worse(stop, trailing) {
+			stop, stopReason = trailing, EXIT_TRAILING_STOP
+		}
+	}
+	// Worst and best prices of the candle for the position
+	worst, best := candle.Low, candle.High
+	if position.short {
+		worst, best = candle.High, candle.Low
+	}
+	hitStop := stop.Sign() > 0 && !position.worse(stop, worst)
+	hitTake := position.take.Sign() > 0 && !position.worse(best, position.take)
+
+	if hitStop && hitTake {
+		switch stops.Rule {
+		case TAKE_PROFIT_FIRST:
+			hitStop = false
+		case CANDLE_DIRECTION:
+			// Up candles go to their low first, which is the stop of longs
+			hitStop = (candle.Close.Cmp(candle.Open) >= 0) != position.short
+			hitTake = !hitStop
+		default:
+			hitTake = false
+		}
+	}
+	// A candle opening past a level is filled at the open
+	if hitStop {
+		if position.worse(candle.Open, stop) {
+			return candle.Open, stopReason, true
+		}
+		return stop, stopReason, true
+	}
+	if hitTake {
+		if position.worse(position.take, candle.Open) {
+			return candle.Open, EXIT_TAKE_PROFIT, true
+		}
+		return position.take, EXIT_TAKE_PROFIT, true
+	}
+
+	if position.worse(position.extreme, best) {
+		position.extreme = best
+	}
+	return decimal.Zero, "", false
+}
+
+// Moves the price by ratio in favor of the position, against it for negative ratios
+func (position *protection) away(price, ratio decimal.Decimal) decimal.Decimal {
+	if position.short {
+		ratio = ratio.Neg()
+	}
+	return price.Mul(decimal.New(1, 0).Add(ratio))
+}
+
+// Whether price a is worse than b for the position, lower for longs and higher for shorts
+func (position *protection) worse(a, b decimal.Decimal) bool {
+	if position.short {
+		return a.Cmp(b) > 0
+	}
+	return a.Cmp(b) < 0
+}
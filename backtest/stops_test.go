@@ -0,0 +1,109 @@
+package backtest
+
+import (
+	"github.com/shopspring/decimal"
+	"testing"
+	"thierry/gocoin/common"
+)
+
+func generateOhlcCandle(open, high, low, close float64) *common.Candle {
+	return &common.Candle{
+		Open:  decimal.NewFromFloat(open),
+		High:  decimal.NewFromFloat(high),
+		Low:   decimal.NewFromFloat(low),
+		Close: decimal.NewFromFloat(close),
+	}
+}
+
+func TestStopsCheck(t *testing.T) {
+	// GIVEN
+	stops := CreateNewStops()
+	stops.StopLoss = decimal.NewFromFloat(0.05)
+	stops.TakeProfit = decimal.NewFromFloat(0.1)
+	chart := common.CreateNewCandleChart()
+
+	// WHEN
+	_, _, quiet := stops.check(stops.open(decimal.NewFromFloat(100), false, chart), generateOhlcCandle(100, 105, 97, 101))
+	stopPrice, stopReason, _ := stops.check(stops.open(decimal.NewFromFloat(100), false, chart), generateOhlcCandle(100, 101, 90, 92))
+	gapPrice, _, _ := stops.check(stops.open(decimal.NewFromFloat(100), false, chart), generateOhlcCandle(90, 91, 85, 88))
+	takePrice, takeReason, _ := stops.check(stops.open(decimal.NewFromFloat(100), false, chart), generateOhlcCandle(100, 115, 99, 112))
+
+	// THEN
+	if quiet {
+		t.Errorf("No level should be hit")
+	}
+	if !stopPrice.Equal(decimal.NewFromFloat(95)) || stopReason != EXIT_STOP_LOSS || !gapPrice.Equal(decimal.NewFromFloat(90)) {
+		t.Errorf("Wrong stop loss %s %s %s", stopPrice, stopReason, gapPrice)
+	}
+	if !takePrice.Equal(decimal.NewFromFloat(110)) || takeReason != EXIT_TAKE_PROFIT {
+		t.Errorf("Wrong take profit %s %s", takePrice, takeReason)
+	}
+}
+
+func TestStopsIntraCandleRule(t *testing.T) {
+	// GIVEN
+	stops := CreateNewStops()
+	stops.StopLoss = decimal.NewFromFloat(0.05)
+	stops.TakeProfit = decimal.NewFromFloat(0.1)
+	chart := common.CreateNewCandleChart()
+	up, down := generateOhlcCandle(100, 112, 90, 108), generateOhlcCandle(100, 112, 90, 92)
+
+	// WHEN
+	_, stopFirst, _ := stops.check(stops.open(decimal.NewFromFloat(100), false, chart), up)
+	stops.Rule = TAKE_PROFIT_FIRST
+	_, takeFirst, _ := stops.check(stops.open(decimal.NewFromFloat(100), false, chart), down)
+	stops.Rule = CANDLE_DIRECTION
+	_, upCandle, _ := stops.check(stops.open(decimal.NewFromFloat(100), false, chart), up)
+	_, downCandle, _ := stops.check(stops.open(decimal.NewFromFloat(100), false, chart), down)
+
+	// THEN
+	if stopFirst != EXIT_STOP_LOSS || takeFirst != EXIT_TAKE_PROFIT || upCandle != EXIT_STOP_LOSS || downCandle != EXIT_TAKE_PROFIT {
+		t.Errorf("Wrong rules %s %s %s %s", stopFirst, takeFirst, upCandle, downCandle)
+	}
+}
+
+func TestStopsAtr(t *testing.T) {
+	// GIVEN
+	stops := CreateNewStops()
+	stops.StopLoss = decimal.NewFromFloat(0.5)
+	stops.StopLossAtr = 2
+	stops.AtrPeriod = 3
+	chart := common.CreateNewCandleChart()
+	for i := 0; i < 5; i++ {
+		chart.AddCandle(*generateOhlcCandle(100, 101, 99, 100))
+	}
+
+	// WHEN
+	position := stops.open(decimal.NewFromFloat(100), false, chart)
+
+	// THEN
+	// ATR of 2 is tighter than the 50% stop
+	if !position.stop.Equal(decimal.NewFromFloat(96)) {
+		t.Errorf("Wrong ATR stop %s", position.stop)
+	}
+}
+
+func TestEngineTrailingStop(t *testing.T) {
+	// GIVEN
+	strategy := &scriptedStrategy{buys: map[int]bool{1: true}}
+	engine := CreateNewEngine(strategy, CreateNewPortfolio(decimal.NewFromFloat(100)))
+	engine.Warmup = 0
+	engine.Stops = CreateNewStops()
+	engine.Stops.TrailingStop = decimal.NewFromFloat(0.1)
+	candles := generateCandles(10, 12, 15, 14, 13, 12)
+	candles[4].Open, candles[4].High = decimal.NewFromFloat(14), decimal.NewFromFloat(14)
+
+	// WHEN
+	engine.Run(candles)
+	report := engine.Report()
+
+	// THEN
+	fills := engine.Portfolio.Fills
+	// Highest at 15, so the trailing stop at 13.5 is hit by the candle going down to 13
+	if len(fills) != 2 || fills[1].Reason != EXIT_TRAILING_STOP || !fills[1].Price.Equal(decimal.NewFromFloat(13.5)) {
+		t.Fatalf("Wrong trailing stop %v", fills)
+	}
+	if len(strategy.fills) != 2 || report.Exits[EXIT_TRAILING_STOP] != 1 {
+		t.Errorf("Exit not reported %v %v", strategy.fills, report.Exits)
+	}
+}
@@ -0,0 +1,214 @@
+package backtest
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"thierry/gocoin/common"
+)
+
+// Closes the position, whether long or short
+const ACTION_CLOSE = "close"
+
+// Signal returned by a strategy for a candle, an empty action does nothing
+type Signal struct {
+	// common.SIDE_BUY, common.SIDE_SELL, ACTION_CLOSE or "". Buys close shorts and
+	// sells close longs
+	Action string
+	// Why the strategy wants to trade, kept on the fill
+	Reason string
+}
+
+// Strategy is called by the engine once per completed candle
+type Strategy interface {
+	Name() string
+	OnCandle(chart *common.CandleChart) Signal
+}
+
+// FillListener can be implemented by strategies which need to know when their signals
+// were actually filled by the portfolio
+type FillListener interface {
+	OnFill(fill Fill)
+}
+
+// MfiMacd buys on a strong MACD histogram when MFI isn't already high and volume is
+// above its average, and sells once MFI gets too high or the histogram weakens
+type MfiMacd struct {
+	// No buy above this MFI
+	MfiBuyMax float64
+	// Sell above this MFI
+	MfiSell float64
+	// Sell above this MFI when the price is going down
+	MfiSellOnDecrease float64
+	// Buy above this MACD histogram
+	MacdhBuy float64
+	// Sell below this MACD histogram when it is going down
+	MacdhSellOnDecrease float64
+	// Sell below this MACD histogram
+	MacdhSell float64
+	// Number of candles in the volume average
+	VolumeLength int
+	// Position sizing, the one of the portfolio when nil
+	Sizing Sizer
+
+	holding      bool
+	counter      int
+	lastSell     int
+	lastPrice    decimal.Decimal
+	lastMacdh    float64
+	volumeData   *Fifo
+	volumeLength int
+}
+
+// Fifo keeps the last values added, in a fixed size circular buffer
+type Fifo struct {
+	Chart    []float64
+	CurrElem int
+}
+
+// Ranges around the default MfiMacd thresholds, for the optimizer
+var MFI_MACD_RANGES = []Range{
+	{Name: "mfi_buy_max", Min: 50, Max: 70, Step: 5},
+	{Name: "mfi_sell", Min: 80, Max: 95, Step: 5},
+	{Name: "mfi_sell_on_decrease", Min: 70, Max: 85, Step: 5},
+	{Name: "macdh_buy", Min: 0.1, Max: 0.3, Step: 0.05},
+	{Name: "macdh_sell", Min: 0.05, Max: 0.2, Step: 0.05},
+	{Name: "volume_length", Min: 3, Max: 9, Step: 2},
+}
+
+// Public
+
+// CreateNewMfiMacdWithParams sets the thresholds given by name, see MFI_MACD_RANGES.
+// Can be used as the optimizer strategy
+func CreateNewMfiMacdWithParams(params Params) (Strategy, error) {
+	strategy := CreateNewMfiMacd()
+	for name, value := range params {
+		switch name {
+		case "mfi_buy_max":
+			strategy.MfiBuyMax = value
+		case "mfi_sell":
+			strategy.MfiSell = value
+		case "mfi_sell_on_decrease":
+			strategy.MfiSellOnDecrease = value
+		case "macdh_buy":
+			strategy.MacdhBuy = value
+		case "macdh_sell_on_decrease":
+			strategy.MacdhSellOnDecrease = value
+		case "macdh_sell":
+			strategy.MacdhSell = value
+		case "volume_length":
+			if value < 1 {
+				return nil, fmt.Errorf("volume_length should be at least 1, got %f", value)
+			}
+			strategy.VolumeLength = int(value)
+		case "fraction":
+			if value <= 0 {
+				return nil, fmt.Errorf("fraction should be positive, got %f", value)
+			}
+			strategy.Sizing = &FixedFraction{Fraction: decimal.NewFromFloat(value)}
+		default:
+			return nil, fmt.Errorf("unknown mfi-macd parameter %s", name)
+		}
+	}
+	return strategy, nil
+}
+
+// CreateNewMfiMacd returns the strategy with the thresholds tuned on december_gdax.txt
+func CreateNewMfiMacd() *MfiMacd {
+	return &MfiMacd{
+		MfiBuyMax:           60,
+		MfiSell:             90,
+		MfiSellOnDecrease:   80,
+		MacdhBuy:            0.2,
+		MacdhSellOnDecrease: 0.2,
+		MacdhSell:           0.15,
+		VolumeLength:        5,
+	}
+}
+
+func (strategy *MfiMacd) Name() string {
+	return "mfi-macd"
+}
+
+func (strategy *MfiMacd) OnCandle(chart *common.CandleChart) Signal {
+	if strategy.volumeData == nil || strategy.volumeLength != strategy.VolumeLength {
+		strategy.volumeData = &Fifo{Chart: make([]float64, strategy.VolumeLength)}
+		strategy.volumeLength = strategy.VolumeLength
+	}
+	candle := chart.CurrentCandle()
+	mfi, macdh := candle.Indicators["mfi"], candle.Indicators["macdh"]
+	volume, _ := candle.Volume.Float64()
+	strategy.volumeData.AddNew(volume)
+	strategy.counter += 1
+	lastPrice, lastMacdh := strategy.lastPrice, strategy.lastMacdh
+	strategy.lastPrice, strategy.lastMacdh = candle.Close, macdh
+
+	if strategy.holding {
+		if mfi > strategy.MfiSell {
+			return Signal{Action: common.SIDE_SELL, Reason: "mfi over max"}
+		} else if mfi > strategy.MfiSellOnDecrease && candle.Close.Cmp(lastPrice) < 0 {
+			return Signal{Action: common.SIDE_SELL, Reason: "mfi high and price decrease"}
+		} else if macdh < strategy.MacdhSellOnDecrease && macdh < lastMacdh {
+			return Signal{Action: common.SIDE_SELL, Reason: "macdh low and decreasing"}
+		} else if macdh < strategy.MacdhSell {
+			return Signal{Action: common.SIDE_SELL, Reason: "macdh under min"}
+		}
+		return Signal{}
+	}
+
+	// Filter out when mfi is already high, when we just sold last candle, and when
+	// volume is lower than average
+	if mfi > strategy.MfiBuyMax || strategy.lastSell+1 == strategy.counter || volume < strategy.volumeData.GetAverage() {
+		return Signal{}
+	}
+	if macdh >= strategy.MacdhBuy {
+		return Signal{Action: common.SIDE_BUY, Reason: "macdh over min"}
+	}
+	return Signal{}
+}
+
+func (strategy *MfiMacd) OnFill(fill Fill) {
+	strategy.holding = !fill.Position.IsZero()
+	if !strategy.holding {
+		strategy.lastSell = strategy.counter
+	}
+}
+
+func (strategy *MfiMacd) Sizer() Sizer {
+	return strategy.Sizing
+}
+
+func (fifo *Fifo) AddNew(value float64) {
+	fifo.CurrElem += 1
+	if fifo.CurrElem == len(fifo.Chart) {
+		fifo.CurrElem = 0
+	}
+	fifo.Chart[fifo.CurrElem] = value
+}
+
+func (fifo *Fifo) GetAverage() float64 {
+	total := 0.0
+	for i := 0; i < len(fifo.Chart); i++ {
+		total += fifo.Chart[i]
+	}
+	return total / float64(len(fifo.Chart))
+}
+
+func (fifo *Fifo) IsIncreasingFromPositive() bool {
+	// Starting from 0 ensure we're starting from positive value
+	lastValue := 0.0
+	// Start from next element (which should be the very beginning)
+	currPos := fifo.CurrElem + 1
+	if currPos == len(fifo.Chart) {
+		currPos = 0
+	}
+	for i := 0; i < len(fifo.Chart); i++ {
+		if lastValue < fifo.Chart[currPos] {
+			return false
+		}
+		currPos += 1
+		if currPos == len(fifo.Chart) {
+			currPos = 0
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package backtest
+
+import (
+	"github.com/shopspring/decimal"
+	"testing"
+	"thierry/gocoin/common"
+)
+
+func setIndicators(chart *common.CandleChart, volume, mfi, macdh float64) {
+	chart.AddCandle(common.Candle{Close: decimal.NewFromFloat(100), Volume: decimal.NewFromFloat(volume)})
+	chart.CurrentCandle().Indicators = map[string]float64{"mfi": mfi, "macdh": macdh}
+}
+
+func TestMfiMacdBuy(t *testing.T) {
+	// GIVEN
+	strategy := CreateNewMfiMacd()
+	chart := common.CreateNewCandleChart()
+	chart.GapPolicy = common.GAP_SKIP
+
+	// WHEN
+	setIndicators(chart, 10, 70, 0.5)
+	highMfi := strategy.OnCandle(chart)
+	setIndicators(chart, 1, 50, 0.5)
+	lowVolume := strategy.OnCandle(chart)
+	setIndicators(chart, 10, 50, 0.1)
+	lowMacdh := strategy.OnCandle(chart)
+	setIndicators(chart, 10, 50, 0.3)
+	buy := strategy.OnCandle(chart)
+
+	// THEN
+	if highMfi.Action != "" || lowVolume.Action != "" || lowMacdh.Action != "" {
+		t.Errorf("Should not buy %v %v %v", highMfi, lowVolume, lowMacdh)
+	}
+	if buy.Action != common.SIDE_BUY {
+		t.Errorf("Should buy %v", buy)
+	}
+}
+
+func TestMfiMacdSell(t *testing.T) {
+	// GIVEN
+	strategy := CreateNewMfiMacd()
+	chart := common.CreateNewCandleChart()
+	chart.GapPolicy = common.GAP_SKIP
+	strategy.OnFill(Fill{Side: common.SIDE_BUY, Position: decimal.NewFromFloat(1)})
+
+	// WHEN
+	setIndicators(chart, 10, 50, 0.3)
+	hold := strategy.OnCandle(chart)
+	setIndicators(chart, 10, 95, 0.3)
+	sell := strategy.OnCandle(chart)
+	strategy.OnFill(Fill{Side: common.SIDE_SELL})
+	setIndicators(chart, 10, 50, 0.5)
+	justSold := strategy.OnCandle(chart)
+
+	// THEN
+	if hold.Action != "" || sell.Action != common.SIDE_SELL || sell.Reason != "mfi over max" {
+		t.Errorf("Wrong sell signals %v %v", hold, sell)
+	}
+	if justSold.Action != "" {
+		t.Errorf("Should not buy right after selling %v", justSold)
+	}
+}
+
+func TestMfiMacdSizing(t *testing.T) {
+	// GIVEN
+	strategy, _ := CreateNewMfiMacdWithParams(Params{"fraction": 0.25})
+
+	// WHEN
+	engine := CreateNewEngine(strategy, CreateNewPortfolio(decimal.NewFromFloat(1000)))
+	_, err := CreateNewMfiMacdWithParams(Params{"fraction": 0})
+
+	// THEN
+	if engine.Portfolio.Sizing == nil || engine.Portfolio.Sizing.String() != "fixed fraction 0.25" || err == nil {
+		t.Errorf("Wrong sizing %v %v", engine.Portfolio.Sizing, err)
+	}
+}
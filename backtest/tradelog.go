@@ -0,0 +1,191 @@
+package backtest
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"thierry/gocoin/common"
+	"time"
+)
+
+// TradeRecord is a fill of the trade log, with the indicators of the candle the
+// position was opened on and of the candle of the fill
+type TradeRecord struct {
+	Time           time.Time `json:"time"`
+	Product        string    `json:"product,omitempty"`
+	Strategy       string    `json:"strategy"`
+	Side           string    `json:"side"`
+	Price          float64   `json:"price"`
+	Size           float64   `json:"size"`
+	Fee            float64   `json:"fee"`
+	Slippage       float64   `json:"slippage"`
+	Reason         string    `json:"reason"`
+	Position       float64   `json:"position"`
+	Pnl            float64   `json:"pnl"`
+	HoldingCandles int       `json:"holding_candles"`
+	Sizing         string    `json:"sizing,omitempty"`
+	Units          int       `json:"units"`
+	// Indicators when the position was first opened
+	EntryIndicators map[string]float64 `json:"entry_indicators"`
+	Indicators      map[string]float64 `json:"indicators"`
+}
+
+// Public
+
+// TradeLog returns a record for each fill of the run
+func (engine *Engine) TradeLog() []TradeRecord {
+	return CreateTradeLog(engine.Strategy.Name(), "", engine.Portfolio.Fills)
+}
+
+// TradeLog returns the records of every asset, in time order
+func (multi *MultiEngine) TradeLog() []TradeRecord {
+	records := []TradeRecord{}
+	for _, product := range multi.Products {
+		engine := multi.Engines[product]
+		records = append(records, CreateTradeLog(engine.Strategy.Name(), product, engine.Portfolio.Fills)...)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records
+}
+
+// CreateTradeLog turns the fills of a portfolio into records, times are in UTC so runs
+// can be compared between machines
+func CreateTradeLog(strategy, product string, fills []Fill) []TradeRecord {
+	records := make([]TradeRecord, 0, len(fills))
+	var entry map[string]float64
+	for _, fill := range fills {
+		if entry == nil {
+			entry = fill.Indicators
+			if entry == nil {
+				entry = map[string]float64{}
+			}
+		}
+		record := TradeRecord{
+			Time:            fill.Time.UTC(),
+			Product:         product,
+			Strategy:        strategy,
+			Side:            fill.Side,
+			Reason:          fill.Reason,
+			HoldingCandles:  fill.HoldingCandles,
+			Sizing:          fill.Sizing,
+			Units:           fill.Units,
+			EntryIndicators: entry,
+			Indicators:      fill.Indicators,
+		}
+		record.Price, _ = fill.Price.Float64()
+		record.Size, _ = fill.Size.Float64()
+		record.Fee, _ = fill.Fee.Float64()
+		record.Slippage, _ = fill.Slippage.Float64()
+		record.Position, _ = fill.Position.Float64()
+		record.Pnl, _ = fill.Pnl.Float64()
+		if record.Indicators == nil {
+			record.Indicators = map[string]float64{}
+		}
+		records = append(records, record)
+		if fill.Position.IsZero() {
+			entry = nil
+		}
+	}
+	return records
+}
+
+// WriteTradeLogCSV writes a header then a line per record, with an entry_ and a fill_
+// column for each indicator
+func WriteTradeLogCSV(w io.Writer, records []TradeRecord) error {
+	names := indicatorNames(records)
+	writer := csv.NewWriter(w)
+	header := []string{"time", "product", "strategy", "side", "price", "size", "fee", "slippage", "reason",
+		"position", "pnl", "holding_candles", "sizing", "units"}
+	for _, name := range names {
+		header = append(header, "entry_"+name)
+	}
+	for _, name := range names {
+		header = append(header, "fill_"+name)
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, record := range records {
+		line := []string{record.Time.Format(time.RFC3339), record.Product, record.Strategy, record.Side,
+			formatFloat(record.Price), formatFloat(record.Size), formatFloat(record.Fee), formatFloat(record.Slippage),
+			record.Reason, formatFloat(record.Position), formatFloat(record.Pnl), strconv.Itoa(record.HoldingCandles),
+			record.Sizing, strconv.Itoa(record.Units)}
+		for _, name := range names {
+			line = append(line, optionalFloat(record.EntryIndicators, name))
+		}
+		for _, name := range names {
+			line = append(line, optionalFloat(record.Indicators, name))
+		}
+		if err := writer.Write(line); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteTradeLogJSONL writes a JSON object per line
+func WriteTradeLogJSONL(w io.Writer, records []TradeRecord) error {
+	writer := bufio.NewWriter(w)
+	for _, record := range records {
+		data, err := common.JSONEncode(record)
+		if err != nil {
+			return err
+		}
+		writer.Write(data)
+		writer.WriteByte('\n')
+	}
+	return writer.Flush()
+}
+
+// WriteTradeLogFile picks the format from the extension, .csv or .jsonl
+func WriteTradeLogFile(path string, records []TradeRecord) error {
+	var write func(io.Writer, []TradeRecord) error
+	switch filepath.Ext(path) {
+	case ".csv":
+		write = WriteTradeLogCSV
+	case ".jsonl", ".json":
+		write = WriteTradeLogJSONL
+	default:
+		return fmt.Errorf("unknown trade log format %s, expected .csv or .jsonl", path)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return write(file, records)
+}
+
+// Private
+
+// Sorted names of all the indicators, so columns are the same between runs
+func indicatorNames(records []TradeRecord) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, record := range records {
+		for _, indicators := range []map[string]float64{record.EntryIndicators, record.Indicators} {
+			for name := range indicators {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func optionalFloat(values map[string]float64, name string) string {
+	value, ok := values[name]
+	if !ok {
+		return ""
+	}
+	return formatFloat(value)
+}
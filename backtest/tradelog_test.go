@@ -0,0 +1,104 @@
+package backtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/shopspring/decimal"
+	"strings"
+	"testing"
+	"time"
+)
+
+func generateTradeFills() []Fill {
+	return []Fill{
+		{Time: time.Unix(0, 0), Side: "buy", Price: decimal.NewFromFloat(10), Size: decimal.NewFromFloat(2),
+			Position: decimal.NewFromFloat(2), Units: 1, Sizing: "all in", Indicators: map[string]float64{"mfi": 20, "macdh": 0.3}},
+		{Time: time.Unix(60, 0), Side: "sell", Price: decimal.NewFromFloat(12), Size: decimal.NewFromFloat(2), Fee: decimal.NewFromFloat(0.1),
+			Pnl: decimal.NewFromFloat(4), Reason: "mfi high", HoldingCandles: 1, Indicators: map[string]float64{"mfi": 85, "macdh": -0.1}},
+		{Time: time.Unix(120, 0), Side: "buy", Price: decimal.NewFromFloat(11), Size: decimal.NewFromFloat(2),
+			Position: decimal.NewFromFloat(2), Units: 1, Indicators: map[string]float64{"mfi": 30}},
+	}
+}
+
+func TestCreateTradeLog(t *testing.T) {
+	// GIVEN
+	fills := generateTradeFills()
+
+	// WHEN
+	records := CreateTradeLog("mfi-macd", "BTC-USD", fills)
+
+	// THEN
+	if len(records) != 3 || records[1].Pnl != 4 || records[1].Reason != "mfi high" || records[0].Time.Location() != time.UTC {
+		t.Fatalf("Wrong records %#v", records)
+	}
+	if records[1].EntryIndicators["mfi"] != 20 || records[1].Indicators["mfi"] != 85 {
+		t.Errorf("Wrong indicators at exit %#v", records[1])
+	}
+	// New position, new entry
+	if records[2].EntryIndicators["mfi"] != 30 {
+		t.Errorf("Wrong indicators at entry %#v", records[2])
+	}
+}
+
+func TestWriteTradeLogCSV(t *testing.T) {
+	// GIVEN
+	records := CreateTradeLog("mfi-macd", "", generateTradeFills())
+	var buffer bytes.Buffer
+
+	// WHEN
+	err := WriteTradeLogCSV(&buffer, records)
+
+	// THEN
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if err != nil || len(lines) != 4 {
+		t.Fatalf("Wrong CSV %v\n%s", err, buffer.String())
+	}
+	if !strings.HasSuffix(lines[0], ",units,entry_macdh,entry_mfi,fill_macdh,fill_mfi") {
+		t.Errorf("Wrong header %s", lines[0])
+	}
+	if lines[2] != "1970-01-01T00:01:00Z,,mfi-macd,sell,12,2,0.1,0,mfi high,0,4,1,,0,0.3,20,-0.1,85" {
+		t.Errorf("Wrong line %s", lines[2])
+	}
+	// Missing indicators are left empty
+	if !strings.HasSuffix(lines[3], ",,30,,30") {
+		t.Errorf("Wrong line %s", lines[3])
+	}
+}
+
+func TestWriteTradeLogJSONL(t *testing.T) {
+	// GIVEN
+	records := CreateTradeLog("mfi-macd", "BTC-USD", generateTradeFills())
+	var buffer bytes.Buffer
+
+	// WHEN
+	err := WriteTradeLogJSONL(&buffer, records)
+
+	// THEN
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if err != nil || len(lines) != 3 {
+		t.Fatalf("Wrong JSONL %v\n%s", err, buffer.String())
+	}
+	var record TradeRecord
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil || record.Product != "BTC-USD" || record.EntryIndicators["macdh"] != 0.3 || !record.Time.Equal(time.Unix(60, 0)) {
+		t.Errorf("Wrong record %v %#v", err, record)
+	}
+}
+
+func TestEngineTradeLog(t *testing.T) {
+	// GIVEN
+	strategy := &scriptedStrategy{buys: map[int]bool{3: true}}
+	engine := CreateNewEngine(strategy, CreateNewPortfolio(decimal.NewFromFloat(100)))
+	engine.Warmup = 2
+
+	// WHEN
+	engine.Run(generateCandles(10, 10, 10, 15))
+	records := engine.TradeLog()
+
+	// THEN
+	if len(records) != 2 || records[0].Strategy != "scripted" || records[1].Reason != "end of backtest" {
+		t.Fatalf("Wrong trade log %#v", records)
+	}
+	if _, ok := records[1].Indicators["mfi"]; !ok {
+		t.Errorf("Indicators not recorded %v", records[1].Indicators)
+	}
+}
@@ -0,0 +1,120 @@
+package backtest
+
+import (
+	"fmt"
+	"strings"
+	"thierry/gocoin/common"
+	"time"
+)
+
+// WalkForward optimizes the parameters on a window of candles (in sample), then runs
+// them unchanged on the candles right after it (out of sample), and rolls both windows
+// forward by the out of sample length
+type WalkForward struct {
+	Optimizer *Optimizer
+	// Number of candles of each window
+	InSample    int
+	OutOfSample int
+}
+
+type WalkForwardWindow struct {
+	InSampleStart    time.Time
+	OutOfSampleStart time.Time
+	OutOfSampleEnd   time.Time
+	// Best parameters on the in sample window
+	Params      Params
+	InSample    Report
+	OutOfSample Report
+}
+
+type WalkForwardResult struct {
+	Windows []WalkForwardWindow
+	// Out of sample runs joined together, each one starting with the equity the
+	// previous one ended with
+	Aggregate Report
+}
+
+// Public
+
+func CreateNewWalkForward(optimizer *Optimizer, inSample, outOfSample int) *WalkForward {
+	return &WalkForward{Optimizer: optimizer, InSample: inSample, OutOfSample: outOfSample}
+}
+
+func (walkForward *WalkForward) Run(candles []common.Candle) (WalkForwardResult, error) {
+	if walkForward.InSample <= 0 || walkForward.OutOfSample <= 0 {
+		return WalkForwardResult{}, fmt.Errorf("walk forward windows should not be empty")
+	}
+	if walkForward.InSample+walkForward.OutOfSample > len(candles) {
+		return WalkForwardResult{}, fmt.Errorf("not enough candles for a single window, got %d", len(candles))
+	}
+
+	result := WalkForwardResult{Windows: []WalkForwardWindow{}}
+	initial := walkForward.Optimizer.Portfolio().Initial
+	equity := initial
+	equityCurve := []EquityPoint{}
+	fills := []Fill{}
+	funding := 0.0
+	name := ""
+	for start := 0; start+walkForward.InSample+walkForward.OutOfSample <= len(candles); start += walkForward.OutOfSample {
+		split := start + walkForward.InSample
+		end := split + walkForward.OutOfSample
+		results, err := walkForward.Optimizer.Run(candles[start:split])
+		if err != nil {
+			return WalkForwardResult{}, err
+		}
+		best := results[0]
+
+		// Candles before the out of sample window are replayed as warmup, so indicators
+		// are ready when it starts
+		warmupStart := split - walkForward.Optimizer.Warmup
+		if warmupStart < 0 {
+			warmupStart = 0
+		}
+		strategy, err := walkForward.Optimizer.Strategy(best.Params)
+		if err != nil {
+			return WalkForwardResult{}, err
+		}
+		portfolio := walkForward.Optimizer.Portfolio()
+		portfolio.Initial, portfolio.Cash = equity, equity
+		engine := CreateNewEngine(strategy, portfolio)
+		engine.Warmup = split - warmupStart
+		engine.Chart.Timeframe = walkForward.Optimizer.Timeframe
+		engine.Stops = walkForward.Optimizer.Stops
+		engine.Funding = walkForward.Optimizer.Funding
+		engine.Run(candles[warmupStart:end])
+		report := engine.Report()
+
+		result.Windows = append(result.Windows, WalkForwardWindow{
+			InSampleStart:    candles[start].Time,
+			OutOfSampleStart: candles[split].Time,
+			OutOfSampleEnd:   candles[end-1].Time,
+			Params:           best.Params,
+			InSample:         best.Report,
+			OutOfSample:      report,
+		})
+		equityCurve = append(equityCurve, engine.Equity...)
+		fills = append(fills, portfolio.Fills...)
+		funding += report.Funding
+		if len(engine.Equity) > 0 {
+			equity = engine.Equity[len(engine.Equity)-1].Equity
+		}
+		name = strategy.Name()
+	}
+	result.Aggregate = CreateNewReport(name, initial, equityCurve, fills)
+	result.Aggregate.Funding = funding
+	return result, nil
+}
+
+func (result WalkForwardResult) String() string {
+	lines := []string{}
+	for i, window := range result.Windows {
+		lines = append(lines, fmt.Sprintf("Window %d, in sample from %s, out of sample from %s to %s, %v",
+			i+1, window.InSampleStart.Format("2006-01-02 15:04"), window.OutOfSampleStart.Format("2006-01-02 15:04"),
+			window.OutOfSampleEnd.Format("2006-01-02 15:04"), window.Params))
+		lines = append(lines, fmt.Sprintf("  in sample %.2f%% (sharpe %.3f), out of sample %.2f%% (sharpe %.3f, %d trades)",
+			100*window.InSample.TotalReturn, window.InSample.Sharpe, 100*window.OutOfSample.TotalReturn,
+			window.OutOfSample.Sharpe, window.OutOfSample.Trades))
+	}
+	lines = append(lines, "", "Out of sample:", result.Aggregate.String())
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,50 @@
+package backtest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWalkForward(t *testing.T) {
+	// GIVEN
+	// Buys on the candle given by the "buy" parameter, and sells 2 candles later
+	strategy := func(params Params) (Strategy, error) {
+		buy := int(params["buy"])
+		return &scriptedStrategy{buys: map[int]bool{buy: true}, sells: map[int]bool{buy + 2: true}}, nil
+	}
+	optimizer := CreateNewOptimizer(strategy, []Range{{Name: "buy", Min: 1, Max: 3, Step: 1}})
+	optimizer.Warmup = 0
+	walkForward := CreateNewWalkForward(optimizer, 5, 5)
+	candles := generateCandles(10, 10, 10, 20, 20, 10, 10, 10, 20, 20, 10, 10, 10, 10, 10, 10, 10)
+
+	// WHEN
+	result, err := walkForward.Run(candles)
+	_, errShort := walkForward.Run(candles[:8])
+
+	// THEN
+	if err != nil || len(result.Windows) != 2 {
+		t.Fatalf("Wrong walk forward %v %v", result, err)
+	}
+	first := result.Windows[0]
+	// Buying on the 2nd candle at 10 and selling on the 4th at 20 is the best in sample
+	if first.Params["buy"] != 2 || first.InSample.TotalReturn != 1 || !first.OutOfSampleStart.Equal(candles[5].Time) {
+		t.Errorf("Wrong first window %#v", first)
+	}
+	// Same trade out of sample, on candles 7 and 9
+	if first.OutOfSample.TotalReturn != 1 || first.OutOfSample.Candles != 5 || first.OutOfSample.StartingEquity != 1000 {
+		t.Errorf("Wrong first out of sample %#v", first.OutOfSample)
+	}
+	second := result.Windows[1]
+	if second.OutOfSample.StartingEquity != 2000 || second.OutOfSample.Trades != 1 {
+		t.Errorf("Wrong second out of sample %#v", second.OutOfSample)
+	}
+	if result.Aggregate.Candles != 10 || result.Aggregate.Trades != 2 || result.Aggregate.EndingEquity != 2000 {
+		t.Errorf("Wrong aggregate %#v", result.Aggregate)
+	}
+	if errShort == nil {
+		t.Errorf("Walk forward should fail without enough candles")
+	}
+	if !strings.Contains(result.String(), "Window 2") {
+		t.Errorf("Wrong text %s", result.String())
+	}
+}
@@ -4,72 +4,209 @@ import (
 	"fmt"
 	"github.com/Jeffail/gabs"
 	ws "github.com/gorilla/websocket"
-	"strconv"
+	"github.com/shopspring/decimal"
 	"thierry/gocoin/common"
+	"time"
 )
 
-func Update(orderBook map[string]*common.Order, prices map[string][]float64) {
-	var wsDialer ws.Dialer
-	wsConn, _, err := wsDialer.Dial("wss://api.bitfinex.com/ws/2", nil)
-	if err != nil {
-		println(err.Error())
+const WS_URL = "wss://api.bitfinex.com/ws/2"
+
+type Bitfinex struct {
+	Url string
+	// Every frame read is recorded when set
+	Recorder *common.Recorder
+
+	conn       common.Feed
+	channels   map[string]subscription
+	orderBooks map[string]*common.OrderBook
+	trades     chan common.Trade
+	books      chan common.BookUpdate
+	events     chan common.Event
+	// Trades dropped because the trades channel was full
+	droppedTrades int
+}
+
+// Bitfinex answers each subscribe with a channel id, which prefixes every message
+type subscription struct {
+	channel string
+	symbol  string
+}
+
+// Public
+
+func CreateNewExchange() *Bitfinex {
+	return &Bitfinex{
+		Url:        WS_URL,
+		channels:   make(map[string]subscription),
+		orderBooks: make(map[string]*common.OrderBook),
+		trades:     make(chan common.Trade, common.EVENT_BUFFER),
+		books:      make(chan common.BookUpdate, common.EVENT_BUFFER),
+		events:     make(chan common.Event, common.EVENT_BUFFER),
 	}
+}
 
-	subscribe := map[string]string{
-		"event":   "subscribe",
-		"channel": "book",
-		"symbol":  "tBTCUSD",
-		"prec":    "P0",
-		"freq":    "F0",
+func (bitfinex *Bitfinex) Name() string {
+	return "bitfinex"
+}
+
+func (bitfinex *Bitfinex) Connect() error {
+	conn := common.CreateNewConnection(bitfinex.Name(), bitfinex.Url, bitfinex.events)
+	conn.OnReconnect = bitfinex.reset
+	conn.Recorder = bitfinex.Recorder
+	bitfinex.conn = conn
+	if err := conn.Connect(); err != nil {
+		return err
 	}
-	if err := wsConn.WriteJSON(subscribe); err != nil {
-		println(err.Error())
+	go bitfinex.read()
+	return nil
+}
+
+// Replay reads the frames of a recording instead of connecting, through the same
+// handlers. Subscribe does nothing, the recording has the messages subscribed to
+func (bitfinex *Bitfinex) Replay(replay *common.Replay) {
+	replay.OnReconnect = bitfinex.reset
+	bitfinex.conn = replay
+	go bitfinex.read()
+}
+
+func (bitfinex *Bitfinex) Subscribe(products, channels []string) error {
+	for _, channel := range channels {
+		if channel != common.CHANNEL_TRADES && channel != common.CHANNEL_BOOK {
+			return fmt.Errorf("bitfinex: unknown channel %s", channel)
+		}
+		for _, product := range products {
+			subscribe := map[string]string{
+				"event":   "subscribe",
+				"channel": channel,
+				"symbol":  product,
+			}
+			if channel == common.CHANNEL_BOOK {
+				subscribe["prec"] = "P0"
+				subscribe["freq"] = "F0"
+			}
+			if err := bitfinex.conn.Subscribe(subscribe); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
+
+func (bitfinex *Bitfinex) Trades() <-chan common.Trade {
+	return bitfinex.trades
+}
+
+func (bitfinex *Bitfinex) BookUpdates() <-chan common.BookUpdate {
+	return bitfinex.books
+}
 
-	counter := 0
-	for true {
-		msgType, resp, err := wsConn.ReadMessage()
+func (bitfinex *Bitfinex) Events() <-chan common.Event {
+	return bitfinex.events
+}
+
+func (bitfinex *Bitfinex) Close() error {
+	if bitfinex.conn == nil {
+		return nil
+	}
+	// Closing the connection ends the read loop, which closes the trade and book channels
+	return bitfinex.conn.Close()
+}
+
+// Private
+
+// Channel ids are given again when resubscribing, and books are sent as snapshots
+func (bitfinex *Bitfinex) reset() {
+	bitfinex.channels = make(map[string]subscription)
+	bitfinex.orderBooks = make(map[string]*common.OrderBook)
+}
+
+func (bitfinex *Bitfinex) read() {
+	defer close(bitfinex.trades)
+	defer close(bitfinex.books)
+
+	for {
+		msgType, resp, err := bitfinex.conn.ReadMessage()
 		if err != nil {
-			fmt.Println(err)
 			break
 		}
 		if msgType != ws.TextMessage {
 			continue
 		}
-		jsonParsed, err := gabs.ParseJSON(resp)
+		jsonParsed, err := common.ParseJSONNumbers(resp)
 		if err != nil {
 			fmt.Println(err)
 			continue
 		}
+		bitfinex.handleMessage(jsonParsed)
+	}
+}
 
-		updateOrderBook(jsonParsed, orderBook)
+func (bitfinex *Bitfinex) handleMessage(jsonParsed *gabs.Container) {
+	// Keep track of channel ids, everything else is an array prefixed by the channel id
+	if event, ok := jsonParsed.Search("event").Data().(string); ok {
+		if event == "subscribed" {
+			chanId := fmt.Sprint(jsonParsed.Search("chanId").Data())
+			channel, _ := jsonParsed.Search("channel").Data().(string)
+			symbol, _ := jsonParsed.Search("symbol").Data().(string)
+			bitfinex.channels[chanId] = subscription{channel: channel, symbol: symbol}
+		} else if event == "error" {
+			fmt.Printf("Bitfinex error: %v\n", jsonParsed.Search("msg").Data())
+		}
+		return
+	}
+	chanId := fmt.Sprint(jsonParsed.Index(0).Data())
+	sub, ok := bitfinex.channels[chanId]
+	if !ok {
+		return
+	}
 
-		// Get highest buy price, so we can short sell it
-		counter += 1
-		if counter%1 == 0 {
-			updateBestPrices(orderBook, prices)
+	if sub.channel == common.CHANNEL_TRADES {
+		// Only trade executions, "tu" updates are duplicates with the trade id, and the
+		// initial snapshot are past trades
+		if msgType, _ := jsonParsed.Index(1).Data().(string); msgType == "te" {
+			if trade, ok := toTrade(sub.symbol, jsonParsed.Index(2)); ok {
+				common.SendTrade(bitfinex.trades, trade, &bitfinex.droppedTrades)
+			}
 		}
+	} else if sub.channel == common.CHANNEL_BOOK {
+		orderBook, ok := bitfinex.orderBooks[sub.symbol]
+		if !ok {
+			orderBook = common.CreateNewOrderBook(common.TickSize(bitfinex.Name(), sub.symbol))
+			bitfinex.orderBooks[sub.symbol] = orderBook
+		}
+		updateOrderBook(jsonParsed, orderBook)
+		book := orderBook.TopOfBook()
+		book.Exchange, book.ProductId, book.Time = bitfinex.Name(), sub.symbol, bitfinex.conn.Now()
+		common.SendBookUpdate(bitfinex.books, book)
 	}
 }
 
-func updateBestPrices(orderBook map[string]*common.Order, prices map[string][]float64) {
-	buy, buySize, sell, sellSize := 0.0, 0.0, 0.0, 0.0
-	for _, order := range orderBook {
-		if order.Side == "sell" && (buy > order.Price || buy == 0.0) && order.Size > 0 {
-			buy = order.Price
-			buySize = order.Size
-		} else if order.Side == "buy" && sell < order.Price && order.Size > 0 {
-			sell = order.Price
-			sellSize = order.Size
-		}
+// Trades are sent as [ID, MTS, AMOUNT, PRICE], with a negative amount for sells
+func toTrade(symbol string, row *gabs.Container) (common.Trade, bool) {
+	if c, _ := row.ArrayCount(); c < 4 {
+		return common.Trade{}, false
 	}
-	prices["bitfinex"][0] = buy
-	prices["bitfinex"][1] = buySize
-	prices["bitfinex"][2] = sell
-	prices["bitfinex"][3] = sellSize
+	id, _ := common.JSONToDecimal(row.Index(0).Data())
+	mts, _ := common.JSONToDecimal(row.Index(1).Data())
+	amount, _ := common.JSONToDecimal(row.Index(2).Data())
+	price, _ := common.JSONToDecimal(row.Index(3).Data())
+	side := common.SIDE_BUY
+	if amount.Sign() < 0 {
+		side = common.SIDE_SELL
+		amount = amount.Neg()
+	}
+	return common.Trade{
+		Exchange:  "bitfinex",
+		ProductId: symbol,
+		TradeId:   id.String(),
+		Side:      side,
+		Price:     price,
+		Size:      amount,
+		Time:      time.Unix(0, mts.IntPart()*int64(time.Millisecond)),
+	}, true
 }
 
-func updateOrderBook(jsonParsed *gabs.Container, orderBook map[string]*common.Order) {
+func updateOrderBook(jsonParsed *gabs.Container, orderBook *common.OrderBook) {
 	// Ignore events
 	exists := jsonParsed.Exists("event")
 	if exists {
@@ -81,60 +218,31 @@ func updateOrderBook(jsonParsed *gabs.Container, orderBook map[string]*common.Or
 	// We have array of array, it's a snapshot
 	if isUpdateCheck > 0 {
 		listSnapshot, _ := row.Children()
-		countBuy, countSell := 0, 0
 		for _, order := range listSnapshot {
-			if c, _ := order.ArrayCount(); c < 3 {
-				continue
-			}
-			price := order.Index(0).Data().(float64)
-			numOrder := order.Index(1).Data().(float64)
-			size := order.Index(2).Data().(float64)
-			side := "unset"
-			if size > 0 {
-				side = "buy"
-				countBuy += 1
-			} else if size < 0 {
-				side = "sell"
-				countSell += 1
-				size = 0 - size
-			}
-			if numOrder == 0 {
-				size = 0
-			}
-
-			id := side + "-" + strconv.FormatFloat(price, 'f', common.PRECISION_DECIMAL, 64)
-			if _, ok := orderBook[id]; !ok {
-				orderBook[id] = &common.Order{Id: id}
-			}
-			orderBook[id].Side = side
-			orderBook[id].Size = size
-			orderBook[id].Price = price
+			updateLevel(order, orderBook)
 		}
 		// Updates
 	} else {
-		if c, _ := row.ArrayCount(); c < 3 {
-			return
-		}
-		price := row.Index(0).Data().(float64)
-		numOrder := row.Index(1).Data()
-		size := row.Index(2).Data().(float64)
-		side := "unset"
-		if size > 0 {
-			side = "buy"
-		} else if size < 0 {
-			side = "sell"
-			size = 0 - size
-		}
-		if numOrder == 0.0 {
-			size = 0
-		}
+		updateLevel(row, orderBook)
+	}
+}
 
-		id := side + "-" + strconv.FormatFloat(price, 'f', common.PRECISION_DECIMAL, 64)
-		if _, ok := orderBook[id]; !ok {
-			orderBook[id] = &common.Order{Id: id}
-		}
-		orderBook[id].Side = side
-		orderBook[id].Size = size
-		orderBook[id].Price = price
+// Levels are sent as [PRICE, COUNT, AMOUNT], with a negative amount for asks and
+// a count of zero when the level is removed
+func updateLevel(order *gabs.Container, orderBook *common.OrderBook) {
+	if c, _ := order.ArrayCount(); c < 3 {
+		return
+	}
+	price, _ := common.JSONToDecimal(order.Index(0).Data())
+	numOrder, _ := common.JSONToDecimal(order.Index(1).Data())
+	size, _ := common.JSONToDecimal(order.Index(2).Data())
+	side := common.SIDE_BUY
+	if size.Sign() < 0 {
+		side = common.SIDE_SELL
+		size = size.Neg()
+	}
+	if numOrder.Sign() == 0 {
+		size = decimal.Decimal{}
 	}
+	orderBook.Update(side, price, size)
 }
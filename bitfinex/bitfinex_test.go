@@ -3,8 +3,13 @@ package bitfinex
 import (
 	"fmt"
 	"github.com/Jeffail/gabs"
+	ws "github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
+	"io/ioutil"
+	"os"
 	"testing"
 	"thierry/gocoin/common"
+	"time"
 )
 
 func generateSnapshotMessage() *gabs.Container {
@@ -25,14 +30,14 @@ func TestUpdateOrderBookSnapshot(t *testing.T) {
 	// Orderbook snapshot
 	message := generateSnapshotMessage()
 	// Order book
-	orderBook := map[string]*common.Order{}
+	orderBook := common.CreateNewOrderBook(common.DEFAULT_TICK_SIZE)
 
 	// WHEN
 	updateOrderBook(message, orderBook)
 
 	// THEN
-	if len(orderBook) != 3 {
-		t.Errorf("Order book should have length %d, has length %d", 3, len(orderBook))
+	if orderBook.Len() != 3 {
+		t.Errorf("Order book should have length %d, has length %d", 3, orderBook.Len())
 	}
 }
 
@@ -45,7 +50,7 @@ func TestUpdateOrderBookUpdateChange(t *testing.T) {
 	messageSell2 := generateChangeMessage("sell", "1031", "3")
 	// Change one buy price
 	messageBuy3 := generateChangeMessage("buy", "1026", "3")
-	orderBook := map[string]*common.Order{}
+	orderBook := common.CreateNewOrderBook(common.DEFAULT_TICK_SIZE)
 
 	// WHEN
 	updateOrderBook(messageBuy1, orderBook)
@@ -55,8 +60,8 @@ func TestUpdateOrderBookUpdateChange(t *testing.T) {
 	updateOrderBook(messageBuy3, orderBook)
 
 	// THEN
-	if len(orderBook) != 4 {
-		t.Errorf("Order book should have length %d, has length %d", 4, len(orderBook))
+	if orderBook.Len() != 4 {
+		t.Errorf("Order book should have length %d, has length %d", 4, orderBook.Len())
 	}
 }
 
@@ -64,19 +69,18 @@ func TestBestPrices(t *testing.T) {
 	// GIVEN
 	message, _ := gabs.ParseJSON([]byte(`[33919,[[1000.5,1,1.5],[1005.3,1,1.1],[1100.32,1,-0.3]]]`))
 	// Send changes
-	orderBook := map[string]*common.Order{}
+	orderBook := common.CreateNewOrderBook(common.DEFAULT_TICK_SIZE)
 	updateOrderBook(message, orderBook)
-	prices := map[string][]float64{"bitfinex": {0, 0, 0, 0}}
 
 	// WHEN
-	updateBestPrices(orderBook, prices)
+	book := orderBook.TopOfBook()
 
 	// THEN
-	if prices["bitfinex"][0] != 1100.32 {
-		t.Errorf("Wrong best buy price at %f, wanted %f", 1100.32, prices["bitfinex"][0])
+	if !book.Ask.Equal(decimal.NewFromFloat(1100.32)) {
+		t.Errorf("Wrong best buy price at %f, wanted %s", 1100.32, book.Ask)
 	}
-	if prices["bitfinex"][2] != 1005.3 {
-		t.Errorf("Wrong best sell price at %f, wanted %f", 1005.3, prices["bitfinex"][2])
+	if !book.Bid.Equal(decimal.NewFromFloat(1005.3)) {
+		t.Errorf("Wrong best sell price at %f, wanted %s", 1005.3, book.Bid)
 	}
 }
 
@@ -90,24 +94,105 @@ func TestBestPricesWithChanges(t *testing.T) {
 	messageSell2 := generateChangeMessage("sell", "1032", "3")
 	messageSell3 := generateChangeMessage("sell", "1031", "3")
 	// Send changes
-	orderBook := map[string]*common.Order{}
+	orderBook := common.CreateNewOrderBook(common.DEFAULT_TICK_SIZE)
 	updateOrderBook(message, orderBook)
 	updateOrderBook(messageBuy1, orderBook)
 	updateOrderBook(messageBuy2, orderBook)
 	updateOrderBook(messageSell1, orderBook)
 	updateOrderBook(messageSell2, orderBook)
 	updateOrderBook(messageSell3, orderBook)
-	prices := map[string][]float64{"bitfinex": {0, 0, 0, 0}}
 
 	// WHEN
-	updateBestPrices(orderBook, prices)
-	fmt.Printf("%#v\n", prices)
+	book := orderBook.TopOfBook()
+	fmt.Printf("%#v\n", book)
 
 	// THEN
-	if prices["bitfinex"][0] != 1031.0 {
-		t.Errorf("Wrong best buy price at %f, wanted %f", 1031.0, prices["bitfinex"][0])
+	if !book.Ask.Equal(decimal.NewFromFloat(1031.0)) {
+		t.Errorf("Wrong best buy price at %f, wanted %s", 1031.0, book.Ask)
 	}
-	if prices["bitfinex"][2] != 1025.0 {
-		t.Errorf("Wrong best sell price at %f, wanted %f", 1025.0, prices["bitfinex"][2])
+	if !book.Bid.Equal(decimal.NewFromFloat(1025.0)) {
+		t.Errorf("Wrong best sell price at %f, wanted %s", 1025.0, book.Bid)
+	}
+}
+
+func TestHandleMessageTrade(t *testing.T) {
+	// GIVEN
+	exchange := CreateNewExchange()
+	subscribed, _ := common.ParseJSONNumbers([]byte(`{"event":"subscribed","channel":"trades","chanId":17,"symbol":"tBTCUSD"}`))
+	snapshot, _ := common.ParseJSONNumbers([]byte(`[17,[[1,1514764800000,0.5,1000]]]`))
+	message, _ := common.ParseJSONNumbers([]byte(`[17,"te",[2,1514764801000,-0.25,1001.5]]`))
+
+	// WHEN
+	exchange.handleMessage(subscribed)
+	exchange.handleMessage(snapshot)
+	exchange.handleMessage(message)
+	trade := <-exchange.Trades()
+
+	// THEN
+	if len(exchange.Trades()) != 0 {
+		t.Errorf("Snapshot trades should not be sent")
+	}
+	if trade.ProductId != "tBTCUSD" || trade.TradeId != "2" || trade.Side != "sell" {
+		t.Errorf("Trade not properly normalized: %v", trade.String())
+	}
+	if trade.Price.String() != "1001.5" || trade.Size.String() != "0.25" {
+		t.Errorf("Trade price or size not properly parsed: %v", trade.String())
+	}
+}
+
+func TestUpdateOrderBookExactPrices(t *testing.T) {
+	// GIVEN
+	// Prices with more than 5 decimals, parsed without going through float64
+	message, _ := common.ParseJSONNumbers([]byte(`[42,[[0.076123412,1,1.5],[0.076123418,1,2.5],[0.076123419,1,-1]]]`))
+	orderBook := common.CreateNewOrderBook(decimal.New(1, -9))
+
+	// WHEN
+	updateOrderBook(message, orderBook)
+	book := orderBook.TopOfBook()
+
+	// THEN
+	if orderBook.Len() != 3 {
+		t.Errorf("Order book should have length %d, has length %d", 3, orderBook.Len())
+	}
+	if book.Bid.String() != "0.076123418" || book.Ask.String() != "0.076123419" {
+		t.Errorf("Wrong best prices %s - %s", book.Bid, book.Ask)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	// GIVEN
+	// Recorded subscribes, book snapshot and trade
+	dir, _ := ioutil.TempDir("", "bitfinex")
+	defer os.RemoveAll(dir)
+	recorder := common.CreateNewRecorder(dir, "bitfinex")
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	frames := []string{
+		`{"event":"subscribed","channel":"book","chanId":18,"symbol":"tBTCUSD"}`,
+		`{"event":"subscribed","channel":"trades","chanId":17,"symbol":"tBTCUSD"}`,
+		`[18,[[1000,1,0.5],[1001,1,-0.5]]]`,
+		`[17,"te",[2,1514764801000,-0.25,1001.5]]`,
+	}
+	for i, frame := range frames {
+		recorder.Record(start.Add(time.Duration(i)*time.Second), ws.TextMessage, []byte(frame))
+	}
+	recorder.Close()
+	files, _ := common.SegmentFiles(dir, "bitfinex")
+	exchange := CreateNewExchange()
+
+	// WHEN
+	exchange.Replay(common.CreateNewReplay(files, 0))
+	exchange.Subscribe([]string{"tBTCUSD"}, []string{common.CHANNEL_TRADES})
+	trades := []common.Trade{}
+	for trade := range exchange.Trades() {
+		trades = append(trades, trade)
+	}
+	book := <-exchange.BookUpdates()
+
+	// THEN
+	if len(trades) != 1 || trades[0].TradeId != "2" {
+		t.Errorf("Recorded trade should be replayed, got %v", trades)
+	}
+	if !book.Bid.Equal(decimal.New(1000, 0)) || !book.Ask.Equal(decimal.New(1001, 0)) || !book.Time.Equal(start.Add(2*time.Second)) {
+		t.Errorf("Book should be at its recorded time %#v", book)
 	}
 }
@@ -4,63 +4,194 @@ import (
 	"fmt"
 	"github.com/Jeffail/gabs"
 	ws "github.com/gorilla/websocket"
-	// "os"
-	"strconv"
+	"github.com/shopspring/decimal"
+	"strings"
 	"thierry/gocoin/common"
+	"time"
 )
 
-func Update(orderBook map[string]*common.Order, prices map[string][]float64) {
-	var wsDialer ws.Dialer
-	wsConn, _, err := wsDialer.Dial("wss://www.bitmex.com/realtime?subscribe=orderBookL2:XBTUSD", nil)
-	if err != nil {
-		println(err.Error())
+const WS_URL = "wss://www.bitmex.com/realtime"
+
+type Bitmex struct {
+	Url string
+	// Every frame read is recorded when set
+	Recorder *common.Recorder
+
+	conn       common.Feed
+	orderBooks map[string]*orderBookL2
+	trades     chan common.Trade
+	books      chan common.BookUpdate
+	events     chan common.Event
+	// Trades dropped because the trades channel was full
+	droppedTrades int
+}
+
+// Bitmex updates and deletes levels by id, without their price, so we keep the
+// level each id stands for next to the sorted book
+type orderBookL2 struct {
+	orders map[string]*common.Order
+	book   *common.OrderBook
+}
+
+type BitmexSubscribe struct {
+	Op   string   `json:"op"`
+	Args []string `json:"args"`
+}
+
+// Public
+
+func CreateNewExchange() *Bitmex {
+	return &Bitmex{
+		Url:        WS_URL,
+		orderBooks: make(map[string]*orderBookL2),
+		trades:     make(chan common.Trade, common.EVENT_BUFFER),
+		books:      make(chan common.BookUpdate, common.EVENT_BUFFER),
+		events:     make(chan common.Event, common.EVENT_BUFFER),
+	}
+}
+
+func (bitmex *Bitmex) Name() string {
+	return "bitmex"
+}
+
+func (bitmex *Bitmex) Connect() error {
+	conn := common.CreateNewConnection(bitmex.Name(), bitmex.Url, bitmex.events)
+	conn.OnReconnect = bitmex.reset
+	conn.Recorder = bitmex.Recorder
+	bitmex.conn = conn
+	if err := conn.Connect(); err != nil {
+		return err
+	}
+	go bitmex.read()
+	return nil
+}
+
+// Replay reads the frames of a recording instead of connecting, through the same
+// handlers. Subscribe does nothing, the recording has the messages subscribed to
+func (bitmex *Bitmex) Replay(replay *common.Replay) {
+	replay.OnReconnect = bitmex.reset
+	bitmex.conn = replay
+	go bitmex.read()
+}
+
+func (bitmex *Bitmex) Subscribe(products, channels []string) error {
+	subscribe := BitmexSubscribe{Op: "subscribe"}
+	for _, channel := range channels {
+		table := ""
+		switch channel {
+		case common.CHANNEL_TRADES:
+			table = "trade"
+		case common.CHANNEL_BOOK:
+			table = "orderBookL2"
+		default:
+			return fmt.Errorf("bitmex: unknown channel %s", channel)
+		}
+		for _, product := range products {
+			subscribe.Args = append(subscribe.Args, table+":"+product)
+		}
+	}
+	return bitmex.conn.Subscribe(subscribe)
+}
+
+func (bitmex *Bitmex) Trades() <-chan common.Trade {
+	return bitmex.trades
+}
+
+func (bitmex *Bitmex) BookUpdates() <-chan common.BookUpdate {
+	return bitmex.books
+}
+
+func (bitmex *Bitmex) Events() <-chan common.Event {
+	return bitmex.events
+}
+
+func (bitmex *Bitmex) Close() error {
+	if bitmex.conn == nil {
+		return nil
 	}
+	// Closing the connection ends the read loop, which closes the trade and book channels
+	return bitmex.conn.Close()
+}
 
-	counter := 0
+// Private
 
-	for true {
-		msgType, resp, err := wsConn.ReadMessage()
+// Books are sent again as partials after resubscribing
+func (bitmex *Bitmex) reset() {
+	bitmex.orderBooks = make(map[string]*orderBookL2)
+}
+
+func (bitmex *Bitmex) read() {
+	defer close(bitmex.trades)
+	defer close(bitmex.books)
+
+	for {
+		msgType, resp, err := bitmex.conn.ReadMessage()
 		if err != nil {
-			fmt.Println(err)
 			break
 		}
 		if msgType != ws.TextMessage {
 			continue
 		}
-		jsonParsed, err := gabs.ParseJSON(resp)
+		jsonParsed, err := common.ParseJSONNumbers(resp)
 		if err != nil {
 			fmt.Println(err)
 			continue
 		}
+		bitmex.handleMessage(jsonParsed)
+	}
+}
 
-		updateOrderBook(jsonParsed, orderBook)
+func (bitmex *Bitmex) handleMessage(jsonParsed *gabs.Container) {
+	table, _ := jsonParsed.Search("table").Data().(string)
+	row, err := jsonParsed.Search("data").Children()
+	if err != nil || len(row) == 0 {
+		return
+	}
 
-		// Get highest buy price, so we can short sell it
-		counter += 1
-		if counter%1 == 0 {
-			updateBestPrices(orderBook, prices)
+	if table == "trade" {
+		// The partial sent on subscribe, and again after each reconnect, holds past trades
+		if action, _ := jsonParsed.Search("action").Data().(string); action == "partial" {
+			return
+		}
+		for _, order := range row {
+			orderParsed, _ := order.ChildrenMap()
+			common.SendTrade(bitmex.trades, toTrade(orderParsed), &bitmex.droppedTrades)
+		}
+	} else if table == "orderBookL2" {
+		// Bitmex sends one message per symbol, so the first row tells us which book to update
+		symbol, _ := row[0].Search("symbol").Data().(string)
+		orderBook, ok := bitmex.orderBooks[symbol]
+		if !ok {
+			orderBook = createOrderBookL2(common.TickSize(bitmex.Name(), symbol))
+			bitmex.orderBooks[symbol] = orderBook
 		}
+		updateOrderBook(jsonParsed, orderBook)
+		book := orderBook.book.TopOfBook()
+		book.Exchange, book.ProductId, book.Time = bitmex.Name(), symbol, bitmex.conn.Now()
+		common.SendBookUpdate(bitmex.books, book)
 	}
 }
 
-func updateBestPrices(orderBook map[string]*common.Order, prices map[string][]float64) {
-	buy, buySize, sell, sellSize := 0.0, 0.0, 0.0, 0.0
-	for _, order := range orderBook {
-		if order.Side == "Sell" && (buy > order.Price || buy == 0.0) && order.Size > 0 {
-			buy = order.Price
-			buySize = order.Size
-		} else if order.Side == "Buy" && sell < order.Price && order.Size > 0 {
-			sell = order.Price
-			sellSize = order.Size
-		}
+func toTrade(orderParsed map[string]*gabs.Container) common.Trade {
+	trade := common.Trade{Exchange: "bitmex"}
+	trade.ProductId, _ = orderParsed["symbol"].Data().(string)
+	trade.TradeId, _ = orderParsed["trdMatchID"].Data().(string)
+	if side, ok := orderParsed["side"].Data().(string); ok {
+		trade.Side = strings.ToLower(side)
+	}
+	trade.Price, _ = common.JSONToDecimal(orderParsed["price"].Data())
+	trade.Size, _ = common.JSONToDecimal(orderParsed["size"].Data())
+	if timestamp, ok := orderParsed["timestamp"].Data().(string); ok {
+		trade.Time, _ = time.Parse(time.RFC3339, timestamp)
 	}
-	prices["bitmex"][0] = buy
-	prices["bitmex"][1] = buySize
-	prices["bitmex"][2] = sell
-	prices["bitmex"][3] = sellSize
+	return trade
 }
 
-func updateOrderBook(jsonParsed *gabs.Container, orderBook map[string]*common.Order) {
+func createOrderBookL2(tickSize decimal.Decimal) *orderBookL2 {
+	return &orderBookL2{orders: map[string]*common.Order{}, book: common.CreateNewOrderBook(tickSize)}
+}
+
+func updateOrderBook(jsonParsed *gabs.Container, orderBook *orderBookL2) {
 	table, ok := jsonParsed.Search("table").Data().(string)
 	if !ok || table != "orderBookL2" {
 		return
@@ -74,25 +205,31 @@ func updateOrderBook(jsonParsed *gabs.Container, orderBook map[string]*common.Or
 	if action == "delete" {
 		for _, order := range row {
 			orderParsed, _ := order.ChildrenMap()
-			delete(orderBook, strconv.FormatFloat(orderParsed["id"].Data().(float64), 'f', common.PRECISION_DECIMAL, 64))
+			id := fmt.Sprint(orderParsed["id"].Data())
+			if existing, ok := orderBook.orders[id]; ok {
+				orderBook.book.Remove(existing.Side, existing.Price)
+				delete(orderBook.orders, id)
+			}
 		}
 
 	} else {
 		for _, order := range row {
 			orderParsed, _ := order.ChildrenMap()
-			id := strconv.FormatFloat(orderParsed["id"].Data().(float64), 'f', common.PRECISION_DECIMAL,  64)
-			if _, ok := orderBook[id]; !ok {
-				orderBook[id] = &common.Order{Id: id}
+			id := fmt.Sprint(orderParsed["id"].Data())
+			if _, ok := orderBook.orders[id]; !ok {
+				orderBook.orders[id] = &common.Order{Id: id}
 			}
+			existing := orderBook.orders[id]
 			if side, ok := orderParsed["side"].Data().(string); ok {
-				orderBook[id].Side = side
+				existing.Side = strings.ToLower(side)
 			}
-			if size, ok := orderParsed["size"].Data().(float64); ok {
-				orderBook[id].Size = size
+			if size, ok := common.JSONToDecimal(orderParsed["size"].Data()); ok {
+				existing.Size = size
 			}
-			if price, ok := orderParsed["price"].Data().(float64); ok {
-				orderBook[id].Price = price
+			if price, ok := common.JSONToDecimal(orderParsed["price"].Data()); ok {
+				existing.Price = price
 			}
+			orderBook.book.Update(existing.Side, existing.Price, existing.Size)
 		}
 	}
 }
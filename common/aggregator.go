@@ -0,0 +1,304 @@
+package common
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"sort"
+	"time"
+)
+
+var DEFAULT_TIMEFRAMES = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour, 24 * time.Hour}
+
+// CandleAggregator builds candles for several timeframes out of a single trade stream.
+// Only the smallest timeframe is built from trades, each higher timeframe is rolled
+// up from the candles of the one below, so they always agree with each other
+type CandleAggregator struct {
+	Timeframes []time.Duration
+	Charts     map[time.Duration]*CandleChart
+	// Whether the current candle of a timeframe is still open, or was completed
+	open      map[time.Duration]bool
+	callbacks map[time.Duration][]func(Candle)
+	// Called with completed candles a late trade changed
+	corrections map[time.Duration][]func(Candle)
+	// No callback is called while warming up
+	silent bool
+}
+
+// Public
+
+func CreateNewCandleAggregator(timeframes []time.Duration) (*CandleAggregator, error) {
+	if len(timeframes) == 0 {
+		return nil, fmt.Errorf("candle aggregator needs at least one timeframe")
+	}
+	sorted := make([]time.Duration, len(timeframes))
+	copy(sorted, timeframes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, timeframe := range sorted {
+		if timeframe <= 0 {
+			return nil, fmt.Errorf("invalid timeframe %s", timeframe)
+		}
+		if i > 0 && (timeframe == sorted[i-1] || timeframe%sorted[i-1] != 0) {
+			return nil, fmt.Errorf("timeframe %s is not a multiple of %s", timeframe, sorted[i-1])
+		}
+	}
+
+	aggregator := &CandleAggregator{
+		Timeframes:  sorted,
+		Charts:      make(map[time.Duration]*CandleChart, len(sorted)),
+		open:        make(map[time.Duration]bool, len(sorted)),
+		callbacks:   make(map[time.Duration][]func(Candle)),
+		corrections: make(map[time.Duration][]func(Candle)),
+	}
+	for _, timeframe := range sorted {
+		chart := CreateNewCandleChart()
+		chart.Timeframe = timeframe
+		// Periods without trades still get a candle, so every timeframe rolls up the same
+		chart.GapPolicy = GAP_FILL
+		aggregator.Charts[timeframe] = chart
+	}
+	return aggregator, nil
+}
+
+// SetIndicators replaces the indicators computed on the charts of every timeframe
+func (aggregator *CandleAggregator) SetIndicators(indicators []Indicator) {
+	for _, chart := range aggregator.Charts {
+		chart.Indicators = indicators
+	}
+}
+
+// SetGapPolicy replaces the gap policy of the charts of every timeframe, GAP_FILL by
+// default. Skipped gaps are not rolled up either
+func (aggregator *CandleAggregator) SetGapPolicy(policy GapPolicy) {
+	for _, chart := range aggregator.Charts {
+		chart.GapPolicy = policy
+	}
+}
+
+// OnCandleComplete registers a callback, called with every completed candle of the timeframe
+func (aggregator *CandleAggregator) OnCandleComplete(timeframe time.Duration, callback func(Candle)) {
+	aggregator.callbacks[timeframe] = append(aggregator.callbacks[timeframe], callback)
+}
+
+// OnCandleCorrected registers a callback, called with a completed candle of the
+// timeframe once more when a late trade changed it
+func (aggregator *CandleAggregator) OnCandleCorrected(timeframe time.Duration, callback func(Candle)) {
+	aggregator.corrections[timeframe] = append(aggregator.corrections[timeframe], callback)
+}
+
+// AddTrade updates the smallest timeframe. Trades are expected mostly in order, a trade
+// belonging to the previous candle is still attributed to it
+func (aggregator *CandleAggregator) AddTrade(price, size decimal.Decimal, t time.Time) {
+	base := aggregator.Timeframes[0]
+	chart := aggregator.Charts[base]
+	currentCandle := chart.CurrentCandle()
+
+	if !aggregator.open[base] || !t.Before(currentCandle.Time.Add(base)) {
+		if aggregator.open[base] {
+			aggregator.complete(0)
+		}
+		for _, filled := range chart.FillGap(t.Truncate(base)) {
+			aggregator.publish(0, filled)
+		}
+		chart.AddCandle(Candle{
+			Time:    t.Truncate(base),
+			Open:    price,
+			High:    price,
+			Low:     price,
+			Close:   price,
+			Average: price,
+			Volume:  size,
+		})
+		aggregator.open[base] = true
+		return
+	}
+
+	if t.Before(currentCandle.Time) && chart.totalCandle < 2 {
+		// Older than the first candle, there is nothing to attribute it to
+		return
+	} else if t.Before(currentCandle.Time) {
+		// Late trade for the previous candle, which was already completed and rolled up.
+		// Higher timeframes still open on that period are updated as well, the candles
+		// already completed are corrected and published again
+		chart.UpdatePreviousCandle(price, size)
+		aggregator.correct(base, *chart.GetPastRelativeCandle(-1))
+		for _, timeframe := range aggregator.Timeframes[1:] {
+			higher := aggregator.Charts[timeframe]
+			candle := higher.CurrentCandle()
+			if higher.totalCandle == 0 || t.Before(candle.Time) || !t.Before(candle.Time.Add(timeframe)) {
+				continue
+			}
+			higher.UpdateCurrentCandle(price, size)
+			if !aggregator.open[timeframe] {
+				higher.CompleteCurrentCandle()
+				aggregator.correct(timeframe, *candle)
+			}
+		}
+	} else {
+		chart.UpdateCurrentCandle(price, size)
+	}
+}
+
+// Warmup fills the charts with past candles of each timeframe, oldest first, so their
+// indicators are ready when live trades come. Candles of periods not over at now are
+// skipped, lower timeframe candles of the periods still open are rolled up into the
+// higher timeframes. Callbacks are not called, the candles were already seen
+func (aggregator *CandleAggregator) Warmup(candles map[time.Duration][]Candle, now time.Time) {
+	aggregator.silent = true
+	defer func() { aggregator.silent = false }()
+	// Higher timeframes first, so lower candles roll up after their completed periods
+	for i := len(aggregator.Timeframes) - 1; i >= 0; i-- {
+		timeframe := aggregator.Timeframes[i]
+		chart := aggregator.Charts[timeframe]
+		open := now.Truncate(timeframe)
+		higherOpen := open
+		if i+1 < len(aggregator.Timeframes) {
+			higherOpen = now.Truncate(aggregator.Timeframes[i+1])
+		}
+		for _, candle := range candles[timeframe] {
+			candle.Time = candle.Time.Truncate(timeframe)
+			if !candle.Time.Before(open) || (chart.totalCandle > 0 && !candle.Time.After(chart.CurrentCandle().Time)) {
+				continue
+			}
+			chart.AddCandle(candle)
+			chart.CompleteCurrentCandle()
+			if i+1 < len(aggregator.Timeframes) && !candle.Time.Before(higherOpen) {
+				aggregator.rollUp(i+1, *chart.CurrentCandle(), timeframe)
+			}
+		}
+	}
+}
+
+// NextPeriod returns the start of the first period of the timeframe not completed yet,
+// zero when there is no candle
+func (aggregator *CandleAggregator) NextPeriod(timeframe time.Duration) time.Time {
+	chart := aggregator.Charts[timeframe]
+	if chart.totalCandle == 0 {
+		return time.Time{}
+	} else if aggregator.open[timeframe] {
+		return chart.CurrentCandle().Time
+	}
+	return chart.CurrentCandle().Time.Add(timeframe)
+}
+
+// Completed returns the completed candles of the timeframe still on its chart from
+// since, oldest first
+func (aggregator *CandleAggregator) Completed(timeframe time.Duration, since time.Time) []Candle {
+	chart := aggregator.Charts[timeframe]
+	count := chart.totalCandle
+	if count > len(chart.Chart) {
+		count = len(chart.Chart)
+	}
+	last := 0
+	if aggregator.open[timeframe] {
+		last = -1
+	}
+	candles := []Candle{}
+	for i := 1 - count; i <= last; i++ {
+		if candle := chart.GetPastRelativeCandle(i); !candle.Time.Before(since) {
+			candles = append(candles, *candle)
+		}
+	}
+	return candles
+}
+
+// Flush completes every open candle, e.g. at the end of a stream
+func (aggregator *CandleAggregator) Flush() {
+	if aggregator.open[aggregator.Timeframes[0]] {
+		aggregator.complete(0)
+	}
+	for i := 1; i < len(aggregator.Timeframes); i++ {
+		if aggregator.open[aggregator.Timeframes[i]] {
+			aggregator.complete(i)
+		}
+	}
+}
+
+func TimeframeName(timeframe time.Duration) string {
+	switch {
+	case timeframe%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", timeframe/(24*time.Hour))
+	case timeframe%time.Hour == 0:
+		return fmt.Sprintf("%dh", timeframe/time.Hour)
+	case timeframe%time.Minute == 0:
+		return fmt.Sprintf("%dm", timeframe/time.Minute)
+	}
+	return timeframe.String()
+}
+
+// Private
+
+// complete finishes the current candle of the i-th timeframe, then publishes it
+func (aggregator *CandleAggregator) complete(i int) {
+	timeframe := aggregator.Timeframes[i]
+	chart := aggregator.Charts[timeframe]
+	chart.CompleteCurrentCandle()
+	aggregator.open[timeframe] = false
+	aggregator.publish(i, *chart.CurrentCandle())
+}
+
+// publish calls the callbacks with a completed candle of the i-th timeframe, traded or
+// filling a gap, then rolls it up into the next timeframe
+func (aggregator *CandleAggregator) publish(i int, candle Candle) {
+	timeframe := aggregator.Timeframes[i]
+	for _, callback := range aggregator.callbacks[timeframe] {
+		if aggregator.silent {
+			break
+		}
+		callback(candle)
+	}
+
+	if i+1 < len(aggregator.Timeframes) {
+		aggregator.rollUp(i+1, candle, timeframe)
+	}
+}
+
+// correct calls the correction callbacks with a completed candle changed by a late trade
+func (aggregator *CandleAggregator) correct(timeframe time.Duration, candle Candle) {
+	if aggregator.silent {
+		return
+	}
+	for _, callback := range aggregator.corrections[timeframe] {
+		callback(candle)
+	}
+}
+
+// rollUp merges a completed lower timeframe candle into the i-th timeframe
+func (aggregator *CandleAggregator) rollUp(i int, lower Candle, lowerTimeframe time.Duration) {
+	timeframe := aggregator.Timeframes[i]
+	chart := aggregator.Charts[timeframe]
+	bucket := lower.Time.Truncate(timeframe)
+
+	if aggregator.open[timeframe] && !chart.CurrentCandle().Time.Equal(bucket) {
+		aggregator.complete(i)
+	}
+	if !aggregator.open[timeframe] {
+		for _, filled := range chart.FillGap(bucket) {
+			aggregator.publish(i, filled)
+		}
+		chart.AddCandle(Candle{
+			Time:    bucket,
+			Open:    lower.Open,
+			High:    lower.High,
+			Low:     lower.Low,
+			Close:   lower.Close,
+			Average: lower.Close,
+			Volume:  lower.Volume,
+		})
+		aggregator.open[timeframe] = true
+	} else {
+		candle := chart.CurrentCandle()
+		if lower.High.Cmp(candle.High) > 0 {
+			candle.High = lower.High
+		}
+		if lower.Low.Cmp(candle.Low) < 0 {
+			candle.Low = lower.Low
+		}
+		candle.Close = lower.Close
+		candle.Volume = candle.Volume.Add(lower.Volume)
+	}
+
+	// No need to wait for the next candle when this one closes the period
+	if !lower.Time.Add(lowerTimeframe).Before(bucket.Add(timeframe)) {
+		aggregator.complete(i)
+	}
+}
@@ -0,0 +1,244 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+	"testing"
+	"time"
+)
+
+func TestCandleAggregatorRollUp(t *testing.T) {
+	// GIVEN
+	// One trade every 30 seconds for 10 minutes, price going up then down
+	aggregator, _ := CreateNewCandleAggregator([]time.Duration{5 * time.Minute, time.Minute})
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	completed := map[time.Duration][]Candle{}
+	for _, timeframe := range aggregator.Timeframes {
+		timeframe := timeframe
+		aggregator.OnCandleComplete(timeframe, func(candle Candle) {
+			completed[timeframe] = append(completed[timeframe], candle)
+		})
+	}
+
+	// WHEN
+	prices := []float64{10, 11, 12, 14, 13, 15, 16, 15, 14, 13, 12, 11, 9, 10, 11, 10, 9, 8, 8, 7}
+	for i, price := range prices {
+		aggregator.AddTrade(decimal.NewFromFloat(price), decimal.NewFromFloat(1), start.Add(time.Duration(i)*30*time.Second))
+	}
+	// Trade of the next period, which completes the last minute of the second 5m candle
+	aggregator.AddTrade(decimal.NewFromFloat(7), decimal.NewFromFloat(1), start.Add(10*time.Minute))
+
+	// THEN
+	if len(completed[time.Minute]) != 10 || len(completed[5*time.Minute]) != 2 {
+		t.Fatalf("Wrong number of candles %d 1m, %d 5m", len(completed[time.Minute]), len(completed[5*time.Minute]))
+	}
+	for i, candle := range completed[5*time.Minute] {
+		minutes := completed[time.Minute][i*5 : i*5+5]
+		high, low, volume := minutes[0].High, minutes[0].Low, decimal.Decimal{}
+		for _, minute := range minutes {
+			if minute.High.Cmp(high) > 0 {
+				high = minute.High
+			}
+			if minute.Low.Cmp(low) < 0 {
+				low = minute.Low
+			}
+			volume = volume.Add(minute.Volume)
+		}
+		if !candle.Time.Equal(start.Add(time.Duration(i) * 5 * time.Minute)) {
+			t.Errorf("Wrong 5m candle time %v", candle.Time)
+		}
+		if !candle.Open.Equal(minutes[0].Open) || !candle.Close.Equal(minutes[4].Close) ||
+			!candle.High.Equal(high) || !candle.Low.Equal(low) || !candle.Volume.Equal(volume) {
+			t.Errorf("5m candle not rolled up from 1m candles %v", candle.String())
+		}
+	}
+	if !completed[5*time.Minute][0].High.Equal(decimal.NewFromFloat(16)) || !completed[5*time.Minute][1].Low.Equal(decimal.NewFromFloat(7)) {
+		t.Errorf("Wrong 5m candles %v %v", completed[5*time.Minute][0].String(), completed[5*time.Minute][1].String())
+	}
+}
+
+func TestCandleAggregatorGapAndLateTrade(t *testing.T) {
+	// GIVEN
+	aggregator, _ := CreateNewCandleAggregator([]time.Duration{time.Minute, 5 * time.Minute})
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	completed := []Candle{}
+	aggregator.OnCandleComplete(5*time.Minute, func(candle Candle) {
+		completed = append(completed, candle)
+	})
+
+	// WHEN
+	aggregator.AddTrade(decimal.NewFromFloat(10), decimal.NewFromFloat(1), start)
+	aggregator.AddTrade(decimal.NewFromFloat(11), decimal.NewFromFloat(1), start.Add(90*time.Second))
+	// Late trade for the first minute
+	aggregator.AddTrade(decimal.NewFromFloat(20), decimal.NewFromFloat(2), start.Add(50*time.Second))
+	// No trades until the next 5 minutes period
+	aggregator.AddTrade(decimal.NewFromFloat(12), decimal.NewFromFloat(1), start.Add(7*time.Minute))
+	aggregator.AddTrade(decimal.NewFromFloat(12), decimal.NewFromFloat(1), start.Add(8*time.Minute))
+
+	// THEN
+	if len(completed) != 1 {
+		t.Fatalf("Should have completed one 5m candle, got %d", len(completed))
+	}
+	if !completed[0].High.Equal(decimal.NewFromFloat(20)) || !completed[0].Volume.Equal(decimal.NewFromFloat(4)) {
+		t.Errorf("Late trade not accounted in 5m candle %v", completed[0].String())
+	}
+	if !aggregator.Charts[5*time.Minute].CurrentCandle().Time.Equal(start.Add(5 * time.Minute)) {
+		t.Errorf("Wrong current 5m candle %v", aggregator.Charts[5*time.Minute].CurrentCandle().String())
+	}
+}
+
+func TestCandleAggregatorLateTradeCorrection(t *testing.T) {
+	// GIVEN
+	// The 10:04 candle closes the 10:00 5m candle, before a late trade of 10:04 comes
+	aggregator, _ := CreateNewCandleAggregator([]time.Duration{time.Minute, 5 * time.Minute})
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	completed := map[time.Duration][]Candle{}
+	corrected := map[time.Duration][]Candle{}
+	for _, timeframe := range aggregator.Timeframes {
+		timeframe := timeframe
+		aggregator.OnCandleComplete(timeframe, func(candle Candle) {
+			completed[timeframe] = append(completed[timeframe], candle)
+		})
+		aggregator.OnCandleCorrected(timeframe, func(candle Candle) {
+			corrected[timeframe] = append(corrected[timeframe], candle)
+		})
+	}
+	for i := 0; i <= 5; i++ {
+		aggregator.AddTrade(decimal.NewFromFloat(10), decimal.NewFromFloat(1), start.Add(time.Duration(i)*time.Minute))
+	}
+
+	// WHEN
+	aggregator.AddTrade(decimal.NewFromFloat(20), decimal.NewFromFloat(2), start.Add(4*time.Minute+50*time.Second))
+
+	// THEN
+	if len(completed[5*time.Minute]) != 1 || !completed[5*time.Minute][0].High.Equal(decimal.NewFromFloat(10)) {
+		t.Fatalf("5m candle should be completed before the late trade %v", completed[5*time.Minute])
+	}
+	if len(corrected[time.Minute]) != 1 || !corrected[time.Minute][0].Time.Equal(start.Add(4*time.Minute)) ||
+		!corrected[time.Minute][0].High.Equal(decimal.NewFromFloat(20)) {
+		t.Errorf("Corrected 1m candle should be published %v", corrected[time.Minute])
+	}
+	if len(corrected[5*time.Minute]) != 1 || !corrected[5*time.Minute][0].Volume.Equal(decimal.NewFromFloat(7)) ||
+		!corrected[5*time.Minute][0].Average.Equal(decimal.NewFromFloat(15)) {
+		t.Errorf("Corrected 5m candle should be published %v", corrected[5*time.Minute])
+	}
+}
+
+func TestCandleAggregatorGapCallbacks(t *testing.T) {
+	// GIVEN
+	aggregator, _ := CreateNewCandleAggregator([]time.Duration{time.Minute, 5 * time.Minute})
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	completed := map[time.Duration][]Candle{}
+	for _, timeframe := range aggregator.Timeframes {
+		timeframe := timeframe
+		aggregator.OnCandleComplete(timeframe, func(candle Candle) {
+			completed[timeframe] = append(completed[timeframe], candle)
+		})
+	}
+
+	// WHEN
+	// No trades from 10:02 to 10:13
+	aggregator.AddTrade(decimal.NewFromFloat(10), decimal.NewFromFloat(1), start)
+	aggregator.AddTrade(decimal.NewFromFloat(11), decimal.NewFromFloat(1), start.Add(90*time.Second))
+	aggregator.AddTrade(decimal.NewFromFloat(12), decimal.NewFromFloat(1), start.Add(14*time.Minute))
+
+	// THEN
+	// Every minute up to 10:13 is completed, and rolled up into 10:00 and 10:05
+	minutes := completed[time.Minute]
+	if len(minutes) != 14 {
+		t.Fatalf("Should have completed 14 1m candles, got %d", len(minutes))
+	}
+	for i, candle := range minutes {
+		if !candle.Time.Equal(start.Add(time.Duration(i) * time.Minute)) {
+			t.Errorf("Wrong candle time %v", candle.String())
+		}
+		if i > 1 && (!candle.Close.Equal(decimal.NewFromFloat(11)) || !candle.Volume.IsZero()) {
+			t.Errorf("Gap should be filled at the previous close %v", candle.String())
+		}
+	}
+	fives := completed[5*time.Minute]
+	if len(fives) != 2 || !fives[1].Time.Equal(start.Add(5*time.Minute)) || !fives[1].Close.Equal(decimal.NewFromFloat(11)) {
+		t.Errorf("Filled candles should be rolled up %v", fives)
+	}
+}
+
+func TestCandleAggregatorInvalidTimeframes(t *testing.T) {
+	// GIVEN
+	// WHEN
+	_, errEmpty := CreateNewCandleAggregator([]time.Duration{})
+	_, errMultiple := CreateNewCandleAggregator([]time.Duration{time.Minute, 90 * time.Second})
+	aggregator, err := CreateNewCandleAggregator(DEFAULT_TIMEFRAMES)
+
+	// THEN
+	if errEmpty == nil || errMultiple == nil {
+		t.Errorf("Should fail on invalid timeframes")
+	}
+	if err != nil || len(aggregator.Charts) != 5 {
+		t.Errorf("Default timeframes should be valid %v", err)
+	}
+	if TimeframeName(15*time.Minute) != "15m" || TimeframeName(time.Hour) != "1h" || TimeframeName(24*time.Hour) != "1d" {
+		t.Errorf("Wrong timeframe names")
+	}
+}
+
+func TestCandleAggregatorWarmup(t *testing.T) {
+	// GIVEN
+	// Past candles up to the open periods at 10:13:30, rising by one every minute
+	aggregator, _ := CreateNewCandleAggregator([]time.Duration{time.Minute, 5 * time.Minute})
+	aggregator.SetIndicators(DefaultIndicators())
+	start := time.Date(2018, 1, 1, 9, 0, 0, 0, time.UTC)
+	now := start.Add(73*time.Minute + 30*time.Second)
+	candles := map[time.Duration][]Candle{}
+	for minute := 0; minute <= 73; minute += 1 {
+		price := decimal.New(int64(100+minute), 0)
+		candles[time.Minute] = append(candles[time.Minute], Candle{Time: start.Add(time.Duration(minute) * time.Minute),
+			Open: price, High: price, Low: price, Close: price, Volume: decimal.New(1, 0)})
+		if minute%5 == 0 {
+			// Already has the trades of the whole period when it is over
+			high := decimal.New(int64(104+minute), 0)
+			candles[5*time.Minute] = append(candles[5*time.Minute], Candle{Time: start.Add(time.Duration(minute) * time.Minute),
+				Open: price, High: high, Low: price, Close: high, Volume: decimal.New(5, 0)})
+		}
+	}
+	completed := map[time.Duration][]Candle{}
+	for _, timeframe := range aggregator.Timeframes {
+		timeframe := timeframe
+		aggregator.OnCandleComplete(timeframe, func(candle Candle) {
+			completed[timeframe] = append(completed[timeframe], candle)
+		})
+	}
+
+	// WHEN
+	aggregator.Warmup(candles, now)
+	minute := *aggregator.Charts[time.Minute].CurrentCandle()
+	open := *aggregator.Charts[5*time.Minute].CurrentCandle()
+	// Live trades finishing the 10:13 and 10:14 candles, and the 10:10 period
+	aggregator.AddTrade(decimal.New(200, 0), decimal.New(1, 0), now.Add(10*time.Second))
+	aggregator.AddTrade(decimal.New(201, 0), decimal.New(1, 0), now.Add(40*time.Second))
+	aggregator.AddTrade(decimal.New(202, 0), decimal.New(1, 0), now.Add(90*time.Second))
+
+	// THEN
+	if !minute.Time.Equal(start.Add(72*time.Minute)) || minute.Indicators["macd"] == 0 {
+		t.Errorf("Last completed minute should have its indicators %v", minute.String())
+	}
+	if !open.Time.Equal(start.Add(70*time.Minute)) || !open.High.Equal(decimal.New(172, 0)) || !open.Volume.Equal(decimal.New(3, 0)) {
+		t.Errorf("Open period should have the minutes already over %v", open.String())
+	}
+	if len(completed[time.Minute]) != 2 || len(completed[5*time.Minute]) != 1 {
+		t.Fatalf("Only live candles should be completed, got %d 1m and %d 5m", len(completed[time.Minute]), len(completed[5*time.Minute]))
+	}
+	period := completed[5*time.Minute][0]
+	if !period.Time.Equal(start.Add(70*time.Minute)) || !period.Open.Equal(decimal.New(170, 0)) || !period.High.Equal(decimal.New(201, 0)) || !period.Volume.Equal(decimal.New(5, 0)) {
+		t.Errorf("Live minutes should complete the warmed up period %v", period.String())
+	}
+	if !aggregator.Charts[5*time.Minute].GetPastRelativeCandle(-1).Time.Equal(start.Add(65 * time.Minute)) {
+		t.Errorf("Previous period should be the last past 5m candle")
+	}
+	// 10:15 is still open, 10:10 was completed by the live minutes
+	next, past := aggregator.NextPeriod(time.Minute), aggregator.Completed(time.Minute, start.Add(72*time.Minute))
+	if !next.Equal(start.Add(75*time.Minute)) || len(past) != 3 || !past[0].Time.Equal(start.Add(72*time.Minute)) || !past[2].Time.Equal(start.Add(74*time.Minute)) {
+		t.Errorf("Wrong next period %v or completed minutes %v", next, past)
+	}
+	if periods := aggregator.Completed(5*time.Minute, start.Add(65*time.Minute)); len(periods) != 2 || !periods[1].Time.Equal(start.Add(70*time.Minute)) {
+		t.Errorf("Wrong completed periods %v", periods)
+	}
+}
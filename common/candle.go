@@ -3,12 +3,26 @@ package common
 import (
 	"fmt"
 	"github.com/shopspring/decimal"
+	"math"
 	"time"
 )
 
 var NUM_CANDLE = 60
 var NUM_INDICATOR = 10
 
+// What to do with periods without any trade
+type GapPolicy int
+
+const (
+	// Keep the gap, past relative candles then cover a longer period. The default, as
+	// charts always did
+	GAP_SKIP GapPolicy = iota
+	// Add flat candles at the previous close, with no volume
+	GAP_FILL
+	// Same as GAP_FILL, but the candles are flagged as Missing
+	GAP_MARK_MISSING
+)
+
 type Candle struct {
 	Time       time.Time
 	Open       decimal.Decimal
@@ -18,10 +32,20 @@ type Candle struct {
 	Average    decimal.Decimal
 	Volume     decimal.Decimal
 	Indicators map[string]float64
+	// Running values of the indicators (e.g. EMAs), so the next candle can be computed
+	// from this one instead of going through the whole history
+	State map[string]decimal.Decimal
+	// Set on candles added by GAP_MARK_MISSING
+	Missing bool
 }
 
 type CandleChart struct {
-	Chart       []Candle
+	Chart []Candle
+	// Duration of a candle, used to detect gaps between candles
+	Timeframe time.Duration
+	GapPolicy GapPolicy
+	// Computed, in order, on each completed candle
+	Indicators  []Indicator
 	currElem    int
 	totalCandle int
 }
@@ -29,15 +53,29 @@ type CandleChart struct {
 // Public
 
 func (candle *Candle) String() string {
-	return fmt.Sprintf("Candle{Time: %v, Open: %s, High: %s, Low: %s, Close: %s, Average: %s, Volume: %s, Indicators: %v}",
-		candle.Time, candle.Open, candle.High, candle.Low, candle.Close, candle.Average, candle.Volume, candle.Indicators)
+	return fmt.Sprintf("Candle{Time: %v, Open: %s, High: %s, Low: %s, Close: %s, Average: %s, Volume: %s, Indicators: %v, Missing: %t}",
+		candle.Time, candle.Open, candle.High, candle.Low, candle.Close, candle.Average, candle.Volume, candle.Indicators, candle.Missing)
 }
 
 func (chart *CandleChart) AddCandle(candle Candle) {
-	// TODO improve, this should not happen often, but check if we're missing candles
-	// (case of no trades for some time)
+	// This should not happen often, but check if we're missing candles (case of no
+	// trades for some time), so past relative candles keep matching past periods
+	chart.FillGap(candle.Time)
+	chart.addCandle(candle)
+}
+
+// FillGap adds the candles missing before t according to the gap policy, and returns
+// them completed, so they can go through the same path as the traded ones
+func (chart *CandleChart) FillGap(t time.Time) []Candle {
+	if chart.GapPolicy == GAP_SKIP {
+		return nil
+	}
+	return chart.fillGap(t)
+}
+
+func (chart *CandleChart) addCandle(candle Candle) {
 	chart.currElem += 1
-	if chart.currElem == NUM_CANDLE {
+	if chart.currElem == len(chart.Chart) {
 		chart.currElem = 0
 	}
 	chart.Chart[chart.currElem] = candle
@@ -68,28 +106,38 @@ func (chart *CandleChart) UpdateCurrentCandle(price, size decimal.Decimal) {
 	chart.updateCandle(price, size, chart.currElem)
 }
 
+// UpdatePreviousCandle adds a late trade to the previous candle. It was completed, so
+// it is completed again, the current candle then builds on its new indicator state
 func (chart *CandleChart) UpdatePreviousCandle(price, size decimal.Decimal) {
 	chart.updateCandle(price, size, chart.getPreviousElemId())
+	current := chart.currElem
+	chart.currElem, chart.totalCandle = chart.getPreviousElemId(), chart.totalCandle-1
+	chart.CompleteCurrentCandle()
+	chart.currElem, chart.totalCandle = current, chart.totalCandle+1
 }
 
-// These calculations could be optimized by saving current value into the candle itself
-// e.g. EMA. Currently we're recalculating past values, although assuming this isn't
-// a big performance hit as they only get called once a candle is complete
+// Indicators save their running values into the candle state, so each completed candle
+// only costs an update from the previous candle, instead of recalculating past values
 func (chart *CandleChart) CompleteCurrentCandle() {
-	mfiConfig := 14
-	emaShortConfig, emaLongConfig, macdEmaSignalConfig := 10, 26, 9
-
 	// Calculate average price, and create indicator array
 	candle := chart.CurrentCandle()
 	candle.Average = (candle.High.Add(candle.Low).Add(candle.Open).Add(candle.Close)).Div(decimal.NewFromFloat(4.0))
 	candle.Indicators = make(map[string]float64, NUM_INDICATOR)
+	candle.State = make(map[string]decimal.Decimal, NUM_INDICATOR)
 
-	// Calculate MFI
-	candle.Indicators["mfi"] = chart.CalculateMfi(mfiConfig)
+	for _, indicator := range chart.Indicators {
+		// Keep enough candles for the indicator to look back
+		if indicator.Lookback() >= len(chart.Chart) {
+			chart.grow(indicator.Lookback() + 1)
+		}
+		for name, value := range indicator.Compute(chart) {
+			candle.Indicators[name] = value
+		}
+	}
+}
 
-	// Calculate MACD. We need at least double the longest period for this.
-	macd, macdh := chart.CalculateMacd(emaShortConfig, emaLongConfig, macdEmaSignalConfig)
-	candle.Indicators["macd"], candle.Indicators["macdh"] = macd, macdh
+func (chart *CandleChart) AddIndicator(indicator Indicator) {
+	chart.Indicators = append(chart.Indicators, indicator)
 }
 
 func (chart *CandleChart) CalculateMfi(days int) float64 {
@@ -125,54 +173,66 @@ func (chart *CandleChart) CalculateMfi(days int) float64 {
 }
 
 func (chart *CandleChart) CalculateMacd(emaShortConfig, emaLongConfig, macdEmaSignalConfig int) (float64, float64) {
-	// We can only calculate MACD if we have enough candles
-	if chart.totalCandle < emaLongConfig*2 || chart.totalCandle < macdEmaSignalConfig*2 {
+	state, ok := chart.calculateMacdState(emaShortConfig, emaLongConfig, macdEmaSignalConfig)
+	if !ok {
 		return 0.0, 0.0
 	}
-	// Calculate starter SMA
-	smaList := make([]decimal.Decimal, emaLongConfig)
-	emaList := make([]decimal.Decimal, emaLongConfig)
-	smaNum, emaNum := 0, 0
-	for i := -(emaLongConfig * 2) + 1; i <= 0; i++ {
-		c := chart.GetPastRelativeCandle(i)
-		// Use the first few for SMA
-		if smaNum < emaLongConfig {
-			smaList[smaNum] = c.Close
-			smaNum += 1
-			// Then for EMA
-		} else {
-			emaList[emaNum] = c.Close
-			emaNum += 1
-		}
-	}
-	// For short SMA, we only need a slice of the data
-	smaShort := calculateSma(smaList[len(smaList)-emaShortConfig:])
-	smaLong := calculateSma(smaList)
+	macdhRes, _ := state.macd.Sub(state.signal).Float64()
+	macdRes, _ := state.macd.Float64()
 
-	// Calculate EMA from SMA starting point
-	emaLong := CalculateEma(emaList, emaLongConfig, smaLong)
-	emaShort := CalculateEma(emaList, emaShortConfig, smaShort)
+	return macdRes, macdhRes
+}
 
-	// Calculate MACD line
-	macd := make([]decimal.Decimal, emaLongConfig)
-	for i := 0; i < emaLongConfig; i++ {
-		macd[i] = emaShort[i].Sub(emaLong[i])
+// CalculateAtr returns the average true range of the last candles, the true range
+// being the high minus the low, extended to the previous close when it gapped
+func (chart *CandleChart) CalculateAtr(period int) float64 {
+	if period <= 0 || chart.totalCandle <= period || period >= len(chart.Chart) {
+		return 0.0
 	}
+	var total decimal.Decimal
+	for i := -period + 1; i <= 0; i++ {
+		c, previous := chart.GetPastRelativeCandle(i), chart.GetPastRelativeCandle(i-1)
+		high, low := c.High, c.Low
+		if previous.Close.Cmp(high) > 0 {
+			high = previous.Close
+		}
+		if previous.Close.Cmp(low) < 0 {
+			low = previous.Close
+		}
+		total = total.Add(high.Sub(low))
+	}
+	res, _ := total.Div(decimal.NewFromFloat(float64(period))).Float64()
+	return res
+}
 
-	// Calculate Signal line
-	macdSignalSma := calculateSma(macd[:macdEmaSignalConfig])
-	macdSignalList := CalculateEma(macd[macdEmaSignalConfig:], macdEmaSignalConfig, macdSignalSma)
-
-	macdValue := macd[len(macd)-1]
-	macdSignalRes := macdSignalList[len(macdSignalList)-1]
-	macdhRes, _ := macdValue.Sub(macdSignalRes).Float64()
-	macdRes, _ := macdValue.Float64()
-
-	return macdRes, macdhRes
+// CalculateStdDev returns the standard deviation of the close to close changes of the
+// last candles, in price like the ATR
+func (chart *CandleChart) CalculateStdDev(period int) float64 {
+	if period <= 0 || chart.totalCandle <= period || period >= len(chart.Chart) {
+		return 0.0
+	}
+	changes := make([]float64, period)
+	mean := 0.0
+	for i := -period + 1; i <= 0; i++ {
+		changes[i+period-1], _ = chart.GetPastRelativeCandle(i).Close.Sub(chart.GetPastRelativeCandle(i - 1).Close).Float64()
+		mean += changes[i+period-1]
+	}
+	mean /= float64(period)
+	variance := 0.0
+	for _, change := range changes {
+		variance += (change - mean) * (change - mean)
+	}
+	return math.Sqrt(variance / float64(period))
 }
 
 func CreateNewCandleChart() *CandleChart {
-	return &CandleChart{currElem: 0, Chart: make([]Candle, NUM_CANDLE)}
+	return &CandleChart{
+		currElem:   0,
+		Chart:      make([]Candle, NUM_CANDLE),
+		Timeframe:  time.Minute,
+		GapPolicy:  GAP_SKIP,
+		Indicators: DefaultIndicators(),
+	}
 }
 
 func CalculateEma(numbers []decimal.Decimal, period int, startEma decimal.Decimal) []decimal.Decimal {
@@ -202,14 +262,106 @@ func (chart *CandleChart) updateCandle(price, size decimal.Decimal, i int) {
 	candle.Volume = candle.Volume.Add(size)
 }
 
+// fillGap adds flat candles at the previous close for each period missing before t.
+// Every one is returned, even on gaps longer than the chart, so candle files have no hole
+func (chart *CandleChart) fillGap(t time.Time) []Candle {
+	previous := chart.CurrentCandle()
+	if chart.totalCandle == 0 || chart.Timeframe <= 0 || previous.Time.IsZero() || t.IsZero() {
+		return nil
+	}
+	missing := int(t.Sub(previous.Time)/chart.Timeframe) - 1
+	filled := []Candle{}
+	for i := missing; i > 0; i-- {
+		price := chart.CurrentCandle().Close
+		chart.addCandle(Candle{
+			Time:    t.Add(-time.Duration(i) * chart.Timeframe),
+			Open:    price,
+			High:    price,
+			Low:     price,
+			Close:   price,
+			Average: price,
+			Missing: chart.GapPolicy == GAP_MARK_MISSING,
+		})
+		chart.CompleteCurrentCandle()
+		filled = append(filled, *chart.CurrentCandle())
+	}
+	return filled
+}
+
+// grow resizes the chart, keeping its candles from oldest to current
+func (chart *CandleChart) grow(size int) {
+	candles := make([]Candle, size)
+	l := len(chart.Chart)
+	for i := 0; i < l; i++ {
+		candles[i] = chart.Chart[(chart.currElem+1+i)%l]
+	}
+	chart.Chart = candles
+	chart.currElem = l - 1
+}
+
 func (chart *CandleChart) getPreviousElemId() int {
 	i := chart.currElem - 1
 	if i == -1 {
-		i = len(chart.Chart)
+		i = len(chart.Chart) - 1
 	}
 	return i
 }
 
+// Last values of the MACD computation, which incremental updates start from
+type macdState struct {
+	emaShort decimal.Decimal
+	emaLong  decimal.Decimal
+	macd     decimal.Decimal
+	signal   decimal.Decimal
+}
+
+func (chart *CandleChart) calculateMacdState(emaShortConfig, emaLongConfig, macdEmaSignalConfig int) (macdState, bool) {
+	// We can only calculate MACD if we have enough candles
+	if chart.totalCandle < emaLongConfig*2 || chart.totalCandle < macdEmaSignalConfig*2 {
+		return macdState{}, false
+	}
+	// Calculate starter SMA
+	smaList := make([]decimal.Decimal, emaLongConfig)
+	emaList := make([]decimal.Decimal, emaLongConfig)
+	smaNum, emaNum := 0, 0
+	for i := -(emaLongConfig * 2) + 1; i <= 0; i++ {
+		c := chart.GetPastRelativeCandle(i)
+		// Use the first few for SMA
+		if smaNum < emaLongConfig {
+			smaList[smaNum] = c.Close
+			smaNum += 1
+			// Then for EMA
+		} else {
+			emaList[emaNum] = c.Close
+			emaNum += 1
+		}
+	}
+	// For short SMA, we only need a slice of the data
+	smaShort := calculateSma(smaList[len(smaList)-emaShortConfig:])
+	smaLong := calculateSma(smaList)
+
+	// Calculate EMA from SMA starting point
+	emaLong := CalculateEma(emaList, emaLongConfig, smaLong)
+	emaShort := CalculateEma(emaList, emaShortConfig, smaShort)
+
+	// Calculate MACD line
+	macd := make([]decimal.Decimal, emaLongConfig)
+	for i := 0; i < emaLongConfig; i++ {
+		macd[i] = emaShort[i].Sub(emaLong[i])
+	}
+
+	// Calculate Signal line
+	macdSignalSma := calculateSma(macd[:macdEmaSignalConfig])
+	macdSignalList := CalculateEma(macd[macdEmaSignalConfig:], macdEmaSignalConfig, macdSignalSma)
+
+	return macdState{
+		emaShort: emaShort[len(emaShort)-1],
+		emaLong:  emaLong[len(emaLong)-1],
+		macd:     macd[len(macd)-1],
+		signal:   macdSignalList[len(macdSignalList)-1],
+	}, true
+}
+
 func calculateSingleEma(price decimal.Decimal, numDays int, previousEma decimal.Decimal) decimal.Decimal {
 	k := decimal.NewFromFloat(2 / (float64(numDays) + 1))
 	one := decimal.NewFromFloat(1.0)
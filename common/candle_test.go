@@ -4,6 +4,7 @@ import (
 	"github.com/shopspring/decimal"
 	"math"
 	"testing"
+	"time"
 )
 
 func generateCandleChart() *CandleChart {
@@ -94,6 +95,24 @@ func TestGetPastRelativeCandle(t *testing.T) {
 	}
 }
 
+func TestUpdatePreviousCandleWrapped(t *testing.T) {
+	// GIVEN
+	// Current candle back at the start of the chart, the previous one at its end
+	candleChart := CreateNewCandleChart()
+	for i := 0; i < len(candleChart.Chart); i++ {
+		candleChart.AddCandle(generateCandle(10, 1))
+	}
+
+	// WHEN
+	candleChart.UpdatePreviousCandle(decimal.NewFromFloat(12), decimal.NewFromFloat(2))
+
+	// THEN
+	previous := candleChart.GetPastRelativeCandle(-1)
+	if !previous.High.Equal(decimal.NewFromFloat(12)) || !previous.Volume.Equal(decimal.NewFromFloat(3)) {
+		t.Errorf("Previous candle not updated %v", previous.String())
+	}
+}
+
 func TestCalculateMfi(t *testing.T) {
 	// GIVEN
 	candleChart := generateCandleChart()
@@ -251,3 +270,128 @@ func TestCalculateMacdAgain(t *testing.T) {
 		t.Errorf("Candle Macdh not correct %f", macdh)
 	}
 }
+
+func generateTimedCandle(t time.Time, price, volume float64) Candle {
+	candle := generateCandle(price, volume)
+	candle.Time = t
+	return candle
+}
+
+func TestAddCandleGapFill(t *testing.T) {
+	// GIVEN
+	// Candles at 10:00, 10:01, then nothing until 10:05
+	candleChart := CreateNewCandleChart()
+	candleChart.GapPolicy = GAP_FILL
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	candleChart.AddCandle(generateTimedCandle(start, 10, 5))
+	candleChart.AddCandle(generateTimedCandle(start.Add(time.Minute), 12, 5))
+
+	// WHEN
+	candleChart.AddCandle(generateTimedCandle(start.Add(5*time.Minute), 15, 5))
+
+	// THEN
+	for i := -3; i <= -1; i++ {
+		candle := candleChart.GetPastRelativeCandle(i)
+		if !candle.Time.Equal(start.Add(time.Duration(5+i) * time.Minute)) {
+			t.Errorf("Filled candle %d has wrong time %v", i, candle.Time)
+		}
+		if !candle.Close.Equal(decimal.NewFromFloat(12)) || !candle.High.Equal(decimal.NewFromFloat(12)) || !candle.Volume.Equal(decimal.Zero) {
+			t.Errorf("Filled candle %d should be flat at previous close %v", i, candle.String())
+		}
+		if candle.Missing {
+			t.Errorf("Filled candle %d should not be marked as missing", i)
+		}
+	}
+	if !candleChart.GetPastRelativeCandle(-4).Close.Equal(decimal.NewFromFloat(12)) || candleChart.GetPastRelativeCandle(-4).Time != start.Add(time.Minute) {
+		t.Errorf("Candle before the gap not found %v", candleChart.GetPastRelativeCandle(-4).String())
+	}
+	if candleChart.totalCandle != 6 {
+		t.Errorf("Chart should have %d candles, has %d", 6, candleChart.totalCandle)
+	}
+}
+
+func TestAddCandleGapSkipAndMark(t *testing.T) {
+	// GIVEN
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	skipChart := CreateNewCandleChart()
+	markChart := CreateNewCandleChart()
+	markChart.GapPolicy = GAP_MARK_MISSING
+	// Hourly chart, where a 5 minutes difference is no gap
+	hourChart := CreateNewCandleChart()
+	hourChart.Timeframe = time.Hour
+	hourChart.GapPolicy = GAP_FILL
+
+	// WHEN
+	for _, chart := range []*CandleChart{skipChart, markChart, hourChart} {
+		chart.AddCandle(generateTimedCandle(start, 10, 5))
+		chart.AddCandle(generateTimedCandle(start.Add(3*time.Minute), 11, 5))
+	}
+
+	// THEN
+	if skipChart.totalCandle != 2 || hourChart.totalCandle != 2 {
+		t.Errorf("Gap should have been skipped, got %d and %d candles", skipChart.totalCandle, hourChart.totalCandle)
+	}
+	if markChart.totalCandle != 4 {
+		t.Errorf("Chart should have %d candles, has %d", 4, markChart.totalCandle)
+	}
+	if !markChart.GetPastRelativeCandle(-1).Missing || !markChart.GetPastRelativeCandle(-2).Missing || markChart.CurrentCandle().Missing {
+		t.Errorf("Only filled candles should be marked as missing")
+	}
+}
+
+func TestAddCandleLongGap(t *testing.T) {
+	// GIVEN
+	candleChart := CreateNewCandleChart()
+	candleChart.GapPolicy = GAP_FILL
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	candleChart.AddCandle(generateTimedCandle(start, 10, 5))
+
+	// WHEN
+	// A whole day without trades, much longer than the chart
+	filled := candleChart.FillGap(start.Add(24 * time.Hour))
+	candleChart.AddCandle(generateTimedCandle(start.Add(24*time.Hour), 11, 5))
+
+	// THEN
+	if len(filled) != 24*60-1 || candleChart.totalCandle != 24*60+1 {
+		t.Errorf("Every missing minute should be filled, got %d candles", len(filled))
+	} else if !filled[0].Time.Equal(start.Add(time.Minute)) || !filled[len(filled)-1].Time.Equal(start.Add(24*time.Hour-time.Minute)) {
+		t.Errorf("Wrong filled candles from %v to %v", filled[0].String(), filled[len(filled)-1].String())
+	}
+	if !candleChart.GetPastRelativeCandle(-1).Time.Equal(start.Add(24*time.Hour - time.Minute)) {
+		t.Errorf("Wrong last filled candle %v", candleChart.GetPastRelativeCandle(-1).String())
+	}
+}
+
+func TestCalculateAtr(t *testing.T) {
+	// GIVEN
+	candleChart := generateCandleChart()
+
+	// WHEN
+	res := candleChart.CalculateAtr(3)
+	resTooLong := candleChart.CalculateAtr(4)
+
+	// THEN
+	if math.Abs(res-0.76) > 0.000001 {
+		t.Errorf("Candle ATR not correct %f", res)
+	}
+	if resTooLong != 0.0 {
+		t.Errorf("ATR should be 0 without enough candles %f", resTooLong)
+	}
+}
+
+func TestCalculateStdDev(t *testing.T) {
+	// GIVEN
+	candleChart := generateCandleChart()
+
+	// WHEN
+	res := candleChart.CalculateStdDev(3)
+	resTooLong := candleChart.CalculateStdDev(4)
+
+	// THEN
+	if math.Abs(res-0.251042) > 0.000001 {
+		t.Errorf("Candle standard deviation not correct %f", res)
+	}
+	if resTooLong != 0.0 {
+		t.Errorf("Standard deviation should be 0 without enough candles %f", resTooLong)
+	}
+}
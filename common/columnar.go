@@ -0,0 +1,399 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+const CANDLE_BINARY_VERSION = 1
+
+// Encodings of a price or volume column
+const (
+	// Exponent shared by the column, then an int64 coefficient per candle
+	COLUMN_SCALED = 0
+	// A length and a decimal string per candle, when a coefficient doesn't fit an int64
+	COLUMN_STRING = 1
+)
+
+var CANDLE_BINARY_MAGIC = []byte("GCDL")
+
+// Candles of a file buffered before writing them as a block, an hour of one minute
+// candles
+var CANDLE_BINARY_BLOCK_SIZE = 60
+
+// Longest time candles stay buffered, higher timeframes would otherwise wait days for
+// a full block
+var CANDLE_BINARY_MAX_AGE = time.Hour
+
+// BinaryCandleStore writes a magic and version header, then blocks of candles. A block
+// has its number of candles and indicator names, then each column one after the other:
+// unix times, open, high, low, close, average, volume, missing flags and one column per
+// indicator. Prices and volumes are decimals scaled to the exponent of the column, so
+// they are read back exactly
+type BinaryCandleStore struct {
+	// Candles appended to a file are buffered until there are this many, then written
+	// as one block. 0 writes a block per Append
+	BlockSize int
+	// Candles buffered this long are written on the next Append or FlushAged, even if
+	// the block isn't full. No limit when 0
+	MaxAge time.Duration
+
+	mutex   sync.Mutex
+	pending map[string][]Candle
+	// When the first pending candle of each file was buffered
+	since map[string]time.Time
+}
+
+// Public
+
+func CreateNewBinaryCandleStore() *BinaryCandleStore {
+	return &BinaryCandleStore{BlockSize: CANDLE_BINARY_BLOCK_SIZE, MaxAge: CANDLE_BINARY_MAX_AGE}
+}
+
+func (store *BinaryCandleStore) Extension() string {
+	return ".candles"
+}
+
+// Append buffers the candles, and writes them with the ones already buffered once
+// there are enough for a block, or the oldest is too old
+func (store *BinaryCandleStore) Append(path string, candles []Candle) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.pending == nil {
+		store.pending, store.since = map[string][]Candle{}, map[string]time.Time{}
+	}
+	if _, ok := store.pending[path]; !ok {
+		store.since[path] = time.Now()
+	}
+	pending := append(store.pending[path], candles...)
+	if len(pending) < store.BlockSize && !store.aged(path) {
+		store.pending[path] = pending
+		return nil
+	}
+	delete(store.pending, path)
+	delete(store.since, path)
+	return writeBlock(path, pending)
+}
+
+// Flush writes the candles still buffered, as a block per file
+func (store *BinaryCandleStore) Flush() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.flush(func(path string) bool { return true })
+}
+
+// FlushAged writes the candles of the files buffered for longer than MaxAge, as a
+// block per file
+func (store *BinaryCandleStore) FlushAged() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.flush(store.aged)
+}
+
+// Read returns the candles of the file, then the ones still buffered for it
+func (store *BinaryCandleStore) Read(path string) ([]Candle, error) {
+	store.mutex.Lock()
+	pending := append([]Candle{}, store.pending[path]...)
+	store.mutex.Unlock()
+	candles, err := readBlocks(path)
+	// Nothing written yet
+	if os.IsNotExist(err) && len(pending) > 0 {
+		return pending, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return append(candles, pending...), nil
+}
+
+// Private
+
+// Writes the buffered candles of the files picked, must hold the mutex
+func (store *BinaryCandleStore) flush(pick func(path string) bool) error {
+	var first error
+	for path, candles := range store.pending {
+		if !pick(path) {
+			continue
+		}
+		if err := writeBlock(path, candles); err != nil && first == nil {
+			first = err
+		}
+		delete(store.pending, path)
+		delete(store.since, path)
+	}
+	return first
+}
+
+func (store *BinaryCandleStore) aged(path string) bool {
+	since, ok := store.since[path]
+	return ok && store.MaxAge > 0 && time.Since(since) >= store.MaxAge
+}
+
+func writeBlock(path string, candles []Candle) error {
+	if len(candles) == 0 {
+		return nil
+	}
+	appendMutex.Lock()
+	defer appendMutex.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	if info, err := file.Stat(); err != nil {
+		return err
+	} else if info.Size() == 0 {
+		writer.Write(CANDLE_BINARY_MAGIC)
+		binary.Write(writer, binary.BigEndian, uint16(CANDLE_BINARY_VERSION))
+	}
+
+	names := indicatorNames(candles)
+	binary.Write(writer, binary.BigEndian, uint32(len(candles)))
+	binary.Write(writer, binary.BigEndian, uint16(len(names)))
+	for _, name := range names {
+		binary.Write(writer, binary.BigEndian, uint16(len(name)))
+		writer.WriteString(name)
+	}
+	for _, candle := range candles {
+		binary.Write(writer, binary.BigEndian, candle.Time.Unix())
+	}
+	for _, value := range []func(Candle) decimal.Decimal{
+		func(candle Candle) decimal.Decimal { return candle.Open },
+		func(candle Candle) decimal.Decimal { return candle.High },
+		func(candle Candle) decimal.Decimal { return candle.Low },
+		func(candle Candle) decimal.Decimal { return candle.Close },
+		func(candle Candle) decimal.Decimal { return candle.Average },
+		func(candle Candle) decimal.Decimal { return candle.Volume },
+	} {
+		column := make([]decimal.Decimal, len(candles))
+		for i, candle := range candles {
+			column[i] = value(candle)
+		}
+		writeDecimalColumn(writer, column)
+	}
+	for _, candle := range candles {
+		missing := uint8(0)
+		if candle.Missing {
+			missing = 1
+		}
+		writer.WriteByte(missing)
+	}
+	for _, name := range names {
+		for _, candle := range candles {
+			// Candles without the indicator get NaN, and are read back without it
+			value, ok := candle.Indicators[name]
+			if !ok {
+				value = math.NaN()
+			}
+			binary.Write(writer, binary.BigEndian, value)
+		}
+	}
+	return writer.Flush()
+}
+
+func readBlocks(path string) ([]Candle, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	header := make([]byte, len(CANDLE_BINARY_MAGIC))
+	if _, err := io.ReadFull(reader, header); err != nil || string(header) != string(CANDLE_BINARY_MAGIC) {
+		return nil, fmt.Errorf("%s: not a candle file", path)
+	}
+	var version uint16
+	if err := binary.Read(reader, binary.BigEndian, &version); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if version > CANDLE_BINARY_VERSION {
+		return nil, fmt.Errorf("%s: version %d is newer than %d", path, version, CANDLE_BINARY_VERSION)
+	}
+	candles := []Candle{}
+	for block := 1; ; block++ {
+		blockCandles, err := readBlock(reader)
+		if err == io.EOF {
+			return candles, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s block %d: %v", path, block, err)
+		}
+		candles = append(candles, blockCandles...)
+	}
+}
+
+// Returns io.EOF when there is no block left
+func readBlock(reader *bufio.Reader) ([]Candle, error) {
+	var count uint32
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	var nameCount uint16
+	if err := binary.Read(reader, binary.BigEndian, &nameCount); err != nil {
+		return nil, unexpected(err)
+	}
+	names := make([]string, nameCount)
+	for i := range names {
+		var length uint16
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return nil, unexpected(err)
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return nil, unexpected(err)
+		}
+		names[i] = string(name)
+	}
+
+	candles := make([]Candle, count)
+	times := make([]int64, count)
+	if err := binary.Read(reader, binary.BigEndian, times); err != nil {
+		return nil, unexpected(err)
+	}
+	for i := range candles {
+		candles[i].Time = time.Unix(times[i], 0)
+		candles[i].Indicators = map[string]float64{}
+	}
+	for _, value := range []func(*Candle) *decimal.Decimal{
+		func(candle *Candle) *decimal.Decimal { return &candle.Open },
+		func(candle *Candle) *decimal.Decimal { return &candle.High },
+		func(candle *Candle) *decimal.Decimal { return &candle.Low },
+		func(candle *Candle) *decimal.Decimal { return &candle.Close },
+		func(candle *Candle) *decimal.Decimal { return &candle.Average },
+		func(candle *Candle) *decimal.Decimal { return &candle.Volume },
+	} {
+		values, err := readDecimalColumn(reader, int(count))
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		for i := range candles {
+			*value(&candles[i]) = values[i]
+		}
+	}
+	missing := make([]uint8, count)
+	if _, err := io.ReadFull(reader, missing); err != nil {
+		return nil, unexpected(err)
+	}
+	for i := range candles {
+		candles[i].Missing = missing[i] == 1
+	}
+	column := make([]float64, count)
+	for _, name := range names {
+		if err := binary.Read(reader, binary.BigEndian, column); err != nil {
+			return nil, unexpected(err)
+		}
+		for i := range candles {
+			if !math.IsNaN(column[i]) {
+				candles[i].Indicators[name] = column[i]
+			}
+		}
+	}
+	return candles, nil
+}
+
+// Scales the values to the smallest exponent of the column, or writes them as strings
+// when one doesn't fit. Trailing zeros are stripped first, divisions such as the
+// average keep 16 decimals which would not fit an int64 for any real price
+func writeDecimalColumn(writer *bufio.Writer, values []decimal.Decimal) {
+	stripped := make([]decimal.Decimal, len(values))
+	for i, value := range values {
+		stripped[i] = stripTrailingZeros(value)
+	}
+	values = stripped
+	exponent := int32(0)
+	for i, value := range values {
+		if i == 0 || value.Exponent() < exponent {
+			exponent = value.Exponent()
+		}
+	}
+	coefficients := make([]int64, len(values))
+	ten := big.NewInt(10)
+	for i, value := range values {
+		scale := new(big.Int).Exp(ten, big.NewInt(int64(value.Exponent()-exponent)), nil)
+		coefficient := new(big.Int).Mul(value.Coefficient(), scale)
+		if !coefficient.IsInt64() {
+			writer.WriteByte(COLUMN_STRING)
+			for _, value := range values {
+				text := value.String()
+				binary.Write(writer, binary.BigEndian, uint16(len(text)))
+				writer.WriteString(text)
+			}
+			return
+		}
+		coefficients[i] = coefficient.Int64()
+	}
+	writer.WriteByte(COLUMN_SCALED)
+	binary.Write(writer, binary.BigEndian, exponent)
+	binary.Write(writer, binary.BigEndian, coefficients)
+}
+
+func readDecimalColumn(reader *bufio.Reader, count int) ([]decimal.Decimal, error) {
+	encoding, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]decimal.Decimal, count)
+	switch encoding {
+	case COLUMN_SCALED:
+		var exponent int32
+		if err := binary.Read(reader, binary.BigEndian, &exponent); err != nil {
+			return nil, err
+		}
+		coefficients := make([]int64, count)
+		if err := binary.Read(reader, binary.BigEndian, coefficients); err != nil {
+			return nil, err
+		}
+		for i, coefficient := range coefficients {
+			values[i] = decimal.New(coefficient, exponent)
+		}
+	case COLUMN_STRING:
+		for i := range values {
+			var length uint16
+			if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+				return nil, err
+			}
+			text := make([]byte, length)
+			if _, err := io.ReadFull(reader, text); err != nil {
+				return nil, err
+			}
+			if values[i], err = decimal.NewFromString(string(text)); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown column encoding %d", encoding)
+	}
+	return values, nil
+}
+
+// Same value with the smallest coefficient, e.g. 6546.5000 becomes 65465 and an
+// exponent of -1
+func stripTrailingZeros(value decimal.Decimal) decimal.Decimal {
+	coefficient, exponent := value.Coefficient(), value.Exponent()
+	if coefficient.Sign() == 0 {
+		return decimal.Zero
+	}
+	ten, remainder := big.NewInt(10), new(big.Int)
+	for {
+		quotient, mod := new(big.Int).QuoRem(coefficient, ten, remainder)
+		if mod.Sign() != 0 {
+			return decimal.NewFromBigInt(coefficient, exponent)
+		}
+		coefficient, exponent = quotient, exponent+1
+	}
+}
+
+// A block cut short is an error, not the end of the file
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBinaryCandleStoreBlocks(t *testing.T) {
+	// GIVEN
+	dir, _ := ioutil.TempDir("", "columnar")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "BTC-USD.candles")
+	store := &BinaryCandleStore{}
+
+	// WHEN
+	// One block of two candles, with an indicator missing on the second one
+	store.Append(path, generateStoreCandles())
+	info, _ := os.Stat(path)
+	candles, err := store.Read(path)
+
+	// THEN
+	if err != nil {
+		t.Fatalf("Could not read %v", err)
+	}
+	checkStoreCandles(t, "binary", candles)
+	// Header, count and names, then 2 times, 6 scaled columns of 2 prices, 2 flags and 4 indicators
+	if info.Size() != 6+6+2+4+2+3+2*8+6*(1+4+2*8)+2+4*8 {
+		t.Errorf("Wrong file size %d", info.Size())
+	}
+}
+
+func TestBinaryCandleStoreBuffer(t *testing.T) {
+	// GIVEN
+	// Blocks of 3 candles, appended one at a time like gdax does
+	dir, _ := ioutil.TempDir("", "columnar")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "BTC-USD.candles")
+	store := CreateNewBinaryCandleStore()
+	store.BlockSize = 3
+	candles := []Candle{}
+	for i := 0; i < 4; i++ {
+		candles = append(candles, generateStoreCandles()...)
+	}
+	for i := range candles {
+		candles[i].Time = candles[i].Time.Add(time.Duration(i) * time.Minute)
+	}
+
+	// WHEN
+	for _, candle := range candles[:7] {
+		store.Append(path, []Candle{candle})
+	}
+	written, _ := (&BinaryCandleStore{}).Read(path)
+	buffered, _ := store.Read(path)
+	store.Append(path, candles[7:])
+	store.Flush()
+	info, _ := os.Stat(path)
+	all, err := (&BinaryCandleStore{}).Read(path)
+
+	// THEN
+	if len(written) != 6 || len(buffered) != 7 {
+		t.Errorf("Only full blocks should be written, got %d written and %d with the buffer", len(written), len(buffered))
+	}
+	if err != nil || len(all) != 8 || !all[7].Time.Equal(candles[7].Time) {
+		t.Fatalf("Flush should write the rest %v", err)
+	}
+	// Header, then 2 blocks of 3 candles and one of 2, each with its count and names
+	block := func(n int64) int64 { return 6 + 2 + 4 + 2 + 3 + n*8 + 6*(1+4+n*8) + n + 2*n*8 }
+	if info.Size() != 6+2*block(3)+block(2) {
+		t.Errorf("Wrong file size %d", info.Size())
+	}
+}
+
+func TestBinaryCandleStoreMaxAge(t *testing.T) {
+	// GIVEN
+	// Hourly candles would take 60 hours to fill a block
+	dir, _ := ioutil.TempDir("", "columnar")
+	defer os.RemoveAll(dir)
+	path, other := filepath.Join(dir, "BTC-USD-1h.candles"), filepath.Join(dir, "ETH-USD-1h.candles")
+	store := CreateNewBinaryCandleStore()
+	store.MaxAge = 20 * time.Millisecond
+	candles := generateStoreCandles()
+
+	// WHEN
+	store.Append(path, candles[:1])
+	store.FlushAged()
+	_, youngErr := os.Stat(path)
+	time.Sleep(30 * time.Millisecond)
+	store.Append(other, candles[:1])
+	store.FlushAged()
+	aged, agedErr := (&BinaryCandleStore{}).Read(path)
+	_, otherErr := os.Stat(other)
+	time.Sleep(30 * time.Millisecond)
+	store.Append(other, candles[1:])
+	appended, appendedErr := (&BinaryCandleStore{}).Read(other)
+
+	// THEN
+	if !os.IsNotExist(youngErr) {
+		t.Errorf("Candles should stay buffered until they are old enough %v", youngErr)
+	}
+	if agedErr != nil || len(aged) != 1 || !os.IsNotExist(otherErr) {
+		t.Errorf("Only the aged candles should be written %v %v %v", aged, agedErr, otherErr)
+	}
+	if appendedErr != nil || len(appended) != 2 {
+		t.Errorf("Append should write aged candles %v %v", appended, appendedErr)
+	}
+}
+
+func TestBinaryCandleStorePrecision(t *testing.T) {
+	// GIVEN
+	// More digits than a float64 holds, and a volume too large for a scaled int64
+	dir, _ := ioutil.TempDir("", "columnar")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "BTC-USD.candles")
+	store := &BinaryCandleStore{}
+	candles := generateStoreCandles()
+	candles[0].Close = decimal.RequireFromString("12345678901234.123456")
+	candles[1].Volume = decimal.RequireFromString("98765432109876543210.5")
+
+	// WHEN
+	store.Append(path, candles)
+	read, err := store.Read(path)
+
+	// THEN
+	if err != nil || len(read) != 2 {
+		t.Fatalf("Could not read %v", err)
+	}
+	if read[0].Close.String() != "12345678901234.123456" || read[1].Close.String() != "10005" {
+		t.Errorf("Prices should be exact %s %s", read[0].Close, read[1].Close)
+	}
+	if read[1].Volume.String() != "98765432109876543210.5" || read[0].Volume.String() != "3.14159265" {
+		t.Errorf("Volumes should be exact %s %s", read[0].Volume, read[1].Volume)
+	}
+}
+
+func TestBinaryCandleStoreAverageScaled(t *testing.T) {
+	// GIVEN
+	// BTC prices, with the average computed by the chart, which keeps 16 decimals
+	dir, _ := ioutil.TempDir("", "columnar")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "BTC-USD.candles")
+	store := &BinaryCandleStore{}
+	chart := CreateNewCandleChart()
+	chart.Indicators = []Indicator{}
+	candles := []Candle{}
+	for i, price := range []float64{6546, 6547.13} {
+		chart.AddCandle(Candle{Time: time.Unix(int64(i*60), 0), Open: decimal.NewFromFloat(price), High: decimal.NewFromFloat(price + 2),
+			Low: decimal.NewFromFloat(price - 1), Close: decimal.NewFromFloat(price + 1), Volume: decimal.NewFromFloat(1.5)})
+		chart.CompleteCurrentCandle()
+		candles = append(candles, *chart.CurrentCandle())
+	}
+
+	// WHEN
+	store.Append(path, candles)
+	info, _ := os.Stat(path)
+	read, err := store.Read(path)
+
+	// THEN
+	if err != nil || len(read) != 2 || !read[0].Average.Equal(candles[0].Average) || !read[1].Average.Equal(candles[1].Average) {
+		t.Fatalf("Could not read the averages %v %v", err, read)
+	}
+	// Header, count and no name, then 2 times, 6 scaled columns of 2 values and 2 flags
+	if info.Size() != 6+6+2*8+6*(1+4+2*8)+2 {
+		t.Errorf("Every column should be scaled integers, file size %d", info.Size())
+	}
+}
+
+func TestBinaryCandleStoreCorrupt(t *testing.T) {
+	// GIVEN
+	dir, _ := ioutil.TempDir("", "columnar")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "BTC-USD.candles")
+	store := &BinaryCandleStore{}
+	store.Append(path, generateStoreCandles())
+	data, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, data[:len(data)-3], 0644)
+	other := filepath.Join(dir, "other.candles")
+	ioutil.WriteFile(other, []byte("1512086400 1 1 1 1 1 1\n"), 0644)
+	newer := filepath.Join(dir, "newer.candles")
+	ioutil.WriteFile(newer, []byte("GCDL\x00\x03"), 0644)
+
+	// WHEN
+	_, truncatedErr := store.Read(path)
+	_, otherErr := store.Read(other)
+	_, newerErr := store.Read(newer)
+
+	// THEN
+	if truncatedErr == nil || otherErr == nil || newerErr == nil {
+		t.Errorf("Invalid files should not be read %v %v %v", truncatedErr, otherErr, newerErr)
+	}
+}
@@ -0,0 +1,261 @@
+package common
+
+import (
+	"errors"
+	ws "github.com/gorilla/websocket"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var MIN_BACKOFF = 500 * time.Millisecond
+var MAX_BACKOFF = 60 * time.Second
+
+var HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// A connection with no frame and no pong for this long is dead, even if TCP didn't
+// notice, e.g. half open after a network change
+var READ_TIMEOUT = 60 * time.Second
+var PING_INTERVAL = 20 * time.Second
+
+var ErrConnectionClosed = errors.New("connection closed")
+var ErrNotConnected = errors.New("not connected")
+
+// Feed is where exchanges read their messages from, a live Connection or a Replay
+type Feed interface {
+	Subscribe(message interface{}) error
+	ReadMessage() (int, []byte, error)
+	// Time of the message last read
+	Now() time.Time
+	Close() error
+}
+
+// Connection is a websocket connection that redials on read errors, with exponential
+// backoff and jitter, and replays the subscribe messages once reconnected
+type Connection struct {
+	Url        string
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Dials taking longer fail, and are retried
+	HandshakeTimeout time.Duration
+	// Reads fail after this long without a frame or a pong, which triggers a reconnect.
+	// Pings are sent every PingInterval so quiet feeds stay up
+	ReadTimeout  time.Duration
+	PingInterval time.Duration
+	// Called from the reading goroutine once redialed and subscribed again, before the
+	// first message is read, so exchanges can reset state that the new connection will
+	// send again (e.g. snapshots)
+	OnReconnect func()
+	// Records every frame read when set, and the reconnects
+	Recorder *Recorder
+
+	exchange   string
+	conn       *ws.Conn
+	subscribes []interface{}
+	events     chan Event
+	quit       chan struct{}
+	mutex      sync.Mutex
+}
+
+// Public
+
+func CreateNewConnection(exchange, url string, events chan Event) *Connection {
+	return &Connection{
+		Url:              url,
+		MinBackoff:       MIN_BACKOFF,
+		MaxBackoff:       MAX_BACKOFF,
+		HandshakeTimeout: HANDSHAKE_TIMEOUT,
+		ReadTimeout:      READ_TIMEOUT,
+		PingInterval:     PING_INTERVAL,
+		exchange:         exchange,
+		events:           events,
+		quit:             make(chan struct{}),
+	}
+}
+
+func (connection *Connection) Connect() error {
+	conn, err := connection.dial()
+	if err != nil {
+		return err
+	}
+	connection.mutex.Lock()
+	connection.conn = conn
+	connection.mutex.Unlock()
+	return nil
+}
+
+// Subscribe sends the message, and keeps it to be sent again after every reconnect
+func (connection *Connection) Subscribe(message interface{}) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if connection.conn == nil {
+		return ErrNotConnected
+	}
+	connection.subscribes = append(connection.subscribes, message)
+	return connection.conn.WriteJSON(message)
+}
+
+// ReadMessage blocks until the next message. Errors are only returned once the
+// connection has been closed, any other failure triggers a reconnect
+func (connection *Connection) ReadMessage() (int, []byte, error) {
+	for {
+		connection.mutex.Lock()
+		conn := connection.conn
+		connection.mutex.Unlock()
+
+		msgType, resp, err := conn.ReadMessage()
+		if err == nil {
+			connection.extendDeadline(conn)
+			connection.record(msgType, resp)
+			return msgType, resp, nil
+		}
+		if connection.isClosed() {
+			return 0, nil, ErrConnectionClosed
+		}
+		SendEvent(connection.events, Event{Type: EVENT_DISCONNECTED, Exchange: connection.exchange, Err: err, Time: time.Now()})
+		if err := connection.reconnect(); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// Now returns the current time, messages are read as they come
+func (connection *Connection) Now() time.Time {
+	return time.Now()
+}
+
+func (connection *Connection) Close() error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	select {
+	case <-connection.quit:
+		return nil
+	default:
+		close(connection.quit)
+	}
+	if connection.conn == nil {
+		return nil
+	}
+	return connection.conn.Close()
+}
+
+// Backoff is exponential from min up to max, with jitter over the second half of the
+// interval so all feeds don't retry at the same time
+func Backoff(min, max time.Duration, attempt int) time.Duration {
+	delay := max
+	if attempt < 32 && min<<uint(attempt) < max {
+		delay = min << uint(attempt)
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Private
+
+func (connection *Connection) dial() (*ws.Conn, error) {
+	wsDialer := ws.Dialer{HandshakeTimeout: connection.HandshakeTimeout}
+	conn, _, err := wsDialer.Dial(connection.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	connection.extendDeadline(conn)
+	conn.SetPongHandler(func(string) error {
+		connection.extendDeadline(conn)
+		return nil
+	})
+	if connection.PingInterval > 0 {
+		go connection.ping(conn)
+	}
+	return conn, nil
+}
+
+// Every frame or pong gives the connection another ReadTimeout
+func (connection *Connection) extendDeadline(conn *ws.Conn) {
+	if connection.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(connection.ReadTimeout))
+	}
+}
+
+// Pings until the connection is closed, replaced connections are closed too. Control
+// frames can be written along with the subscribes
+func (connection *Connection) ping(conn *ws.Conn) {
+	ticker := time.NewTicker(connection.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-connection.quit:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(ws.PingMessage, nil, time.Now().Add(connection.PingInterval)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (connection *Connection) reconnect() error {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-connection.quit:
+			return ErrConnectionClosed
+		case <-time.After(connection.backoff(attempt)):
+		}
+
+		conn, err := connection.dial()
+		if err != nil {
+			continue
+		}
+
+		connection.mutex.Lock()
+		// We could have been closed while dialing
+		if connection.isClosed() {
+			connection.mutex.Unlock()
+			conn.Close()
+			return ErrConnectionClosed
+		}
+		connection.conn.Close()
+		connection.conn = conn
+		for _, message := range connection.subscribes {
+			if err = conn.WriteJSON(message); err != nil {
+				break
+			}
+		}
+		connection.mutex.Unlock()
+		if err != nil {
+			continue
+		}
+		// Only once per reconnect, failed subscribes are retried on a new connection
+		connection.record(FRAME_RECONNECT, nil)
+		if connection.OnReconnect != nil {
+			connection.OnReconnect()
+		}
+		SendEvent(connection.events, Event{Type: EVENT_RECONNECTED, Exchange: connection.exchange, Attempt: attempt + 1, Time: time.Now()})
+		return nil
+	}
+}
+
+func (connection *Connection) backoff(attempt int) time.Duration {
+	return Backoff(connection.MinBackoff, connection.MaxBackoff, attempt)
+}
+
+// A failing recorder doesn't stop the feed
+func (connection *Connection) record(msgType int, data []byte) {
+	if connection.Recorder == nil {
+		return
+	}
+	// Frames still read while shutting down are not worth a message
+	if err := connection.Recorder.Record(time.Now(), msgType, data); err != nil && err != ErrRecorderClosed {
+		println("Error recording", connection.exchange, "message:", err.Error())
+	}
+}
+
+func (connection *Connection) isClosed() bool {
+	select {
+	case <-connection.quit:
+		return true
+	default:
+		return false
+	}
+}
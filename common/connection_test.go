@@ -0,0 +1,206 @@
+package common
+
+import (
+	ws "github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Websocket server echoing back subscribe messages, dropping the connection
+// after the given number of messages
+func generateDroppingServer(dropAfter int) (*httptest.Server, *int) {
+	var upgrader ws.Upgrader
+	var mutex sync.Mutex
+	connections := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mutex.Lock()
+		connections += 1
+		mutex.Unlock()
+		for i := 0; i < dropAfter; i++ {
+			_, resp, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(ws.TextMessage, resp)
+		}
+	}))
+	return server, &connections
+}
+
+func TestConnectionReconnect(t *testing.T) {
+	// GIVEN
+	// Server dropping the connection right after answering the subscribe
+	server, connections := generateDroppingServer(1)
+	defer server.Close()
+	events := make(chan Event, EVENT_BUFFER)
+	connection := CreateNewConnection("test", "ws"+strings.TrimPrefix(server.URL, "http"), events)
+	connection.MinBackoff = time.Millisecond
+	connection.MaxBackoff = 10 * time.Millisecond
+	resets := 0
+	connection.OnReconnect = func() { resets += 1 }
+	if err := connection.Connect(); err != nil {
+		t.Fatalf("Could not connect %v", err)
+	}
+	defer connection.Close()
+
+	// WHEN
+	connection.Subscribe(map[string]string{"type": "subscribe"})
+	messages := []string{}
+	for i := 0; i < 3; i++ {
+		_, resp, err := connection.ReadMessage()
+		if err != nil {
+			t.Fatalf("Read should not fail while reconnecting %v", err)
+		}
+		messages = append(messages, strings.TrimSpace(string(resp)))
+	}
+
+	// THEN
+	// Subscribe was replayed on every new connection, and echoed back
+	for _, message := range messages {
+		if message != `{"type":"subscribe"}` {
+			t.Errorf("Wrong message received %s", message)
+		}
+	}
+	if *connections < 3 || resets < 2 {
+		t.Errorf("Should have reconnected twice, got %d connections and %d resets", *connections, resets)
+	}
+	event := <-events
+	if event.Type != EVENT_DISCONNECTED || event.Exchange != "test" {
+		t.Errorf("First event should be a disconnect %v", event.String())
+	}
+	event = <-events
+	if event.Type != EVENT_RECONNECTED || event.Attempt != 1 {
+		t.Errorf("Second event should be a reconnect %v", event.String())
+	}
+}
+
+func TestConnectionReadTimeout(t *testing.T) {
+	// GIVEN
+	// Server never reading, so pings get no pong, and sending nothing
+	var upgrader ws.Upgrader
+	quit := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-quit
+	}))
+	defer server.Close()
+	defer close(quit)
+	events := make(chan Event, EVENT_BUFFER)
+	connection := CreateNewConnection("test", "ws"+strings.TrimPrefix(server.URL, "http"), events)
+	connection.ReadTimeout = 50 * time.Millisecond
+	connection.PingInterval = 10 * time.Millisecond
+	connection.MinBackoff = time.Millisecond
+	if err := connection.Connect(); err != nil {
+		t.Fatalf("Could not connect %v", err)
+	}
+
+	// WHEN
+	go connection.ReadMessage()
+	var event Event
+	select {
+	case event = <-events:
+	case <-time.After(time.Second):
+	}
+	connection.Close()
+
+	// THEN
+	if event.Type != EVENT_DISCONNECTED || event.Err == nil {
+		t.Errorf("Silent connection should time out and reconnect %v", event.String())
+	}
+}
+
+func TestConnectionKeepAlive(t *testing.T) {
+	// GIVEN
+	// Server answering pings while it reads, but sending nothing
+	server, _ := generateDroppingServer(100)
+	defer server.Close()
+	events := make(chan Event, EVENT_BUFFER)
+	connection := CreateNewConnection("test", "ws"+strings.TrimPrefix(server.URL, "http"), events)
+	connection.ReadTimeout = 50 * time.Millisecond
+	connection.PingInterval = 10 * time.Millisecond
+	if err := connection.Connect(); err != nil {
+		t.Fatalf("Could not connect %v", err)
+	}
+
+	// WHEN
+	go connection.ReadMessage()
+	time.Sleep(200 * time.Millisecond)
+	connection.Close()
+
+	// THEN
+	if len(events) != 0 {
+		event := <-events
+		t.Errorf("Pongs should keep the connection up %v", event.String())
+	}
+}
+
+func TestConnectionClose(t *testing.T) {
+	// GIVEN
+	server, _ := generateDroppingServer(100)
+	defer server.Close()
+	connection := CreateNewConnection("test", "ws"+strings.TrimPrefix(server.URL, "http"), make(chan Event, EVENT_BUFFER))
+	if err := connection.Connect(); err != nil {
+		t.Fatalf("Could not connect %v", err)
+	}
+
+	// WHEN
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		connection.Close()
+	}()
+	_, _, err := connection.ReadMessage()
+
+	// THEN
+	if err != ErrConnectionClosed {
+		t.Errorf("Read should stop once closed, got %v", err)
+	}
+}
+
+func TestConnectionSubscribeNotConnected(t *testing.T) {
+	// GIVEN
+	connection := CreateNewConnection("test", "ws://localhost", make(chan Event, EVENT_BUFFER))
+
+	// WHEN
+	err := connection.Subscribe(map[string]string{"type": "subscribe"})
+
+	// THEN
+	if err != ErrNotConnected || len(connection.subscribes) != 0 {
+		t.Errorf("Subscribe should fail before connecting, got %v", err)
+	}
+}
+
+func TestConnectionBackoff(t *testing.T) {
+	// GIVEN
+	connection := CreateNewConnection("test", "", nil)
+	connection.MinBackoff = 100 * time.Millisecond
+	connection.MaxBackoff = time.Second
+
+	// WHEN
+	first := connection.backoff(0)
+	third := connection.backoff(2)
+	capped := connection.backoff(50)
+
+	// THEN
+	if first < 50*time.Millisecond || first > 100*time.Millisecond {
+		t.Errorf("First backoff out of range %v", first)
+	}
+	if third < 200*time.Millisecond || third > 400*time.Millisecond {
+		t.Errorf("Third backoff out of range %v", third)
+	}
+	if capped < 500*time.Millisecond || capped > time.Second {
+		t.Errorf("Backoff should be capped %v", capped)
+	}
+}
@@ -1,3 +1,28 @@
 package common
 
-const PRECISION_DECIMAL = 5
+import "github.com/shopspring/decimal"
+
+// Used for order books of instruments without a known tick size, small enough to
+// keep every price exact
+var DEFAULT_TICK_SIZE = decimal.New(1, -8)
+
+// Minimum price increment of each instrument, per exchange
+var TICK_SIZES = map[string]map[string]decimal.Decimal{
+	"gdax": {
+		"BTC-USD": decimal.New(1, -2),
+		"ETH-USD": decimal.New(1, -2),
+		"LTC-USD": decimal.New(1, -2),
+		"ETH-BTC": decimal.New(1, -5),
+		"LTC-BTC": decimal.New(1, -5),
+	},
+	"bitmex": {
+		"XBTUSD": decimal.New(5, -1),
+	},
+}
+
+func TickSize(exchange, productId string) decimal.Decimal {
+	if tickSize, ok := TICK_SIZES[exchange][productId]; ok {
+		return tickSize
+	}
+	return DEFAULT_TICK_SIZE
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"time"
+)
+
+const (
+	CHANNEL_TRADES = "trades"
+	CHANNEL_BOOK   = "book"
+
+	EVENT_DISCONNECTED  = "disconnected"
+	EVENT_RECONNECTED   = "reconnected"
+	EVENT_BOOK_STALE    = "book stale"
+	EVENT_BOOK_RESYNCED = "book resynced"
+
+	// Size of the buffered channels exchanges publish events on
+	EVENT_BUFFER = 1024
+)
+
+// Exchange is implemented by every venue feed, so they can be started and consumed
+// the same way regardless of the underlying websocket protocol
+type Exchange interface {
+	Name() string
+	Connect() error
+	// Subscribe to the given products (in the exchange own symbol format) for the given
+	// channels, CHANNEL_TRADES and/or CHANNEL_BOOK
+	Subscribe(products, channels []string) error
+	// Trades not read fast enough are dropped, rather than stalling the feed
+	Trades() <-chan Trade
+	BookUpdates() <-chan BookUpdate
+	// Connection lifecycle events, such as disconnects and reconnects
+	Events() <-chan Event
+	Close() error
+}
+
+// Trade is a normalized match, as received from any exchange
+type Trade struct {
+	Exchange  string
+	ProductId string
+	TradeId   string
+	Side      string
+	Price     decimal.Decimal
+	Size      decimal.Decimal
+	Time      time.Time
+}
+
+// BookUpdate holds the top of book of a product, sent after every order book change
+type BookUpdate struct {
+	Exchange  string
+	ProductId string
+	Bid       decimal.Decimal
+	BidSize   decimal.Decimal
+	Ask       decimal.Decimal
+	AskSize   decimal.Decimal
+	Time      time.Time
+}
+
+// Event reports something that happened to a feed, outside of the market data itself
+type Event struct {
+	Type      string
+	Exchange  string
+	ProductId string
+	Attempt   int
+	Err       error
+	Time      time.Time
+}
+
+// Public
+
+func (trade *Trade) String() string {
+	return fmt.Sprintf("Trade{Exchange: %s, ProductId: %s, TradeId: %s, Side: %s, Price: %s, Size: %s, Time: %v}",
+		trade.Exchange, trade.ProductId, trade.TradeId, trade.Side, trade.Price, trade.Size, trade.Time)
+}
+
+func (event *Event) String() string {
+	return fmt.Sprintf("Event{Type: %s, Exchange: %s, ProductId: %s, Attempt: %d, Err: %v, Time: %v}",
+		event.Type, event.Exchange, event.ProductId, event.Attempt, event.Err, event.Time)
+}
+
+// SendBookUpdate publishes the top of book without blocking. If the consumer is lagging
+// behind, the update is dropped, as a newer one will follow with the next book change
+func SendBookUpdate(books chan BookUpdate, book BookUpdate) {
+	select {
+	case books <- book:
+	default:
+	}
+}
+
+// SendTrade publishes the trade without blocking, so a consumer lagging behind can't
+// stall the feed, and the books read along with the trades. Dropped trades are counted,
+// and logged every EVENT_BUFFER of them
+func SendTrade(trades chan Trade, trade Trade, dropped *int) {
+	select {
+	case trades <- trade:
+	default:
+		*dropped += 1
+		if *dropped%EVENT_BUFFER == 1 {
+			fmt.Printf("%s trades not read, %d dropped so far\n", trade.Exchange, *dropped)
+		}
+	}
+}
+
+// SendEvent publishes the event without blocking, as nobody may be listening
+func SendEvent(events chan Event, event Event) {
+	select {
+	case events <- event:
+	default:
+	}
+}
@@ -0,0 +1,239 @@
+package common
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"strconv"
+	"strings"
+)
+
+// Indicator computes values for the current candle of a chart, once it is complete
+type Indicator interface {
+	// Name is used as the key of the main value in Candle.Indicators
+	Name() string
+	// Number of candles needed before the indicator returns anything but zero
+	Lookback() int
+	// Compute returns the values for the current candle, keyed by name
+	Compute(chart *CandleChart) map[string]float64
+}
+
+// Indicators which can be created from a configuration string, see ParseIndicators
+var INDICATORS = map[string]func(label string, params []int) (Indicator, error){
+	"mfi": func(label string, params []int) (Indicator, error) {
+		if len(params) != 1 {
+			return nil, fmt.Errorf("mfi takes 1 parameter, got %d", len(params))
+		}
+		return &Mfi{Label: label, Period: params[0]}, nil
+	},
+	"macd": func(label string, params []int) (Indicator, error) {
+		if len(params) != 3 {
+			return nil, fmt.Errorf("macd takes 3 parameters, got %d", len(params))
+		}
+		// The short and signal EMAs are computed from the last candles of the long period
+		if params[0] >= params[1] || params[2] > params[1] {
+			return nil, fmt.Errorf("macd needs short < long and signal <= long, got %d,%d,%d", params[0], params[1], params[2])
+		}
+		return &Macd{Label: label, Short: params[0], Long: params[1], Signal: params[2]}, nil
+	},
+}
+
+// Mfi keeps the money flow of each candle, and the rolling sums of positive and
+// negative money flows over the period
+type Mfi struct {
+	Label  string
+	Period int
+}
+
+// Macd keeps the short and long EMAs and the signal EMA. It sets two values, the MACD
+// line under its name, and the histogram under its name followed by "h"
+type Macd struct {
+	Label  string
+	Short  int
+	Long   int
+	Signal int
+}
+
+// Public
+
+func DefaultIndicators() []Indicator {
+	return []Indicator{&Mfi{Period: 14}, &Macd{Short: 10, Long: 26, Signal: 9}}
+}
+
+// ParseIndicators creates indicators from a comma separated list such as
+// "mfi(14),macd(12,26,9),fast=macd(5,35,5)", where an optional label renames the values
+func ParseIndicators(spec string) ([]Indicator, error) {
+	indicators := []Indicator{}
+	for spec = strings.TrimSpace(spec); spec != ""; {
+		end := strings.Index(spec, ")")
+		if end == -1 {
+			return nil, fmt.Errorf("missing parenthesis in indicator %s", spec)
+		}
+		indicator, err := parseIndicator(spec[:end+1])
+		if err != nil {
+			return nil, err
+		}
+		indicators = append(indicators, indicator)
+		spec = strings.TrimLeft(spec[end+1:], ", ")
+	}
+	return indicators, nil
+}
+
+func (mfi *Mfi) Name() string {
+	if mfi.Label != "" {
+		return mfi.Label
+	}
+	return "mfi"
+}
+
+func (mfi *Mfi) Lookback() int {
+	return mfi.Period
+}
+
+// Compute updates the rolling money flow sums with the current candle flow, minus the
+// flow of the candle leaving the period. The sums are rebuilt from the chart when the
+// previous candle has no state, e.g. the first time enough candles are available
+func (mfi *Mfi) Compute(chart *CandleChart) map[string]float64 {
+	if chart.totalCandle < mfi.Period {
+		return map[string]float64{mfi.Name(): 0.0}
+	}
+	candle, previous, leaving := chart.CurrentCandle(), chart.GetPastRelativeCandle(-1), chart.GetPastRelativeCandle(-mfi.Period)
+	positive, okPositive := previous.State[mfi.Name()+".positive"]
+	negative, okNegative := previous.State[mfi.Name()+".negative"]
+	leavingFlow, okLeaving := leaving.State[mfi.Name()+".flow"]
+
+	if !okPositive || !okNegative || !okLeaving {
+		positive, negative = decimal.Decimal{}, decimal.Decimal{}
+		for i := -mfi.Period + 1; i <= 0; i++ {
+			c := chart.GetPastRelativeCandle(i)
+			flow := moneyFlow(c, chart.GetPastRelativeCandle(i-1))
+			setState(c, mfi.Name()+".flow", flow)
+			positive, negative = addMoneyFlow(positive, negative, flow)
+		}
+	} else {
+		flow := moneyFlow(candle, previous)
+		setState(candle, mfi.Name()+".flow", flow)
+		positive, negative = addMoneyFlow(positive, negative, flow)
+		positive, negative = removeMoneyFlow(positive, negative, leavingFlow)
+	}
+	setState(candle, mfi.Name()+".positive", positive)
+	setState(candle, mfi.Name()+".negative", negative)
+
+	// Money ratio
+	moneyFlowRatio := positive
+	if !negative.Equal(decimal.NewFromFloat(0.0)) {
+		moneyFlowRatio = positive.Div(negative)
+	}
+	hundred := decimal.NewFromFloat(100.0)
+	res, _ := hundred.Sub(hundred.Div((decimal.NewFromFloat(1.0).Add(moneyFlowRatio)))).Float64()
+	return map[string]float64{mfi.Name(): res}
+}
+
+func (macd *Macd) Name() string {
+	if macd.Label != "" {
+		return macd.Label
+	}
+	return "macd"
+}
+
+// We need at least double the longest period
+func (macd *Macd) Lookback() int {
+	if macd.Signal > macd.Long {
+		return macd.Signal * 2
+	}
+	return macd.Long * 2
+}
+
+// Compute moves the EMAs forward with the current close. They start from the
+// CalculateMacd values the first time enough candles are available
+func (macd *Macd) Compute(chart *CandleChart) map[string]float64 {
+	candle, previous := chart.CurrentCandle(), chart.GetPastRelativeCandle(-1)
+	emaShort, okShort := previous.State[macd.Name()+".emaShort"]
+	emaLong, okLong := previous.State[macd.Name()+".emaLong"]
+	signal, okSignal := previous.State[macd.Name()+".signal"]
+
+	state := macdState{}
+	if okShort && okLong && okSignal {
+		state.emaShort = calculateSingleEma(candle.Close, macd.Short, emaShort)
+		state.emaLong = calculateSingleEma(candle.Close, macd.Long, emaLong)
+		state.macd = state.emaShort.Sub(state.emaLong)
+		state.signal = calculateSingleEma(state.macd, macd.Signal, signal)
+	} else {
+		var ok bool
+		if state, ok = chart.calculateMacdState(macd.Short, macd.Long, macd.Signal); !ok {
+			return map[string]float64{macd.Name(): 0.0, macd.Name() + "h": 0.0}
+		}
+	}
+	setState(candle, macd.Name()+".emaShort", state.emaShort)
+	setState(candle, macd.Name()+".emaLong", state.emaLong)
+	setState(candle, macd.Name()+".signal", state.signal)
+
+	value, _ := state.macd.Float64()
+	histogram, _ := state.macd.Sub(state.signal).Float64()
+	return map[string]float64{macd.Name(): value, macd.Name() + "h": histogram}
+}
+
+// Private
+
+func parseIndicator(spec string) (Indicator, error) {
+	label := ""
+	if i := strings.Index(spec, "="); i != -1 {
+		label, spec = strings.TrimSpace(spec[:i]), spec[i+1:]
+	}
+	open := strings.Index(spec, "(")
+	if open == -1 {
+		return nil, fmt.Errorf("missing parenthesis in indicator %s", spec)
+	}
+	name := strings.TrimSpace(spec[:open])
+	factory, ok := INDICATORS[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown indicator %s", name)
+	}
+	params := []int{}
+	for _, param := range strings.Split(spec[open+1:len(spec)-1], ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(param))
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("invalid parameter %s for indicator %s", param, name)
+		}
+		params = append(params, value)
+	}
+	return factory(label, params)
+}
+
+// Values are rounded to the division precision, otherwise EMAs gain digits with every
+// candle and get slower to compute
+func setState(candle *Candle, key string, value decimal.Decimal) {
+	if candle.State == nil {
+		candle.State = make(map[string]decimal.Decimal, NUM_INDICATOR)
+	}
+	candle.State[key] = value.Round(int32(decimal.DivisionPrecision))
+}
+
+// Money flow of a candle, positive when the typical price went up since the previous
+// candle, negative when it went down
+func moneyFlow(candle, previous *Candle) decimal.Decimal {
+	price, previousPrice := typicalPrice(candle), typicalPrice(previous)
+	if price.Cmp(previousPrice) > 0 {
+		return price.Mul(candle.Volume)
+	} else if price.Cmp(previousPrice) < 0 {
+		return price.Mul(candle.Volume).Neg()
+	}
+	return decimal.Decimal{}
+}
+
+func addMoneyFlow(positive, negative, flow decimal.Decimal) (decimal.Decimal, decimal.Decimal) {
+	if flow.Sign() > 0 {
+		return positive.Add(flow), negative
+	}
+	return positive, negative.Sub(flow)
+}
+
+func removeMoneyFlow(positive, negative, flow decimal.Decimal) (decimal.Decimal, decimal.Decimal) {
+	if flow.Sign() > 0 {
+		return positive.Sub(flow), negative
+	}
+	return positive, negative.Add(flow)
+}
+
+func typicalPrice(candle *Candle) decimal.Decimal {
+	return (candle.High.Add(candle.Low).Add(candle.Close)).Div(decimal.NewFromFloat(3))
+}
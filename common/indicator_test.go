@@ -0,0 +1,262 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func generateTrendingCandleChart(num int) *CandleChart {
+	candleChart := CreateNewCandleChart()
+	for i := 0; i < num; i++ {
+		price := 100 + float64(i%7) + float64(i)/2
+		candleChart.AddCandle(generateCandle(price, float64(10+i%3)))
+	}
+	return candleChart
+}
+
+func TestParseIndicators(t *testing.T) {
+	// GIVEN
+	spec := "mfi(14), macd(12,26,9),fast=macd(5, 35, 5)"
+
+	// WHEN
+	indicators, err := ParseIndicators(spec)
+	_, errUnknown := ParseIndicators("rsi(14)")
+	_, errParams := ParseIndicators("macd(12,26)")
+	_, errParenthesis := ParseIndicators("mfi(14")
+	_, errShort := ParseIndicators("macd(26,12,9)")
+	_, errSignal := ParseIndicators("macd(12,26,30)")
+
+	// THEN
+	if err != nil || len(indicators) != 3 {
+		t.Fatalf("Could not parse indicators %v", err)
+	}
+	if indicators[0].Name() != "mfi" || indicators[0].Lookback() != 14 {
+		t.Errorf("Wrong mfi %#v", indicators[0])
+	}
+	macd := indicators[1].(*Macd)
+	if macd.Name() != "macd" || macd.Short != 12 || macd.Long != 26 || macd.Signal != 9 || macd.Lookback() != 52 {
+		t.Errorf("Wrong macd %#v", macd)
+	}
+	if indicators[2].Name() != "fast" || indicators[2].Lookback() != 70 {
+		t.Errorf("Wrong labelled macd %#v", indicators[2])
+	}
+	if errUnknown == nil || errParams == nil || errParenthesis == nil {
+		t.Errorf("Invalid indicators should not be parsed")
+	}
+	if errShort == nil || errSignal == nil {
+		t.Errorf("Macd with periods longer than the long period should not be parsed")
+	}
+}
+
+func TestCompleteCurrentCandleDefaultIndicators(t *testing.T) {
+	// GIVEN
+	candleChart := generateTrendingCandleChart(NUM_CANDLE)
+
+	// WHEN
+	candleChart.CompleteCurrentCandle()
+	candle := candleChart.CurrentCandle()
+
+	// THEN
+	macd, macdh := candleChart.CalculateMacd(10, 26, 9)
+	if candle.Indicators["mfi"] != candleChart.CalculateMfi(14) || candle.Indicators["macd"] != macd || candle.Indicators["macdh"] != macdh {
+		t.Errorf("Default indicators not computed %v", candle.Indicators)
+	}
+}
+
+func TestCompleteCurrentCandlePerChartIndicators(t *testing.T) {
+	// GIVEN
+	btcChart := generateTrendingCandleChart(NUM_CANDLE)
+	btcChart.Indicators, _ = ParseIndicators("macd(12,26,9)")
+	ethChart := generateTrendingCandleChart(NUM_CANDLE)
+	ethChart.Indicators, _ = ParseIndicators("macd(5,35,5),slow=macd(10,29,9)")
+
+	// WHEN
+	btcChart.CompleteCurrentCandle()
+	// Chart grows for the longest lookback, then gets enough candles
+	ethChart.CompleteCurrentCandle()
+	for i := NUM_CANDLE; i < 80; i++ {
+		ethChart.AddCandle(generateCandle(100+float64(i%7)+float64(i)/2, float64(10+i%3)))
+	}
+	ethChart.CompleteCurrentCandle()
+
+	// THEN
+	btc, eth := btcChart.CurrentCandle().Indicators, ethChart.CurrentCandle().Indicators
+	if _, ok := btc["mfi"]; ok || len(btc) != 2 {
+		t.Errorf("Only configured indicators should be computed %v", btc)
+	}
+	if btc["macd"] == 0 || btc["macd"] == eth["macd"] {
+		t.Errorf("Each chart should use its own parameters %f %f", btc["macd"], eth["macd"])
+	}
+	slow, slowh := ethChart.CalculateMacd(10, 29, 9)
+	if len(eth) != 4 || eth["slow"] != slow || eth["slowh"] != slowh {
+		t.Errorf("Labelled indicator not computed %v", eth)
+	}
+	if len(ethChart.Chart) != 71 || eth["macd"] == 0 {
+		t.Errorf("Labelled indicator not computed %v", eth)
+	}
+}
+
+func TestCandleChartGrow(t *testing.T) {
+	// GIVEN
+	candleChart := CreateNewCandleChart()
+	for i := 0; i < NUM_CANDLE+5; i++ {
+		candleChart.AddCandle(generateCandle(float64(i), 1))
+	}
+
+	// WHEN
+	candleChart.grow(NUM_CANDLE + 10)
+	candleChart.AddCandle(generateCandle(1000, 1))
+
+	// THEN
+	if !candleChart.CurrentCandle().Close.Equal(decimal.NewFromFloat(1000)) {
+		t.Errorf("Wrong current candle %v", candleChart.CurrentCandle().String())
+	}
+	for i := -1; i >= -NUM_CANDLE; i-- {
+		expected := decimal.NewFromFloat(float64(NUM_CANDLE + 5 + i))
+		if !candleChart.GetPastRelativeCandle(i).Close.Equal(expected) {
+			t.Errorf("Wrong candle %d after growing %v", i, candleChart.GetPastRelativeCandle(i).String())
+		}
+	}
+}
+
+func TestCompleteCurrentCandleAverage(t *testing.T) {
+	// GIVEN
+	candleChart := CreateNewCandleChart()
+	candleChart.Indicators = nil
+	candleChart.AddCandle(Candle{
+		Open:  decimal.NewFromFloat(10),
+		High:  decimal.NewFromFloat(14),
+		Low:   decimal.NewFromFloat(8),
+		Close: decimal.NewFromFloat(12),
+	})
+
+	// WHEN
+	candleChart.CompleteCurrentCandle()
+
+	// THEN
+	if !candleChart.CurrentCandle().Average.Equal(decimal.NewFromFloat(11)) || len(candleChart.CurrentCandle().Indicators) != 0 {
+		t.Errorf("Wrong completed candle %v", candleChart.CurrentCandle().String())
+	}
+}
+
+func generateRandomWalkCandle(r *rand.Rand, price float64) Candle {
+	high, low := price+r.Float64(), price-r.Float64()
+	return Candle{
+		Open:   decimal.NewFromFloat(price),
+		High:   decimal.NewFromFloat(high),
+		Low:    decimal.NewFromFloat(low),
+		Close:  decimal.NewFromFloat(low + (high-low)*r.Float64()),
+		Volume: decimal.NewFromFloat(1 + 10*r.Float64()),
+	}
+}
+
+func TestIncrementalMfi(t *testing.T) {
+	// GIVEN
+	r := rand.New(rand.NewSource(1))
+	candleChart := CreateNewCandleChart()
+	candleChart.Indicators = []Indicator{&Mfi{Period: 14}, &Mfi{Label: "mfi5", Period: 5}}
+	price := 100.0
+
+	for i := 0; i < 3*NUM_CANDLE; i++ {
+		// WHEN
+		candle := generateRandomWalkCandle(r, price)
+		price, _ = candle.Close.Float64()
+		candleChart.AddCandle(candle)
+		candleChart.CompleteCurrentCandle()
+
+		// THEN
+		current := candleChart.CurrentCandle()
+		if current.Indicators["mfi"] != candleChart.CalculateMfi(14) || current.Indicators["mfi5"] != candleChart.CalculateMfi(5) {
+			t.Fatalf("Incremental MFI differs at candle %d: %v vs %f", i, current.Indicators, candleChart.CalculateMfi(14))
+		}
+	}
+}
+
+func TestIncrementalMacd(t *testing.T) {
+	// GIVEN
+	r := rand.New(rand.NewSource(2))
+	candleChart := CreateNewCandleChart()
+	candleChart.Indicators = []Indicator{&Macd{Short: 10, Long: 26, Signal: 9}}
+	price := 100.0
+
+	for i := 0; i < 3*NUM_CANDLE; i++ {
+		// WHEN
+		candle := generateRandomWalkCandle(r, price)
+		price, _ = candle.Close.Float64()
+		candleChart.AddCandle(candle)
+		candleChart.CompleteCurrentCandle()
+
+		// THEN
+		current := candleChart.CurrentCandle()
+		macd, macdh := candleChart.CalculateMacd(10, 26, 9)
+		if candleChart.totalCandle == 52 && (current.Indicators["macd"] != macd || current.Indicators["macdh"] != macdh) {
+			t.Errorf("Incremental MACD should start from the batch value %v vs %f %f", current.Indicators, macd, macdh)
+		}
+		// Batch values only use the last candles while incremental ones keep the whole
+		// history, so they only get close
+		if math.Abs(current.Indicators["macd"]-macd) > 0.1 || math.Abs(current.Indicators["macdh"]-macdh) > 0.1 {
+			t.Errorf("Incremental MACD differs at candle %d: %v vs %f %f", i, current.Indicators, macd, macdh)
+		}
+	}
+}
+
+func TestIndicatorsAfterLateTrade(t *testing.T) {
+	// GIVEN
+	// Completed candles, then a current candle still open
+	r := rand.New(rand.NewSource(4))
+	candleChart := CreateNewCandleChart()
+	price := 100.0
+	for i := 0; i < 2*NUM_CANDLE; i++ {
+		candle := generateRandomWalkCandle(r, price)
+		price, _ = candle.Close.Float64()
+		candleChart.AddCandle(candle)
+		candleChart.CompleteCurrentCandle()
+	}
+	candleChart.AddCandle(generateRandomWalkCandle(r, price))
+	before := candleChart.GetPastRelativeCandle(-1).Indicators["mfi"]
+
+	// WHEN
+	// Late trade well above the previous candle
+	candleChart.UpdatePreviousCandle(decimal.NewFromFloat(price+5), decimal.NewFromFloat(20))
+	candleChart.CompleteCurrentCandle()
+
+	// THEN
+	previous := candleChart.GetPastRelativeCandle(-1)
+	if previous.Indicators["mfi"] == before || !previous.Average.Equal(previous.High.Add(previous.Low).Add(previous.Open).Add(previous.Close).Div(decimal.NewFromFloat(4))) {
+		t.Errorf("Previous candle should be completed again %v", previous.String())
+	}
+	if candleChart.CurrentCandle().Indicators["mfi"] != candleChart.CalculateMfi(14) {
+		t.Errorf("MFI should build on the updated candle %v vs %f", candleChart.CurrentCandle().Indicators, candleChart.CalculateMfi(14))
+	}
+}
+
+func BenchmarkBatchIndicators(b *testing.B) {
+	r := rand.New(rand.NewSource(3))
+	candleChart := CreateNewCandleChart()
+	candleChart.Indicators = nil
+	price := 100.0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		candle := generateRandomWalkCandle(r, price)
+		price, _ = candle.Close.Float64()
+		candleChart.AddCandle(candle)
+		candleChart.CompleteCurrentCandle()
+		candleChart.CalculateMfi(14)
+		candleChart.CalculateMacd(10, 26, 9)
+	}
+}
+
+func BenchmarkIncrementalIndicators(b *testing.B) {
+	r := rand.New(rand.NewSource(3))
+	candleChart := CreateNewCandleChart()
+	price := 100.0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		candle := generateRandomWalkCandle(r, price)
+		price, _ = candle.Close.Float64()
+		candleChart.AddCandle(candle)
+		candleChart.CompleteCurrentCandle()
+	}
+}
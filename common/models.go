@@ -1,11 +1,14 @@
 package common
 
-import "time"
+import (
+	"github.com/shopspring/decimal"
+	"time"
+)
 
 type Order struct {
 	Id    string
 	Side  string
-	Size  float64
-	Price float64
+	Size  decimal.Decimal
+	Price decimal.Decimal
 	Time  time.Time
 }
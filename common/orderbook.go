@@ -0,0 +1,226 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+	"math/rand"
+)
+
+const (
+	SIDE_BUY  = "buy"
+	SIDE_SELL = "sell"
+
+	// Skip lists levels, enough for millions of price levels
+	MAX_SKIP_LEVEL = 24
+)
+
+// OrderBook keeps price levels sorted, bids from highest and asks from lowest, so
+// updates are O(log n) and the best prices are always the first level.
+// Levels are keyed by their price in ticks of the instrument, so two prices only
+// share a level when they are the same price on the exchange
+type OrderBook struct {
+	TickSize decimal.Decimal
+	bids     *skipList
+	asks     *skipList
+}
+
+type skipNode struct {
+	ticks int64
+	order Order
+	next  []*skipNode
+}
+
+type skipList struct {
+	head   *skipNode
+	level  int
+	length int
+	// Whether a price should come before another one
+	before func(a, b int64) bool
+}
+
+// Public
+
+func CreateNewOrderBook(tickSize decimal.Decimal) *OrderBook {
+	return &OrderBook{
+		TickSize: tickSize,
+		bids:     createSkipList(func(a, b int64) bool { return a > b }),
+		asks:     createSkipList(func(a, b int64) bool { return a < b }),
+	}
+}
+
+// Update sets the size of a price level, a size of zero removes it
+func (book *OrderBook) Update(side string, price, size decimal.Decimal) {
+	list := book.side(side)
+	if list == nil {
+		return
+	}
+	if size.Sign() <= 0 {
+		list.remove(book.Ticks(price))
+		return
+	}
+	list.set(book.Ticks(price), Order{Side: side, Price: price, Size: size})
+}
+
+func (book *OrderBook) Remove(side string, price decimal.Decimal) {
+	if list := book.side(side); list != nil {
+		list.remove(book.Ticks(price))
+	}
+}
+
+func (book *OrderBook) Get(side string, price decimal.Decimal) (Order, bool) {
+	list := book.side(side)
+	if list == nil {
+		return Order{}, false
+	}
+	node := list.find(book.Ticks(price))
+	if node == nil {
+		return Order{}, false
+	}
+	return node.order, true
+}
+
+func (book *OrderBook) BestBid() (Order, bool) {
+	return book.bids.first()
+}
+
+func (book *OrderBook) BestAsk() (Order, bool) {
+	return book.asks.first()
+}
+
+// Depth returns up to n best levels of a side, best price first. A negative n
+// is treated as 0
+func (book *OrderBook) Depth(side string, n int) []Order {
+	list := book.side(side)
+	if list == nil {
+		return nil
+	}
+	if n < 0 {
+		n = 0
+	}
+	levels := make([]Order, 0, n)
+	for node := list.head.next[0]; node != nil && len(levels) < n; node = node.next[0] {
+		levels = append(levels, node.order)
+	}
+	return levels
+}
+
+// Len returns the number of price levels, on both sides
+func (book *OrderBook) Len() int {
+	return book.bids.length + book.asks.length
+}
+
+func (book *OrderBook) Clear() {
+	book.bids = createSkipList(book.bids.before)
+	book.asks = createSkipList(book.asks.before)
+}
+
+// TopOfBook returns the best bid and ask, with their sizes
+func (book *OrderBook) TopOfBook() BookUpdate {
+	update := BookUpdate{}
+	if bid, ok := book.BestBid(); ok {
+		update.Bid, update.BidSize = bid.Price, bid.Size
+	}
+	if ask, ok := book.BestAsk(); ok {
+		update.Ask, update.AskSize = ask.Price, ask.Size
+	}
+	return update
+}
+
+// Ticks returns the price as a number of ticks, rounded to the closest one
+func (book *OrderBook) Ticks(price decimal.Decimal) int64 {
+	return price.Div(book.TickSize).Round(0).IntPart()
+}
+
+// Private
+
+func (book *OrderBook) side(side string) *skipList {
+	if side == SIDE_BUY {
+		return book.bids
+	} else if side == SIDE_SELL {
+		return book.asks
+	}
+	return nil
+}
+
+func createSkipList(before func(a, b int64) bool) *skipList {
+	return &skipList{
+		head:   &skipNode{next: make([]*skipNode, MAX_SKIP_LEVEL)},
+		level:  1,
+		before: before,
+	}
+}
+
+func (list *skipList) first() (Order, bool) {
+	if list.head.next[0] == nil {
+		return Order{}, false
+	}
+	return list.head.next[0].order, true
+}
+
+// Fills update with the last node before price on each level
+func (list *skipList) search(ticks int64, update []*skipNode) *skipNode {
+	node := list.head
+	for i := list.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && list.before(node.next[i].ticks, ticks) {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (list *skipList) find(ticks int64) *skipNode {
+	node := list.search(ticks, nil)
+	if node != nil && node.ticks == ticks {
+		return node
+	}
+	return nil
+}
+
+func (list *skipList) set(ticks int64, order Order) {
+	update := make([]*skipNode, MAX_SKIP_LEVEL)
+	node := list.search(ticks, update)
+	if node != nil && node.ticks == ticks {
+		node.order = order
+		return
+	}
+
+	level := randomLevel()
+	if level > list.level {
+		for i := list.level; i < level; i++ {
+			update[i] = list.head
+		}
+		list.level = level
+	}
+	node = &skipNode{ticks: ticks, order: order, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	list.length += 1
+}
+
+func (list *skipList) remove(ticks int64) {
+	update := make([]*skipNode, MAX_SKIP_LEVEL)
+	node := list.search(ticks, update)
+	if node == nil || node.ticks != ticks {
+		return
+	}
+	for i := 0; i < list.level && update[i].next[i] == node; i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for list.level > 1 && list.head.next[list.level-1] == nil {
+		list.level -= 1
+	}
+	list.length -= 1
+}
+
+// Each level has a 1/4 chance of being promoted to the next one
+func randomLevel() int {
+	level := 1
+	for level < MAX_SKIP_LEVEL && rand.Int63()&3 == 0 {
+		level += 1
+	}
+	return level
+}
@@ -0,0 +1,184 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func d(value float64) decimal.Decimal {
+	return decimal.NewFromFloat(value)
+}
+
+func generateOrderBook() *OrderBook {
+	orderBook := CreateNewOrderBook(DEFAULT_TICK_SIZE)
+	orderBook.Update(SIDE_BUY, d(1000), d(2))
+	orderBook.Update(SIDE_BUY, d(1020), d(3))
+	orderBook.Update(SIDE_BUY, d(1029), d(5))
+	orderBook.Update(SIDE_SELL, d(1033), d(8))
+	orderBook.Update(SIDE_SELL, d(1031), d(1))
+	orderBook.Update(SIDE_SELL, d(1040), d(4))
+	return orderBook
+}
+
+func TestOrderBookBestPrices(t *testing.T) {
+	// GIVEN
+	orderBook := generateOrderBook()
+
+	// WHEN
+	bid, okBid := orderBook.BestBid()
+	ask, okAsk := orderBook.BestAsk()
+
+	// THEN
+	if !okBid || !bid.Price.Equal(d(1029)) || !bid.Size.Equal(d(5)) {
+		t.Errorf("Wrong best bid %#v", bid)
+	}
+	if !okAsk || !ask.Price.Equal(d(1031)) || !ask.Size.Equal(d(1)) {
+		t.Errorf("Wrong best ask %#v", ask)
+	}
+	if orderBook.Len() != 6 {
+		t.Errorf("Order book should have length %d, has length %d", 6, orderBook.Len())
+	}
+}
+
+func TestOrderBookUpdateAndRemove(t *testing.T) {
+	// GIVEN
+	orderBook := generateOrderBook()
+
+	// WHEN
+	orderBook.Update(SIDE_BUY, d(1029), d(0))
+	orderBook.Update(SIDE_BUY, d(1020), d(7))
+	orderBook.Remove(SIDE_SELL, d(1031))
+	orderBook.Remove(SIDE_SELL, d(1032))
+	top := orderBook.TopOfBook()
+
+	// THEN
+	if !top.Bid.Equal(d(1020)) || !top.BidSize.Equal(d(7)) || !top.Ask.Equal(d(1033)) || !top.AskSize.Equal(d(8)) {
+		t.Errorf("Wrong top of book %#v", top)
+	}
+	if _, ok := orderBook.Get(SIDE_BUY, d(1029)); ok {
+		t.Errorf("Level with size 0 should have been removed")
+	}
+	if orderBook.Len() != 4 {
+		t.Errorf("Order book should have length %d, has length %d", 4, orderBook.Len())
+	}
+}
+
+func TestOrderBookDepth(t *testing.T) {
+	// GIVEN
+	orderBook := generateOrderBook()
+
+	// WHEN
+	bids := orderBook.Depth(SIDE_BUY, 2)
+	asks := orderBook.Depth(SIDE_SELL, 10)
+	none := orderBook.Depth(SIDE_SELL, -1)
+
+	// THEN
+	if len(bids) != 2 || !bids[0].Price.Equal(d(1029)) || !bids[1].Price.Equal(d(1020)) {
+		t.Errorf("Wrong bid depth %v", bids)
+	}
+	if len(asks) != 3 || !asks[0].Price.Equal(d(1031)) || !asks[1].Price.Equal(d(1033)) || !asks[2].Price.Equal(d(1040)) {
+		t.Errorf("Wrong ask depth %v", asks)
+	}
+	if len(none) != 0 {
+		t.Errorf("Negative depth should return no level, got %v", none)
+	}
+}
+
+func TestOrderBookRandomUpdates(t *testing.T) {
+	// GIVEN
+	orderBook := CreateNewOrderBook(DEFAULT_TICK_SIZE)
+	expected := map[int64]int64{}
+
+	// WHEN
+	for i := 0; i < 5000; i++ {
+		price := int64(rand.Intn(500))
+		size := int64(rand.Intn(3))
+		orderBook.Update(SIDE_SELL, decimal.New(price, 0), decimal.New(size, 0))
+		if size == 0 {
+			delete(expected, price)
+		} else {
+			expected[price] = size
+		}
+	}
+
+	// THEN
+	levels := orderBook.Depth(SIDE_SELL, 1000)
+	if len(levels) != len(expected) {
+		t.Fatalf("Book should have %d levels, has %d", len(expected), len(levels))
+	}
+	for i, level := range levels {
+		if i > 0 && levels[i-1].Price.Cmp(level.Price) >= 0 {
+			t.Errorf("Levels not sorted at %d: %s then %s", i, levels[i-1].Price, level.Price)
+		}
+		if expected[level.Price.IntPart()] != level.Size.IntPart() {
+			t.Errorf("Wrong size at %s: %s, wanted %d", level.Price, level.Size, expected[level.Price.IntPart()])
+		}
+	}
+}
+
+func TestOrderBookTickPrecision(t *testing.T) {
+	// GIVEN
+	// ETH-BTC like prices, which used to collide when formatted with 5 decimals
+	orderBook := CreateNewOrderBook(decimal.New(1, -8))
+	price1, _ := decimal.NewFromString("0.07612341")
+	price2, _ := decimal.NewFromString("0.07612342")
+
+	// WHEN
+	orderBook.Update(SIDE_BUY, price1, d(1))
+	orderBook.Update(SIDE_BUY, price2, d(2))
+
+	// THEN
+	if orderBook.Len() != 2 {
+		t.Errorf("Order book should have length %d, has length %d", 2, orderBook.Len())
+	}
+	bid, _ := orderBook.BestBid()
+	if bid.Price.String() != "0.07612342" {
+		t.Errorf("Best bid should keep the exchange price, got %s", bid.Price)
+	}
+	if orderBook.Ticks(price1) != 7612341 {
+		t.Errorf("Wrong number of ticks %d", orderBook.Ticks(price1))
+	}
+}
+
+// Updates around the top of a deep book, followed by reading the best prices, as done
+// for every book message
+func BenchmarkOrderBookUpdate(b *testing.B) {
+	orderBook := CreateNewOrderBook(DEFAULT_TICK_SIZE)
+	for i := 0; i < 10000; i++ {
+		orderBook.Update(SIDE_BUY, decimal.New(int64(i), -2), d(1))
+		orderBook.Update(SIDE_SELL, decimal.New(int64(10000+i), -2), d(1))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		orderBook.Update(SIDE_BUY, decimal.New(int64(9990+i%10), -2), decimal.New(int64(i%3), 0))
+		orderBook.TopOfBook()
+	}
+}
+
+// Previous implementation, a map keyed by side and price scanned for the best prices
+func BenchmarkMapScanUpdate(b *testing.B) {
+	orderBook := map[string]*Order{}
+	for i := 0; i < 10000; i++ {
+		orderBook["buy-"+strconv.Itoa(i)] = &Order{Side: SIDE_BUY, Price: decimal.New(int64(i), -2), Size: d(1)}
+		orderBook["sell-"+strconv.Itoa(10000+i)] = &Order{Side: SIDE_SELL, Price: decimal.New(int64(10000+i), -2), Size: d(1)}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := "buy-" + strconv.Itoa(9990+i%10)
+		if _, ok := orderBook[id]; !ok {
+			orderBook[id] = &Order{Side: SIDE_BUY}
+		}
+		orderBook[id].Price, orderBook[id].Size = decimal.New(int64(9990+i%10), -2), decimal.New(int64(i%3), 0)
+
+		var buy, sell decimal.Decimal
+		for _, order := range orderBook {
+			if order.Side == SIDE_SELL && (buy.Cmp(order.Price) > 0 || buy.Sign() == 0) && order.Size.Sign() > 0 {
+				buy = order.Price
+			} else if order.Side == SIDE_BUY && sell.Cmp(order.Price) < 0 && order.Size.Sign() > 0 {
+				sell = order.Price
+			}
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package common
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Recorded when the connection was dialed again, so replays reset the feed state at the
+// same point
+const FRAME_RECONNECT = -1
+
+// Data an exchange fetched outside of the feed, e.g. a REST book snapshot, recorded so
+// replays don't need the network
+const FRAME_SNAPSHOT = -2
+
+const SEGMENT_EXTENSION = ".rec.gz"
+
+var SEGMENT_DURATION = time.Hour
+
+// Longest time a frame stays in the gzip buffer, and is lost on a crash
+var RECORD_FLUSH_INTERVAL = 10 * time.Second
+
+var ErrRecorderClosed = errors.New("recorder closed")
+
+// Recorder writes every raw frame read by a connection to gzipped segment files named
+// <prefix>-<start time>.rec.gz, starting a new one every SegmentDuration. Each frame is
+// its unix time in nanoseconds, its websocket message type, its length and its data
+type Recorder struct {
+	Dir             string
+	Prefix          string
+	SegmentDuration time.Duration
+	// Frames are written to the segment file at most this long after being recorded,
+	// only when the segment is closed when 0
+	FlushInterval time.Duration
+
+	mutex        sync.Mutex
+	file         *os.File
+	writer       *gzip.Writer
+	segmentStart time.Time
+	// Pending flush of the frames recorded since the last one
+	flushTimer *time.Timer
+	// Frames read after Close are refused, instead of starting a segment never closed
+	closed bool
+}
+
+// Replay reads recorded segments back as a Feed, waiting between frames as long as when
+// they were recorded, divided by Speed
+type Replay struct {
+	Files []string
+	// 1 for the recorded speed, 10 for ten times faster, 0 as fast as possible
+	Speed float64
+	// Called when a reconnect was recorded, see Connection.OnReconnect
+	OnReconnect func()
+	// Called with the time and data of each recorded snapshot frame, see FRAME_SNAPSHOT
+	OnSnapshot func(t time.Time, data []byte)
+
+	reader     *bufio.Reader
+	gzip       *gzip.Reader
+	file       *os.File
+	next       int
+	now        time.Time
+	firstFrame time.Time
+	started    time.Time
+	quit       chan struct{}
+	closeOnce  sync.Once
+}
+
+// Public
+
+func CreateNewRecorder(dir, prefix string) *Recorder {
+	return &Recorder{Dir: dir, Prefix: prefix, SegmentDuration: SEGMENT_DURATION, FlushInterval: RECORD_FLUSH_INTERVAL}
+}
+
+// Record appends the frame to the current segment, starting a new one when it is older
+// than the segment duration
+func (recorder *Recorder) Record(t time.Time, msgType int, data []byte) error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.closed {
+		return ErrRecorderClosed
+	}
+	if recorder.writer == nil || (recorder.SegmentDuration > 0 && t.Sub(recorder.segmentStart) >= recorder.SegmentDuration) {
+		if err := recorder.rotate(t); err != nil {
+			return err
+		}
+	}
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint64(header[0:8], uint64(t.UnixNano()))
+	header[8] = byte(int8(msgType))
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(data)))
+	if _, err := recorder.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := recorder.writer.Write(data); err != nil {
+		return err
+	}
+	if recorder.flushTimer == nil && recorder.FlushInterval > 0 {
+		recorder.flushTimer = time.AfterFunc(recorder.FlushInterval, recorder.flush)
+	}
+	return nil
+}
+
+// Close flushes and closes the current segment, later frames are not recorded
+func (recorder *Recorder) Close() error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.closed = true
+	return recorder.closeSegment()
+}
+
+// SegmentFiles returns the segments recorded in dir with the prefix, oldest first
+func SegmentFiles(dir, prefix string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, prefix+"-*"+SEGMENT_EXTENSION))
+	if err != nil {
+		return nil, err
+	}
+	// Start times sort as strings
+	sort.Strings(files)
+	return files, nil
+}
+
+func CreateNewReplay(files []string, speed float64) *Replay {
+	return &Replay{Files: files, Speed: speed, quit: make(chan struct{})}
+}
+
+// ReadMessage returns the next recorded frame, after waiting for its time to come.
+// Returns io.EOF after the last frame, and ErrConnectionClosed once closed
+func (replay *Replay) ReadMessage() (int, []byte, error) {
+	for {
+		t, msgType, data, err := replay.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := replay.wait(t); err != nil {
+			return 0, nil, err
+		}
+		replay.now = t
+		if msgType == FRAME_RECONNECT {
+			if replay.OnReconnect != nil {
+				replay.OnReconnect()
+			}
+			continue
+		} else if msgType == FRAME_SNAPSHOT {
+			if replay.OnSnapshot != nil {
+				replay.OnSnapshot(t, data)
+			}
+			continue
+		}
+		return msgType, data, nil
+	}
+}
+
+// Subscribe does nothing, subscriptions are part of the recording
+func (replay *Replay) Subscribe(message interface{}) error {
+	return nil
+}
+
+// Now returns the recorded time of the last frame read
+func (replay *Replay) Now() time.Time {
+	return replay.now
+}
+
+func (replay *Replay) Close() error {
+	replay.closeOnce.Do(func() { close(replay.quit) })
+	return nil
+}
+
+// Private
+
+// Writes the frames buffered by gzip to the segment file, so a crash doesn't lose them
+func (recorder *Recorder) flush() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.flushTimer = nil
+	if recorder.writer == nil {
+		return
+	}
+	if err := recorder.writer.Flush(); err != nil {
+		println("Error flushing recording:", err.Error())
+	}
+}
+
+func (recorder *Recorder) rotate(t time.Time) error {
+	if err := recorder.closeSegment(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(recorder.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s%s", recorder.Prefix, t.UTC().Format("20060102T150405.000000000"), SEGMENT_EXTENSION)
+	file, err := os.OpenFile(filepath.Join(recorder.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	recorder.file, recorder.writer, recorder.segmentStart = file, gzip.NewWriter(file), t
+	return nil
+}
+
+func (recorder *Recorder) closeSegment() error {
+	if recorder.flushTimer != nil {
+		recorder.flushTimer.Stop()
+		recorder.flushTimer = nil
+	}
+	if recorder.writer == nil {
+		return nil
+	}
+	err := recorder.writer.Close()
+	if closeErr := recorder.file.Close(); err == nil {
+		err = closeErr
+	}
+	recorder.file, recorder.writer = nil, nil
+	return err
+}
+
+// Reads the next frame, going through the files in order
+func (replay *Replay) readFrame() (time.Time, int, []byte, error) {
+	for {
+		if replay.reader == nil {
+			if replay.next >= len(replay.Files) {
+				return time.Time{}, 0, nil, io.EOF
+			}
+			if err := replay.open(replay.Files[replay.next]); err != nil {
+				return time.Time{}, 0, nil, err
+			}
+			replay.next += 1
+		}
+		header := make([]byte, 13)
+		if _, err := io.ReadFull(replay.reader, header); err != nil {
+			replay.closeFile()
+			// A segment cut short by a crash still has its first frames
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				continue
+			}
+			return time.Time{}, 0, nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[9:13]))
+		if _, err := io.ReadFull(replay.reader, data); err != nil {
+			replay.closeFile()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				continue
+			}
+			return time.Time{}, 0, nil, err
+		}
+		t := time.Unix(0, int64(binary.BigEndian.Uint64(header[0:8])))
+		return t, int(int8(header[8])), data, nil
+	}
+}
+
+func (replay *Replay) open(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	replay.file, replay.gzip, replay.reader = file, reader, bufio.NewReader(reader)
+	return nil
+}
+
+func (replay *Replay) closeFile() {
+	if replay.file != nil {
+		replay.gzip.Close()
+		replay.file.Close()
+	}
+	replay.file, replay.gzip, replay.reader = nil, nil, nil
+}
+
+// Waits until the frame is due, relative to the first one
+func (replay *Replay) wait(t time.Time) error {
+	select {
+	case <-replay.quit:
+		replay.closeFile()
+		return ErrConnectionClosed
+	default:
+	}
+	if replay.firstFrame.IsZero() {
+		replay.firstFrame, replay.started = t, time.Now()
+		return nil
+	}
+	if replay.Speed <= 0 {
+		return nil
+	}
+	due := replay.started.Add(time.Duration(float64(t.Sub(replay.firstFrame)) / replay.Speed))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-replay.quit:
+		replay.closeFile()
+		return ErrConnectionClosed
+	case <-time.After(delay):
+		return nil
+	}
+}
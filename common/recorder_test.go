@@ -0,0 +1,224 @@
+package common
+
+import (
+	ws "github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func generateRecording(t *testing.T, frames []string, gap time.Duration) string {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := CreateNewRecorder(dir, "test")
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, frame := range frames {
+		msgType := ws.TextMessage
+		if frame == "" {
+			msgType = FRAME_RECONNECT
+		}
+		if err := recorder.Record(start.Add(time.Duration(i)*gap), msgType, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder.Close()
+	return dir
+}
+
+func TestRecorderSegments(t *testing.T) {
+	// GIVEN
+	// Frames 20 minutes apart, segments of an hour
+	dir := generateRecording(t, []string{"a", "b", "c", "d", "e", "f", "g"}, 20*time.Minute)
+	defer os.RemoveAll(dir)
+
+	// WHEN
+	files, _ := SegmentFiles(dir, "test")
+	replay := CreateNewReplay(files, 0)
+	frames := []string{}
+	var last time.Time
+	for {
+		msgType, data, err := replay.ReadMessage()
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("Replay should end with EOF %v", err)
+			}
+			break
+		}
+		if msgType != ws.TextMessage {
+			t.Errorf("Wrong message type %d", msgType)
+		}
+		frames = append(frames, string(data))
+		last = replay.Now()
+	}
+
+	// THEN
+	if len(files) != 3 || !strings.HasSuffix(files[1], "test-20180101T010000.000000000.rec.gz") {
+		t.Errorf("Should have 3 segments, got %v", files)
+	}
+	if strings.Join(frames, "") != "abcdefg" {
+		t.Errorf("Frames should be replayed in order, got %v", frames)
+	}
+	if !last.Equal(time.Date(2018, 1, 1, 2, 0, 0, 0, time.UTC)) {
+		t.Errorf("Replay time should be the recorded one, got %v", last)
+	}
+}
+
+func TestRecorderClosed(t *testing.T) {
+	// GIVEN
+	dir := generateRecording(t, []string{"a"}, time.Second)
+	defer os.RemoveAll(dir)
+	recorder := CreateNewRecorder(dir, "test")
+	recorder.Record(time.Date(2018, 1, 1, 1, 0, 0, 0, time.UTC), ws.TextMessage, []byte("b"))
+	recorder.Close()
+
+	// WHEN
+	// A frame read just before the connection closed
+	err := recorder.Record(time.Date(2018, 1, 1, 2, 0, 0, 0, time.UTC), ws.TextMessage, []byte("c"))
+	files, _ := SegmentFiles(dir, "test")
+
+	// THEN
+	if err != ErrRecorderClosed {
+		t.Errorf("Recording after close should fail, got %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("No segment should be started after close %v", files)
+	}
+}
+
+func TestRecorderFlush(t *testing.T) {
+	// GIVEN
+	// Recorder never closed, as after a crash
+	dir, _ := ioutil.TempDir("", "recorder")
+	defer os.RemoveAll(dir)
+	recorder := CreateNewRecorder(dir, "test")
+	recorder.FlushInterval = 10 * time.Millisecond
+	recorder.Record(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), ws.TextMessage, []byte("a"))
+
+	// WHEN
+	time.Sleep(50 * time.Millisecond)
+	files, _ := SegmentFiles(dir, "test")
+	_, data, err := CreateNewReplay(files, 0).ReadMessage()
+
+	// THEN
+	if err != nil || string(data) != "a" {
+		t.Errorf("Frame should be written once flushed, got %q %v", data, err)
+	}
+}
+
+func TestReplayReconnect(t *testing.T) {
+	// GIVEN
+	dir := generateRecording(t, []string{"a", "", "b"}, time.Second)
+	defer os.RemoveAll(dir)
+	files, _ := SegmentFiles(dir, "test")
+	replay := CreateNewReplay(files, 0)
+	frames := []string{}
+	replay.OnReconnect = func() { frames = append(frames, "reset") }
+
+	// WHEN
+	for {
+		_, data, err := replay.ReadMessage()
+		if err != nil {
+			break
+		}
+		frames = append(frames, string(data))
+	}
+
+	// THEN
+	if strings.Join(frames, ",") != "a,reset,b" {
+		t.Errorf("Reconnect should reset between the frames, got %v", frames)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	// GIVEN
+	// Two seconds recorded, replayed 40 times faster
+	dir := generateRecording(t, []string{"a", "b", "c"}, time.Second)
+	defer os.RemoveAll(dir)
+	files, _ := SegmentFiles(dir, "test")
+	replay := CreateNewReplay(files, 40)
+
+	// WHEN
+	start := time.Now()
+	for {
+		if _, _, err := replay.ReadMessage(); err != nil {
+			break
+		}
+	}
+	elapsed := time.Since(start)
+
+	// THEN
+	if elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Replay should take about 50ms, took %v", elapsed)
+	}
+}
+
+func TestReplayClose(t *testing.T) {
+	// GIVEN
+	// An hour between frames at the recorded speed
+	dir := generateRecording(t, []string{"a", "b"}, time.Hour)
+	defer os.RemoveAll(dir)
+	files, _ := SegmentFiles(dir, "test")
+	replay := CreateNewReplay(files, 1)
+	replay.ReadMessage()
+
+	// WHEN
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		replay.Close()
+	}()
+	_, _, err := replay.ReadMessage()
+
+	// THEN
+	if err != ErrConnectionClosed {
+		t.Errorf("Closing should stop the wait, got %v", err)
+	}
+}
+
+func TestConnectionRecord(t *testing.T) {
+	// GIVEN
+	// Server dropping the connection after each echo
+	server, _ := generateDroppingServer(1)
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "recorder")
+	defer os.RemoveAll(dir)
+	connection := CreateNewConnection("test", "ws"+strings.TrimPrefix(server.URL, "http"), make(chan Event, EVENT_BUFFER))
+	connection.MinBackoff = time.Millisecond
+	connection.MaxBackoff = 10 * time.Millisecond
+	connection.Recorder = CreateNewRecorder(dir, "test")
+	if err := connection.Connect(); err != nil {
+		t.Fatalf("Could not connect %v", err)
+	}
+
+	// WHEN
+	connection.Subscribe(map[string]string{"type": "subscribe"})
+	connection.ReadMessage()
+	connection.ReadMessage()
+	connection.Close()
+	connection.Recorder.Close()
+
+	// THEN
+	// Both echoes were recorded, with the reconnect between them
+	files, _ := SegmentFiles(dir, "test")
+	replay := CreateNewReplay(files, 0)
+	resets := 0
+	replay.OnReconnect = func() { resets += 1 }
+	messages := 0
+	for {
+		_, data, err := replay.ReadMessage()
+		if err != nil {
+			break
+		}
+		if strings.TrimSpace(string(data)) != `{"type":"subscribe"}` {
+			t.Errorf("Wrong message recorded %s", data)
+		}
+		messages += 1
+	}
+	if messages != 2 || resets != 1 {
+		t.Errorf("Should have recorded 2 messages and a reconnect, got %d and %d", messages, resets)
+	}
+}
@@ -0,0 +1,294 @@
+package common
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SPREAD_OPEN  = "open"
+	SPREAD_CLOSE = "close"
+)
+
+// Bases named differently on some exchanges
+var SYMBOL_ALIASES = map[string]string{"XBT": "BTC"}
+
+// Quotes recognised at the end of symbols without a separator, longest first so USDT
+// isn't read as USD
+var SYMBOL_QUOTES = []string{"USDT", "USD", "EUR", "GBP", "JPY", "BTC", "ETH"}
+
+// Quotes further apart than this are not compared, one of the feeds is lagging
+var SPREAD_MAX_AGE = 10 * time.Second
+
+// Spread of a route: buying a symbol at the ask of one exchange and selling it at the
+// bid of another. Rates are relative to the ask
+type Spread struct {
+	Time   time.Time       `json:"time"`
+	Event  string          `json:"event,omitempty"`
+	Symbol string          `json:"symbol"`
+	Buy    string          `json:"buy"`
+	Sell   string          `json:"sell"`
+	Ask    decimal.Decimal `json:"ask"`
+	Bid    decimal.Decimal `json:"bid"`
+	// Size available at both prices
+	Size  decimal.Decimal `json:"size"`
+	Gross decimal.Decimal `json:"gross"`
+	// Gross less the fees of both exchanges and the transfer from the one bought on
+	Net decimal.Decimal `json:"net"`
+	// How long the opportunity lasted, on close
+	Seconds float64 `json:"seconds,omitempty"`
+}
+
+// SpreadStats of a route since the monitor started, on the gross rate
+type SpreadStats struct {
+	Last          Spread
+	Count         int
+	Min           decimal.Decimal
+	Max           decimal.Decimal
+	Sum           decimal.Decimal
+	Opportunities int
+	// Time the current opportunity opened, zero when there is none
+	opened time.Time
+}
+
+// SpreadMonitor keeps the top of book of every exchange for each symbol, normalized
+// so BTC-USD, tBTCUSD and XBTUSD are compared together, and tracks the spread of
+// every route. An opportunity opens when the net rate of a route clears MinProfit,
+// and closes when it doesn't anymore, both are written to Log as a JSON line
+type SpreadMonitor struct {
+	// Taker fee rate of each exchange
+	Fees map[string]decimal.Decimal
+	// Cost of moving the asset out of each exchange, as a rate of the notional
+	Transfers map[string]decimal.Decimal
+	MinProfit decimal.Decimal
+	MaxAge    time.Duration
+	// Opportunities are also printed to the terminal when set
+	Verbose bool
+	Log     io.Writer
+
+	// Symbol, then exchange
+	quotes map[string]map[string]BookUpdate
+	routes map[string]*SpreadStats
+}
+
+// Public
+
+func CreateNewSpreadMonitor() *SpreadMonitor {
+	return &SpreadMonitor{
+		Fees:      map[string]decimal.Decimal{},
+		Transfers: map[string]decimal.Decimal{},
+		MaxAge:    SPREAD_MAX_AGE,
+		quotes:    map[string]map[string]BookUpdate{},
+		routes:    map[string]*SpreadStats{},
+	}
+}
+
+// NormalizeSymbol returns the symbol of a product as BASE-QUOTE, e.g. BTC-USD for the
+// tBTCUSD of bitfinex and the XBTUSD of bitmex
+func NormalizeSymbol(exchange, productId string) string {
+	symbol := productId
+	if exchange == "bitfinex" && strings.HasPrefix(symbol, "t") {
+		symbol = symbol[1:]
+	}
+	symbol = strings.ToUpper(symbol)
+	base, quote := "", ""
+	if parts := strings.SplitN(symbol, "-", 2); len(parts) == 2 {
+		base, quote = parts[0], parts[1]
+	} else {
+		for _, known := range SYMBOL_QUOTES {
+			if strings.HasSuffix(symbol, known) && len(symbol) > len(known) {
+				base, quote = strings.TrimSuffix(symbol, known), known
+				break
+			}
+		}
+	}
+	if base == "" {
+		return symbol
+	}
+	if alias, ok := SYMBOL_ALIASES[base]; ok {
+		base = alias
+	}
+	if alias, ok := SYMBOL_ALIASES[quote]; ok {
+		quote = alias
+	}
+	return base + "-" + quote
+}
+
+// Update replaces the quote of the exchange and computes the routes between it and
+// every other exchange quoting the symbol. Returns the opportunities it opened
+func (monitor *SpreadMonitor) Update(book BookUpdate) []Spread {
+	symbol := NormalizeSymbol(book.Exchange, book.ProductId)
+	quotes, ok := monitor.quotes[symbol]
+	if !ok {
+		quotes = map[string]BookUpdate{}
+		monitor.quotes[symbol] = quotes
+	}
+	// An empty side can't be traded against
+	if !book.Bid.IsPositive() || !book.Ask.IsPositive() {
+		delete(quotes, book.Exchange)
+	} else {
+		quotes[book.Exchange] = book
+	}
+
+	_, live := quotes[book.Exchange]
+	opened := []Spread{}
+	for exchange, other := range quotes {
+		if exchange == book.Exchange {
+			continue
+		}
+		age := book.Time.Sub(other.Time)
+		if age < 0 {
+			age = -age
+		}
+		for _, route := range [][2]BookUpdate{{book, other}, {other, book}} {
+			if !live || age > monitor.MaxAge {
+				monitor.close(symbol, route[0].Exchange, route[1].Exchange, book.Time)
+				continue
+			}
+			if spread, ok := monitor.update(symbol, route[0], route[1], book.Time); ok {
+				opened = append(opened, spread)
+			}
+		}
+	}
+	return opened
+}
+
+// Stats returns a copy of the stats of every route, by symbol then exchanges
+func (monitor *SpreadMonitor) Stats() []SpreadStats {
+	stats := make([]SpreadStats, 0, len(monitor.routes))
+	for _, route := range monitor.routes {
+		stats = append(stats, *route)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i].Last, stats[j].Last
+		if a.Symbol != b.Symbol {
+			return a.Symbol < b.Symbol
+		}
+		if a.Buy != b.Buy {
+			return a.Buy < b.Buy
+		}
+		return a.Sell < b.Sell
+	})
+	return stats
+}
+
+// Print writes a line per route, with its last spread and how it went so far
+func (monitor *SpreadMonitor) Print(w io.Writer) {
+	for _, stats := range monitor.Stats() {
+		last := stats.Last
+		mark := ""
+		if stats.Open() {
+			mark = " *"
+		}
+		fmt.Fprintf(w, "%s buy %s %s sell %s %s - gross %s%% net %s%% (min %s%% mean %s%% max %s%%, %d opportunities)%s\n",
+			last.Symbol, last.Buy, last.Ask, last.Sell, last.Bid, percent(last.Gross), percent(last.Net),
+			percent(stats.Min), percent(stats.Mean()), percent(stats.Max), stats.Opportunities, mark)
+	}
+}
+
+// Mean gross rate of the route
+func (stats *SpreadStats) Mean() decimal.Decimal {
+	if stats.Count == 0 {
+		return decimal.Zero
+	}
+	return stats.Sum.Div(decimal.New(int64(stats.Count), 0))
+}
+
+// Open tells whether the route currently clears the fees and costs
+func (stats *SpreadStats) Open() bool {
+	return !stats.opened.IsZero()
+}
+
+// Private
+
+func (monitor *SpreadMonitor) update(symbol string, buy, sell BookUpdate, t time.Time) (Spread, bool) {
+	spread := monitor.spread(symbol, buy, sell, t)
+	key := routeKey(symbol, buy.Exchange, sell.Exchange)
+	stats, ok := monitor.routes[key]
+	if !ok {
+		stats = &SpreadStats{Min: spread.Gross, Max: spread.Gross}
+		monitor.routes[key] = stats
+	}
+	stats.Last = spread
+	stats.Count += 1
+	stats.Sum = stats.Sum.Add(spread.Gross)
+	if spread.Gross.LessThan(stats.Min) {
+		stats.Min = spread.Gross
+	}
+	if spread.Gross.GreaterThan(stats.Max) {
+		stats.Max = spread.Gross
+	}
+
+	if spread.Net.GreaterThan(monitor.MinProfit) {
+		if stats.Open() {
+			return Spread{}, false
+		}
+		stats.opened = t
+		stats.Opportunities += 1
+		spread.Event = SPREAD_OPEN
+		monitor.log(spread)
+		return spread, true
+	}
+	monitor.close(symbol, buy.Exchange, sell.Exchange, t)
+	return Spread{}, false
+}
+
+// Closes the opportunity of the route, if there is one
+func (monitor *SpreadMonitor) close(symbol, buy, sell string, t time.Time) {
+	stats, ok := monitor.routes[routeKey(symbol, buy, sell)]
+	if !ok || !stats.Open() {
+		return
+	}
+	spread := stats.Last
+	spread.Time, spread.Event = t, SPREAD_CLOSE
+	spread.Seconds = t.Sub(stats.opened).Seconds()
+	stats.opened = time.Time{}
+	monitor.log(spread)
+}
+
+func (monitor *SpreadMonitor) spread(symbol string, buy, sell BookUpdate, t time.Time) Spread {
+	gross := sell.Bid.Sub(buy.Ask).Div(buy.Ask)
+	net := gross.Sub(monitor.Fees[buy.Exchange]).Sub(monitor.Fees[sell.Exchange]).Sub(monitor.Transfers[buy.Exchange])
+	return Spread{
+		Time:   t,
+		Symbol: symbol,
+		Buy:    buy.Exchange,
+		Sell:   sell.Exchange,
+		Ask:    buy.Ask,
+		Bid:    sell.Bid,
+		Size:   decimal.Min(buy.AskSize, sell.BidSize),
+		Gross:  gross,
+		Net:    net,
+	}
+}
+
+func (monitor *SpreadMonitor) log(spread Spread) {
+	if monitor.Verbose {
+		fmt.Printf("%s: %s %s buy %s %s sell %s %s size %s net %s%%\n", spread.Time.Format(time.RFC3339), spread.Event,
+			spread.Symbol, spread.Buy, spread.Ask, spread.Sell, spread.Bid, spread.Size, percent(spread.Net))
+	}
+	if monitor.Log == nil {
+		return
+	}
+	spread.Time = spread.Time.UTC()
+	data, err := JSONEncode(spread)
+	if err != nil {
+		fmt.Printf("Could not log spread: %v\n", err)
+		return
+	}
+	if _, err := monitor.Log.Write(append(data, '\n')); err != nil {
+		fmt.Printf("Could not log spread: %v\n", err)
+	}
+}
+
+func routeKey(symbol, buy, sell string) string {
+	return symbol + " " + buy + " " + sell
+}
+
+func percent(rate decimal.Decimal) string {
+	return rate.Mul(decimal.New(100, 0)).StringFixed(3)
+}
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"bytes"
+	"github.com/shopspring/decimal"
+	"strings"
+	"testing"
+	"time"
+)
+
+func generateBook(exchange, productId, bid, ask string, t time.Time) BookUpdate {
+	return BookUpdate{
+		Exchange: exchange, ProductId: productId, Time: t,
+		Bid: decimal.RequireFromString(bid), BidSize: decimal.New(2, 0),
+		Ask: decimal.RequireFromString(ask), AskSize: decimal.New(1, 0),
+	}
+}
+
+func TestNormalizeSymbol(t *testing.T) {
+	// GIVEN
+	products := [][3]string{
+		{"gdax", "BTC-USD", "BTC-USD"},
+		{"bitfinex", "tBTCUSD", "BTC-USD"},
+		{"bitmex", "XBTUSD", "BTC-USD"},
+		{"bitfinex", "tETHUSDT", "ETH-USDT"},
+		{"gdax", "LTC-BTC", "LTC-BTC"},
+		{"bitmex", "TRUMP", "TRUMP"},
+	}
+
+	for _, product := range products {
+		// WHEN
+		symbol := NormalizeSymbol(product[0], product[1])
+
+		// THEN
+		if symbol != product[2] {
+			t.Errorf("%s on %s should be %s, got %s", product[1], product[0], product[2], symbol)
+		}
+	}
+}
+
+func TestSpreadMonitor(t *testing.T) {
+	// GIVEN
+	// Fees of 0.1% on each exchange and 0.1% to move coins out of gdax
+	monitor := CreateNewSpreadMonitor()
+	monitor.Fees["gdax"] = decimal.RequireFromString("0.001")
+	monitor.Fees["bitmex"] = decimal.RequireFromString("0.001")
+	monitor.Transfers["gdax"] = decimal.RequireFromString("0.001")
+	log := &bytes.Buffer{}
+	monitor.Log = log
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// WHEN
+	// 0.2% apart doesn't clear the costs, 0.5% does, then it goes back
+	monitor.Update(generateBook("gdax", "BTC-USD", "999", "1000", start))
+	small := monitor.Update(generateBook("bitmex", "XBTUSD", "1002", "1003", start.Add(time.Second)))
+	large := monitor.Update(generateBook("bitmex", "XBTUSD", "1005", "1006", start.Add(2*time.Second)))
+	again := monitor.Update(generateBook("bitmex", "XBTUSD", "1005.5", "1006", start.Add(3*time.Second)))
+	monitor.Update(generateBook("bitmex", "XBTUSD", "1000", "1001", start.Add(5*time.Second)))
+	stats := monitor.Stats()
+
+	// THEN
+	if len(small) != 0 || len(again) != 0 {
+		t.Errorf("Only the first update clearing the costs should open an opportunity %v %v", small, again)
+	}
+	if len(large) != 1 || large[0].Buy != "gdax" || large[0].Sell != "bitmex" || large[0].Symbol != "BTC-USD" {
+		t.Fatalf("Should open buying on gdax and selling on bitmex %v", large)
+	}
+	if large[0].Gross.String() != "0.005" || large[0].Net.String() != "0.002" || large[0].Size.String() != "1" {
+		t.Errorf("Wrong opportunity %v %v %v", large[0].Gross, large[0].Net, large[0].Size)
+	}
+	if len(stats) != 2 || stats[1].Last.Buy != "gdax" || stats[1].Count != 4 || stats[1].Opportunities != 1 {
+		t.Fatalf("Wrong routes %v", stats)
+	}
+	if stats[1].Min.String() != "0" || stats[1].Max.String() != "0.0055" || stats[1].Mean().String() != "0.003125" || stats[1].Open() {
+		t.Errorf("Wrong stats %v %v %v", stats[1].Min, stats[1].Max, stats[1].Mean())
+	}
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"event":"open"`) || !strings.Contains(lines[1], `"event":"close"`) ||
+		!strings.Contains(lines[1], `"seconds":3`) {
+		t.Errorf("Should log the opening and closing %v", lines)
+	}
+}
+
+func TestSpreadMonitorStale(t *testing.T) {
+	// GIVEN
+	monitor := CreateNewSpreadMonitor()
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	monitor.Update(generateBook("gdax", "BTC-USD", "999", "1000", start))
+	opened := monitor.Update(generateBook("bitfinex", "tBTCUSD", "1010", "1011", start))
+
+	// WHEN
+	// gdax stops updating
+	stale := monitor.Update(generateBook("bitfinex", "tBTCUSD", "1020", "1021", start.Add(time.Minute)))
+	stats := monitor.Stats()
+
+	// THEN
+	if len(opened) != 1 || len(stale) != 0 {
+		t.Errorf("Stale quotes should not be compared %v %v", opened, stale)
+	}
+	if len(stats) != 2 || stats[1].Open() || !stats[1].Last.Bid.Equal(decimal.New(1010, 0)) {
+		t.Errorf("Opportunities should close when a quote goes stale %v", stats)
+	}
+}
@@ -0,0 +1,504 @@
+package common
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Versions of the formats written. Readers refuse newer versions, adding indicators
+// doesn't need a new version since they are read by name
+const CANDLE_CSV_VERSION = 1
+const CANDLE_JSONL_VERSION = 1
+
+// CandleStore appends candles to a file and reads them back, in one format
+type CandleStore interface {
+	// Append adds the candles at the end of the file, creating it when missing
+	Append(path string, candles []Candle) error
+	Read(path string) ([]Candle, error)
+	// Extension of the files of the format, e.g. ".csv"
+	Extension() string
+	// Flush writes what Append buffered, stores writing straight away do nothing
+	Flush() error
+}
+
+// AgedCandleStore is a CandleStore buffering candles, FlushAged writes those buffered
+// for too long. It is called regularly so candles are not lost on a crash
+type AgedCandleStore interface {
+	CandleStore
+	FlushAged() error
+}
+
+// CSVCandleStore writes a version line, a header, then a line per candle. Indicators
+// get a column each, named after them. Appending candles with indicators not in the
+// header starts a new section, with a version line and a header having them too
+type CSVCandleStore struct{}
+
+// JSONLCandleStore writes a JSON object per candle, with its version
+type JSONLCandleStore struct{}
+
+// TextCandleStore writes the format gdax always wrote, a line per candle as "time open
+// high low close average volume mfi macd macdh" with a unix time. Other indicators and
+// the missing flag are left out, an indicator not computed is written as 0
+type TextCandleStore struct{}
+
+// Indicators of the text format, in their column order
+var TEXT_INDICATORS = []string{"mfi", "macd", "macdh"}
+
+// Line of a JSONL file
+type candleRecord struct {
+	Version    int                `json:"version"`
+	Time       time.Time          `json:"time"`
+	Open       decimal.Decimal    `json:"open"`
+	High       decimal.Decimal    `json:"high"`
+	Low        decimal.Decimal    `json:"low"`
+	Close      decimal.Decimal    `json:"close"`
+	Average    decimal.Decimal    `json:"average"`
+	Volume     decimal.Decimal    `json:"volume"`
+	Missing    bool               `json:"missing,omitempty"`
+	Indicators map[string]float64 `json:"indicators,omitempty"`
+}
+
+var CANDLE_COLUMNS = []string{"time", "open", "high", "low", "close", "average", "volume", "missing"}
+
+// Files can be appended to and flushed from different goroutines, a header must only be
+// written once
+var appendMutex sync.Mutex
+
+// Indicator columns of the last section of the CSV files appended to, so they are only
+// read once. Guarded by appendMutex
+var csvIndicators = map[string][]string{}
+
+// Public
+
+// CandleStoreFor picks the store from the extension of the path
+func CandleStoreFor(path string) (CandleStore, error) {
+	for _, store := range []CandleStore{&CSVCandleStore{}, &JSONLCandleStore{}, &BinaryCandleStore{}, &TextCandleStore{}} {
+		if filepath.Ext(path) == store.Extension() {
+			return store, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown candle format %s, expected .csv, .jsonl, .candles or .txt", path)
+}
+
+// ParseCandleStore returns the store of a format name: text, csv, jsonl or binary
+func ParseCandleStore(format string) (CandleStore, error) {
+	switch format {
+	case "text":
+		return &TextCandleStore{}, nil
+	case "csv":
+		return &CSVCandleStore{}, nil
+	case "jsonl":
+		return &JSONLCandleStore{}, nil
+	case "binary":
+		return CreateNewBinaryCandleStore(), nil
+	}
+	return nil, fmt.Errorf("unknown candle format %s, expected text, csv, jsonl or binary", format)
+}
+
+func (store *CSVCandleStore) Extension() string {
+	return ".csv"
+}
+
+func (store *CSVCandleStore) Flush() error {
+	return nil
+}
+
+func (store *CSVCandleStore) Append(path string, candles []Candle) error {
+	appendMutex.Lock()
+	defer appendMutex.Unlock()
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	names, ok := csvIndicators[path]
+	if info.Size() == 0 {
+		names = nil
+	} else if !ok {
+		if names, err = lastCSVIndicators(bufio.NewReader(file)); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	// Columns are kept, the new indicators are added to them
+	if added := addedIndicators(names, candles); info.Size() == 0 || len(added) > 0 {
+		names = append(append([]string{}, names...), added...)
+		sort.Strings(names)
+		header := append(append([]string{}, CANDLE_COLUMNS...), names...)
+		if _, err := fmt.Fprintf(file, "# candles v%d\n%s\n", CANDLE_CSV_VERSION, strings.Join(header, ",")); err != nil {
+			return err
+		}
+	}
+	csvIndicators[path] = names
+
+	writer := csv.NewWriter(file)
+	for _, candle := range candles {
+		missing := ""
+		if candle.Missing {
+			missing = "1"
+		}
+		line := []string{candle.Time.UTC().Format(time.RFC3339), candle.Open.String(), candle.High.String(),
+			candle.Low.String(), candle.Close.String(), candle.Average.String(), candle.Volume.String(), missing}
+		for _, name := range names {
+			value, ok := candle.Indicators[name]
+			if !ok {
+				line = append(line, "")
+				continue
+			}
+			line = append(line, strconv.FormatFloat(value, 'f', -1, 64))
+		}
+		if err := writer.Write(line); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (store *CSVCandleStore) Read(path string) ([]Candle, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var header []string
+	var columns map[string]int
+	candles := []Candle{}
+	for line := 1; ; line++ {
+		text, err := reader.ReadString('\n')
+		if err == io.EOF && text == "" {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		text = strings.TrimSpace(text)
+		// Each section starts with a version line and its header
+		if header == nil || strings.HasPrefix(text, "#") {
+			if header, err = readCSVHeader(text, reader); err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+			}
+			line++
+			if columns, err = csvColumns(header); err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+			}
+			continue
+		} else if text == "" {
+			continue
+		}
+		record, err := csv.NewReader(strings.NewReader(text)).Read()
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		candle, err := parseCSVCandle(record, header, columns)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		candles = append(candles, candle)
+	}
+	if header == nil {
+		return nil, fmt.Errorf("%s: no version line", path)
+	}
+	return candles, nil
+}
+
+func (store *JSONLCandleStore) Extension() string {
+	return ".jsonl"
+}
+
+func (store *JSONLCandleStore) Flush() error {
+	return nil
+}
+
+func (store *JSONLCandleStore) Append(path string, candles []Candle) error {
+	appendMutex.Lock()
+	defer appendMutex.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	for _, candle := range candles {
+		data, err := JSONEncode(candleRecord{
+			Version:    CANDLE_JSONL_VERSION,
+			Time:       candle.Time.UTC(),
+			Open:       candle.Open,
+			High:       candle.High,
+			Low:        candle.Low,
+			Close:      candle.Close,
+			Average:    candle.Average,
+			Volume:     candle.Volume,
+			Missing:    candle.Missing,
+			Indicators: candle.Indicators,
+		})
+		if err != nil {
+			return err
+		}
+		writer.Write(data)
+		writer.WriteByte('\n')
+	}
+	return writer.Flush()
+}
+
+func (store *JSONLCandleStore) Read(path string) ([]Candle, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	candles := []Candle{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		record := candleRecord{}
+		if err := JSONDecode([]byte(text), &record); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		if record.Version > CANDLE_JSONL_VERSION {
+			return nil, fmt.Errorf("%s line %d: version %d is newer than %d", path, line, record.Version, CANDLE_JSONL_VERSION)
+		}
+		if record.Indicators == nil {
+			record.Indicators = map[string]float64{}
+		}
+		candles = append(candles, Candle{
+			Time:       record.Time,
+			Open:       record.Open,
+			High:       record.High,
+			Low:        record.Low,
+			Close:      record.Close,
+			Average:    record.Average,
+			Volume:     record.Volume,
+			Missing:    record.Missing,
+			Indicators: record.Indicators,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return candles, nil
+}
+
+func (store *TextCandleStore) Extension() string {
+	return ".txt"
+}
+
+func (store *TextCandleStore) Flush() error {
+	return nil
+}
+
+func (store *TextCandleStore) Append(path string, candles []Candle) error {
+	appendMutex.Lock()
+	defer appendMutex.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	for _, candle := range candles {
+		fmt.Fprintf(writer, "%d %s %s %s %s %s %s %f %f %f\n", candle.Time.Unix(), candle.Open, candle.High,
+			candle.Low, candle.Close, candle.Average, candle.Volume,
+			candle.Indicators["mfi"], candle.Indicators["macd"], candle.Indicators["macdh"])
+	}
+	return writer.Flush()
+}
+
+func (store *TextCandleStore) Read(path string) ([]Candle, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	candles := []Candle{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		candle, err := parseTextCandle(strings.Fields(text))
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		candles = append(candles, candle)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return candles, nil
+}
+
+// Private
+
+// Older files may have fewer indicators, or none
+func parseTextCandle(fields []string) (Candle, error) {
+	if len(fields) < 7 {
+		return Candle{}, fmt.Errorf("expected at least 7 fields, got %d", len(fields))
+	}
+	seconds, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return Candle{}, err
+	}
+	candle := Candle{Time: time.Unix(seconds, 0), Indicators: map[string]float64{}}
+	values := []*decimal.Decimal{&candle.Open, &candle.High, &candle.Low, &candle.Close, &candle.Average, &candle.Volume}
+	for i, value := range values {
+		if *value, err = decimal.NewFromString(fields[i+1]); err != nil {
+			return Candle{}, fmt.Errorf("%s: %v", CANDLE_COLUMNS[i+1], err)
+		}
+	}
+	for i, name := range TEXT_INDICATORS {
+		if len(fields) <= 7+i {
+			break
+		}
+		if candle.Indicators[name], err = strconv.ParseFloat(fields[7+i], 64); err != nil {
+			return Candle{}, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return candle, nil
+}
+
+// Checks the version line of a section, then reads its header
+func readCSVHeader(versionLine string, reader *bufio.Reader) ([]string, error) {
+	var version int
+	if _, err := fmt.Sscanf(versionLine, "# candles v%d", &version); err != nil {
+		return nil, fmt.Errorf("invalid version line %q", versionLine)
+	}
+	if version > CANDLE_CSV_VERSION {
+		return nil, fmt.Errorf("version %d is newer than %d", version, CANDLE_CSV_VERSION)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, fmt.Errorf("no header")
+	}
+	header := strings.Split(strings.TrimSpace(line), ",")
+	if len(header) < len(CANDLE_COLUMNS) {
+		return nil, fmt.Errorf("invalid header %q", strings.TrimSpace(line))
+	}
+	return header, nil
+}
+
+// Position of each column of the header
+func csvColumns(header []string) (map[string]int, error) {
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range CANDLE_COLUMNS {
+		if _, ok := columns[name]; !ok && name != "missing" {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+	return columns, nil
+}
+
+// Indicator columns of the last section of a file, those candles are appended with.
+// Columns of newer writers are kept, so their values are left empty
+func lastCSVIndicators(reader *bufio.Reader) ([]string, error) {
+	var header []string
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.HasPrefix(line, "#") {
+			if header, err = readCSVHeader(strings.TrimSpace(line), reader); err != nil {
+				return nil, err
+			}
+		} else if header == nil {
+			return nil, fmt.Errorf("no version line")
+		}
+		if err == io.EOF {
+			return header[len(CANDLE_COLUMNS):], nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func parseCSVCandle(record, header []string, columns map[string]int) (Candle, error) {
+	if len(record) != len(header) {
+		return Candle{}, fmt.Errorf("expected %d fields, got %d", len(header), len(record))
+	}
+	candle := Candle{Indicators: map[string]float64{}}
+	var err error
+	if candle.Time, err = time.Parse(time.RFC3339, record[columns["time"]]); err != nil {
+		return Candle{}, err
+	}
+	values := []*decimal.Decimal{&candle.Open, &candle.High, &candle.Low, &candle.Close, &candle.Average, &candle.Volume}
+	for i, name := range CANDLE_COLUMNS[1:7] {
+		if *values[i], err = decimal.NewFromString(record[columns[name]]); err != nil {
+			return Candle{}, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if i, ok := columns["missing"]; ok {
+		candle.Missing = record[i] == "1"
+	}
+	for i, name := range header {
+		if isCandleColumn(name) || record[i] == "" {
+			continue
+		}
+		if candle.Indicators[name], err = strconv.ParseFloat(record[i], 64); err != nil {
+			return Candle{}, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return candle, nil
+}
+
+func isCandleColumn(name string) bool {
+	for _, column := range CANDLE_COLUMNS {
+		if name == column {
+			return true
+		}
+	}
+	return false
+}
+
+// Sorted names of the indicators of the candles which are not in names
+func addedIndicators(names []string, candles []Candle) []string {
+	known := map[string]bool{}
+	for _, name := range names {
+		known[name] = true
+	}
+	added := []string{}
+	for _, name := range indicatorNames(candles) {
+		if !known[name] {
+			added = append(added, name)
+		}
+	}
+	return added
+}
+
+// Sorted names of the indicators of all the candles
+func indicatorNames(candles []Candle) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, candle := range candles {
+		for name := range candle.Indicators {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
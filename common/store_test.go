@@ -0,0 +1,204 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func generateStoreCandles() []Candle {
+	start := time.Date(2017, 12, 1, 0, 0, 0, 0, time.UTC)
+	return []Candle{
+		{
+			Time: start, Open: decimal.RequireFromString("10000.01"), High: decimal.RequireFromString("10010.5"),
+			Low: decimal.RequireFromString("9990"), Close: decimal.RequireFromString("10005"),
+			Average: decimal.RequireFromString("10001.25"), Volume: decimal.RequireFromString("3.14159265"),
+			Indicators: map[string]float64{"mfi": 51.5, "macd": -0.125},
+		},
+		{
+			Time: start.Add(time.Minute), Open: decimal.RequireFromString("10005"), High: decimal.RequireFromString("10005"),
+			Low: decimal.RequireFromString("10005"), Close: decimal.RequireFromString("10005"),
+			Average: decimal.RequireFromString("10005"), Volume: decimal.Zero, Missing: true,
+			Indicators: map[string]float64{"mfi": 49},
+		},
+	}
+}
+
+func checkStoreCandles(t *testing.T, format string, candles []Candle) {
+	expected := generateStoreCandles()
+	if len(candles) != len(expected) {
+		t.Fatalf("%s: should read %d candles, got %d", format, len(expected), len(candles))
+	}
+	for i, candle := range candles {
+		if !candle.Time.Equal(expected[i].Time) || !candle.Open.Equal(expected[i].Open) || !candle.High.Equal(expected[i].High) ||
+			!candle.Low.Equal(expected[i].Low) || !candle.Close.Equal(expected[i].Close) ||
+			!candle.Average.Equal(expected[i].Average) || !candle.Volume.Equal(expected[i].Volume) || candle.Missing != expected[i].Missing {
+			t.Errorf("%s: wrong candle %d %s", format, i, candle.String())
+		}
+		if len(candle.Indicators) != len(expected[i].Indicators) {
+			t.Errorf("%s: wrong indicators for candle %d %v", format, i, candle.Indicators)
+		}
+		for name, value := range expected[i].Indicators {
+			if candle.Indicators[name] != value {
+				t.Errorf("%s: wrong %s for candle %d %v", format, name, i, candle.Indicators)
+			}
+		}
+	}
+}
+
+func TestCandleStores(t *testing.T) {
+	// GIVEN
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+	candles := generateStoreCandles()
+
+	for _, format := range []string{"csv", "jsonl", "binary"} {
+		store, _ := ParseCandleStore(format)
+		path := filepath.Join(dir, "BTC-USD"+store.Extension())
+
+		// WHEN
+		// Appended one at a time, as gdax does
+		for _, candle := range candles {
+			if err := store.Append(path, []Candle{candle}); err != nil {
+				t.Fatalf("%s: could not append %v", format, err)
+			}
+		}
+		store.Flush()
+		found, _ := CandleStoreFor(path)
+		read, err := found.Read(path)
+
+		// THEN
+		if err != nil {
+			t.Fatalf("%s: could not read %v", format, err)
+		}
+		checkStoreCandles(t, format, read)
+	}
+}
+
+func TestTextCandleStore(t *testing.T) {
+	// GIVEN
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "BTC-USD.txt")
+	store, _ := ParseCandleStore("text")
+
+	// WHEN
+	for _, candle := range generateStoreCandles() {
+		store.Append(path, []Candle{candle})
+	}
+	data, _ := ioutil.ReadFile(path)
+	read, err := store.Read(path)
+
+	// THEN
+	lines := strings.Split(string(data), "\n")
+	if lines[0] != "1512086400 10000.01 10010.5 9990 10005 10001.25 3.14159265 51.500000 -0.125000 0.000000" {
+		t.Errorf("Should write the format gdax always wrote, got %q", lines[0])
+	}
+	if err != nil || len(read) != 2 || !read[0].Volume.Equal(decimal.RequireFromString("3.14159265")) ||
+		read[0].Indicators["mfi"] != 51.5 || read[0].Indicators["macd"] != -0.125 || !read[1].Time.Equal(time.Unix(1512086460, 0)) {
+		t.Errorf("Wrong candles read back %v %v", read, err)
+	}
+}
+
+func TestCSVCandleStoreHeader(t *testing.T) {
+	// GIVEN
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "BTC-USD.csv")
+	store := &CSVCandleStore{}
+
+	// WHEN
+	store.Append(path, generateStoreCandles()[:1])
+	data, _ := ioutil.ReadFile(path)
+	lines := strings.Split(string(data), "\n")
+
+	// THEN
+	if lines[0] != "# candles v1" || lines[1] != "time,open,high,low,close,average,volume,missing,macd,mfi" {
+		t.Errorf("Wrong header %v", lines[:2])
+	}
+	if lines[2] != "2017-12-01T00:00:00Z,10000.01,10010.5,9990,10005,10001.25,3.14159265,,-0.125,51.5" {
+		t.Errorf("Wrong line %s", lines[2])
+	}
+}
+
+func TestCSVCandleStoreAddedIndicator(t *testing.T) {
+	// GIVEN
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "BTC-USD.csv")
+	store := &CSVCandleStore{}
+	store.Append(path, generateStoreCandles()[:1])
+	added := generateStoreCandles()[1]
+	added.Indicators["rsi"] = 70
+	fewer := generateStoreCandles()[1]
+
+	// WHEN
+	fewerErr := store.Append(path, []Candle{fewer})
+	addedErr := store.Append(path, []Candle{added})
+	// Appended again from another process, which reads the last header
+	csvIndicators = map[string][]string{}
+	againErr := store.Append(path, []Candle{added})
+	candles, err := store.Read(path)
+	data, _ := ioutil.ReadFile(path)
+
+	// THEN
+	if fewerErr != nil || addedErr != nil || againErr != nil || err != nil || len(candles) != 4 {
+		t.Fatalf("Every candle should be appended %v %v %v %v %v", fewerErr, addedErr, againErr, err, candles)
+	}
+	if candles[1].Indicators["mfi"] != 49 || candles[2].Indicators["rsi"] != 70 || candles[3].Indicators["rsi"] != 70 {
+		t.Errorf("Indicators not read back %v", candles)
+	}
+	if strings.Count(string(data), "# candles") != 2 {
+		t.Errorf("A new section should only start with the new indicator\n%s", data)
+	}
+}
+
+func TestCandleStoreNewerFields(t *testing.T) {
+	// GIVEN
+	// Files written by a newer writer, with columns and fields we don't know about
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+	csvPath, jsonlPath := filepath.Join(dir, "new.csv"), filepath.Join(dir, "new.jsonl")
+	ioutil.WriteFile(csvPath, []byte("# candles v1\nvolume,time,open,high,low,close,average,rsi\n3,2017-12-01T00:00:00Z,1,2,1,2,1.5,70\n"), 0644)
+	ioutil.WriteFile(jsonlPath, []byte(`{"version":1,"time":"2017-12-01T00:00:00Z","open":"1","high":"2","low":"1","close":"2","average":"1.5","volume":"3","trades":12,"indicators":{"rsi":70}}`+"\n"), 0644)
+
+	// WHEN
+	csvCandles, csvErr := (&CSVCandleStore{}).Read(csvPath)
+	jsonlCandles, jsonlErr := (&JSONLCandleStore{}).Read(jsonlPath)
+
+	// THEN
+	for _, candles := range [][]Candle{csvCandles, jsonlCandles} {
+		if len(candles) != 1 || !candles[0].Volume.Equal(decimal.New(3, 0)) || candles[0].Indicators["rsi"] != 70 {
+			t.Errorf("Wrong candles %v", candles)
+		}
+	}
+	if csvErr != nil || jsonlErr != nil {
+		t.Errorf("Unknown fields should be skipped %v %v", csvErr, jsonlErr)
+	}
+}
+
+func TestCandleStoreVersion(t *testing.T) {
+	// GIVEN
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+	csvPath, jsonlPath := filepath.Join(dir, "new.csv"), filepath.Join(dir, "new.jsonl")
+	ioutil.WriteFile(csvPath, []byte("# candles v2\ntime,open,high,low,close,average,volume\n"), 0644)
+	ioutil.WriteFile(jsonlPath, []byte(`{"version":2,"time":"2017-12-01T00:00:00Z"}`+"\n"), 0644)
+
+	// WHEN
+	_, csvErr := (&CSVCandleStore{}).Read(csvPath)
+	_, jsonlErr := (&JSONLCandleStore{}).Read(jsonlPath)
+	_, formatErr := CandleStoreFor("BTC-USD.dat")
+
+	// THEN
+	if csvErr == nil || jsonlErr == nil {
+		t.Errorf("Newer versions should not be read")
+	}
+	if formatErr == nil {
+		t.Errorf("Unknown extensions should fail")
+	}
+}
@@ -1,8 +1,12 @@
 package common
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"github.com/shopspring/decimal"
 	"reflect"
 	"strings"
 )
@@ -19,3 +23,29 @@ func JSONDecode(data []byte, to interface{}) error {
 	}
 	return json.Unmarshal(data, to)
 }
+
+// ParseJSONNumbers parses JSON keeping numbers as json.Number, so prices and sizes
+// can be read as decimals without going through float64
+func ParseJSONNumbers(data []byte) (*gabs.Container, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return gabs.ParseJSONDecoder(decoder)
+}
+
+// JSONToDecimal converts a JSON value, whether parsed as json.Number, float64 or string
+func JSONToDecimal(value interface{}) (decimal.Decimal, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		d, err := decimal.NewFromString(v.String())
+		return d, err == nil
+	case string:
+		d, err := decimal.NewFromString(v)
+		return d, err == nil
+	case float64:
+		return decimal.NewFromFloat(v), true
+	case nil:
+		return decimal.Decimal{}, false
+	}
+	d, err := decimal.NewFromString(fmt.Sprint(value))
+	return d, err == nil
+}
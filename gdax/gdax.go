@@ -2,9 +2,7 @@ package gdax
 
 import (
 	"fmt"
-	ws "github.com/gorilla/websocket"
 	"github.com/shopspring/decimal"
-	"os"
 	"strconv"
 	"thierry/gocoin/common"
 	"time"
@@ -25,9 +23,9 @@ type GdaxMessage struct {
 	MakerOrderId  string     `json:"maker_order_id"`
 	TakerOrderId  string     `json:"taker_order_id"`
 	Time          time.Time  `json:"time,string"`
-	RemainingSize float64    `json:"remaining_size,string"`
-	NewSize       float64    `json:"new_size,string"`
-	OldSize       float64    `json:"old_size,string"`
+	RemainingSize string     `json:"remaining_size"`
+	NewSize       string     `json:"new_size"`
+	OldSize       string     `json:"old_size"`
 	Size          string     `json:"size"`
 	Price         string     `json:"price"`
 	Side          string     `json:"side"`
@@ -40,207 +38,759 @@ type GdaxMessage struct {
 	Bids          [][]string `json:"bids,omitempty"`
 	Asks          [][]string `json:"asks,omitempty"`
 	Changes       [][]string `json:"changes,omitempty"`
+	// Local time the message was read, or the snapshot fetched. Book updates have this
+	// time like those of the other exchanges, snapshots have no exchange time
+	received time.Time
 }
 
-func Update() {
-	var wsDialer ws.Dialer
-	wsConn, _, err := wsDialer.Dial("wss://ws-feed.gdax.com", nil)
-	if err != nil {
-		println(err.Error())
+const WS_URL = "wss://ws-feed.gdax.com"
+
+// Channels a book can be built from
+const (
+	// Every order, sequenced so gaps are detected and the book resynced. The whole order
+	// flow of the products is received, much more than for the top of book
+	BOOK_FULL = "full"
+	// Price levels only, lighter and enough for the top of book. Without sequence, a
+	// missed update is only fixed by the snapshot sent after a reconnect
+	BOOK_LEVEL2 = "level2"
+)
+
+// Enough for MACD, which needs twice its long EMA period
+const BACKFILL_CANDLES = 100
+
+// How often candles buffered for too long by the store are written, see
+// common.AgedCandleStore
+const FLUSH_INTERVAL = time.Minute
+
+// Longest wait on Close for the candles still being written, e.g. to a slow disk. The
+// candles the store buffered are not written past it
+const CLOSE_TIMEOUT = 5 * time.Second
+
+type Gdax struct {
+	Url string
+	// Channel the books are built from, BOOK_FULL or BOOK_LEVEL2
+	BookChannel string
+	// Used to fetch a fresh book when a sequence gap is detected
+	Rest BookClient
+	// Wait between failed snapshot requests
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Candles are built from matches, per product, for each of the timeframes
+	Timeframes []time.Duration
+	// Indicators computed on the candles of a product, defaults are used for other products
+	Indicators map[string][]common.Indicator
+	// Candles are written for periods without matches too, at the previous close
+	GapPolicy common.GapPolicy
+	// Format of the candle files, the .txt files gdax always wrote by default
+	Store common.CandleStore
+	// Also called with every completed candle when set, in order, on the goroutine
+	// writing the candles. Called again with a candle a late trade corrected, which
+	// the candle files keep as first completed
+	OnCandle func(productId string, timeframe time.Duration, candle common.Candle)
+	// Fetches the past candles and trades of a product when its first match comes, so
+	// its charts don't start empty. No backfill when nil
+	History HistoryClient
+	// Past candles fetched for each timeframe
+	BackfillCandles int
+
+	// Every frame read is recorded when set
+	Recorder *common.Recorder
+
+	conn       common.Feed
+	orderBooks map[string]*common.OrderBook
+	// Open orders of the full channel, per product then order id
+	orders      map[string]map[string]*common.Order
+	sequences   map[string]*sequenceState
+	aggregators map[string]*common.CandleAggregator
+	messages    chan GdaxMessage
+	snapshots   chan snapshotResult
+	backfills   chan backfillResult
+	// Completed candles, written in order by a single goroutine
+	candles chan completedCandle
+	// Closed once every completed candle is written, and the store flushed
+	written chan struct{}
+	trades  chan common.Trade
+	books   chan common.BookUpdate
+	events  chan common.Event
+	// Closed when the read loop ends, stops the snapshot requests still running
+	quit chan struct{}
+	// Last trade id applied to the candles of each product, to drop matches seen twice
+	lastTrades map[string]int
+	// Live matches of the products being backfilled, applied once the past is
+	backfilling map[string][]GdaxMessage
+	// First period of each timeframe not written when the products reconnected. The
+	// backfilled candles from there are written, instead of filling the gap
+	resumes map[string]map[time.Duration]time.Time
+	// Counts reconnects, backfills requested before the last one are dropped
+	generation int
+	// Trades dropped because the trades channel was full
+	droppedTrades int
+	// Error of the last flush, set before written is closed
+	flushErr error
+}
+
+// Last sequence applied to a product book. While stale, a snapshot has been requested
+// and messages are buffered until it arrives. A book starts stale, the full channel
+// sends no snapshot
+type sequenceState struct {
+	sequence int64
+	stale    bool
+	buffer   []GdaxMessage
+}
+
+type snapshotResult struct {
+	productId string
+	snapshot  GdaxMessage
+	err       error
+	// Failed requests before this one
+	attempt int
+}
+
+type completedCandle struct {
+	productId string
+	timeframe time.Duration
+	candle    common.Candle
+	corrected bool
+}
+
+// Past candles and trades of a product, fetched before its first live match
+type backfillResult struct {
+	generation int
+	first      GdaxMessage
+	candles    map[time.Duration][]common.Candle
+	matches    []GdaxMessage
+	err        error
+}
+
+// Public
+
+func CreateNewExchange() *Gdax {
+	return &Gdax{
+		Url:             WS_URL,
+		BookChannel:     BOOK_FULL,
+		Rest:            CreateNewRestClient(),
+		MinBackoff:      common.MIN_BACKOFF,
+		MaxBackoff:      common.MAX_BACKOFF,
+		orderBooks:      make(map[string]*common.OrderBook),
+		orders:          make(map[string]map[string]*common.Order),
+		sequences:       make(map[string]*sequenceState),
+		Timeframes:      common.DEFAULT_TIMEFRAMES,
+		Indicators:      make(map[string][]common.Indicator),
+		GapPolicy:       common.GAP_FILL,
+		Store:           &common.TextCandleStore{},
+		BackfillCandles: BACKFILL_CANDLES,
+		lastTrades:      make(map[string]int),
+		aggregators:     make(map[string]*common.CandleAggregator),
+		messages:        make(chan GdaxMessage, common.EVENT_BUFFER),
+		snapshots:       make(chan snapshotResult, 1),
+		backfills:       make(chan backfillResult, 1),
+		backfilling:     make(map[string][]GdaxMessage),
+		resumes:         make(map[string]map[time.Duration]time.Time),
+		candles:         make(chan completedCandle, common.EVENT_BUFFER),
+		written:         make(chan struct{}),
+		trades:          make(chan common.Trade, common.EVENT_BUFFER),
+		books:           make(chan common.BookUpdate, common.EVENT_BUFFER),
+		events:          make(chan common.Event, common.EVENT_BUFFER),
+		quit:            make(chan struct{}),
 	}
+}
 
-	var candleCharts map[string]*common.CandleChart = make(map[string]*common.CandleChart)
+func (gdax *Gdax) Name() string {
+	return "gdax"
+}
 
+func (gdax *Gdax) Connect() error {
+	conn := common.CreateNewConnection(gdax.Name(), gdax.Url, gdax.events)
+	conn.OnReconnect = gdax.reset
+	conn.Recorder = gdax.Recorder
+	// Wrapped once, connecting again would record every snapshot twice
+	if _, ok := gdax.Rest.(*RecordingBookClient); gdax.Recorder != nil && !ok {
+		gdax.Rest = &RecordingBookClient{Client: gdax.Rest, Recorder: gdax.Recorder}
+	}
+	gdax.conn = conn
+	if err := conn.Connect(); err != nil {
+		return err
+	}
+	go gdax.read()
+	return nil
+}
+
+// Replay reads the frames of a recording instead of connecting, through the same
+// handlers. Subscribe does nothing, the recording has the messages subscribed to. Book
+// snapshots come from the recording too, so the replay doesn't use the network
+func (gdax *Gdax) Replay(replay *common.Replay) {
+	books := CreateNewReplayBookClient(gdax.quit)
+	gdax.Rest = books
+	replay.OnReconnect = gdax.reset
+	replay.OnSnapshot = books.AddSnapshot
+	gdax.conn = replay
+	go gdax.read()
+}
+
+func (gdax *Gdax) Subscribe(products, channels []string) error {
 	subscribe := GdaxSubscribe{
 		Type:       "subscribe",
-		Channels:   []map[string]string{ /*{"name": "level2"}, */ {"name": "matches"}},
-		ProductIds: []string{"BTC-USD", "LTC-USD", "ETH-USD"},
+		Channels:   []map[string]string{},
+		ProductIds: products,
 	}
+	for _, channel := range channels {
+		switch channel {
+		case common.CHANNEL_TRADES:
+			subscribe.Channels = append(subscribe.Channels, map[string]string{"name": "matches"})
+		case common.CHANNEL_BOOK:
+			if gdax.BookChannel != BOOK_FULL && gdax.BookChannel != BOOK_LEVEL2 {
+				return fmt.Errorf("gdax: unknown book channel %s", gdax.BookChannel)
+			}
+			subscribe.Channels = append(subscribe.Channels, map[string]string{"name": gdax.BookChannel})
+		default:
+			return fmt.Errorf("gdax: unknown channel %s", channel)
+		}
+	}
+	return gdax.conn.Subscribe(subscribe)
+}
 
-	if err := wsConn.WriteJSON(subscribe); err != nil {
-		println(err.Error())
+func (gdax *Gdax) Trades() <-chan common.Trade {
+	return gdax.trades
+}
+
+func (gdax *Gdax) BookUpdates() <-chan common.BookUpdate {
+	return gdax.books
+}
+
+func (gdax *Gdax) Events() <-chan common.Event {
+	return gdax.events
+}
+
+func (gdax *Gdax) Close() error {
+	if gdax.conn == nil {
+		return nil
+	}
+	// Closing the connection ends the read loop, which closes the trade and book channels,
+	// then the candles, which are written and flushed
+	err := gdax.conn.Close()
+	select {
+	case <-gdax.written:
+		if err == nil {
+			err = gdax.flushErr
+		}
+	case <-time.After(CLOSE_TIMEOUT):
+		fmt.Println("Gdax candles still being written on close")
 	}
+	return err
+}
 
-	message := GdaxMessage{}
-	counter := 0
+// Private
 
-	for true {
-		if err := wsConn.ReadJSON(&message); err != nil {
-			println(err.Error())
-			break
+// Books are sent again as snapshots after resubscribing. Going through the message
+// queue keeps the reset in order with the messages from the previous connection
+func (gdax *Gdax) reset() {
+	gdax.messages <- GdaxMessage{Type: "reconnect"}
+}
+
+// Messages are read on their own goroutine, so snapshots requested after a gap and
+// backfills can be applied between two messages
+func (gdax *Gdax) read() {
+	defer close(gdax.trades)
+	defer close(gdax.books)
+	defer close(gdax.quit)
+	// Candles only complete on this goroutine
+	defer close(gdax.candles)
+	go gdax.write()
+
+	go func() {
+		defer close(gdax.messages)
+		for {
+			_, resp, err := gdax.conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			message := GdaxMessage{received: gdax.conn.Now()}
+			if err := common.JSONDecode(resp, &message); err != nil {
+				println(err.Error())
+				continue
+			}
+			gdax.messages <- message
+		}
+	}()
+
+	for {
+		select {
+		case message, ok := <-gdax.messages:
+			if !ok {
+				return
+			}
+			gdax.handleMessage(message)
+		case result := <-gdax.snapshots:
+			gdax.resync(result)
+		case result := <-gdax.backfills:
+			gdax.applyBackfill(result)
 		}
-		if message.Type == "match" {
-			updateMatch(message, candleCharts)
+	}
+}
 
-		} else {
-			// updateOrderBook(message, orderBook)
+func (gdax *Gdax) handleMessage(message GdaxMessage) {
+	switch message.Type {
+	case "match":
+		// Matches of the full channel fill the maker order. Those of the matches channel
+		// have the same sequence, so only one of them is applied
+		if _, ok := gdax.sequences[message.ProductId]; ok && gdax.checkSequence(message) {
+			gdax.applyOrderMessage(message)
+		}
+		// Already applied, e.g. by the backfill or on the other channel
+		if message.TradeId != 0 && message.TradeId <= gdax.lastTrades[message.ProductId] {
+			return
+		}
+		gdax.updateMatch(message)
+		common.SendTrade(gdax.trades, toTrade(message), &gdax.droppedTrades)
+	case "received", "open", "done", "change":
+		if gdax.checkSequence(message) {
+			gdax.applyOrderMessage(message)
 		}
+	case "snapshot", "l2update":
+		// Level 2 channel, see BOOK_LEVEL2
+		gdax.applyBookMessage(message)
+	case "reconnect":
+		gdax.orderBooks = make(map[string]*common.OrderBook)
+		gdax.orders = make(map[string]map[string]*common.Order)
+		gdax.sequences = make(map[string]*sequenceState)
+		if gdax.History != nil {
+			gdax.resetCandles()
+		}
+	case "error":
+		fmt.Println("Gdax error: " + message.Message)
+	}
+}
+
+func (gdax *Gdax) applyBookMessage(message GdaxMessage) {
+	orderBook := gdax.orderBook(message.ProductId)
+	updateOrderBook(message, orderBook)
+	gdax.sendBook(message.ProductId, message.received)
+}
 
-		// Get highest buy (that we can sell to) / lowest sell (that we can buy from) price
-		counter += 1
-		// TODO: Reduce the counter cooldown
-		if counter%10 == 0 {
-			// updateBestPrices(orderBook, prices)
+// Orders of the full channel are kept by id, the book holds the size of each price
+// level, which is the sum of the orders at that price
+func (gdax *Gdax) applyOrderMessage(message GdaxMessage) {
+	orderBook := gdax.orderBook(message.ProductId)
+	orders, ok := gdax.orders[message.ProductId]
+	if !ok {
+		orders = make(map[string]*common.Order)
+		gdax.orders[message.ProductId] = orders
+	}
+	switch message.Type {
+	case "snapshot":
+		for side, levels := range map[string][][]string{common.SIDE_BUY: message.Bids, common.SIDE_SELL: message.Asks} {
+			for _, level := range levels {
+				if len(level) < 3 {
+					continue
+				}
+				price, errPrice := decimal.NewFromString(level[0])
+				size, errSize := decimal.NewFromString(level[1])
+				if errPrice != nil || errSize != nil {
+					fmt.Printf("Gdax invalid %s snapshot order %v\n", message.ProductId, level)
+					continue
+				}
+				addOrder(orderBook, orders, common.Order{Id: level[2], Side: side, Price: price, Size: size})
+			}
+		}
+	case "open":
+		price, errPrice := decimal.NewFromString(message.Price)
+		size, errSize := decimal.NewFromString(message.RemainingSize)
+		if errPrice != nil || errSize != nil {
+			fmt.Printf("Gdax invalid %s open order %s\n", message.ProductId, message.OrderId)
+			return
+		}
+		addOrder(orderBook, orders, common.Order{Id: message.OrderId, Side: message.Side, Price: price, Size: size})
+	case "done":
+		resizeOrder(orderBook, orders, message.OrderId, decimal.Zero)
+	case "match":
+		size, err := decimal.NewFromString(message.Size)
+		order, ok := orders[message.MakerOrderId]
+		if err != nil || !ok {
+			return
+		}
+		resizeOrder(orderBook, orders, message.MakerOrderId, order.Size.Sub(size))
+	case "change":
+		// Orders still being received are not on the book yet, and have no new size
+		size, err := decimal.NewFromString(message.NewSize)
+		if err != nil {
+			return
 		}
+		resizeOrder(orderBook, orders, message.OrderId, size)
+	default:
+		// Received orders are only on the book once open
+		return
+	}
+	gdax.sendBook(message.ProductId, message.received)
+}
+
+func (gdax *Gdax) orderBook(productId string) *common.OrderBook {
+	orderBook, ok := gdax.orderBooks[productId]
+	if !ok {
+		orderBook = common.CreateNewOrderBook(common.TickSize(gdax.Name(), productId))
+		gdax.orderBooks[productId] = orderBook
+	}
+	return orderBook
+}
+
+func (gdax *Gdax) sendBook(productId string, t time.Time) {
+	book := gdax.orderBooks[productId].TopOfBook()
+	book.Exchange, book.ProductId, book.Time = gdax.Name(), productId, t
+	common.SendBookUpdate(gdax.books, book)
+}
+
+// checkSequence returns whether a full channel message can be applied to the book.
+// The first message of a product requests a snapshot, older messages are dropped, and
+// a gap marks the book as stale until a fresh snapshot is received
+func (gdax *Gdax) checkSequence(message GdaxMessage) bool {
+	state, ok := gdax.sequences[message.ProductId]
+	if !ok {
+		gdax.sequences[message.ProductId] = &sequenceState{stale: true, buffer: []GdaxMessage{message}}
+		go gdax.requestSnapshot(message.ProductId, 0)
+		return false
+	}
+	if state.stale {
+		state.buffer = append(state.buffer, message)
+		return false
 	}
+	if message.Sequence <= state.sequence {
+		return false
+	}
+	if message.Sequence > state.sequence+1 {
+		fmt.Printf("Gdax sequence gap on %s, expected %d got %d\n", message.ProductId, state.sequence+1, message.Sequence)
+		state.stale = true
+		state.buffer = []GdaxMessage{message}
+		common.SendEvent(gdax.events, common.Event{Type: common.EVENT_BOOK_STALE, Exchange: gdax.Name(), ProductId: message.ProductId, Time: time.Now()})
+		go gdax.requestSnapshot(message.ProductId, 0)
+		return false
+	}
+	state.sequence = message.Sequence
+	return true
 }
 
-func updateBestPrices(orderBook map[string]*common.Order, prices map[string][]float64) {
-	buy, buySize, sell, sellSize := 0.0, 0.0, 0.0, 0.0
-	for _, order := range orderBook {
-		if order.Side == "sell" && (buy > order.Price || buy == 0.0) && order.Size > 0 {
-			buy = order.Price
-			buySize = order.Size
-		} else if order.Side == "buy" && sell < order.Price && order.Size > 0 {
-			sell = order.Price
-			sellSize = order.Size
+// Retries wait longer after each failure, and give up once the read loop has ended
+func (gdax *Gdax) requestSnapshot(productId string, attempt int) {
+	if attempt > 0 {
+		select {
+		case <-time.After(common.Backoff(gdax.MinBackoff, gdax.MaxBackoff, attempt-1)):
+		case <-gdax.quit:
+			return
 		}
 	}
-	prices["gdax"][0] = buy
-	prices["gdax"][1] = buySize
-	prices["gdax"][2] = sell
-	prices["gdax"][3] = sellSize
+	snapshot, err := gdax.Rest.GetBook(productId)
+	select {
+	case gdax.snapshots <- snapshotResult{productId: productId, snapshot: snapshot, err: err, attempt: attempt}:
+	case <-gdax.quit:
+	}
 }
 
-func updateMatch(message GdaxMessage, candleCharts map[string]*common.CandleChart) {
-	// Check if we're still in the current minute, or we need a new one
-	// Note: There is a small possibility of misattributing the match to the wrong candle,
-	// we're still doing some logic processing to attribute match to current or past candle,
-	// but not more than that (e.g. issues could appear if match received is older than a minute)
-	t := message.Time
+// resync replaces the stale book with the snapshot, then replays the buffered messages
+// more recent than the snapshot
+func (gdax *Gdax) resync(result snapshotResult) {
+	state, ok := gdax.sequences[result.productId]
+	if !ok || !state.stale {
+		return
+	}
+	if result.err != nil {
+		fmt.Printf("Gdax could not fetch %s book: %v\n", result.productId, result.err)
+		go gdax.requestSnapshot(result.productId, result.attempt+1)
+		return
+	}
+
+	delete(gdax.orderBooks, result.productId)
+	delete(gdax.orders, result.productId)
+	gdax.applyOrderMessage(result.snapshot)
+	buffer := state.buffer
+	state.stale, state.buffer, state.sequence = false, nil, result.snapshot.Sequence
+	common.SendEvent(gdax.events, common.Event{Type: common.EVENT_BOOK_RESYNCED, Exchange: gdax.Name(), ProductId: result.productId, Time: time.Now()})
+
+	for _, message := range buffer {
+		if gdax.checkSequence(message) {
+			gdax.applyOrderMessage(message)
+		}
+	}
+}
+
+func toTrade(message GdaxMessage) common.Trade {
+	price, _ := decimal.NewFromString(message.Price)
+	size, _ := decimal.NewFromString(message.Size)
+	return common.Trade{
+		Exchange:  "gdax",
+		ProductId: message.ProductId,
+		TradeId:   strconv.Itoa(message.TradeId),
+		Side:      message.Side,
+		Price:     price,
+		Size:      size,
+		Time:      message.Time,
+	}
+}
+
+func (gdax *Gdax) updateMatch(message GdaxMessage) {
 	productId := message.ProductId
-	if _, ok := candleCharts[productId]; !ok {
-		candleCharts[productId] = common.CreateNewCandleChart()
+	if _, ok := gdax.aggregators[productId]; !ok {
+		aggregator, err := common.CreateNewCandleAggregator(gdax.Timeframes)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		if indicators, ok := gdax.Indicators[productId]; ok {
+			aggregator.SetIndicators(indicators)
+		}
+		aggregator.SetGapPolicy(gdax.GapPolicy)
+		for _, timeframe := range aggregator.Timeframes {
+			timeframe := timeframe
+			// Following output could be improved. Right now we are waiting for the next message
+			// to indicate a new candle, and possibly loosing a few seconds of headstart.
+			aggregator.OnCandleComplete(timeframe, func(candle common.Candle) {
+				gdax.candles <- completedCandle{productId: productId, timeframe: timeframe, candle: candle}
+			})
+			aggregator.OnCandleCorrected(timeframe, func(candle common.Candle) {
+				gdax.candles <- completedCandle{productId: productId, timeframe: timeframe, candle: candle, corrected: true}
+			})
+		}
+		gdax.aggregators[productId] = aggregator
+		if gdax.History != nil {
+			gdax.backfilling[productId] = nil
+			go gdax.backfill(gdax.generation, message, aggregator.Timeframes)
+		}
+	}
+
+	// Held until the past trades are applied, they come before it
+	if buffer, ok := gdax.backfilling[productId]; ok {
+		gdax.backfilling[productId] = append(buffer, message)
+		if message.TradeId > gdax.lastTrades[productId] {
+			gdax.lastTrades[productId] = message.TradeId
+		}
+		return
 	}
-	candleChart := candleCharts[productId]
 
 	// Decimal package
 	price, _ := decimal.NewFromString(message.Price)
 	size, _ := decimal.NewFromString(message.Size)
 
-	// Check if message belongs to this current or previous candle
-	currentCandle := candleChart.CurrentCandle()
-	if currentCandle.Time.UnixNano()+60000000000 <= t.UnixNano() {
-
-		// Update current candle with indicators
-		candleChart.CompleteCurrentCandle()
-
-		// Following output could be improved. Right now we are waiting for the next message
-		// to indicate a new candle, and possibly loosing a few seconds of headstart.
-		go output(message.ProductId, *currentCandle)
-
-		// Add new candle
-		candleChart.AddCandle(common.Candle{
-			Time:    t.Truncate(time.Minute),
-			Open:    price,
-			High:    price,
-			Low:     price,
-			Close:   price,
-			Average: price,
-			Volume:  size,
-		})
-	} else {
-		// We're handling the edge case here, if we already created a new current candle, but
-		// for some reason we just got a match from past minute, we need to handle past minute candle
-		if currentCandle.Time.UnixNano() > t.UnixNano() {
-			candleChart.UpdatePreviousCandle(price, size)
-		} else {
-			candleChart.UpdateCurrentCandle(price, size)
+	// Note: There is a small possibility of misattributing the match to the wrong candle,
+	// the aggregator still attributes a match to the current or past candle, but not more
+	// than that (e.g. issues could appear if match received is older than a minute)
+	gdax.aggregators[productId].AddTrade(price, size, message.Time)
+	if message.TradeId > gdax.lastTrades[productId] {
+		gdax.lastTrades[productId] = message.TradeId
+	}
+}
+
+// Writes the completed candles one at a time, gap fills and backfills complete many
+// at once and would be written out of order on their own goroutines. Candles the store
+// buffered for too long are written meanwhile, and the others once the candles end
+func (gdax *Gdax) write() {
+	defer close(gdax.written)
+	ticker := time.NewTicker(FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case completed, ok := <-gdax.candles:
+			if !ok {
+				// Candles the store buffered would be lost on exit
+				gdax.flushErr = gdax.Store.Flush()
+				return
+			}
+			// Candle files are only appended to
+			if !completed.corrected {
+				output(gdax.Store, completed.productId, completed.timeframe, completed.candle)
+			}
+			if gdax.OnCandle != nil {
+				gdax.OnCandle(completed.productId, completed.timeframe, completed.candle)
+			}
+		case <-ticker.C:
+			if store, ok := gdax.Store.(common.AgedCandleStore); ok {
+				if err := store.FlushAged(); err != nil {
+					fmt.Printf("Error while writing buffered candles: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+// Trades missed while disconnected are backfilled like at startup. The charts start
+// again from the next match of each product, the candles not written yet are written
+// from the backfill
+func (gdax *Gdax) resetCandles() {
+	for productId, aggregator := range gdax.aggregators {
+		// Still backfilling since the previous reconnect, its resume is kept
+		if aggregator.NextPeriod(aggregator.Timeframes[0]).IsZero() {
+			continue
+		}
+		resume := map[time.Duration]time.Time{}
+		for _, timeframe := range aggregator.Timeframes {
+			resume[timeframe] = aggregator.NextPeriod(timeframe)
+		}
+		gdax.resumes[productId] = resume
+	}
+	gdax.aggregators = make(map[string]*common.CandleAggregator)
+	gdax.backfilling = make(map[string][]GdaxMessage)
+	gdax.generation += 1
+}
+
+// Fetches the past candles of the product of the first live match, and the trades of
+// the current minute before that match. Runs off the read loop, the live matches are
+// held meanwhile
+func (gdax *Gdax) backfill(generation int, first GdaxMessage, timeframes []time.Duration) {
+	productId := first.ProductId
+	result := backfillResult{generation: generation, first: first, candles: map[time.Duration][]common.Candle{}}
+	for _, timeframe := range timeframes {
+		start := first.Time.Truncate(timeframe).Add(-time.Duration(gdax.BackfillCandles) * timeframe)
+		candles, err := gdax.History.GetCandles(productId, timeframe, start, first.Time)
+		if err != nil {
+			fmt.Printf("Could not backfill %s %s candles: %v\n", productId, common.TimeframeName(timeframe), err)
+			result.err = err
+			break
+		}
+		result.candles[timeframe] = candles
+	}
+	if result.err == nil {
+		result.matches, result.err = gdax.History.GetTrades(productId, first.Time.Truncate(timeframes[0]))
+		if result.err != nil {
+			fmt.Printf("Could not backfill %s trades: %v\n", productId, result.err)
+		}
+	}
+	select {
+	case gdax.backfills <- result:
+	case <-gdax.quit:
+	}
+}
+
+// Warms up the charts with the past candles, then applies the past trades and the live
+// matches held since. Later trades are left to the live feed, so none is applied twice.
+// Past trades only go to the charts, they are not sent as trades. On failure the charts
+// start with the live matches only. After a reconnect, the past candles not written
+// before are written
+func (gdax *Gdax) applyBackfill(result backfillResult) {
+	productId := result.first.ProductId
+	buffer, ok := gdax.backfilling[productId]
+	if !ok || result.generation != gdax.generation {
+		return
+	}
+	delete(gdax.backfilling, productId)
+	resume := gdax.resumes[productId]
+	delete(gdax.resumes, productId)
+
+	aggregator := gdax.aggregators[productId]
+	if result.err == nil {
+		since := result.first.Time.Truncate(aggregator.Timeframes[0])
+		aggregator.Warmup(result.candles, result.first.Time)
+		for _, timeframe := range aggregator.Timeframes {
+			from, ok := resume[timeframe]
+			if !ok {
+				continue
+			}
+			for _, candle := range aggregator.Completed(timeframe, from) {
+				gdax.candles <- completedCandle{productId: productId, timeframe: timeframe, candle: candle}
+			}
 		}
+		for _, match := range result.matches {
+			if match.TradeId >= result.first.TradeId || match.Time.Before(since) {
+				continue
+			}
+			price, _ := decimal.NewFromString(match.Price)
+			size, _ := decimal.NewFromString(match.Size)
+			aggregator.AddTrade(price, size, match.Time)
+		}
+	}
+	for _, message := range buffer {
+		gdax.updateMatch(message)
+	}
+}
+
+// Adds the size of a new order to its price level
+func addOrder(orderBook *common.OrderBook, orders map[string]*common.Order, order common.Order) {
+	if _, ok := orders[order.Id]; ok {
+		resizeOrder(orderBook, orders, order.Id, order.Size)
+		return
+	}
+	orders[order.Id] = &order
+	level, _ := orderBook.Get(order.Side, order.Price)
+	orderBook.Update(order.Side, order.Price, level.Size.Add(order.Size))
+}
+
+// Changes the size of an order on the book, a size of zero removes it. Unknown orders
+// are not on the book, e.g. market orders
+func resizeOrder(orderBook *common.OrderBook, orders map[string]*common.Order, id string, size decimal.Decimal) {
+	order, ok := orders[id]
+	if !ok {
+		return
 	}
+	level, _ := orderBook.Get(order.Side, order.Price)
+	orderBook.Update(order.Side, order.Price, level.Size.Sub(order.Size).Add(size))
+	if size.Sign() <= 0 {
+		delete(orders, id)
+		return
+	}
+	order.Size = size
 }
 
-func updateOrderBook(message GdaxMessage, orderBook map[string]*common.Order) {
+func updateOrderBook(message GdaxMessage, orderBook *common.OrderBook) {
 	var err error
 	if message.Type == "snapshot" {
+		// Gdax level2 is easier, but only provides price level data
 		for _, order := range message.Bids {
-			// Gdax level2 is easier, but only provides price level data, which we're using as id
-			size, price := 0.0, 0.0
-			if price, err = strconv.ParseFloat(order[0], 64); err != nil {
+			var size, price decimal.Decimal
+			if price, err = decimal.NewFromString(order[0]); err != nil {
 				println(err.Error())
 				continue
 			}
-			if size, err = strconv.ParseFloat(order[1], 64); err != nil {
+			if size, err = decimal.NewFromString(order[1]); err != nil {
 				println(err.Error())
 				continue
 			}
-			id := "buy-" + strconv.FormatFloat(price, 'f', common.PRECISION_DECIMAL, 64)
-			if _, ok := orderBook[id]; !ok {
-				orderBook[id] = &common.Order{Id: id, Side: "buy"}
-			}
-			orderBook[id].Size = size
-			orderBook[id].Price = price
+			orderBook.Update(common.SIDE_BUY, price, size)
 		}
 		fmt.Printf("Processed %d bids in Gdax snapshots\n", len(message.Bids))
 		for _, order := range message.Asks {
-			// Gdax level2 is easier, but only provides price level data, which we're using as id
-			size, price := 0.0, 0.0
-			if price, err = strconv.ParseFloat(order[0], 64); err != nil {
+			var size, price decimal.Decimal
+			if price, err = decimal.NewFromString(order[0]); err != nil {
 				println(err.Error())
 				continue
 			}
-			if size, err = strconv.ParseFloat(order[1], 64); err != nil {
+			if size, err = decimal.NewFromString(order[1]); err != nil {
 				println(err.Error())
 				continue
 			}
-			id := "sell-" + strconv.FormatFloat(price, 'f', common.PRECISION_DECIMAL, 64)
-			if _, ok := orderBook[id]; !ok {
-				orderBook[id] = &common.Order{Id: id, Side: "sell"}
-			}
-			orderBook[id].Size = size
-			orderBook[id].Price = price
+			orderBook.Update(common.SIDE_SELL, price, size)
 		}
 		fmt.Printf("Processed %d asks in Gdax snapshots\n", len(message.Asks))
 
 	} else if message.Type == "l2update" {
 		for _, order := range message.Changes {
 			side := order[0]
-			size, price := 0.0, 0.0
-			if price, err = strconv.ParseFloat(order[1], 64); err != nil {
+			var size, price decimal.Decimal
+			if price, err = decimal.NewFromString(order[1]); err != nil {
 				println(err.Error())
 				continue
 			}
-			if size, err = strconv.ParseFloat(order[2], 64); err != nil {
+			if size, err = decimal.NewFromString(order[2]); err != nil {
 				println(err.Error())
 				continue
 			}
-			id := side + "-" + strconv.FormatFloat(price, 'f', common.PRECISION_DECIMAL, 64)
-			if _, ok := orderBook[id]; !ok {
-				orderBook[id] = &common.Order{Id: id}
-			}
-			orderBook[id].Size = size
-			orderBook[id].Side = side
-			orderBook[id].Price = price
+			orderBook.Update(side, price, size)
 		}
 	} else {
 		fmt.Println("Message type is " + message.Type)
 	}
 }
 
-func output(productId string, candle common.Candle) {
+// One minute candles go to <product><extension>, other timeframes to
+// <product>-<timeframe><extension>
+func output(store common.CandleStore, productId string, timeframe time.Duration, candle common.Candle) {
 	if candle.Time.Unix() < 0 {
 		return
 	}
-	file, err := os.OpenFile(productId+".txt", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		panic(err)
+	fileName := productId + store.Extension()
+	if timeframe != time.Minute {
+		fileName = productId + "-" + common.TimeframeName(timeframe) + store.Extension()
 	}
-	defer file.Close()
-	if _, err = file.WriteString(fmt.Sprintf("%d %s %s %s %s %s %s %f %f %f\n",
-		candle.Time.Unix(),
-		candle.Open,
-		candle.High,
-		candle.Low,
-		candle.Close,
-		candle.Average,
-		candle.Volume,
-		candle.Indicators["mfi"],
-		candle.Indicators["macd"],
-		candle.Indicators["macdh"])); err != nil {
-		fmt.Printf("ERROR WHILE WRITING")
+	if err := store.Append(fileName, []common.Candle{candle}); err != nil {
+		fmt.Printf("Error while writing %s: %v\n", fileName, err)
 	}
-	fmt.Printf("%s %s %s %s %s %s %s %s %f %f %f\n",
+	fmt.Printf("%s %s %s %s %s %s %s %s %s %f %f %f\n",
 		productId,
+		common.TimeframeName(timeframe),
 		candle.Time.Format(time.RFC3339),
 		candle.Open,
 		candle.High,
@@ -2,8 +2,15 @@ package gdax
 
 import (
 	"fmt"
+	ws "github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"thierry/gocoin/common"
+	"time"
 )
 
 func generateSnapshotMessage() GdaxMessage {
@@ -34,14 +41,14 @@ func TestUpdateOrderBookSnapshot(t *testing.T) {
 	// Orderbook snapshot
 	message := generateSnapshotMessage()
 	// Order book
-	orderBook := map[string]*common.Order{}
+	orderBook := common.CreateNewOrderBook(common.DEFAULT_TICK_SIZE)
 
 	// WHEN
 	updateOrderBook(message, orderBook)
 
 	// THEN
-	if len(orderBook) != 4 {
-		t.Errorf("Order book should have length %d, has length %d", 4, len(orderBook))
+	if orderBook.Len() != 4 {
+		t.Errorf("Order book should have length %d, has length %d", 4, orderBook.Len())
 	}
 }
 
@@ -54,7 +61,7 @@ func TestUpdateOrderBookUpdateChange(t *testing.T) {
 	messageSell2 := generateChangeMessage("sell", "1031", "3")
 	// Change one buy price
 	messageBuy3 := generateChangeMessage("buy", "1026", "3")
-	orderBook := map[string]*common.Order{}
+	orderBook := common.CreateNewOrderBook(common.DEFAULT_TICK_SIZE)
 
 	// WHEN
 	updateOrderBook(messageBuy1, orderBook)
@@ -64,8 +71,8 @@ func TestUpdateOrderBookUpdateChange(t *testing.T) {
 	updateOrderBook(messageBuy3, orderBook)
 
 	// THEN
-	if len(orderBook) != 4 {
-		t.Errorf("Order book should have length %d, has length %d", 4, len(orderBook))
+	if orderBook.Len() != 4 {
+		t.Errorf("Order book should have length %d, has length %d", 4, orderBook.Len())
 	}
 }
 
@@ -81,19 +88,18 @@ func TestBestPrices(t *testing.T) {
 		},
 	}
 	// Send changes
-	orderBook := map[string]*common.Order{}
+	orderBook := common.CreateNewOrderBook(common.DEFAULT_TICK_SIZE)
 	updateOrderBook(message, orderBook)
-	prices := map[string][]float64{"gdax": {0, 0, 0, 0}}
 
 	// WHEN
-	updateBestPrices(orderBook, prices)
+	book := orderBook.TopOfBook()
 
 	// THEN
-	if prices["gdax"][0] != 1033.0 {
-		t.Errorf("Wrong best buy price at %f, wanted %f", 1033.0, prices["gdax"][0])
+	if !book.Ask.Equal(decimal.NewFromFloat(1033.0)) {
+		t.Errorf("Wrong best buy price at %f, wanted %s", 1033.0, book.Ask)
 	}
-	if prices["gdax"][2] != 1020.0 {
-		t.Errorf("Wrong best sell price at %f, wanted %f", 1020.0, prices["gdax"][2])
+	if !book.Bid.Equal(decimal.NewFromFloat(1020.0)) {
+		t.Errorf("Wrong best sell price at %f, wanted %s", 1020.0, book.Bid)
 	}
 }
 
@@ -115,24 +121,614 @@ func TestBestPricesWithChanges(t *testing.T) {
 	messageSell2 := generateChangeMessage("sell", "1032", "3")
 	messageSell3 := generateChangeMessage("sell", "1031", "3")
 	// Send changes
-	orderBook := map[string]*common.Order{}
+	orderBook := common.CreateNewOrderBook(common.DEFAULT_TICK_SIZE)
 	updateOrderBook(message, orderBook)
 	updateOrderBook(messageBuy1, orderBook)
 	updateOrderBook(messageBuy2, orderBook)
 	updateOrderBook(messageSell1, orderBook)
 	updateOrderBook(messageSell2, orderBook)
 	updateOrderBook(messageSell3, orderBook)
-	prices := map[string][]float64{"gdax": {0, 0, 0, 0}}
 
 	// WHEN
-	updateBestPrices(orderBook, prices)
-	fmt.Printf("%#v\n", prices)
+	book := orderBook.TopOfBook()
+	fmt.Printf("%#v\n", book)
 
 	// THEN
-	if prices["gdax"][0] != 1031.0 {
-		t.Errorf("Wrong best buy price at %f, wanted %f", 1031.0, prices["gdax"][0])
+	if !book.Ask.Equal(decimal.NewFromFloat(1031.0)) {
+		t.Errorf("Wrong best buy price at %f, wanted %s", 1031.0, book.Ask)
 	}
-	if prices["gdax"][2] != 1025.0 {
-		t.Errorf("Wrong best sell price at %f, wanted %f", 1025.0, prices["gdax"][2])
+	if !book.Bid.Equal(decimal.NewFromFloat(1025.0)) {
+		t.Errorf("Wrong best sell price at %f, wanted %s", 1025.0, book.Bid)
+	}
+}
+
+func TestHandleMessageMatch(t *testing.T) {
+	// GIVEN
+	exchange := CreateNewExchange()
+	message := GdaxMessage{
+		Type:      "match",
+		ProductId: "BTC-USD",
+		TradeId:   42,
+		Side:      "sell",
+		Price:     "1020.5",
+		Size:      "0.3",
+	}
+
+	// WHEN
+	exchange.handleMessage(message)
+	trade := <-exchange.Trades()
+
+	// THEN
+	if trade.Exchange != "gdax" || trade.ProductId != "BTC-USD" || trade.TradeId != "42" {
+		t.Errorf("Trade not properly normalized: %v", trade.String())
+	}
+	if trade.Price.String() != "1020.5" || trade.Size.String() != "0.3" {
+		t.Errorf("Trade price or size not properly parsed: %v", trade.String())
+	}
+}
+
+func TestTradesDroppedWhenNotRead(t *testing.T) {
+	// GIVEN
+	// Nobody reading the trades
+	exchange := CreateNewExchange()
+	for i := 1; i <= common.EVENT_BUFFER+1; i++ {
+		exchange.handleMessage(GdaxMessage{Type: "match", ProductId: "BTC-USD", TradeId: i, Price: "1000", Size: "1"})
+	}
+	message := generateSnapshotMessage()
+	message.ProductId = "BTC-USD"
+
+	// WHEN
+	exchange.handleMessage(message)
+
+	// THEN
+	if exchange.droppedTrades != 1 || len(exchange.Trades()) != common.EVENT_BUFFER {
+		t.Errorf("Trade over the buffer should be dropped, %d dropped", exchange.droppedTrades)
+	}
+	if len(exchange.BookUpdates()) != 1 {
+		t.Errorf("Book should still be updated")
+	}
+}
+
+// Feed keeping the messages subscribed
+type stubFeed struct {
+	common.Replay
+	subscribes []interface{}
+}
+
+func (feed *stubFeed) Subscribe(message interface{}) error {
+	feed.subscribes = append(feed.subscribes, message)
+	return nil
+}
+
+func TestSubscribeBookChannel(t *testing.T) {
+	// GIVEN
+	full, level2 := CreateNewExchange(), CreateNewExchange()
+	level2.BookChannel = BOOK_LEVEL2
+	fullFeed, level2Feed := &stubFeed{}, &stubFeed{}
+	full.conn, level2.conn = fullFeed, level2Feed
+
+	// WHEN
+	full.Subscribe([]string{"BTC-USD"}, []string{common.CHANNEL_BOOK})
+	level2.Subscribe([]string{"BTC-USD"}, []string{common.CHANNEL_BOOK})
+
+	// THEN
+	if name := fullFeed.subscribes[0].(GdaxSubscribe).Channels[0]["name"]; name != "full" {
+		t.Errorf("Books should come from the full channel by default, got %s", name)
+	}
+	if name := level2Feed.subscribes[0].(GdaxSubscribe).Channels[0]["name"]; name != "level2" {
+		t.Errorf("Books should come from the level2 channel, got %s", name)
+	}
+}
+
+func TestHandleMessageBook(t *testing.T) {
+	// GIVEN
+	exchange := CreateNewExchange()
+	message := generateSnapshotMessage()
+	message.ProductId = "ETH-USD"
+
+	// WHEN
+	exchange.handleMessage(message)
+	book := <-exchange.BookUpdates()
+
+	// THEN
+	if book.ProductId != "ETH-USD" || !book.Bid.Equal(decimal.NewFromFloat(1029.0)) || !book.Ask.Equal(decimal.NewFromFloat(1033.0)) {
+		t.Errorf("Wrong book update %#v", book)
+	}
+}
+
+type stubBookClient struct {
+	snapshot GdaxMessage
+	requests int
+}
+
+func (client *stubBookClient) GetBook(productId string) (GdaxMessage, error) {
+	client.requests += 1
+	client.snapshot.ProductId = productId
+	return client.snapshot, nil
+}
+
+// Full channel message as sent by gdax, on BTC-USD
+func generateFullMessage(t *testing.T, sequence int64, fields string) GdaxMessage {
+	message := GdaxMessage{}
+	data := fmt.Sprintf(`{"product_id":"BTC-USD","sequence":%d,"time":"2018-01-01T00:00:00.000000Z",%s}`, sequence, fields)
+	if err := common.JSONDecode([]byte(data), &message); err != nil {
+		t.Fatalf("Invalid message %s: %v", data, err)
+	}
+	return message
+}
+
+func generateOpenMessage(t *testing.T, sequence int64, orderId, side, price, size string) GdaxMessage {
+	return generateFullMessage(t, sequence, fmt.Sprintf(`"type":"open","order_id":"%s","side":"%s","price":"%s","remaining_size":"%s"`,
+		orderId, side, price, size))
+}
+
+// Starts the book of BTC-USD from a snapshot with one bid, at the sequence given
+func generateStartedExchange(t *testing.T, sequence int64) (*Gdax, *stubBookClient) {
+	client := &stubBookClient{snapshot: GdaxMessage{
+		Type:     "snapshot",
+		Sequence: sequence,
+		Bids:     [][]string{{"980", "1", "x"}},
+	}}
+	exchange := CreateNewExchange()
+	exchange.Rest = client
+	exchange.handleMessage(generateFullMessage(t, sequence, `"type":"received","order_id":"r","order_type":"limit","side":"buy","price":"1","size":"1"`))
+	exchange.resync(<-exchange.snapshots)
+	return exchange, client
+}
+
+func TestFullChannelBook(t *testing.T) {
+	// GIVEN
+	// Two orders at the same price, partly filled then changed and canceled
+	exchange, client := generateStartedExchange(t, 9)
+	messages := []GdaxMessage{
+		generateOpenMessage(t, 10, "a", "sell", "1010.00", "1.5"),
+		generateOpenMessage(t, 11, "b", "sell", "1010.00", "0.5"),
+		generateFullMessage(t, 12, `"type":"match","trade_id":7,"maker_order_id":"a","taker_order_id":"c","side":"sell","price":"1010.00","size":"1.0"`),
+		generateFullMessage(t, 13, `"type":"change","order_id":"b","side":"sell","price":"1010.00","new_size":"0.25","old_size":"0.5"`),
+		generateFullMessage(t, 14, `"type":"done","order_id":"x","side":"buy","price":"980","remaining_size":"1","reason":"canceled"`),
+		// Same match on the matches channel
+		generateFullMessage(t, 12, `"type":"match","trade_id":7,"maker_order_id":"a","taker_order_id":"c","side":"sell","price":"1010.00","size":"1.0"`),
+	}
+
+	// WHEN
+	for _, message := range messages {
+		exchange.handleMessage(message)
+	}
+	book := exchange.orderBooks["BTC-USD"].TopOfBook()
+
+	// THEN
+	if client.requests != 1 {
+		t.Errorf("Snapshot should only be requested to start the book, was %d", client.requests)
+	}
+	if !book.Ask.Equal(decimal.NewFromFloat(1010)) || book.AskSize.String() != "0.75" || book.Bid.Sign() != 0 {
+		t.Errorf("Wrong book %#v", book)
+	}
+	if len(exchange.orders["BTC-USD"]) != 2 || len(exchange.Trades()) != 1 {
+		t.Errorf("Wrong orders %v or trades %d", exchange.orders["BTC-USD"], len(exchange.Trades()))
+	}
+}
+
+func TestSequenceGapResync(t *testing.T) {
+	// GIVEN
+	// Snapshot at sequence 13, while we last saw 11 and buffered 13, 14 and 15
+	exchange, client := generateStartedExchange(t, 9)
+	exchange.handleMessage(generateOpenMessage(t, 10, "c", "buy", "990", "1"))
+	exchange.handleMessage(generateOpenMessage(t, 11, "b", "sell", "1010", "1"))
+	client.snapshot = GdaxMessage{
+		Type:     "snapshot",
+		Sequence: 13,
+		Bids:     [][]string{{"1000", "1", "a"}},
+		Asks:     [][]string{{"1010", "1", "b"}},
+	}
+
+	// WHEN
+	exchange.handleMessage(generateOpenMessage(t, 13, "d", "buy", "995", "1"))
+	exchange.handleMessage(generateOpenMessage(t, 14, "e", "buy", "1005", "2"))
+	exchange.handleMessage(generateFullMessage(t, 15, `"type":"done","order_id":"b","side":"sell","price":"1010","remaining_size":"1","reason":"canceled"`))
+	staleBook := exchange.orderBooks["BTC-USD"].TopOfBook()
+	exchange.resync(<-exchange.snapshots)
+
+	// THEN
+	if client.requests != 2 {
+		t.Errorf("Snapshot should have been requested again, was %d", client.requests)
+	}
+	if !staleBook.Bid.Equal(decimal.NewFromFloat(990.0)) {
+		t.Errorf("Stale book should not be updated, best bid %s", staleBook.Bid)
+	}
+	// 990 was dropped with the snapshot, 995 is already in it, 1005 and the cancel of 1010 replayed
+	orderBook := exchange.orderBooks["BTC-USD"]
+	book := orderBook.TopOfBook()
+	if !book.Bid.Equal(decimal.NewFromFloat(1005.0)) || !book.BidSize.Equal(decimal.NewFromFloat(2.0)) || book.Ask.Sign() != 0 {
+		t.Errorf("Book not properly resynced %#v", book)
+	}
+	if _, ok := orderBook.Get(common.SIDE_BUY, decimal.NewFromFloat(990)); ok {
+		t.Errorf("Book should have been replaced by the snapshot")
+	}
+	if _, ok := orderBook.Get(common.SIDE_BUY, decimal.NewFromFloat(995)); ok {
+		t.Errorf("Messages older than the snapshot should not be replayed")
+	}
+	if exchange.sequences["BTC-USD"].sequence != 15 || exchange.sequences["BTC-USD"].stale {
+		t.Errorf("Sequence not properly tracked %#v", exchange.sequences["BTC-USD"])
+	}
+	var event common.Event
+	for len(exchange.Events()) > 0 {
+		event = <-exchange.Events()
+	}
+	if event.Type != common.EVENT_BOOK_RESYNCED || event.ProductId != "BTC-USD" {
+		t.Errorf("Last event should be a resync %v", event.String())
+	}
+}
+
+func TestSequenceOldMessageDropped(t *testing.T) {
+	// GIVEN
+	exchange, _ := generateStartedExchange(t, 9)
+	exchange.handleMessage(generateOpenMessage(t, 10, "a", "buy", "990", "1"))
+
+	// WHEN
+	exchange.handleMessage(generateOpenMessage(t, 9, "b", "buy", "995", "1"))
+	exchange.handleMessage(generateOpenMessage(t, 11, "c", "buy", "992", "1"))
+
+	// THEN
+	book := exchange.orderBooks["BTC-USD"].TopOfBook()
+	if !book.Bid.Equal(decimal.NewFromFloat(992.0)) {
+		t.Errorf("Old message should have been dropped, best bid %s", book.Bid)
+	}
+	if exchange.sequences["BTC-USD"].stale {
+		t.Errorf("Book should not be stale")
+	}
+}
+
+// Fails every request
+type failingBookClient struct {
+	mutex    sync.Mutex
+	requests int
+}
+
+func (client *failingBookClient) GetBook(productId string) (GdaxMessage, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.requests += 1
+	return GdaxMessage{}, fmt.Errorf("unavailable")
+}
+
+func (client *failingBookClient) count() int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.requests
+}
+
+func TestSnapshotRetry(t *testing.T) {
+	// GIVEN
+	client := &failingBookClient{}
+	exchange := CreateNewExchange()
+	exchange.Rest = client
+	exchange.MinBackoff = 20 * time.Millisecond
+	exchange.handleMessage(generateOpenMessage(t, 10, "a", "buy", "990", "1"))
+
+	// WHEN
+	// The first failure is retried, then the feed is closed while waiting for the next
+	exchange.resync(<-exchange.snapshots)
+	retry := <-exchange.snapshots
+	exchange.resync(retry)
+	close(exchange.quit)
+	time.Sleep(100 * time.Millisecond)
+
+	// THEN
+	if retry.attempt != 1 {
+		t.Errorf("Retry should be the second attempt, got %d", retry.attempt)
+	}
+	if client.count() != 2 || len(exchange.snapshots) != 0 {
+		t.Errorf("Retries should stop once closed, %d requests", client.count())
+	}
+}
+
+func TestReplay(t *testing.T) {
+	// GIVEN
+	// Two recorded matches, replayed through the same handlers
+	dir, _ := ioutil.TempDir("", "gdax")
+	defer os.RemoveAll(dir)
+	recorder := common.CreateNewRecorder(dir, "gdax")
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	recorder.Record(start, ws.TextMessage, []byte(`{"type":"match","product_id":"BTC-USD","trade_id":1,"side":"buy","price":"1000","size":"0.1","time":"2018-01-01T00:00:00Z"}`))
+	recorder.Record(start.Add(time.Second), ws.TextMessage, []byte(`{"type":"match","product_id":"BTC-USD","trade_id":2,"side":"sell","price":"1001","size":"0.2","time":"2018-01-01T00:00:01Z"}`))
+	recorder.Close()
+	files, _ := common.SegmentFiles(dir, "gdax")
+	exchange := CreateNewExchange()
+
+	// WHEN
+	exchange.Replay(common.CreateNewReplay(files, 0))
+	trades := []common.Trade{}
+	for trade := range exchange.Trades() {
+		trades = append(trades, trade)
+	}
+
+	// THEN
+	if len(trades) != 2 || trades[0].TradeId != "1" || trades[1].Price.String() != "1001" {
+		t.Errorf("Recorded matches should be replayed in order, got %v", trades)
+	}
+}
+
+func TestReplayBook(t *testing.T) {
+	// GIVEN
+	// The first message of the full channel requests a snapshot, recorded after it
+	dir, _ := ioutil.TempDir("", "gdax")
+	defer os.RemoveAll(dir)
+	recorder := common.CreateNewRecorder(dir, "gdax")
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	frame := func(delay time.Duration, msgType int, message interface{}) {
+		data, _ := common.JSONEncode(message)
+		recorder.Record(start.Add(delay), msgType, data)
+	}
+	frame(0, ws.TextMessage, generateOpenMessage(t, 10, "a", "sell", "1010", "1"))
+	frame(10*time.Millisecond, common.FRAME_SNAPSHOT, GdaxMessage{Type: "snapshot", ProductId: "BTC-USD", Sequence: 9, Bids: [][]string{{"980", "1", "x"}}})
+	frame(20*time.Millisecond, ws.TextMessage, generateOpenMessage(t, 11, "b", "buy", "990", "1"))
+	// Leaves time for the snapshot to be applied before the end
+	frame(300*time.Millisecond, ws.TextMessage, GdaxMessage{Type: "heartbeat", ProductId: "BTC-USD"})
+	recorder.Close()
+	files, _ := common.SegmentFiles(dir, "gdax")
+	client := &failingBookClient{}
+	exchange := CreateNewExchange()
+	exchange.Rest = client
+
+	// WHEN
+	exchange.Replay(common.CreateNewReplay(files, 1))
+	books := []common.BookUpdate{}
+	for book := range exchange.BookUpdates() {
+		books = append(books, book)
+	}
+
+	// THEN
+	if client.count() != 0 {
+		t.Errorf("Replay should not fetch snapshots, %d requests", client.count())
+	}
+	if len(books) == 0 || !books[len(books)-1].Bid.Equal(decimal.New(990, 0)) || !books[len(books)-1].Ask.Equal(decimal.New(1010, 0)) {
+		t.Fatalf("Book should start from the recorded snapshot %v", books)
+	}
+	// Recorded times of the snapshot then of the last message, not the gdax times
+	if !books[0].Time.Equal(start.Add(10*time.Millisecond)) || !books[len(books)-1].Time.Equal(start.Add(20*time.Millisecond)) {
+		t.Errorf("Book updates should have the time they were received %v %v", books[0].Time, books[len(books)-1].Time)
+	}
+}
+
+// Rising candles every minute and trades every 10 seconds, trade ids going up with time
+type stubHistoryClient struct {
+	start time.Time
+}
+
+func (client *stubHistoryClient) GetCandles(productId string, granularity time.Duration, start, end time.Time) ([]common.Candle, error) {
+	candles := []common.Candle{}
+	for t := start; t.Before(end); t = t.Add(granularity) {
+		price := decimal.New(int64(t.Sub(client.start)/time.Minute), 0)
+		candles = append(candles, common.Candle{Time: t, Open: price, High: price, Low: price, Close: price, Volume: decimal.New(1, 0)})
+	}
+	return candles, nil
+}
+
+func (client *stubHistoryClient) GetTrades(productId string, since time.Time) ([]GdaxMessage, error) {
+	matches := []GdaxMessage{}
+	for i := 0; i < 12; i++ {
+		t := client.start.Add(time.Duration(i) * 10 * time.Second)
+		if !t.Before(since) {
+			matches = append(matches, GdaxMessage{Type: "match", ProductId: productId, TradeId: 100 + i, Side: "buy", Price: "1", Size: "1", Time: t})
+		}
+	}
+	return matches, nil
+}
+
+func TestBackfill(t *testing.T) {
+	// GIVEN
+	// First live match at 10:00:35, after trades 100 to 103 of the same minute
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	exchange := CreateNewExchange()
+	exchange.Timeframes = []time.Duration{time.Minute}
+	exchange.History = &stubHistoryClient{start: start}
+	live := GdaxMessage{Type: "match", ProductId: "BTC-USD", TradeId: 104, Side: "buy", Price: "2", Size: "1", Time: start.Add(35 * time.Second)}
+
+	// WHEN
+	exchange.handleMessage(live)
+	// Trade 103 again, e.g. a backfilled trade also received live
+	duplicate := live
+	duplicate.TradeId = 103
+	exchange.handleMessage(duplicate)
+	// Trade 105 comes while the backfill is still running
+	next := live
+	next.TradeId, next.Time = 105, start.Add(40*time.Second)
+	exchange.handleMessage(next)
+	exchange.applyBackfill(<-exchange.backfills)
+	trades := []string{}
+	for len(exchange.Trades()) > 0 {
+		trades = append(trades, (<-exchange.Trades()).TradeId)
+	}
+	chart := exchange.aggregators["BTC-USD"].Charts[time.Minute]
+
+	// THEN
+	if strings.Join(trades, ",") != "104,105" {
+		t.Errorf("Only the live trades should be sent, once, got %v", trades)
+	}
+	if !chart.CurrentCandle().Time.Equal(start) || !chart.CurrentCandle().Volume.Equal(decimal.New(6, 0)) ||
+		!chart.CurrentCandle().Open.Equal(decimal.New(1, 0)) {
+		t.Errorf("Current candle should have the backfilled then the live trades %v", chart.CurrentCandle().String())
+	}
+	previous := chart.GetPastRelativeCandle(-1)
+	if !previous.Time.Equal(start.Add(-time.Minute)) || previous.Indicators["macd"] == 0 {
+		t.Errorf("Past candles should be warmed up with their indicators %v", previous.String())
+	}
+}
+
+// Keeps the candles appended, in order, instead of writing files
+type memoryCandleStore struct {
+	mutex   sync.Mutex
+	files   []string
+	candles []common.Candle
+	// Slows down each Append when set
+	delay time.Duration
+	// Number of candles appended when Flush was called
+	flushed int
+}
+
+func (store *memoryCandleStore) Append(path string, candles []common.Candle) error {
+	time.Sleep(store.delay)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, candle := range candles {
+		store.files = append(store.files, path)
+		store.candles = append(store.candles, candle)
+	}
+	return nil
+}
+
+func (store *memoryCandleStore) Read(path string) ([]common.Candle, error) {
+	return nil, nil
+}
+
+func (store *memoryCandleStore) Extension() string {
+	return ".mem"
+}
+
+func (store *memoryCandleStore) Flush() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.flushed = len(store.candles)
+	return nil
+}
+
+func TestCandlesWrittenInOrder(t *testing.T) {
+	// GIVEN
+	// A match at 10:00, then one at 10:30, the gap completes 30 candles at once
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	store := &memoryCandleStore{}
+	exchange := CreateNewExchange()
+	exchange.Timeframes = []time.Duration{time.Minute}
+	exchange.Store = store
+	written := make(chan common.Candle, 100)
+	exchange.OnCandle = func(productId string, timeframe time.Duration, candle common.Candle) {
+		written <- candle
+	}
+	go exchange.write()
+
+	// WHEN
+	exchange.handleMessage(GdaxMessage{Type: "match", ProductId: "BTC-USD", TradeId: 1, Side: "buy", Price: "1000", Size: "1", Time: start})
+	exchange.handleMessage(GdaxMessage{Type: "match", ProductId: "BTC-USD", TradeId: 2, Side: "buy", Price: "1001", Size: "1", Time: start.Add(30 * time.Minute)})
+	close(exchange.candles)
+	candles := []common.Candle{}
+	for i := 0; i < 30; i++ {
+		candles = append(candles, <-written)
+	}
+
+	// THEN
+	for i, candle := range candles {
+		if !candle.Time.Equal(start.Add(time.Duration(i)*time.Minute)) || !store.candles[i].Time.Equal(candle.Time) || store.files[i] != "BTC-USD.mem" {
+			t.Fatalf("Candle %d written out of order at %v", i, store.candles[i].Time)
+		}
+	}
+}
+
+func TestCorrectedCandleNotWrittenAgain(t *testing.T) {
+	// GIVEN
+	// A match at 10:00 and one at 10:01 complete the 10:00 candle
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	store := &memoryCandleStore{}
+	exchange := CreateNewExchange()
+	exchange.Timeframes = []time.Duration{time.Minute}
+	exchange.Store = store
+	written := make(chan common.Candle, 10)
+	exchange.OnCandle = func(productId string, timeframe time.Duration, candle common.Candle) {
+		written <- candle
+	}
+	go exchange.write()
+	exchange.handleMessage(GdaxMessage{Type: "match", ProductId: "BTC-USD", TradeId: 1, Side: "buy", Price: "1000", Size: "1", Time: start.Add(10 * time.Second)})
+	exchange.handleMessage(GdaxMessage{Type: "match", ProductId: "BTC-USD", TradeId: 2, Side: "buy", Price: "1001", Size: "1", Time: start.Add(70 * time.Second)})
+
+	// WHEN
+	// A late match of 10:00 comes after
+	exchange.handleMessage(GdaxMessage{Type: "match", ProductId: "BTC-USD", TradeId: 3, Side: "buy", Price: "1010", Size: "1", Time: start.Add(50 * time.Second)})
+	close(exchange.candles)
+	completed, corrected := <-written, <-written
+	<-exchange.written
+
+	// THEN
+	// OnCandle gets the corrected candle again, the file keeps the first one
+	if !completed.High.Equal(decimal.NewFromFloat(1000)) || !corrected.Time.Equal(start) || !corrected.High.Equal(decimal.NewFromFloat(1010)) {
+		t.Fatalf("Candle not corrected: %v then %v", completed, corrected)
+	}
+	if len(store.candles) != 1 || !store.candles[0].High.Equal(decimal.NewFromFloat(1000)) {
+		t.Fatalf("Corrected candle written to the file: %v", store.candles)
+	}
+}
+
+func TestCloseWaitsForCandles(t *testing.T) {
+	// GIVEN
+	// Matches over three minutes complete two candles, written slowly
+	dir, _ := ioutil.TempDir("", "gdax")
+	defer os.RemoveAll(dir)
+	recorder := common.CreateNewRecorder(dir, "gdax")
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		recorder.Record(start.Add(time.Duration(i)*time.Minute), ws.TextMessage, []byte(fmt.Sprintf(
+			`{"type":"match","product_id":"BTC-USD","trade_id":%d,"side":"buy","price":"1000","size":"0.1","time":"%s"}`,
+			i+1, start.Add(time.Duration(i)*time.Minute).Format(time.RFC3339))))
+	}
+	recorder.Close()
+	files, _ := common.SegmentFiles(dir, "gdax")
+	store := &memoryCandleStore{delay: 50 * time.Millisecond}
+	exchange := CreateNewExchange()
+	exchange.Timeframes = []time.Duration{time.Minute}
+	exchange.Store = store
+
+	// WHEN
+	exchange.Replay(common.CreateNewReplay(files, 0))
+	for range exchange.Trades() {
+	}
+	exchange.Close()
+
+	// THEN
+	if store.flushed != 2 {
+		t.Errorf("Store should be flushed once the %d candles are written, got %d", 2, store.flushed)
+	}
+}
+
+func TestBackfillAfterReconnect(t *testing.T) {
+	// GIVEN
+	// Started at 10:00:35, then disconnected until 10:05:10
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	store := &memoryCandleStore{}
+	exchange := CreateNewExchange()
+	exchange.Timeframes = []time.Duration{time.Minute}
+	exchange.History = &stubHistoryClient{start: start}
+	exchange.Store = store
+	written := make(chan common.Candle, 100)
+	exchange.OnCandle = func(productId string, timeframe time.Duration, candle common.Candle) {
+		written <- candle
+	}
+	go exchange.write()
+	exchange.handleMessage(GdaxMessage{Type: "match", ProductId: "BTC-USD", TradeId: 104, Side: "buy", Price: "2", Size: "1", Time: start.Add(35 * time.Second)})
+	stale := <-exchange.backfills
+	exchange.applyBackfill(stale)
+
+	// WHEN
+	exchange.handleMessage(GdaxMessage{Type: "reconnect"})
+	// A backfill from before the reconnect is dropped
+	exchange.handleMessage(GdaxMessage{Type: "match", ProductId: "BTC-USD", TradeId: 200, Side: "buy", Price: "7", Size: "1", Time: start.Add(5*time.Minute + 10*time.Second)})
+	exchange.applyBackfill(stale)
+	exchange.applyBackfill(<-exchange.backfills)
+	candles := []common.Candle{}
+	for i := 0; i < 5; i++ {
+		candles = append(candles, <-written)
+	}
+	chart := exchange.aggregators["BTC-USD"].Charts[time.Minute]
+
+	// THEN
+	// The open 10:00 candle and the minutes missed are the backfilled ones
+	for i, candle := range candles {
+		if !candle.Time.Equal(start.Add(time.Duration(i)*time.Minute)) || !candle.Close.Equal(decimal.New(int64(i), 0)) || !candle.Volume.Equal(decimal.New(1, 0)) {
+			t.Errorf("Candle %d should be backfilled %s", i, candle.String())
+		}
+	}
+	if len(written) != 0 || len(exchange.resumes) != 0 {
+		t.Errorf("Only the candles missed should be written, %d more", len(written))
+	}
+	if !chart.CurrentCandle().Time.Equal(start.Add(5*time.Minute)) || !chart.CurrentCandle().Close.Equal(decimal.New(7, 0)) ||
+		!chart.GetPastRelativeCandle(-1).Volume.Equal(decimal.New(1, 0)) {
+		t.Errorf("Chart should go on from the backfilled candles %s", chart.CurrentCandle().String())
 	}
 }
@@ -0,0 +1,296 @@
+package gdax
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"thierry/gocoin/common"
+	"time"
+)
+
+const REST_URL = "https://api.gdax.com"
+
+// Most candles and trades returned by a single request
+var MAX_CANDLES_PER_REQUEST = 300
+var MAX_TRADES_PER_REQUEST = 100
+
+// Pages of trades fetched at most going back in time
+var MAX_TRADE_PAGES = 50
+
+// BookClient fetches a full order book snapshot, with every order, used to start the
+// book of the full channel and to resync it after a gap
+type BookClient interface {
+	GetBook(productId string) (GdaxMessage, error)
+}
+
+// HistoryClient fetches past candles and trades, used to warm up the charts after a
+// restart
+type HistoryClient interface {
+	// Candles of the granularity from start up to end, oldest first
+	GetCandles(productId string, granularity time.Duration, start, end time.Time) ([]common.Candle, error)
+	// Trades since the time as match messages, oldest first
+	GetTrades(productId string, since time.Time) ([]GdaxMessage, error)
+}
+
+type RestClient struct {
+	Url    string
+	Client *http.Client
+}
+
+// RecordingBookClient records every snapshot the client fetches along with the feed
+// frames, see common.FRAME_SNAPSHOT
+type RecordingBookClient struct {
+	Client   BookClient
+	Recorder *common.Recorder
+}
+
+// ReplayBookClient returns the snapshots of a recording instead of fetching them, in
+// the order they were recorded for each product. A request waits for the replay to
+// read the next snapshot of its product
+type ReplayBookClient struct {
+	mutex     sync.Mutex
+	snapshots map[string]chan GdaxMessage
+	quit      <-chan struct{}
+}
+
+// Level 3 book as returned by the REST api, entries are [price, size, order-id]
+type gdaxRestBook struct {
+	Sequence int64           `json:"sequence"`
+	Bids     [][]interface{} `json:"bids"`
+	Asks     [][]interface{} `json:"asks"`
+}
+
+// Trade as returned by the REST api, side is the maker side like in match messages
+type gdaxRestTrade struct {
+	Time    time.Time `json:"time"`
+	TradeId int       `json:"trade_id"`
+	Price   string    `json:"price"`
+	Size    string    `json:"size"`
+	Side    string    `json:"side"`
+}
+
+// Public
+
+func CreateNewRestClient() *RestClient {
+	return &RestClient{Url: REST_URL, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// GetBook returns the level 3 book as a snapshot message, with the order id as the
+// third field of each level
+func (client *RestClient) GetBook(productId string) (GdaxMessage, error) {
+	body, _, err := client.get("/products/"+productId+"/book", url.Values{"level": {"3"}})
+	if err != nil {
+		return GdaxMessage{}, err
+	}
+
+	book := gdaxRestBook{}
+	if err := common.JSONDecode(body, &book); err != nil {
+		return GdaxMessage{}, err
+	}
+	return GdaxMessage{
+		Type:      "snapshot",
+		ProductId: productId,
+		Sequence:  book.Sequence,
+		Bids:      toLevels(book.Bids),
+		Asks:      toLevels(book.Asks),
+		received:  time.Now(),
+	}, nil
+}
+
+func (client *RecordingBookClient) GetBook(productId string) (GdaxMessage, error) {
+	snapshot, err := client.Client.GetBook(productId)
+	if err != nil {
+		return snapshot, err
+	}
+	data, err := common.JSONEncode(snapshot)
+	if err == nil {
+		err = client.Recorder.Record(time.Now(), common.FRAME_SNAPSHOT, data)
+	}
+	if err != nil && err != common.ErrRecorderClosed {
+		fmt.Printf("Could not record %s snapshot: %v\n", productId, err)
+	}
+	return snapshot, nil
+}
+
+// CreateNewReplayBookClient stops waiting for snapshots once quit is closed
+func CreateNewReplayBookClient(quit <-chan struct{}) *ReplayBookClient {
+	return &ReplayBookClient{snapshots: map[string]chan GdaxMessage{}, quit: quit}
+}
+
+// AddSnapshot queues a snapshot recorded at t, see common.Replay.OnSnapshot
+func (client *ReplayBookClient) AddSnapshot(t time.Time, data []byte) {
+	snapshot := GdaxMessage{received: t}
+	if err := common.JSONDecode(data, &snapshot); err != nil {
+		fmt.Printf("Invalid recorded snapshot: %v\n", err)
+		return
+	}
+	select {
+	case client.queue(snapshot.ProductId) <- snapshot:
+	case <-client.quit:
+	}
+}
+
+func (client *ReplayBookClient) GetBook(productId string) (GdaxMessage, error) {
+	select {
+	case snapshot := <-client.queue(productId):
+		return snapshot, nil
+	case <-client.quit:
+		return GdaxMessage{}, fmt.Errorf("replay of %s ended before its snapshot", productId)
+	}
+}
+
+// GetCandles requests the candles in windows of MAX_CANDLES_PER_REQUEST. Candles are
+// [time, low, high, open, close, volume], periods without trades are missing
+func (client *RestClient) GetCandles(productId string, granularity time.Duration, start, end time.Time) ([]common.Candle, error) {
+	candles := []common.Candle{}
+	window := time.Duration(MAX_CANDLES_PER_REQUEST) * granularity
+	for from := start; from.Before(end); from = from.Add(window) {
+		to := from.Add(window)
+		if to.After(end) {
+			to = end
+		}
+		body, _, err := client.get("/products/"+productId+"/candles", url.Values{
+			"granularity": {strconv.Itoa(int(granularity / time.Second))},
+			"start":       {from.UTC().Format(time.RFC3339)},
+			"end":         {to.UTC().Format(time.RFC3339)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		windowCandles, err := toCandles(body)
+		if err != nil {
+			return nil, err
+		}
+		candles = append(candles, windowCandles...)
+	}
+	sort.Slice(candles, func(i, j int) bool { return candles[i].Time.Before(candles[j].Time) })
+	// Windows share their bounds
+	unique := []common.Candle{}
+	for _, candle := range candles {
+		if len(unique) == 0 || candle.Time.After(unique[len(unique)-1].Time) {
+			unique = append(unique, candle)
+		}
+	}
+	return unique, nil
+}
+
+// GetTrades goes back through the pages of trades, newest first, until one is older
+// than since, then returns them as matches
+func (client *RestClient) GetTrades(productId string, since time.Time) ([]GdaxMessage, error) {
+	matches := []GdaxMessage{}
+	query := url.Values{"limit": {strconv.Itoa(MAX_TRADES_PER_REQUEST)}}
+	for page := 0; page < MAX_TRADE_PAGES; page++ {
+		body, header, err := client.get("/products/"+productId+"/trades", query)
+		if err != nil {
+			return nil, err
+		}
+		trades := []gdaxRestTrade{}
+		if err := common.JSONDecode(body, &trades); err != nil {
+			return nil, err
+		}
+		done := len(trades) == 0
+		for _, trade := range trades {
+			if trade.Time.Before(since) {
+				done = true
+				continue
+			}
+			matches = append(matches, GdaxMessage{
+				Type:      "match",
+				ProductId: productId,
+				TradeId:   trade.TradeId,
+				Side:      trade.Side,
+				Price:     trade.Price,
+				Size:      trade.Size,
+				Time:      trade.Time,
+			})
+		}
+		// Cursor of the older page
+		after := header.Get("Cb-After")
+		if done || after == "" {
+			break
+		}
+		query.Set("after", after)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].TradeId < matches[j].TradeId })
+	return matches, nil
+}
+
+// Private
+
+func (client *ReplayBookClient) queue(productId string) chan GdaxMessage {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	queue, ok := client.snapshots[productId]
+	if !ok {
+		queue = make(chan GdaxMessage, common.EVENT_BUFFER)
+		client.snapshots[productId] = queue
+	}
+	return queue
+}
+
+func (client *RestClient) get(path string, query url.Values) ([]byte, http.Header, error) {
+	resp, err := client.Client.Get(client.Url + path + "?" + query.Encode())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("gdax: %s request failed with %d %s", path, resp.StatusCode, body)
+	}
+	return body, resp.Header, nil
+}
+
+func toCandles(body []byte) ([]common.Candle, error) {
+	jsonParsed, err := common.ParseJSONNumbers(body)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := jsonParsed.Children()
+	if err != nil {
+		return nil, fmt.Errorf("gdax: candles are not a list")
+	}
+	candles := []common.Candle{}
+	for _, entry := range entries {
+		values, err := entry.Children()
+		if err != nil || len(values) < 6 {
+			return nil, fmt.Errorf("gdax: invalid candle %s", entry.String())
+		}
+		seconds, ok := common.JSONToDecimal(values[0].Data())
+		if !ok {
+			return nil, fmt.Errorf("gdax: invalid candle time %s", entry.String())
+		}
+		candle := common.Candle{Time: time.Unix(seconds.IntPart(), 0)}
+		fields := []*decimal.Decimal{&candle.Low, &candle.High, &candle.Open, &candle.Close, &candle.Volume}
+		for i, field := range fields {
+			if *field, ok = common.JSONToDecimal(values[i+1].Data()); !ok {
+				return nil, fmt.Errorf("gdax: invalid candle %s", entry.String())
+			}
+		}
+		candles = append(candles, candle)
+	}
+	return candles, nil
+}
+
+func toLevels(entries [][]interface{}) [][]string {
+	levels := make([][]string, 0, len(entries))
+	for _, entry := range entries {
+		if len(entry) < 2 {
+			continue
+		}
+		level := make([]string, len(entry))
+		for i, field := range entry {
+			level[i] = fmt.Sprint(field)
+		}
+		levels = append(levels, level)
+	}
+	return levels
+}
@@ -0,0 +1,163 @@
+package gdax
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"thierry/gocoin/common"
+	"time"
+)
+
+func TestRestClientGetBook(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/products/ETH-USD/book" || r.URL.Query().Get("level") != "3" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"sequence":3501,"bids":[["295.96","4.39088265","3b0f1225-7f84-490b-a29f-0faef9de823a"]],"asks":[["295.97","25.23542881","da863862-25f4-4868-ac41-005d11ab0a5f"],["296.01","1","7b3f2a4e-2f29-4cd4-9d8c-5a0e2e8a4c3d"]]}`))
+	}))
+	defer server.Close()
+	client := CreateNewRestClient()
+	client.Url = server.URL
+
+	// WHEN
+	snapshot, err := client.GetBook("ETH-USD")
+	_, errNotFound := client.GetBook("BTC-EUR")
+
+	// THEN
+	if err != nil {
+		t.Fatalf("Could not get book %v", err)
+	}
+	if snapshot.Type != "snapshot" || snapshot.ProductId != "ETH-USD" || snapshot.Sequence != 3501 {
+		t.Errorf("Wrong snapshot %#v", snapshot)
+	}
+	if len(snapshot.Bids) != 1 || len(snapshot.Asks) != 2 || snapshot.Asks[0][0] != "295.97" || snapshot.Asks[0][1] != "25.23542881" ||
+		snapshot.Asks[0][2] != "da863862-25f4-4868-ac41-005d11ab0a5f" {
+		t.Errorf("Wrong levels %v %v", snapshot.Bids, snapshot.Asks)
+	}
+	if errNotFound == nil {
+		t.Errorf("Should fail on unknown product")
+	}
+}
+
+func TestRestClientGetCandles(t *testing.T) {
+	// GIVEN
+	// 5 candles per request, newest first, start and end included
+	defer func(max int) { MAX_CANDLES_PER_REQUEST = max }(MAX_CANDLES_PER_REQUEST)
+	MAX_CANDLES_PER_REQUEST = 5
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		start, _ := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+		end, _ := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+		if r.URL.Path != "/products/ETH-USD/candles" || r.URL.Query().Get("granularity") != "60" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		entries := []string{}
+		for t := end; !t.Before(start); t = t.Add(-time.Minute) {
+			entries = append(entries, fmt.Sprintf("[%d,295.5,296.25,295.75,296,%d.125]", t.Unix(), t.Minute()))
+		}
+		w.Write([]byte("[" + strings.Join(entries, ",") + "]"))
+	}))
+	defer server.Close()
+	client := CreateNewRestClient()
+	client.Url = server.URL
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	// WHEN
+	candles, err := client.GetCandles("ETH-USD", time.Minute, start, start.Add(9*time.Minute))
+
+	// THEN
+	if err != nil || len(candles) != 10 || requests != 2 {
+		t.Fatalf("Should get 10 candles in 2 requests %v %d %v", err, requests, candles)
+	}
+	for i, candle := range candles {
+		if !candle.Time.Equal(start.Add(time.Duration(i) * time.Minute)) {
+			t.Errorf("Candles should be in order %v", candle.String())
+		}
+	}
+	if candles[3].Low.String() != "295.5" || candles[3].High.String() != "296.25" || candles[3].Open.String() != "295.75" ||
+		candles[3].Close.String() != "296" || candles[3].Volume.String() != "3.125" {
+		t.Errorf("Wrong candle %v", candles[3].String())
+	}
+}
+
+func TestRestClientGetTrades(t *testing.T) {
+	// GIVEN
+	// Pages of two trades a minute apart, newest first, down to trade 1
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	pages := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages += 1
+		after, _ := strconv.Atoi(r.URL.Query().Get("after"))
+		if after == 0 {
+			after = 7
+		}
+		if after > 1 {
+			w.Header().Set("Cb-After", strconv.Itoa(after-2))
+		}
+		entries := []string{}
+		for id := after - 1; id >= after-2 && id > 0; id-- {
+			entries = append(entries, fmt.Sprintf(`{"time":"%s","trade_id":%d,"price":"10.5","size":"0.01","side":"sell"}`,
+				start.Add(time.Duration(id)*time.Minute).Format(time.RFC3339), id))
+		}
+		w.Write([]byte("[" + strings.Join(entries, ",") + "]"))
+	}))
+	defer server.Close()
+	client := CreateNewRestClient()
+	client.Url = server.URL
+
+	// WHEN
+	matches, err := client.GetTrades("ETH-USD", start.Add(3*time.Minute))
+
+	// THEN
+	// The third page has the first trade before since, the last page is never requested
+	if err != nil || len(matches) != 4 || pages != 3 {
+		t.Fatalf("Should get trades 3 to 6 from 3 pages %v %d %v", err, pages, matches)
+	}
+	if matches[0].TradeId != 3 || matches[3].TradeId != 6 || matches[0].Type != "match" || matches[0].ProductId != "ETH-USD" ||
+		matches[0].Side != "sell" || matches[0].Price != "10.5" || !matches[0].Time.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("Wrong match %#v", matches[0])
+	}
+}
+
+func TestRecordedBookClient(t *testing.T) {
+	// GIVEN
+	// A snapshot fetched while recording, then a replay of the recording
+	dir, _ := ioutil.TempDir("", "gdax")
+	defer os.RemoveAll(dir)
+	recorder := common.CreateNewRecorder(dir, "gdax")
+	recording := &RecordingBookClient{Client: &stubBookClient{snapshot: GdaxMessage{Type: "snapshot", Sequence: 9, Bids: [][]string{{"980", "1", "x"}}}}, Recorder: recorder}
+	recorded, recordErr := recording.GetBook("BTC-USD")
+	recorder.Close()
+	files, _ := common.SegmentFiles(dir, "gdax")
+	quit := make(chan struct{})
+	replaying := CreateNewReplayBookClient(quit)
+	replay := common.CreateNewReplay(files, 0)
+	replay.OnSnapshot = replaying.AddSnapshot
+
+	// WHEN
+	_, _, endErr := replay.ReadMessage()
+	replayed, replayErr := replaying.GetBook("BTC-USD")
+	close(quit)
+	_, missingErr := replaying.GetBook("ETH-USD")
+
+	// THEN
+	if recordErr != nil || recorded.ProductId != "BTC-USD" || endErr != io.EOF {
+		t.Fatalf("Snapshot should be recorded as a frame %v %v", recordErr, endErr)
+	}
+	if replayErr != nil || replayed.Sequence != 9 || len(replayed.Bids) != 1 || replayed.Bids[0][2] != "x" || replayed.received.IsZero() {
+		t.Errorf("Recorded snapshot should be replayed %v %#v", replayErr, replayed)
+	}
+	if missingErr == nil {
+		t.Errorf("Snapshot requests should stop once the replay has ended")
+	}
+}
@@ -1,59 +1,193 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/shopspring/decimal"
+	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
 	// "github.com/Jeffail/gabs"
-	// "os"
-	// "thierry/gocoin/bitfinex"
-	// "thierry/gocoin/bitmex"
-	// "thierry/gocoin/common"
+	"thierry/gocoin/bitfinex"
+	"thierry/gocoin/bitmex"
+	"thierry/gocoin/common"
 	"thierry/gocoin/gdax"
+	"thierry/gocoin/storage"
 	"time"
 )
 
-func timer(prices map[string][]float64) {
-	for true {
-		// if prices["gdax"][0] <= 1 ||
-		// 	prices["gdax"][2] <= 1 ||
-		// 	prices["bitfinex"][0] <= 1 ||
-		// 	prices["bitfinex"][2] <= 1 ||
-		// 	prices["bitmex"][0] <= 1 ||
-		// 	prices["bitmex"][2] <= 1 {
-		// 	continue
-		// }
-		fmt.Printf("Gdax - %f (%f) - %f (%f)\n",
-			prices["gdax"][0],
-			prices["gdax"][1],
-			prices["gdax"][2],
-			prices["gdax"][3],
-		)
-		// fmt.Printf("Bitfinex - %f (%f) - %f (%f)\n",
-		// 	prices["bitfinex"][0],
-		// 	prices["bitfinex"][1],
-		// 	prices["bitfinex"][2],
-		// 	prices["bitfinex"][3],
-		// )
-		// fmt.Printf("Bitmex - %f (%f) - %f (%f)\n",
-		// 	prices["bitmex"][0],
-		// 	prices["bitmex"][1],
-		// 	prices["bitmex"][2],
-		// 	prices["bitmex"][3],
-		// )
-		// file, err := os.OpenFile("output.txt", os.O_APPEND|os.O_WRONLY, 0600)
-		// if err != nil {
-		// 	panic(err)
-		// }
-		// defer file.Close()
-		// if _, err = file.WriteString(fmt.Sprintf("%s###%f###%f###%f###%f###%f###%f\n",
-		// 	time.Now().Format(time.RFC3339),
-		// 	prices["gdax"][0], prices["gdax"][2],
-		// 	prices["bitfinex"][0], prices["bitfinex"][2],
-		// 	prices["bitmex"][0], prices["bitmex"][2])); err != nil {
-		// 	panic(err)
-		// }
-		time.Sleep(1 * time.Second)
+var exchangesFlag = flag.String("exchanges", "gdax", "Comma separated list of exchanges to start (gdax, bitfinex, bitmex)")
+var channelsFlag = flag.String("channels", common.CHANNEL_TRADES, "Comma separated list of channels to subscribe to (trades, book)")
+var indicatorsFlag = flag.String("indicators", "", "Indicators per gdax product, e.g. \"BTC-USD=mfi(14),macd(12,26,9);ETH-USD=macd(5,35,5)\"")
+var candleFormatFlag = flag.String("candle-format", "text", "Format of the gdax candle files (text, csv, jsonl, binary), text being the .txt files written so far")
+var dbFlag = flag.String("db", "", "Save every trade and gdax candle to this SQLite database")
+var backfillFlag = flag.Bool("backfill", true, "Warm up the gdax charts with past candles and trades when not replaying")
+var verboseFlag = flag.Bool("verbose", false, "Print every trade and book update received")
+var recordFlag = flag.String("record", "", "Directory to record every raw message received to, one segment file per exchange and hour")
+var replayFlag = flag.String("replay", "", "Directory of recorded messages to replay instead of connecting")
+var replaySpeedFlag = flag.Float64("replay-speed", 1, "Speed of the replay, 1 for the recorded speed, 0 as fast as possible")
+var gdaxBookFlag = flag.String("gdax-book", "", "Gdax channel the books are built from: full has every order and detects gaps, but receives the whole order flow; level2 has price levels only, enough for the top of book. Defaults to level2 with -spread, full otherwise")
+var spreadFlag = flag.Bool("spread", false, "Monitor the spreads of each product between the exchanges, subscribes to the book channel")
+var spreadFeesFlag = flag.String("spread-fees", "gdax=0.003,bitfinex=0.002,bitmex=0.00075", "Taker fee rate of each exchange, e.g. \"gdax=0.003,bitfinex=0.002\"")
+var spreadTransfersFlag = flag.String("spread-transfers", "", "Cost of moving coins out of each exchange, as a rate of the notional, e.g. \"gdax=0.0005\"")
+var spreadMinFlag = flag.Float64("spread-min", 0, "Net rate a spread must clear to be an opportunity, e.g. 0.001 for 0.1%")
+var spreadLogFlag = flag.String("spread-log", "spreads.jsonl", "File the opportunities are logged to, a JSON object per line")
+var productsFlags = map[string]*string{
+	"gdax":     flag.String("gdax-products", "BTC-USD,LTC-USD,ETH-USD", "Products to subscribe to on gdax"),
+	"bitfinex": flag.String("bitfinex-products", "tBTCUSD", "Products to subscribe to on bitfinex"),
+	"bitmex":   flag.String("bitmex-products", "XBTUSD", "Products to subscribe to on bitmex"),
+}
+
+// Exchanges reading a recording instead of connecting
+type replayer interface {
+	Replay(replay *common.Replay)
+}
+
+func createExchange(name string, recorder *common.Recorder, database *storage.Database) (common.Exchange, error) {
+	switch name {
+	case "gdax":
+		exchange := gdax.CreateNewExchange()
+		indicators, err := parseIndicatorsFlag(*indicatorsFlag)
+		if err != nil {
+			return nil, err
+		}
+		exchange.Indicators = indicators
+		if exchange.Store, err = common.ParseCandleStore(*candleFormatFlag); err != nil {
+			return nil, err
+		}
+		exchange.Recorder = recorder
+		if *gdaxBookFlag != "" {
+			exchange.BookChannel = *gdaxBookFlag
+		} else if *spreadFlag {
+			// The monitor only needs the top of book
+			exchange.BookChannel = gdax.BOOK_LEVEL2
+		}
+		if *backfillFlag && *replayFlag == "" {
+			exchange.History = gdax.CreateNewRestClient()
+		}
+		if database != nil {
+			exchange.OnCandle = func(productId string, timeframe time.Duration, candle common.Candle) {
+				if err := database.SaveCandles(productId, timeframe, []common.Candle{candle}); err != nil {
+					fmt.Printf("Could not save %s candle: %v\n", productId, err)
+				}
+			}
+		}
+		return exchange, nil
+	case "bitfinex":
+		exchange := bitfinex.CreateNewExchange()
+		exchange.Recorder = recorder
+		return exchange, nil
+	case "bitmex":
+		exchange := bitmex.CreateNewExchange()
+		exchange.Recorder = recorder
+		return exchange, nil
+	}
+	return nil, fmt.Errorf("unknown exchange %s", name)
+}
+
+// Parses "<product>=<indicators>;<product>=<indicators>"
+func parseIndicatorsFlag(value string) (map[string][]common.Indicator, error) {
+	indicators := map[string][]common.Indicator{}
+	for _, product := range strings.Split(value, ";") {
+		if strings.TrimSpace(product) == "" {
+			continue
+		}
+		parts := strings.SplitN(product, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid indicators %s", product)
+		}
+		list, err := common.ParseIndicators(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		indicators[strings.TrimSpace(parts[0])] = list
 	}
+	return indicators, nil
+}
+
+// Parses "<exchange>=<rate>,<exchange>=<rate>"
+func parseRatesFlag(value string) (map[string]decimal.Decimal, error) {
+	rates := map[string]decimal.Decimal{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate %s", pair)
+		}
+		rate, err := decimal.NewFromString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate %s: %v", pair, err)
+		}
+		rates[strings.TrimSpace(parts[0])] = rate
+	}
+	return rates, nil
+}
+
+func createSpreadMonitor() (*common.SpreadMonitor, *os.File, error) {
+	monitor := common.CreateNewSpreadMonitor()
+	monitor.Verbose = true
+	monitor.MinProfit = decimal.NewFromFloat(*spreadMinFlag)
+	var err error
+	if monitor.Fees, err = parseRatesFlag(*spreadFeesFlag); err != nil {
+		return nil, nil, err
+	}
+	if monitor.Transfers, err = parseRatesFlag(*spreadTransfersFlag); err != nil {
+		return nil, nil, err
+	}
+	if *spreadLogFlag == "" {
+		return monitor, nil, nil
+	}
+	file, err := os.OpenFile(*spreadLogFlag, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	monitor.Log = file
+	return monitor, file, nil
+}
+
+// Connect, or start the replay, and subscribe, then forward every event to the shared
+// channels. The name of the exchange is sent to done once its trades end
+func run(exchange common.Exchange, products, channels []string, trades chan<- common.Trade, books chan<- common.BookUpdate, events chan<- common.Event, done chan<- string) error {
+	if *replayFlag != "" {
+		files, err := common.SegmentFiles(*replayFlag, exchange.Name())
+		if err != nil {
+			return err
+		} else if len(files) == 0 {
+			return fmt.Errorf("no recording in %s", *replayFlag)
+		}
+		replaying, ok := exchange.(replayer)
+		if !ok {
+			return fmt.Errorf("%s cannot replay recordings", exchange.Name())
+		}
+		replaying.Replay(common.CreateNewReplay(files, *replaySpeedFlag))
+	} else if err := exchange.Connect(); err != nil {
+		return err
+	}
+	if err := exchange.Subscribe(products, channels); err != nil {
+		exchange.Close()
+		return err
+	}
+	go func() {
+		for trade := range exchange.Trades() {
+			trades <- trade
+		}
+		done <- exchange.Name()
+	}()
+	go func() {
+		for book := range exchange.BookUpdates() {
+			books <- book
+		}
+	}()
+	go func() {
+		for event := range exchange.Events() {
+			events <- event
+		}
+	}()
+	return nil
 }
 
 func mem() {
@@ -66,43 +200,101 @@ func mem() {
 }
 
 func main() {
-	queue := make(chan int)
-	// bitmexOrderBook := map[string]*common.Order{}
-	// bitfinexOrderBook := map[string]*common.Order{}
-	// gdaxOrderBook := map[string]*common.Order{}
+	flag.Parse()
 
-	// Buy Price, Size Avail, Sell Price, Size Avail, Last Ticker Price, Volume
-	// prices := map[string][]float64{
-	// 	"gdax":     {0, 0, 0, 0, 0, 0},
-	// 	// "bitfinex": {0, 0, 0, 0},
-	// 	// "bitmex":   {0, 0, 0, 0},
-	// }
-	go gdax.Update() //gdaxOrderBook, prices)
-	// go bitfinex.Update(bitfinexOrderBook, prices)
-	// go bitmex.Update(bitmexOrderBook, prices)
-	// go timer(prices)
-	// go mem()
+	trades := make(chan common.Trade, common.EVENT_BUFFER)
+	books := make(chan common.BookUpdate, common.EVENT_BUFFER)
+	events := make(chan common.Event, common.EVENT_BUFFER)
+	var database *storage.Database
+	var writer *storage.TradeWriter
+	if *dbFlag != "" {
+		var err error
+		if database, err = storage.OpenDatabase(*dbFlag); err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer database.Close()
+		// Closed before the database, to save the trades still waiting
+		writer = storage.CreateNewTradeWriter(database)
+		defer writer.Close()
+	}
 
-	// orderBook := map[float64]Order{}
-	// jsonParsed, _ := gabs.ParseJSON([]byte(`[33919,[[8861.5,1,0.011275],[8857.9,1,0.1],[8856.6,2,0.27655864]]]`))
-	// row := jsonParsed.Index(1)
-	// data, _ := row.Index(0).ArrayCount()
-	// if data > 0 {
-	// 	listSnapshot, _ := row.Children()
-	// 	for _, order := range listSnapshot {
-	// 		fmt.Printf("%#v\n", order.Index(0).Data())
-	// 	}
-	// }
-	// row, err := jsonParsed.Search("data").Children()
-	// if err != nil {
-	// 	fmt.Println(err)
-	// }
-	// for _, order := range row {
-	// 	orderParsed, _ := order.ChildrenMap()
-	// 	orderBook[orderParsed["id"].Data().(float64)] = Order{Id: orderParsed["id"].Data().(float64), Side: orderParsed["side"].Data().(string), Size: orderParsed["size"].Data().(float64), Price: orderParsed["price"].Data().(float64)}
-	// }
-	// fmt.Printf("%#v", orderBook)
+	done := make(chan string)
+	channels := strings.Split(*channelsFlag, ",")
+	var monitor *common.SpreadMonitor
+	// Stays nil, and never ticks, without a monitor
+	var tick <-chan time.Time
+	if *spreadFlag {
+		var file *os.File
+		var err error
+		if monitor, file, err = createSpreadMonitor(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if file != nil {
+			defer file.Close()
+		}
+		if !strings.Contains(*channelsFlag, common.CHANNEL_BOOK) {
+			channels = append(channels, common.CHANNEL_BOOK)
+		}
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	names := strings.Split(*exchangesFlag, ",")
+	for _, name := range names {
+		var recorder *common.Recorder
+		if *recordFlag != "" {
+			recorder = common.CreateNewRecorder(*recordFlag, name)
+			// Closed after the exchange, to flush the last segment
+			defer recorder.Close()
+		}
+		exchange, err := createExchange(name, recorder, database)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		products := strings.Split(*productsFlags[name], ",")
+		if err := run(exchange, products, channels, trades, books, events, done); err != nil {
+			fmt.Printf("Could not start %s: %v\n", name, err)
+			return
+		}
+		defer exchange.Close()
+	}
+	interrupt := make(chan os.Signal, 1)
+	// Buffered candles and recordings are flushed by the deferred closes
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	finished := 0
+	// go mem()
 
-	waiter := <-queue
-	println(waiter)
+	for {
+		select {
+		case trade := <-trades:
+			if *verboseFlag {
+				fmt.Println(trade.String())
+			}
+			if writer != nil {
+				writer.Add(trade)
+			}
+		case book := <-books:
+			if *verboseFlag {
+				fmt.Printf("%s %s - %s (%s) - %s (%s)\n", book.Exchange, book.ProductId, book.Bid, book.BidSize, book.Ask, book.AskSize)
+			}
+			if monitor != nil {
+				monitor.Update(book)
+			}
+		case <-tick:
+			monitor.Print(os.Stdout)
+		case event := <-events:
+			fmt.Printf("%s: %s %s (attempt %d, %v)\n", event.Time.Format(time.RFC3339), event.Exchange, event.Type, event.Attempt, event.Err)
+		case name := <-done:
+			// Only replays end on their own
+			fmt.Printf("%s: end of feed\n", name)
+			if finished += 1; finished == len(names) {
+				return
+			}
+		case <-interrupt:
+			return
+		}
+	}
 }
@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/shopspring/decimal"
+	"thierry/gocoin/common"
+	"time"
+)
+
+// Pure Go SQLite driver, nothing to install
+const DRIVER = "sqlite"
+
+// Version of the tables, a database with a newer version is not opened
+const SCHEMA_VERSION = 1
+
+// Decimals are kept as text so they come back exactly as they went in. Trade times are
+// in unix nanoseconds, candle times in unix seconds and timeframes as their name, e.g. 5m
+var SCHEMA = []string{
+	`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS trades (
+		exchange TEXT NOT NULL,
+		product_id TEXT NOT NULL,
+		trade_id TEXT NOT NULL,
+		side TEXT NOT NULL,
+		price TEXT NOT NULL,
+		size TEXT NOT NULL,
+		time INTEGER NOT NULL,
+		PRIMARY KEY (exchange, product_id, trade_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS trades_time ON trades (product_id, time)`,
+	`CREATE TABLE IF NOT EXISTS candles (
+		product_id TEXT NOT NULL,
+		timeframe TEXT NOT NULL,
+		time INTEGER NOT NULL,
+		open TEXT NOT NULL,
+		high TEXT NOT NULL,
+		low TEXT NOT NULL,
+		close TEXT NOT NULL,
+		average TEXT NOT NULL,
+		volume TEXT NOT NULL,
+		missing INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (product_id, timeframe, time)
+	)`,
+	`CREATE TABLE IF NOT EXISTS indicators (
+		product_id TEXT NOT NULL,
+		timeframe TEXT NOT NULL,
+		time INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value REAL,
+		PRIMARY KEY (product_id, timeframe, time, name)
+	)`,
+}
+
+// Database keeps trades, candles of each timeframe and their indicators in a SQLite
+// file. Saving a trade or a candle again replaces it, so late trades and candles
+// computed again can be saved like new ones
+type Database struct {
+	db *sql.DB
+}
+
+// Public
+
+// OpenDatabase opens the file, creating it and its tables when missing
+func OpenDatabase(path string) (*Database, error) {
+	db, err := sql.Open(DRIVER, path)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection, SQLite only has one writer anyway
+	db.SetMaxOpenConns(1)
+	database := &Database{db: db}
+	if err := database.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return database, nil
+}
+
+func (database *Database) Close() error {
+	return database.db.Close()
+}
+
+// SaveTrades inserts the trades, or replaces the ones with the same exchange, product
+// and trade id
+func (database *Database) SaveTrades(trades []common.Trade) error {
+	return database.transaction(func(tx *sql.Tx) error {
+		statement, err := tx.Prepare(`INSERT INTO trades (exchange, product_id, trade_id, side, price, size, time)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (exchange, product_id, trade_id) DO UPDATE SET
+			side = excluded.side, price = excluded.price, size = excluded.size, time = excluded.time`)
+		if err != nil {
+			return err
+		}
+		defer statement.Close()
+		for _, trade := range trades {
+			if _, err := statement.Exec(trade.Exchange, trade.ProductId, trade.TradeId, trade.Side,
+				trade.Price.String(), trade.Size.String(), trade.Time.UnixNano()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SaveCandles inserts the candles of a timeframe with their indicators, or replaces the
+// ones already saved at the same time. Indicators not on the new candle are kept
+func (database *Database) SaveCandles(productId string, timeframe time.Duration, candles []common.Candle) error {
+	name := common.TimeframeName(timeframe)
+	return database.transaction(func(tx *sql.Tx) error {
+		candleStatement, err := tx.Prepare(`INSERT INTO candles
+			(product_id, timeframe, time, open, high, low, close, average, volume, missing)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (product_id, timeframe, time) DO UPDATE SET
+			open = excluded.open, high = excluded.high, low = excluded.low, close = excluded.close,
+			average = excluded.average, volume = excluded.volume, missing = excluded.missing`)
+		if err != nil {
+			return err
+		}
+		defer candleStatement.Close()
+		indicatorStatement, err := tx.Prepare(`INSERT INTO indicators (product_id, timeframe, time, name, value)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (product_id, timeframe, time, name) DO UPDATE SET value = excluded.value`)
+		if err != nil {
+			return err
+		}
+		defer indicatorStatement.Close()
+		for _, candle := range candles {
+			if _, err := candleStatement.Exec(productId, name, candle.Time.Unix(), candle.Open.String(),
+				candle.High.String(), candle.Low.String(), candle.Close.String(), candle.Average.String(),
+				candle.Volume.String(), candle.Missing); err != nil {
+				return err
+			}
+			for indicator, value := range candle.Indicators {
+				if _, err := indicatorStatement.Exec(productId, name, candle.Time.Unix(), indicator, value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Trades returns the trades of a product on an exchange from from, up to but without
+// to, in time order then trade id. No bound when a time is zero. Ids are numbers on gdax
+// and bitfinex, compared as such, and text on bitmex
+func (database *Database) Trades(exchange, productId string, from, to time.Time) ([]common.Trade, error) {
+	low, high := bounds(from, to, time.Time.UnixNano)
+	rows, err := database.db.Query(`SELECT trade_id, side, price, size, time FROM trades
+		WHERE exchange = ? AND product_id = ? AND time >= ? AND time < ?
+		ORDER BY time, CAST(trade_id AS INTEGER), trade_id`, exchange, productId, low, high)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	trades := []common.Trade{}
+	for rows.Next() {
+		trade := common.Trade{Exchange: exchange, ProductId: productId}
+		var price, size string
+		var nanoseconds int64
+		if err := rows.Scan(&trade.TradeId, &trade.Side, &price, &size, &nanoseconds); err != nil {
+			return nil, err
+		}
+		if trade.Price, err = decimal.NewFromString(price); err != nil {
+			return nil, err
+		}
+		if trade.Size, err = decimal.NewFromString(size); err != nil {
+			return nil, err
+		}
+		trade.Time = time.Unix(0, nanoseconds)
+		trades = append(trades, trade)
+	}
+	return trades, rows.Err()
+}
+
+// Candles returns the candles of a product and timeframe from from, up to but without
+// to, in time order and with their indicators. No bound when a time is zero
+func (database *Database) Candles(productId string, timeframe time.Duration, from, to time.Time) ([]common.Candle, error) {
+	name := common.TimeframeName(timeframe)
+	low, high := bounds(from, to, time.Time.Unix)
+	rows, err := database.db.Query(`SELECT time, open, high, low, close, average, volume, missing FROM candles
+		WHERE product_id = ? AND timeframe = ? AND time >= ? AND time < ?
+		ORDER BY time`, productId, name, low, high)
+	if err != nil {
+		return nil, err
+	}
+	candles := []common.Candle{}
+	positions := map[int64]int{}
+	for rows.Next() {
+		var seconds int64
+		values := make([]string, 6)
+		candle := common.Candle{Indicators: map[string]float64{}}
+		if err := rows.Scan(&seconds, &values[0], &values[1], &values[2], &values[3], &values[4], &values[5], &candle.Missing); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		fields := []*decimal.Decimal{&candle.Open, &candle.High, &candle.Low, &candle.Close, &candle.Average, &candle.Volume}
+		for i, value := range values {
+			if *fields[i], err = decimal.NewFromString(value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+		}
+		candle.Time = time.Unix(seconds, 0)
+		positions[seconds] = len(candles)
+		candles = append(candles, candle)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = database.db.Query(`SELECT time, name, value FROM indicators
+		WHERE product_id = ? AND timeframe = ? AND time >= ? AND time < ?`, productId, name, low, high)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var seconds int64
+		var indicator string
+		var value sql.NullFloat64
+		if err := rows.Scan(&seconds, &indicator, &value); err != nil {
+			return nil, err
+		}
+		// Indicators of a candle which was never saved are skipped
+		if i, ok := positions[seconds]; ok && value.Valid {
+			candles[i].Indicators[indicator] = value.Float64
+		}
+	}
+	return candles, rows.Err()
+}
+
+// Products returns the products with candles of the timeframe
+func (database *Database) Products(timeframe time.Duration) ([]string, error) {
+	rows, err := database.db.Query(`SELECT DISTINCT product_id FROM candles WHERE timeframe = ? ORDER BY product_id`,
+		common.TimeframeName(timeframe))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	products := []string{}
+	for rows.Next() {
+		var product string
+		if err := rows.Scan(&product); err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+	return products, rows.Err()
+}
+
+// Private
+
+func (database *Database) migrate() error {
+	return database.transaction(func(tx *sql.Tx) error {
+		for _, statement := range SCHEMA {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		var version int
+		err := tx.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+		if err == sql.ErrNoRows {
+			_, err = tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, SCHEMA_VERSION)
+			return err
+		} else if err != nil {
+			return err
+		}
+		if version > SCHEMA_VERSION {
+			return fmt.Errorf("schema version %d is newer than %d", version, SCHEMA_VERSION)
+		}
+		return nil
+	})
+}
+
+// Runs f in a transaction, committed when it doesn't fail
+func (database *Database) transaction(f func(tx *sql.Tx) error) error {
+	tx, err := database.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Range of a query, from the lowest to the highest value when a time is zero
+func bounds(from, to time.Time, value func(time.Time) int64) (int64, int64) {
+	low, high := int64(-1<<63), int64(1<<63-1)
+	if !from.IsZero() {
+		low = value(from)
+	}
+	if !to.IsZero() {
+		high = value(to)
+	}
+	return low, high
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"github.com/shopspring/decimal"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"thierry/gocoin/common"
+	"time"
+)
+
+func generateDatabase(t *testing.T) (*Database, string) {
+	dir, _ := ioutil.TempDir("", "storage")
+	database, err := OpenDatabase(filepath.Join(dir, "gocoin.db"))
+	if err != nil {
+		t.Fatalf("Could not open the database %v", err)
+	}
+	return database, dir
+}
+
+func generateCandle(start time.Time, minute int, price string, indicators map[string]float64) common.Candle {
+	value := decimal.RequireFromString(price)
+	return common.Candle{
+		Time: start.Add(time.Duration(minute) * time.Minute), Open: value, High: value, Low: value, Close: value,
+		Average: value, Volume: decimal.New(1, 0), Indicators: indicators,
+	}
+}
+
+func TestSaveTrades(t *testing.T) {
+	// GIVEN
+	database, dir := generateDatabase(t)
+	defer os.RemoveAll(dir)
+	defer database.Close()
+	start := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+	trade := common.Trade{Exchange: "gdax", ProductId: "ETH-USD", TradeId: "2", Side: "buy",
+		Price: decimal.RequireFromString("750.01"), Size: decimal.RequireFromString("0.1"), Time: start.Add(time.Second)}
+	database.SaveTrades([]common.Trade{trade})
+
+	// WHEN
+	// A late trade before it, the same trade again corrected, and one on another exchange
+	late := trade
+	late.TradeId, late.Time = "1", start
+	corrected := trade
+	corrected.Size = decimal.RequireFromString("0.2")
+	other := trade
+	other.Exchange = "bitfinex"
+	err := database.SaveTrades([]common.Trade{late, corrected, other})
+	trades, _ := database.Trades("gdax", "ETH-USD", start, start.Add(time.Minute))
+	after, _ := database.Trades("gdax", "ETH-USD", start.Add(time.Second), time.Time{})
+
+	// THEN
+	if err != nil {
+		t.Fatalf("Could not save trades %v", err)
+	}
+	if len(trades) != 2 || trades[0].TradeId != "1" || trades[1].TradeId != "2" {
+		t.Fatalf("Trades should be in time order without duplicates %v", trades)
+	}
+	if !trades[1].Size.Equal(decimal.RequireFromString("0.2")) || trades[1].Price.String() != "750.01" || !trades[1].Time.Equal(trade.Time) {
+		t.Errorf("Trade should have been replaced %v", trades[1].String())
+	}
+	if len(after) != 1 || after[0].TradeId != "2" {
+		t.Errorf("Wrong trades after a time %v", after)
+	}
+}
+
+func TestTradesIdOrder(t *testing.T) {
+	// GIVEN
+	// Trades of the same time, whose ids don't sort as text
+	database, dir := generateDatabase(t)
+	defer os.RemoveAll(dir)
+	defer database.Close()
+	start := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+	saved := []common.Trade{}
+	for _, id := range []string{"10", "9", "100"} {
+		saved = append(saved, common.Trade{Exchange: "gdax", ProductId: "ETH-USD", TradeId: id, Side: "buy",
+			Price: decimal.RequireFromString("750"), Size: decimal.RequireFromString("1"), Time: start})
+	}
+	database.SaveTrades(saved)
+
+	// WHEN
+	trades, err := database.Trades("gdax", "ETH-USD", time.Time{}, time.Time{})
+
+	// THEN
+	if err != nil || len(trades) != 3 || trades[0].TradeId != "9" || trades[1].TradeId != "10" || trades[2].TradeId != "100" {
+		t.Errorf("Trades should be in trade id order %v %v", trades, err)
+	}
+}
+
+func TestSaveCandles(t *testing.T) {
+	// GIVEN
+	database, dir := generateDatabase(t)
+	defer os.RemoveAll(dir)
+	defer database.Close()
+	start := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+	database.SaveCandles("ETH-USD", 5*time.Minute, []common.Candle{
+		generateCandle(start, 0, "750", map[string]float64{"mfi": 40}),
+		generateCandle(start, 5, "751", map[string]float64{"mfi": 45}),
+		generateCandle(start, 10, "752", nil),
+	})
+	database.SaveCandles("ETH-USD", time.Minute, []common.Candle{generateCandle(start, 0, "1", nil)})
+
+	// WHEN
+	// The second candle computed again with a late trade, and a new indicator
+	err := database.SaveCandles("ETH-USD", 5*time.Minute, []common.Candle{
+		generateCandle(start, 5, "749.5", map[string]float64{"macd": -0.5}),
+	})
+	candles, _ := database.Candles("ETH-USD", 5*time.Minute, start.Add(5*time.Minute), start.Add(15*time.Minute))
+	all, _ := database.Candles("ETH-USD", 5*time.Minute, time.Time{}, time.Time{})
+	products, _ := database.Products(5 * time.Minute)
+
+	// THEN
+	if err != nil {
+		t.Fatalf("Could not save candles %v", err)
+	}
+	if len(candles) != 2 || !candles[0].Time.Equal(start.Add(5*time.Minute)) || candles[0].Close.String() != "749.5" {
+		t.Fatalf("Wrong candles in range %v", candles)
+	}
+	if candles[0].Indicators["mfi"] != 45 || candles[0].Indicators["macd"] != -0.5 || len(candles[1].Indicators) != 0 {
+		t.Errorf("Wrong indicators %v %v", candles[0].Indicators, candles[1].Indicators)
+	}
+	if len(all) != 3 || all[0].Indicators["mfi"] != 40 {
+		t.Errorf("Timeframes should be kept apart %v", all)
+	}
+	if len(products) != 1 || products[0] != "ETH-USD" {
+		t.Errorf("Wrong products %v", products)
+	}
+}
+
+func TestOpenDatabaseVersion(t *testing.T) {
+	// GIVEN
+	// Database written by a newer version
+	database, dir := generateDatabase(t)
+	defer os.RemoveAll(dir)
+	database.db.Exec(`UPDATE schema_version SET version = ?`, SCHEMA_VERSION+1)
+	database.Close()
+
+	// WHEN
+	_, err := OpenDatabase(filepath.Join(dir, "gocoin.db"))
+
+	// THEN
+	if err == nil {
+		t.Errorf("Newer databases should not be opened")
+	}
+}
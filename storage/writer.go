@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"fmt"
+	"thierry/gocoin/common"
+	"time"
+)
+
+// Trades saved together in one transaction, at most
+const TRADE_BATCH_SIZE = 500
+
+// Longest a trade waits before its batch is saved
+const TRADE_BATCH_INTERVAL = time.Second
+
+// TradeWriter saves trades to the database in batches on its own goroutine, so a slow
+// disk doesn't hold the feeds. Trades still waiting are saved on Close
+type TradeWriter struct {
+	database *Database
+	trades   chan common.Trade
+	done     chan bool
+}
+
+// Public
+
+func CreateNewTradeWriter(database *Database) *TradeWriter {
+	writer := &TradeWriter{
+		database: database,
+		trades:   make(chan common.Trade, TRADE_BATCH_SIZE),
+		done:     make(chan bool),
+	}
+	go writer.write()
+	return writer
+}
+
+// Add queues the trade, it only waits when a full batch is already queued
+func (writer *TradeWriter) Add(trade common.Trade) {
+	writer.trades <- trade
+}
+
+// Close saves the trades still waiting, no trade can be added after
+func (writer *TradeWriter) Close() {
+	close(writer.trades)
+	<-writer.done
+}
+
+// Private
+
+// Saves the batch once full, and what was added at every tick
+func (writer *TradeWriter) write() {
+	defer close(writer.done)
+	batch := []common.Trade{}
+	ticker := time.NewTicker(TRADE_BATCH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case trade, ok := <-writer.trades:
+			if !ok {
+				writer.save(batch)
+				return
+			}
+			if batch = append(batch, trade); len(batch) >= TRADE_BATCH_SIZE {
+				batch = writer.save(batch)
+			}
+		case <-ticker.C:
+			batch = writer.save(batch)
+		}
+	}
+}
+
+// Saves the trades, returning an empty batch
+func (writer *TradeWriter) save(trades []common.Trade) []common.Trade {
+	if len(trades) == 0 {
+		return trades
+	}
+	if err := writer.database.SaveTrades(trades); err != nil {
+		fmt.Printf("Could not save %d trades: %v\n", len(trades), err)
+	}
+	return []common.Trade{}
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"github.com/shopspring/decimal"
+	"os"
+	"strconv"
+	"testing"
+	"thierry/gocoin/common"
+	"time"
+)
+
+func TestTradeWriter(t *testing.T) {
+	// GIVEN
+	database, dir := generateDatabase(t)
+	defer os.RemoveAll(dir)
+	defer database.Close()
+	start := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+	writer := CreateNewTradeWriter(database)
+
+	// WHEN
+	// More trades than a batch, the last ones only saved on close
+	for i := 0; i < TRADE_BATCH_SIZE+10; i++ {
+		writer.Add(common.Trade{Exchange: "gdax", ProductId: "ETH-USD", TradeId: strconv.Itoa(i + 1), Side: "buy",
+			Price: decimal.RequireFromString("750.01"), Size: decimal.RequireFromString("0.1"), Time: start.Add(time.Duration(i) * time.Second)})
+	}
+	writer.Close()
+	trades, err := database.Trades("gdax", "ETH-USD", start, time.Time{})
+
+	// THEN
+	if err != nil || len(trades) != TRADE_BATCH_SIZE+10 {
+		t.Fatalf("Every trade should have been saved, got %d %v", len(trades), err)
+	}
+}
+
+func TestTradeWriterInterval(t *testing.T) {
+	// GIVEN
+	database, dir := generateDatabase(t)
+	defer os.RemoveAll(dir)
+	defer database.Close()
+	writer := CreateNewTradeWriter(database)
+	defer writer.Close()
+
+	// WHEN
+	// A single trade, less than a batch
+	writer.Add(common.Trade{Exchange: "gdax", ProductId: "ETH-USD", TradeId: "1", Side: "buy",
+		Price: decimal.RequireFromString("750.01"), Size: decimal.RequireFromString("0.1"), Time: time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)})
+	time.Sleep(TRADE_BATCH_INTERVAL + 500*time.Millisecond)
+	trades, _ := database.Trades("gdax", "ETH-USD", time.Time{}, time.Time{})
+
+	// THEN
+	if len(trades) != 1 {
+		t.Fatalf("Trade should have been saved after an interval, got %v", trades)
+	}
+}
@@ -1,246 +1,306 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
 	"github.com/shopspring/decimal"
-	"io"
-	"os"
-	"strconv"
+	"io/ioutil"
 	"strings"
+	"thierry/gocoin/backtest"
 	"thierry/gocoin/common"
+	"thierry/gocoin/storage"
 	"time"
 )
 
-type Fifo struct {
-	Chart    []float64
-	CurrElem int
-}
+func main() {
+	candleFile := flag.String("candles", "data/december_gdax.txt", "Candle file to backtest")
+	dbFile := flag.String("db", "", "Read the candles from this database instead of files")
+	product := flag.String("product", "BTC-USD", "Product to backtest from the database")
+	timeframe := flag.Duration("timeframe", time.Minute, "Timeframe of the candles read from the database")
+	from := flag.String("from", "", "Read the database candles from this day or RFC3339 time")
+	to := flag.String("to", "", "Read the database candles up to this day or RFC3339 time, excluded")
+	reportFile := flag.String("report", "", "Write the report as JSON to this file")
+	tradesFile := flag.String("trades", "", "Write every fill to this .csv or .jsonl file")
+	monteCarloRuns := flag.Int("monte-carlo", 0, "Resample the trades of the run this many times")
+	bootstrap := flag.Bool("bootstrap", false, "Draw the Monte Carlo trades with replacement instead of shuffling them")
+	priceNoise := flag.Float64("price-noise", 0, "Standard deviation of the Monte Carlo entry price moves, e.g. 0.001 for 0.1%")
+	ruinLevel := flag.Float64("ruin", 0.5, "Monte Carlo runs going under this ratio of the initial equity are ruined")
+	optimize := flag.Bool("optimize", false, "Optimize the strategy thresholds instead of running them once")
+	samples := flag.Int("samples", 0, "Number of random parameters to optimize with, the whole grid when 0")
+	metric := flag.String("metric", "total_return", "Metric ranking the optimizer results")
+	resultsFile := flag.String("results", "optimizer.csv", "Write the optimizer results to this CSV file")
+	walkForward := flag.Bool("walk-forward", false, "Optimize on rolling windows, and run the best parameters on the following candles")
+	inSample := flag.Int("in-sample", 7*24*60, "Number of candles the walk forward optimizes on")
+	outOfSample := flag.Int("out-of-sample", 24*60, "Number of candles the walk forward runs the best parameters on")
+	fees := flag.String("fees", "", "Use the fees of this exchange (gdax, bitfinex, bitmex), no fees when empty")
+	slippage := flag.Float64("slippage", 0, "Slippage in basis points")
+	depthFile := flag.String("depth", "", "Walk the order book snapshots of this file to fill orders, falling back to -slippage when not deep enough")
+	depthAge := flag.Duration("depth-age", time.Minute, "Order book snapshots older than this are not used")
+	stopLoss := flag.Float64("stop-loss", 0, "Stop loss under the entry price, e.g. 0.02 for 2%")
+	stopLossAtr := flag.Float64("stop-loss-atr", 0, "Stop loss at this many ATR under the entry price")
+	takeProfit := flag.Float64("take-profit", 0, "Take profit over the entry price, e.g. 0.05 for 5%")
+	trailingStop := flag.Float64("trailing-stop", 0, "Trailing stop under the highest price since the entry")
+	short := flag.Bool("short", false, "Open short positions on sell signals")
+	leverage := flag.Float64("leverage", 1, "Position value as a multiple of the cash")
+	maintenanceMargin := flag.Float64("maintenance-margin", 0.005, "Liquidate positions when the equity goes under this ratio of their value")
+	fundingFile := flag.String("funding", "", "Funding rate file, one \"time rate\" per line, no funding when empty")
+	sizing := flag.String("sizing", "", "Position sizing (fraction, notional, atr, stddev, kelly), all the equity when empty")
+	size := flag.Float64("size", 0, "Fraction, notional or risked part of the equity of the sizing, half Kelly when 0")
+	maxUnits := flag.Int("max-units", 1, "Add to positions on new signals up to this many units")
+	products := flag.String("products", "", "Backtest these products together, e.g. BTC-USD,ETH-USD,LTC-USD, read from <product>.csv, .jsonl, .candles or .txt files")
+	dataDir := flag.String("data", ".", "Directory of the product files")
+	rebalanceEvery := flag.Duration("rebalance", 0, "Rebalance the products to equal weights this often, e.g. 24h")
+	rebalanceDrift := flag.Float64("rebalance-drift", 0, "Also rebalance a product when its weight drifts this far from its target, e.g. 0.2")
+	flag.Parse()
 
-func (fifo *Fifo) AddNew(value float64) {
-	fifo.CurrElem += 1
-	if fifo.CurrElem == len(fifo.Chart) {
-		fifo.CurrElem = 0
-	}
-	fifo.Chart[fifo.CurrElem] = value
-}
+	stops := backtest.CreateNewStops()
+	stops.StopLoss = decimal.NewFromFloat(*stopLoss)
+	stops.StopLossAtr = *stopLossAtr
+	stops.TakeProfit = decimal.NewFromFloat(*takeProfit)
+	stops.TrailingStop = decimal.NewFromFloat(*trailingStop)
 
-func (fifo *Fifo) GetAverage() float64 {
-	total := 0.0
-	for i := 0; i < len(fifo.Chart); i++ {
-		total += fifo.Chart[i]
+	var funding *backtest.FundingRates
+	if *fundingFile != "" {
+		var err error
+		if funding, err = backtest.ReadFundingFile(*fundingFile); err != nil {
+			fmt.Printf(" > Failed!: %v\n", err)
+			return
+		}
 	}
-	return total / float64(len(fifo.Chart))
-}
-
-func (fifo *Fifo) IsIncreasingFromPositive() bool {
-	// Starting from 0 ensure we're starting from positive value
-	lastValue := 0.0
-	// Start from next element (which should be the very beginning)
-	currPos := fifo.CurrElem + 1
-	if currPos == len(fifo.Chart) {
-		currPos = 0
-	}
-	for i := 0; i < len(fifo.Chart); i++ {
-		if lastValue < fifo.Chart[currPos] {
-			return false
+	var depth *backtest.RecordedDepth
+	if *depthFile != "" {
+		var err error
+		if depth, err = backtest.ReadDepthFile(*depthFile); err != nil {
+			fmt.Printf(" > Failed!: %v\n", err)
+			return
 		}
-		currPos += 1
-		if currPos == len(fifo.Chart) {
-			currPos = 0
+		depth.MaxAge = *depthAge
+	}
+	if *fees != "" {
+		if _, err := backtest.ExchangeFees(*fees); err != nil {
+			fmt.Printf(" > Failed!: %v\n", err)
+			return
 		}
 	}
-	return true
-}
-
-func stringToTime(s string) time.Time {
-	i, err := strconv.ParseInt(s, 10, 64)
-	if err != nil {
-		panic(err)
+	if _, err := createSizer(*sizing, *size, *maxUnits); err != nil {
+		fmt.Printf(" > Failed!: %v\n", err)
+		return
+	}
+	// Each run gets its own portfolio, tiered fees keep track of the volume
+	createPortfolio := func() *backtest.Portfolio {
+		portfolio := backtest.CreateNewPortfolio(decimal.NewFromFloat(1000.0))
+		portfolio.AllowShort = *short
+		portfolio.Leverage = decimal.NewFromFloat(*leverage)
+		portfolio.MaintenanceMargin = decimal.NewFromFloat(*maintenanceMargin)
+		if *fees != "" {
+			portfolio.Fees, _ = backtest.ExchangeFees(*fees)
+		}
+		if *slippage > 0 {
+			portfolio.Slippage = &backtest.FixedSlippage{Bps: decimal.NewFromFloat(*slippage)}
+		}
+		if depth != nil {
+			portfolio.Slippage = &backtest.BookSlippage{Depth: depth, Fallback: portfolio.Slippage}
+		}
+		portfolio.Sizing, _ = createSizer(*sizing, *size, *maxUnits)
+		return portfolio
 	}
-	return time.Unix(i, 0)
-}
-
-// Send in starting money, returns number of shares, and fee
-func buy(strat string, startingMoney, price, fee decimal.Decimal, t time.Time) (decimal.Decimal, decimal.Decimal) {
-	res := startingMoney.Div(price)
-	feeCalc := startingMoney.Mul(fee)
-	fmt.Printf("%s: Buying at %s price for a total of %s. Fee %s. (%s)\n", t.Format("2006-01-02 15:04"), price, startingMoney, feeCalc, strat)
-	return res, feeCalc
-}
-
-// Send in number of shares, returns money gained
-func sell(strat string, numShare, price, fee decimal.Decimal, t time.Time, currentlyHoldingCandle int) (decimal.Decimal, decimal.Decimal) {
-	res := numShare.Mul(price)
-	feeCalc := fee.Mul(res)
-	fmt.Printf("%s: Selling %s price for a total of %s, minus fee of %s (%s - %d)\n", t.Format("2006-01-02 15:04"), price, res, feeCalc, strat, currentlyHoldingCandle)
-	return res, feeCalc
-}
 
-func output(candle *common.Candle) {
-	if candle.Time.Unix() < 0 {
+	// Candles of a product, from the database when one is given
+	var database *storage.Database
+	if *dbFile != "" {
+		var err error
+		if database, err = storage.OpenDatabase(*dbFile); err != nil {
+			fmt.Printf(" > Failed!: %v\n", err)
+			return
+		}
+		defer database.Close()
+	}
+	fromTime, err := parseTime(*from)
+	if err != nil {
+		fmt.Printf(" > Failed!: %v\n", err)
 		return
 	}
-	file, err := os.OpenFile("res.txt", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	toTime, err := parseTime(*to)
 	if err != nil {
-		panic(err)
-	}
-	defer file.Close()
-	if _, err = file.WriteString(fmt.Sprintf("%s %s %s %s %s %s %s %f %f %f\n",
-		candle.Time.Format(time.RFC3339),
-		candle.Open,
-		candle.High,
-		candle.Low,
-		candle.Close,
-		candle.Average,
-		candle.Volume,
-		candle.Indicators["mfi"],
-		candle.Indicators["macd"],
-		candle.Indicators["macdh"])); err != nil {
-		fmt.Printf("ERROR WHILE WRITING")
+		fmt.Printf(" > Failed!: %v\n", err)
+		return
+	}
+	// Candle files are recorded every minute
+	candleTimeframe := time.Minute
+	if database != nil {
+		candleTimeframe = *timeframe
+	}
+	readCandles := func(products []string) (map[string][]common.Candle, error) {
+		if database != nil {
+			return backtest.ReadProductSource(database, products, *timeframe, fromTime, toTime)
+		}
+		return backtest.ReadProductFiles(*dataDir, products)
 	}
-}
-
-func main() {
-
-	startingMoney := decimal.NewFromFloat(1000.0)
-	feeBuy := decimal.NewFromFloat(0.0)
-	feeSell := decimal.NewFromFloat(0.0)
-
-	candleChart := common.CreateNewCandleChart()
-
-	// Read through a log file, grab data and add candles one at a time
-	// file, err := os.Open("LTC-USD.txt")
-	file, err := os.Open("data/december_gdax.txt")
-	defer file.Close()
 
-	if err != nil {
-		fmt.Printf("Error opening file %v\n", err)
+	if *products != "" {
+		rebalance := &backtest.Rebalance{Every: *rebalanceEvery, Threshold: decimal.NewFromFloat(*rebalanceDrift)}
+		runMulti(readCandles, strings.Split(*products, ","), candleTimeframe, rebalance, stops, createPortfolio, funding, *tradesFile)
+		return
+	}
+	var candles []common.Candle
+	if database != nil {
+		productCandles, err := readCandles([]string{*product})
+		if err != nil {
+			fmt.Printf(" > Failed!: %v\n", err)
+			return
+		}
+		candles = productCandles[*product]
+	} else if candles, err = backtest.ReadCandleFile(*candleFile); err != nil {
+		fmt.Printf(" > Failed!: %v\n", err)
+		return
+	}
+	if *optimize {
+		runOptimizer(candles, candleTimeframe, *samples, *metric, *resultsFile, stops, createPortfolio, funding)
+		return
+	}
+	if *walkForward {
+		runWalkForward(candles, candleTimeframe, *samples, *metric, *inSample, *outOfSample, stops, createPortfolio, funding)
 		return
 	}
 
-	reader := bufio.NewReader(file)
+	portfolio := createPortfolio()
+	portfolio.Verbose = true
+	engine := backtest.CreateNewEngine(backtest.CreateNewMfiMacd(), portfolio)
+	engine.Chart.Timeframe = candleTimeframe
+	engine.Stops = stops
+	engine.Funding = funding
 
-	var line string
-	counter := 0
-	lastSellCounter := 0
-	lastMacdh := 0.0
-	volumeData := &Fifo{CurrElem: 0, Chart: make([]float64, 5)}
-	macdhData := &Fifo{CurrElem: 0, Chart: make([]float64, 3)}
-	var numShare, lastPrice, feeCalc, gain decimal.Decimal
-	var lastTime time.Time
-	currentlyHoldingCandle := 0
-	for {
-		line, err = reader.ReadString('\n')
+	// Add candles one at a time
+	engine.Run(candles)
+
+	// Strategy run complete, display gain loss
+	report := engine.Report()
+	fmt.Printf("\n\n==================\n\n%s\n\n", report)
+	if *reportFile != "" {
+		data, err := report.JSON()
+		if err == nil {
+			err = ioutil.WriteFile(*reportFile, data, 0644)
+		}
 		if err != nil {
-			break
+			fmt.Printf(" > Could not write report: %v\n", err)
 		}
-		if line == "" {
-			continue
+	}
+	if *tradesFile != "" {
+		if err := backtest.WriteTradeLogFile(*tradesFile, engine.TradeLog()); err != nil {
+			fmt.Printf(" > Could not write trades: %v\n", err)
 		}
-		data := strings.Split(strings.Trim(line, "\n"), " ")
-		t := stringToTime(data[0])
-		open, _ := decimal.NewFromString(data[1])
-		high, _ := decimal.NewFromString(data[2])
-		low, _ := decimal.NewFromString(data[3])
-		clos, _ := decimal.NewFromString(data[4])
-		// average, _ := decimal.NewFromString(data[5])
-		volume, _ := decimal.NewFromString(data[6])
-		// mfi, _ := decimal.NewFromString(data[7])
-		// macd, _ := decimal.NewFromString(data[8])
-		// macdh, _ := decimal.NewFromString(data[9])
-
-		if t.Before(lastTime) {
-			panic(fmt.Sprintf("We got wrong time %s (%d) before %s (%d)\n", t, t.Unix(), lastTime, lastTime.Unix()))
+	}
+	if *monteCarloRuns > 0 {
+		monteCarlo := backtest.CreateNewMonteCarlo()
+		monteCarlo.Runs = *monteCarloRuns
+		if *bootstrap {
+			monteCarlo.Method = backtest.RESAMPLE_BOOTSTRAP
 		}
-		lastTime = t
+		monteCarlo.PriceNoise = *priceNoise
+		monteCarlo.RuinLevel = *ruinLevel
+		fmt.Printf("%s\n\n", monteCarlo.Run(portfolio.Initial, portfolio.Fills))
+	}
+}
 
-		candleChart.AddCandle(common.Candle{
-			Time:   t,
-			Open:   open,
-			High:   high,
-			Low:    low,
-			Close:  clos,
-			Volume: volume,
-		})
-		candleChart.CompleteCurrentCandle()
-		candle := candleChart.CurrentCandle()
-		volFloat, _ := volume.Float64()
-		volumeData.AddNew(volFloat)
-		macdhData.AddNew(candle.Indicators["macdh"])
-		counter += 1
+func runOptimizer(candles []common.Candle, timeframe time.Duration, samples int, metric, resultsFile string, stops *backtest.Stops, portfolio func() *backtest.Portfolio, funding *backtest.FundingRates) {
+	optimizer := backtest.CreateNewOptimizer(backtest.CreateNewMfiMacdWithParams, backtest.MFI_MACD_RANGES)
+	optimizer.Timeframe = timeframe
+	optimizer.Samples = samples
+	optimizer.Metric = metric
+	optimizer.Stops = stops
+	optimizer.Portfolio = portfolio
+	optimizer.Funding = funding
+	results, err := optimizer.Run(candles)
+	if err != nil {
+		fmt.Printf(" > Failed!: %v\n", err)
+		return
+	}
+	if err := backtest.WriteResultsCSVFile(resultsFile, optimizer.Ranges, results); err != nil {
+		fmt.Printf(" > Could not write results: %v\n", err)
+	}
+	for i := 0; i < len(results) && i < 5; i++ {
+		fmt.Printf("%d. %v: %s %f\n", i+1, results[i].Params, metric, results[i].Score)
+	}
+}
 
-		// After 60 candles have been added, start running strategy
-		if counter > 60 {
-			// Check if we're currently holding, we're looking at the sell strategy
-			if currentlyHoldingCandle > 0 {
-				// Sell when mfi > 90
-				if candle.Indicators["mfi"] > 90 {
-					gain, feeCalc = sell("mfi over 90", numShare, clos, feeSell, t, currentlyHoldingCandle)
-					startingMoney = gain.Sub(feeCalc)
-					currentlyHoldingCandle = 0
-					lastSellCounter = counter
-					// Sell when mfi > 0 and price decrease
-				} else if candle.Indicators["mfi"] > 80 && clos.Cmp(lastPrice) < 0 {
-					gain, feeCalc = sell("mfi over 80 and price decrease", numShare, clos, feeSell, t, currentlyHoldingCandle)
-					startingMoney = gain.Sub(feeCalc)
-					currentlyHoldingCandle = 0
-					lastSellCounter = counter
-					// Sell when macd < 0.2 and not growing
-				} else if candle.Indicators["macdh"] < 0.2 && candle.Indicators["macdh"] < lastMacdh {
-					gain, feeCalc = sell("mfi over 80 and price decrease", numShare, clos, feeSell, t, currentlyHoldingCandle)
-					startingMoney = gain.Sub(feeCalc)
-					currentlyHoldingCandle = 0
-					lastSellCounter = counter
-					// Sell when macd < 0.15
-				} else if candle.Indicators["macdh"] < 0.15 {
-					gain, feeCalc = sell("macdh < 0.15", numShare, clos, feeSell, t, currentlyHoldingCandle)
-					startingMoney = gain.Sub(feeCalc)
-					currentlyHoldingCandle = 0
-					lastSellCounter = counter
-				} else {
-					currentlyHoldingCandle += 1
-				}
+func runWalkForward(candles []common.Candle, timeframe time.Duration, samples int, metric string, inSample, outOfSample int, stops *backtest.Stops, portfolio func() *backtest.Portfolio, funding *backtest.FundingRates) {
+	optimizer := backtest.CreateNewOptimizer(backtest.CreateNewMfiMacdWithParams, backtest.MFI_MACD_RANGES)
+	optimizer.Timeframe = timeframe
+	optimizer.Samples = samples
+	optimizer.Metric = metric
+	optimizer.Stops = stops
+	optimizer.Portfolio = portfolio
+	optimizer.Funding = funding
+	result, err := backtest.CreateNewWalkForward(optimizer, inSample, outOfSample).Run(candles)
+	if err != nil {
+		fmt.Printf(" > Failed!: %v\n", err)
+		return
+	}
+	fmt.Printf("%s\n", result)
+}
 
-				// If not, look at the buy strategy
-			} else {
-				// fmt.Printf("mfi: %f, macdh: %f\n", candle.Indicators["mfi"], candle.Indicators["macdh"])
-				// Filter out when mfi > 60
-				if candle.Indicators["mfi"] > 60 {
-					// Filter out when we just sold last tick
-				} else if lastSellCounter+1 == counter {
-					// Filter out when volume is lower than average
-				} else if volFloat < volumeData.GetAverage() {
-					// Buy when macd > 20
-				} else if candle.Indicators["macdh"] >= 0.20 {
-					numShare, feeCalc = buy("macdh over 0.2", startingMoney, clos, feeBuy, t)
-					startingMoney = decimal.NewFromFloat(0).Sub(feeCalc)
-					currentlyHoldingCandle = 1
-					// Buy when macd > 10 and increasing macdh
-					// } else if candle.Indicators["macdh"] >= 0.10 && macdhData.IsIncreasingFromPositive() {
-				} else if false && candle.Indicators["macdh"] >= 0.10 && candle.Indicators["macdh"] > lastMacdh {
-					numShare, feeCalc = buy("increasing macdh over 0.1", startingMoney, clos, feeBuy, t)
-					startingMoney = decimal.NewFromFloat(0).Sub(feeCalc)
-					currentlyHoldingCandle = 1
-				}
-			}
-			// output(candle)
+func runMulti(readCandles func([]string) (map[string][]common.Candle, error), products []string, timeframe time.Duration, rebalance *backtest.Rebalance, stops *backtest.Stops, portfolio func() *backtest.Portfolio, funding *backtest.FundingRates, tradesFile string) {
+	candles, err := readCandles(products)
+	if err != nil {
+		fmt.Printf(" > Failed!: %v\n", err)
+		return
+	}
+	multi := backtest.CreateNewMultiEngine(decimal.NewFromFloat(1000.0))
+	multi.Rebalance = rebalance
+	multi.Timeframe = timeframe
+	for _, product := range products {
+		engine := multi.AddAsset(product, backtest.CreateNewMfiMacd())
+		// Same costs and sizing as single runs, the cash comes from the shared balance
+		assetPortfolio := portfolio()
+		assetPortfolio.Initial, assetPortfolio.Cash = decimal.Zero, decimal.Zero
+		assetPortfolio.Chart = engine.Chart
+		engine.Portfolio = assetPortfolio
+		engine.Stops = stops
+		engine.Funding = funding
+	}
+	multi.Run(candles)
+	fmt.Printf("\n\n==================\n\n%s\n\n", multi.Report())
+	if tradesFile != "" {
+		if err := backtest.WriteTradeLogFile(tradesFile, multi.TradeLog()); err != nil {
+			fmt.Printf(" > Could not write trades: %v\n", err)
 		}
-
-		lastPrice = clos
-		lastMacdh = candle.Indicators["macdh"]
-
 	}
+}
 
-	if currentlyHoldingCandle > 0 {
-		gain, feeCalc = sell("mfi over 80 and price decrease", numShare, candleChart.CurrentCandle().Close, feeSell, candleChart.CurrentCandle().Time, currentlyHoldingCandle)
-		startingMoney = gain.Sub(feeCalc)
+func createSizer(sizing string, size float64, maxUnits int) (backtest.Sizer, error) {
+	var sizer backtest.Sizer
+	switch sizing {
+	case "":
+	case "fraction":
+		sizer = &backtest.FixedFraction{Fraction: decimal.NewFromFloat(size)}
+	case "notional":
+		sizer = &backtest.FixedNotional{Value: decimal.NewFromFloat(size)}
+	case "atr":
+		sizer = backtest.CreateNewVolatilityTarget(decimal.NewFromFloat(size), backtest.VOLATILITY_ATR)
+	case "stddev":
+		sizer = backtest.CreateNewVolatilityTarget(decimal.NewFromFloat(size), backtest.VOLATILITY_STDDEV)
+	case "kelly":
+		kelly := backtest.CreateNewKelly()
+		if size > 0 {
+			kelly.Fraction = size
+		}
+		sizer = kelly
+	default:
+		return nil, fmt.Errorf("unknown sizing %s", sizing)
 	}
+	if maxUnits > 1 {
+		sizer = &backtest.Pyramid{Unit: sizer, MaxUnits: maxUnits}
+	}
+	return sizer, nil
+}
 
-	// Strategy run complete, display gain loss
-	fmt.Printf("\n\n==================\n\nWe ended with %s (%d candles)\n\n", startingMoney, counter)
-
-	if err != io.EOF {
-		fmt.Printf(" > Failed!: %v\n", err)
+// Parses a day as 2006-01-02 or an RFC3339 time, the zero time when empty
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
 	}
+	return time.Parse(time.RFC3339, value)
 }